@@ -0,0 +1,69 @@
+package sessiontest
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminSessions(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	requestorTransport := irma.NewHTTPTransport("http://localhost:48682", false)
+	requestorTransport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	var sesPkg server.SessionPackage
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, requestorTransport.Post("session", &sesPkg, request))
+
+	// The admin API cannot be accessed with requestor credentials
+	var sessions []*server.SessionInfo
+	err := requestorTransport.Get("admin/sessions", &sessions)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorAdminUnauthorized.Status, err.(*irma.SessionError).RemoteStatus)
+
+	adminTransport := irma.NewHTTPTransport("http://localhost:48682", false)
+	adminTransport.SetHeader("Authorization", JwtServerConfiguration.AdminToken)
+	require.NoError(t, adminTransport.Get("admin/sessions", &sessions))
+	var info *server.SessionInfo
+	for _, s := range sessions {
+		if s.Token == sesPkg.Token {
+			info = s
+		}
+	}
+	require.NotNil(t, info)
+	require.Equal(t, irma.ActionDisclosing, info.Action)
+	require.Equal(t, "requestor2", info.Requestor)
+	require.Equal(t, irma.ServerStatusInitialized, info.Status)
+	require.Nil(t, info.ProtocolVersion)
+
+	// Cancel the session using the admin API
+	deleteTransport := irma.NewHTTPTransport("http://localhost:48682/admin/sessions/"+string(sesPkg.Token), false)
+	deleteTransport.SetHeader("Authorization", JwtServerConfiguration.AdminToken)
+	deleteTransport.Delete()
+	var status irma.ServerStatus
+	require.NoError(t, requestorTransport.Get("session/"+string(sesPkg.Token)+"/status", &status))
+	require.Equal(t, irma.ServerStatusCancelled, status)
+
+	require.NoError(t, adminTransport.Get("admin/sessions", &sessions))
+	for _, s := range sessions {
+		require.NotEqual(t, sesPkg.Token, s.Token)
+	}
+}
+
+func TestAdminCallbacks(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	adminTransport := irma.NewHTTPTransport("http://localhost:48682", false)
+	adminTransport.SetHeader("Authorization", JwtServerConfiguration.AdminToken)
+	var callbacks []*server.CallbackInfo
+	require.NoError(t, adminTransport.Get("admin/callbacks", &callbacks))
+	require.Empty(t, callbacks)
+
+	err := adminTransport.Post("admin/callbacks/nonexisting/retry", nil, nil)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorCallbackUnknown.Status, err.(*irma.SessionError).RemoteStatus)
+}
@@ -0,0 +1,31 @@
+package sessiontest
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackURLAllowlist(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682", false)
+	transport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	request := &irma.ServiceProviderRequest{
+		Request: getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+
+	var sesPkg server.SessionPackage
+	request.CallbackURL = "http://localhost:48685/callback"
+	require.NoError(t, transport.Post("session", &sesPkg, request))
+
+	request.CallbackURL = "http://localhost:48686/callback"
+	err := transport.Post("session", &sesPkg, request)
+	require.Error(t, err)
+	serr := err.(*irma.SessionError)
+	require.Equal(t, server.ErrorCallbackNotAllowed.Status, serr.RemoteStatus)
+	require.Equal(t, string(server.ErrorCallbackNotAllowed.Type), serr.RemoteError.ErrorName)
+}
@@ -0,0 +1,47 @@
+package sessiontest
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	StartRequestorServer(reloadServerConfiguration())
+	defer StopRequestorServer()
+
+	var health server.Health
+	test.HTTPGet(t, nil, "http://localhost:48682/health", nil, 200, &health)
+	require.Equal(t, server.HealthStatusOK, health.Status)
+
+	health = server.Health{}
+	test.HTTPGet(t, nil, "http://localhost:48682/ready", nil, 200, &health)
+	require.Equal(t, server.HealthStatusOK, health.Status)
+	require.Len(t, health.Components, 3)
+	require.Equal(t, server.HealthStatusOK, health.Components["schemes"].Status)
+	require.Equal(t, server.HealthStatusOK, health.Components["private_keys"].Status)
+	require.Equal(t, server.HealthStatusOK, health.Components["sessions"].Status)
+}
+
+func TestHealthInvalidScheme(t *testing.T) {
+	conf := reloadServerConfiguration()
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	scheme := conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier("irma-demo")]
+	scheme.Status = irma.SchemeManagerStatusContentParsingError
+	defer func() { scheme.Status = irma.SchemeManagerStatusValid }()
+
+	// The server is alive but not ready
+	var health server.Health
+	test.HTTPGet(t, nil, "http://localhost:48682/health", nil, 200, &health)
+	require.Equal(t, server.HealthStatusOK, health.Status)
+
+	test.HTTPGet(t, nil, "http://localhost:48682/ready", nil, 503, &health)
+	require.Equal(t, server.HealthStatusError, health.Status)
+	require.Equal(t, server.HealthStatusError, health.Components["schemes"].Status)
+	require.Equal(t, server.HealthStatusOK, health.Components["private_keys"].Status)
+}
@@ -0,0 +1,66 @@
+package sessiontest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJwks(t *testing.T) {
+	// Rotate the RSA JWT key to a new ECDSA key, keeping the RSA public key as previous key
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	skbts, err := x509.MarshalECPrivateKey(sk)
+	require.NoError(t, err)
+	rsabts, err := ioutil.ReadFile(filepath.Join(testdata, "jwtkeys", "sk.pem"))
+	require.NoError(t, err)
+	rsask, err := server.ParseJwtPrivateKey(rsabts)
+	require.NoError(t, err)
+	rsapkbts, err := x509.MarshalPKIXPublicKey(rsask.Public())
+	require.NoError(t, err)
+
+	conf := reloadServerConfiguration()
+	conf.JwtPrivateKeyFile = ""
+	conf.JwtPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: skbts}))
+	conf.JwtPreviousPublicKeys = []string{string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsapkbts}))}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	var jwks server.JWKS
+	require.NoError(t, irma.NewHTTPTransport("http://localhost:48682", false).Get(".well-known/jwks.json", &jwks))
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, "EC", jwks.Keys[0].KeyType)
+	require.Equal(t, "ES256", jwks.Keys[0].Algorithm)
+	require.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	require.Equal(t, "RS256", jwks.Keys[1].Algorithm)
+
+	// The result JWT is signed with the new key, which is found in the JWKS using its kid
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	var sesPkg server.SessionPackage
+	requestor := requestorTransport(JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	require.NoError(t, requestor.Post("session", &sesPkg, request))
+	var resultJwt string
+	require.NoError(t, requestor.Get("session/"+string(sesPkg.Token)+"/result-jwt", &resultJwt))
+
+	token, err := jwt.Parse(resultJwt, func(token *jwt.Token) (interface{}, error) {
+		for _, jwk := range jwks.Keys {
+			if jwk.ID == token.Header["kid"] {
+				return jwk.PublicKey()
+			}
+		}
+		return nil, jwt.ErrInvalidKey
+	})
+	require.NoError(t, err)
+	require.Equal(t, "ES256", token.Method.Alg())
+	require.Equal(t, string(sesPkg.Token), token.Claims.(jwt.MapClaims)["token"])
+}
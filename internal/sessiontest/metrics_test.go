@@ -0,0 +1,42 @@
+package sessiontest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+
+	transport := irma.NewHTTPTransport("http://localhost:48682", false)
+	transport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	var sesPkg server.SessionPackage
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, transport.Post("session", &sesPkg, request))
+
+	deleteTransport := irma.NewHTTPTransport("http://localhost:48682/session/"+string(sesPkg.Token), false)
+	deleteTransport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	deleteTransport.Delete()
+
+	// Results in a server.ErrorSessionUnknown
+	var status irma.ServerStatus
+	require.Error(t, transport.Get("session/nonexisting/status", &status))
+
+	res, err := http.Get("http://localhost:48687/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	bts, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	metrics := string(bts)
+
+	require.Contains(t, metrics, `irma_server_sessions_started_total{action="disclosing",requestor="requestor2"}`)
+	require.Contains(t, metrics, `irma_server_sessions_finished_total{action="disclosing",outcome="cancelled",requestor="requestor2"}`)
+	require.Contains(t, metrics, `irma_server_errors_total{type="`+string(server.ErrorSessionUnknown.Type)+`"}`)
+}
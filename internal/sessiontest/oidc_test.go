@@ -0,0 +1,236 @@
+package sessiontest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+const oidcRedirectURI = "https://client.example.com/callback"
+
+func oidcServerConfiguration() *requestorserver.Configuration {
+	conf := reloadServerConfiguration()
+	conf.OidcIssuer = "http://localhost:48682/oidc/"
+	conf.OidcClients = map[string]requestorserver.OidcClient{
+		"client": {Secret: "Tq2%xV8!eW4kZ", RedirectURIs: []string{oidcRedirectURI}},
+	}
+	conf.OidcClaims = map[string][]string{
+		"sub":        {"irma-demo.RU.studentCard.studentID"},
+		"university": {"irma-demo.RU.studentCard.university", "irma-demo.MijnOverheid.root.BSN"},
+	}
+	conf.OidcScopes = map[string][]string{
+		"openid":  {"sub"},
+		"student": {"university"},
+	}
+	return conf
+}
+
+// oidcAuthorize starts an OpenID Connect authentication request, performs its disclosure session
+// using the client, and returns the URL to which the user is redirected afterwards.
+func oidcAuthorize(t *testing.T, params url.Values) *url.URL {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	transport := irma.NewHTTPTransport("http://localhost:48682/oidc/", false)
+	transport.SetHeader("Accept", "application/json")
+	var page struct {
+		SessionPtr *irma.Qr `json:"sessionPtr"`
+		StatusURL  string   `json:"statusUrl"`
+	}
+	require.NoError(t, transport.Get("authorize?"+params.Encode(), &page))
+
+	c := make(chan *SessionResult)
+	h := &TestHandler{t: t, c: c, client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)}
+	qrjson, err := json.Marshal(page.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	var status struct {
+		Status      irma.ServerStatus `json:"status"`
+		RedirectURI string            `json:"redirect_uri"`
+	}
+	require.NoError(t, irma.NewHTTPTransport("", false).Get(page.StatusURL, &status))
+	require.Equal(t, irma.ServerStatusDone, status.Status)
+	require.True(t, strings.HasPrefix(status.RedirectURI, oidcRedirectURI+"?"))
+	redirect, err := url.Parse(status.RedirectURI)
+	require.NoError(t, err)
+	return redirect
+}
+
+func TestOidcProvider(t *testing.T) {
+	StartRequestorServer(oidcServerConfiguration())
+	defer StopRequestorServer()
+
+	var discovery map[string]interface{}
+	require.NoError(t, irma.NewHTTPTransport("http://localhost:48682/oidc/", false).Get(".well-known/openid-configuration", &discovery))
+	require.Equal(t, "http://localhost:48682/oidc", discovery["issuer"])
+	require.Equal(t, "http://localhost:48682/oidc/token", discovery["token_endpoint"])
+	require.Equal(t, []interface{}{"RS256"}, discovery["id_token_signing_alg_values_supported"])
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := sha256.Sum256([]byte(verifier))
+	redirect := oidcAuthorize(t, url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"client"},
+		"redirect_uri":          {oidcRedirectURI},
+		"scope":                 {"openid student"},
+		"state":                 {"af0ifjsldkj"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	})
+	require.Equal(t, "af0ifjsldkj", redirect.Query().Get("state"))
+	code := redirect.Query().Get("code")
+	require.NotEmpty(t, code)
+
+	token := func(code, verifier string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:48682/oidc/token", strings.NewReader(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {oidcRedirectURI},
+			"code_verifier": {verifier},
+		}.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("client", url.QueryEscape("Tq2%xV8!eW4kZ"))
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		return res, body
+	}
+
+	// A wrong code verifier invalidates the code
+	res, body := token(code, "wrong")
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.Equal(t, "invalid_grant", body["error"])
+	res, _ = token(code, verifier)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	redirect = oidcAuthorize(t, url.Values{
+		"response_type": {"code"},
+		"client_id":     {"client"},
+		"redirect_uri":  {oidcRedirectURI},
+		"scope":         {"openid student"},
+		"nonce":         {"n-0S6_WzA2Mj"},
+	})
+	res, body = token(redirect.Query().Get("code"), "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+	require.Equal(t, "Bearer", body["token_type"])
+
+	// Verify the ID token using the JWKS of the provider
+	var jwks server.JWKS
+	require.NoError(t, irma.NewHTTPTransport("http://localhost:48682/oidc/", false).Get("jwks.json", &jwks))
+	idToken, err := jwt.Parse(body["id_token"].(string), func(token *jwt.Token) (interface{}, error) {
+		for _, jwk := range jwks.Keys {
+			if jwk.ID == token.Header["kid"] {
+				return jwk.PublicKey()
+			}
+		}
+		return nil, jwt.ErrInvalidKey
+	})
+	require.NoError(t, err)
+	claims := idToken.Claims.(jwt.MapClaims)
+	require.Equal(t, "http://localhost:48682/oidc", claims["iss"])
+	require.Equal(t, "client", claims["aud"])
+	require.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+	require.Equal(t, "456", claims["sub"])
+	require.Equal(t, "Radboud", claims["university"])
+
+	// The access token gives access to the userinfo endpoint
+	userinfo := irma.NewHTTPTransport("http://localhost:48682/oidc/", false)
+	userinfo.SetHeader("Authorization", "Bearer "+body["access_token"].(string))
+	var info map[string]interface{}
+	require.NoError(t, userinfo.Get("userinfo", &info))
+	require.Equal(t, map[string]interface{}{"sub": "456", "university": "Radboud"}, info)
+	userinfo.SetHeader("Authorization", "Bearer invalid")
+	require.Error(t, userinfo.Get("userinfo", &info))
+}
+
+func TestOidcProviderInvalidRequests(t *testing.T) {
+	StartRequestorServer(oidcServerConfiguration())
+	defer StopRequestorServer()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	authorize := func(params url.Values) *http.Response {
+		res, err := client.Get("http://localhost:48682/oidc/authorize?" + params.Encode())
+		require.NoError(t, err)
+		_ = res.Body.Close()
+		return res
+	}
+
+	// Unknown clients or redirect URIs are not redirected to
+	res := authorize(url.Values{"response_type": {"code"}, "client_id": {"unknown"}, "redirect_uri": {oidcRedirectURI}, "scope": {"openid"}})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = authorize(url.Values{"response_type": {"code"}, "client_id": {"client"}, "redirect_uri": {"https://attacker.example.com"}, "scope": {"openid"}})
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// Other errors are reported to the client
+	for scope, expected := range map[string]string{"profile": "invalid_scope", "openid unknown": "invalid_scope"} {
+		res = authorize(url.Values{"response_type": {"code"}, "client_id": {"client"}, "redirect_uri": {oidcRedirectURI}, "scope": {scope}, "state": {"s"}})
+		require.Equal(t, http.StatusFound, res.StatusCode)
+		location, err := url.Parse(res.Header.Get("Location"))
+		require.NoError(t, err)
+		require.Equal(t, expected, location.Query().Get("error"))
+		require.Equal(t, "s", location.Query().Get("state"))
+	}
+
+	// Without Accept: application/json, the login page is shown
+	res = authorize(url.Values{"response_type": {"code"}, "client_id": {"client"}, "redirect_uri": {oidcRedirectURI}, "scope": {"openid"}})
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.True(t, strings.HasPrefix(res.Header.Get("Content-Type"), "text/html"))
+}
+
+func TestOidcProviderLimits(t *testing.T) {
+	conf := oidcServerConfiguration()
+	conf.Limits = requestorserver.Limits{SessionsPerMinute: 1}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	params := url.Values{"response_type": {"code"}, "client_id": {"client"}, "redirect_uri": {oidcRedirectURI}, "scope": {"openid"}, "state": {"s"}}
+	res, err := client.Get("http://localhost:48682/oidc/authorize?" + params.Encode())
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// The limits of the oidc:client requestor apply to authentication requests
+	res, err = client.Get("http://localhost:48682/oidc/authorize?" + params.Encode())
+	require.NoError(t, err)
+	_ = res.Body.Close()
+	require.Equal(t, http.StatusFound, res.StatusCode)
+	location, err := url.Parse(res.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "temporarily_unavailable", location.Query().Get("error"))
+	require.Equal(t, "s", location.Query().Get("state"))
+}
+
+func TestOidcProviderRequiresSubject(t *testing.T) {
+	// Clients recognize users by their subject identifier, which therefore must be an attribute
+	conf := oidcServerConfiguration()
+	delete(conf.OidcClaims, "sub")
+	conf.OidcScopes["openid"] = nil
+	_, err := requestorserver.New(conf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "claim sub")
+}
@@ -0,0 +1,82 @@
+package sessiontest
+
+import (
+	"net/http"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+func limitedServerConfiguration(limits requestorserver.Limits, clientRateLimit int) *requestorserver.Configuration {
+	conf := *JwtServerConfiguration
+	irmaconf := *conf.Configuration
+	irmaconf.ClientRateLimit = clientRateLimit
+	conf.Configuration = &irmaconf
+	conf.Limits = limits
+	return &conf
+}
+
+func requireTooManyRequests(t *testing.T, err error) {
+	require.Error(t, err)
+	serr := err.(*irma.SessionError)
+	require.Equal(t, http.StatusTooManyRequests, serr.RemoteStatus)
+	require.Equal(t, string(server.ErrorTooManyRequests.Type), serr.RemoteError.ErrorName)
+}
+
+func TestRequestorLimits(t *testing.T) {
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	transport := irma.NewHTTPTransport("http://localhost:48682", false)
+	transport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	var sesPkg server.SessionPackage
+
+	t.Run("sessions per minute", func(t *testing.T) {
+		StartRequestorServer(limitedServerConfiguration(requestorserver.Limits{SessionsPerMinute: 2}, 0))
+		defer StopRequestorServer()
+
+		require.NoError(t, transport.Post("session", &sesPkg, request))
+		require.NoError(t, transport.Post("session", &sesPkg, request))
+		requireTooManyRequests(t, transport.Post("session", &sesPkg, request))
+	})
+
+	t.Run("issuance sessions per day", func(t *testing.T) {
+		StartRequestorServer(limitedServerConfiguration(requestorserver.Limits{SessionsPerMinute: 2, IssuanceSessionsPerDay: 1}, 0))
+		defer StopRequestorServer()
+
+		require.NoError(t, transport.Post("session", &sesPkg, getIssuanceRequest(true)))
+		requireTooManyRequests(t, transport.Post("session", &sesPkg, getIssuanceRequest(true)))
+
+		// The refused issuance session did not count towards the sessions per minute
+		require.NoError(t, transport.Post("session", &sesPkg, request))
+		requireTooManyRequests(t, transport.Post("session", &sesPkg, request))
+	})
+
+	t.Run("concurrent sessions", func(t *testing.T) {
+		StartRequestorServer(limitedServerConfiguration(requestorserver.Limits{ConcurrentSessions: 1}, 0))
+		defer StopRequestorServer()
+
+		require.NoError(t, transport.Post("session", &sesPkg, request))
+		requireTooManyRequests(t, transport.Post("session", &sesPkg, request))
+
+		// After the first session is finished, a new one may be started
+		deleteTransport := irma.NewHTTPTransport("http://localhost:48682/session/"+string(sesPkg.Token), false)
+		deleteTransport.SetHeader("Authorization", JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+		deleteTransport.Delete()
+		require.NoError(t, transport.Post("session", &sesPkg, request))
+	})
+
+	t.Run("client rate limit", func(t *testing.T) {
+		StartRequestorServer(limitedServerConfiguration(requestorserver.Limits{}, 3))
+		defer StopRequestorServer()
+
+		require.NoError(t, transport.Post("session", &sesPkg, request))
+		clientTransport := irma.NewHTTPTransport(sesPkg.SessionPtr.URL, false)
+		var status irma.ServerStatus
+		for i := 0; i < 3; i++ {
+			require.NoError(t, clientTransport.Get("status", &status))
+		}
+		requireTooManyRequests(t, clientTransport.Get("status", &status))
+	})
+}
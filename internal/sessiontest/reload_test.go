@@ -0,0 +1,123 @@
+package sessiontest
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+// reloadServerConfiguration returns a copy of JwtServerConfiguration, so that reloading it does not
+// affect other tests.
+func reloadServerConfiguration() *requestorserver.Configuration {
+	conf := *JwtServerConfiguration
+	irmaconf := *conf.Configuration
+	conf.Configuration = &irmaconf
+	conf.Requestors = map[string]requestorserver.Requestor{}
+	for name, requestor := range JwtServerConfiguration.Requestors {
+		conf.Requestors[name] = requestor
+	}
+	return &conf
+}
+
+func reloadedConfiguration() *requestorserver.Configuration {
+	return &requestorserver.Configuration{
+		Configuration: &server.Configuration{
+			StaticSessions: map[string]interface{}{
+				"reloadedsession": JwtServerConfiguration.StaticSessions["staticsession"],
+			},
+		},
+		Permissions: requestorserver.Permissions{
+			Disclosing: []string{"irma-demo.RU.*"},
+		},
+		Requestors: map[string]requestorserver.Requestor{
+			"requestor4": {
+				AuthenticationMethod: requestorserver.AuthenticationMethodToken,
+				AuthenticationKey:    "Dy3%3Mr6j@Ac!nQ9vUq2s=wZ8kH1xT",
+			},
+		},
+	}
+}
+
+func requestorTransport(token string) *irma.HTTPTransport {
+	transport := irma.NewHTTPTransport("http://localhost:48682", false)
+	transport.SetHeader("Authorization", token)
+	return transport
+}
+
+func TestReload(t *testing.T) {
+	conf := reloadServerConfiguration()
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	oldRequestor := requestorTransport(JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	newRequestor := requestorTransport("Dy3%3Mr6j@Ac!nQ9vUq2s=wZ8kH1xT")
+	var sesPkg server.SessionPackage
+	require.NoError(t, oldRequestor.Post("session", &sesPkg, request))
+	require.Error(t, newRequestor.Post("session", &sesPkg, request))
+
+	// Invalid configurations are refused, and leave the current configuration intact
+	invalid := reloadedConfiguration()
+	invalid.Disclosing = []string{"irma-demo.nonexisting.*"}
+	require.Error(t, requestorServer.Reload(invalid))
+	invalid = reloadedConfiguration()
+	invalid.Requestors["requestor4"] = requestorserver.Requestor{AuthenticationMethod: "nonexisting"}
+	require.Error(t, requestorServer.Reload(invalid))
+	invalid = reloadedConfiguration()
+	invalid.StaticSessions["invalid"] = irma.ServiceProviderRequest{}
+	require.Error(t, requestorServer.Reload(invalid))
+	require.NoError(t, oldRequestor.Post("session", &sesPkg, request))
+
+	var qr irma.Qr
+	staticTransport := irma.NewHTTPTransport("http://localhost:48682/irma/session/", false)
+	require.NoError(t, staticTransport.Post("staticsession", &qr, nil))
+	require.Error(t, staticTransport.Post("reloadedsession", &qr, nil))
+
+	// Reload a valid configuration
+	require.NoError(t, requestorServer.Reload(reloadedConfiguration()))
+	require.Error(t, oldRequestor.Post("session", &sesPkg, request))
+	require.NoError(t, newRequestor.Post("session", &sesPkg, request))
+	require.Error(t, staticTransport.Post("staticsession", &qr, nil))
+	require.NoError(t, staticTransport.Post("reloadedsession", &qr, nil))
+
+	// Without a reloader, the configuration cannot be reloaded using the admin API
+	err := requestorTransport(JwtServerConfiguration.AdminToken).Post("admin/reload", nil, nil)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorUnsupported.Status, err.(*irma.SessionError).RemoteStatus)
+
+	// The new global permissions apply
+	err = newRequestor.Post("session", &sesPkg, getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")))
+	require.Error(t, err)
+	require.Equal(t, server.ErrorUnauthorized.Status, err.(*irma.SessionError).RemoteStatus)
+}
+
+func TestAdminReload(t *testing.T) {
+	reloaded := reloadedConfiguration()
+	reloaded.Disclosing = []string{"irma-demo.nonexisting.*"}
+	conf := reloadServerConfiguration()
+	conf.Reloader = func() (*requestorserver.Configuration, error) {
+		return reloaded, nil
+	}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	adminTransport := requestorTransport(JwtServerConfiguration.AdminToken)
+	err := adminTransport.Post("admin/reload", nil, nil)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorReloadFailed.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+
+	reloaded = reloadedConfiguration()
+	reloaded.Disclosing = []string{"*"}
+	require.NoError(t, adminTransport.Post("admin/reload", nil, nil))
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	var sesPkg server.SessionPackage
+	require.NoError(t, requestorTransport("Dy3%3Mr6j@Ac!nQ9vUq2s=wZ8kH1xT").Post("session", &sesPkg, request))
+
+	// The admin API cannot be used by requestors
+	err = requestorTransport("Dy3%3Mr6j@Ac!nQ9vUq2s=wZ8kH1xT").Post("admin/reload", nil, nil)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorAdminUnauthorized.Status, err.(*irma.SessionError).RemoteStatus)
+}
@@ -109,6 +109,20 @@ func TestRequestorInvalidRequest(t *testing.T) {
 		irma.NewAttributeTypeIdentifier("irma-demo.baz.qux.abc"),
 	), nil)
 	require.Error(t, err)
+
+	// A negative session lifetime is invalid
+	_, _, _, err = irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{SessionLifetime: -1},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}, nil)
+	require.Error(t, err)
+
+	// So is an unsupported result format
+	_, _, _, err = irmaServer.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ResultFormat: "xml"},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}, nil)
+	require.Error(t, err)
 }
 
 func TestRequestorDoubleGET(t *testing.T) {
@@ -0,0 +1,13 @@
+// +build local_tests
+
+package sessiontest
+
+import (
+	"os"
+	"path/filepath"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// Without a database server, the revocation tests use a SQLite database
+var revocationDbType, revocationDbStr = "sqlite3", filepath.Join(os.TempDir(), "irmago_revocation_test.db")
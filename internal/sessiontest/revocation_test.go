@@ -1,8 +1,7 @@
-// +build !local_tests
-
 package sessiontest
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/jinzhu/gorm"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
@@ -28,9 +28,6 @@ var (
 	revocationServer        *irmaserver.Server
 	revocationConfiguration *server.Configuration
 
-	revocationDbType, revocationDbStr = "postgres", "host=127.0.0.1 port=5432 user=testuser dbname=test password='testpassword' sslmode=disable"
-	//revocationDbType, revocationDbStr = "mysql", "testuser:testpassword@tcp(127.0.0.1)/test"
-
 	revocationPkCounter uint = 2
 )
 
@@ -538,6 +535,192 @@ func TestRevocationAll(t *testing.T) {
 		}
 	})
 
+	t.Run("RevokeBatch", func(t *testing.T) {
+		startRevocationServer(t, true)
+		defer stopRevocationServer()
+		rev := revocationConfiguration.IrmaConfiguration.Revocation
+		sacc, err := rev.Accumulator(revocationTestCred, revocationPkCounter)
+		require.NoError(t, err)
+		keys := []string{"1", "2", "3"}
+		for _, key := range keys {
+			insertIssuanceRecord(t, key, rev, sacc.Accumulator)
+		}
+
+		// nothing is revoked if one of the keys is unknown
+		err = rev.RevokeBatch(revocationTestCred, []*irma.RevocationKey{{Key: "1"}, {Key: "4"}})
+		require.True(t, errors.Is(err, irma.ErrUnknownRevocationKey))
+		require.Contains(t, err.Error(), "4")
+		_, err = rev.IssuanceRecords(revocationTestCred, "1", time.Time{})
+		require.NoError(t, err)
+
+		// revoke all keys at once, specifying one of them twice
+		require.NoError(t, rev.RevokeBatch(revocationTestCred, []*irma.RevocationKey{{Key: "1"}, {Key: "2"}, {Key: "3"}, {Key: "1"}}))
+		for _, key := range keys {
+			_, err = rev.IssuanceRecords(revocationTestCred, key, time.Time{})
+			require.Equal(t, irma.ErrUnknownRevocationKey, err)
+		}
+
+		// the update contains one event per revoked credential
+		update, err := rev.UpdateLatest(revocationTestCred, 10, &revocationPkCounter)
+		require.NoError(t, err)
+		pk, err := rev.Keys.PublicKey(revocationTestCred.IssuerIdentifier(), revocationPkCounter)
+		require.NoError(t, err)
+		_, err = update[revocationPkCounter].Verify(pk)
+		require.NoError(t, err)
+		require.Len(t, update[revocationPkCounter].Events, 4)
+	})
+
+	t.Run("IssuanceRecords", func(t *testing.T) {
+		startRevocationServer(t, true)
+		defer stopRevocationServer()
+		rev := revocationConfiguration.IrmaConfiguration.Revocation
+		sacc, err := rev.Accumulator(revocationTestCred, revocationPkCounter)
+		require.NoError(t, err)
+		start := time.Now().UnixNano()
+		for _, key := range []string{"1", "2", "3"} {
+			insertIssuanceRecord(t, key, rev, sacc.Accumulator)
+		}
+		require.NoError(t, rev.Revoke(revocationTestCred, "2", time.Time{}))
+
+		// paging
+		page, err := revocationServer.IssuanceRecords(&irma.IssuanceRecordsRequest{
+			CredentialType: revocationTestCred,
+			Limit:          2,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 3, page.Total)
+		require.Len(t, page.Records, 2)
+		require.Equal(t, "1", page.Records[0].Key)
+		require.Equal(t, revocationPkCounter, page.Records[0].PKCounter)
+		require.True(t, page.Records[0].Issued >= start)
+		page, err = revocationServer.IssuanceRecords(&irma.IssuanceRecordsRequest{
+			CredentialType: revocationTestCred,
+			Offset:         2,
+			Limit:          2,
+		})
+		require.NoError(t, err)
+		require.Len(t, page.Records, 1)
+		require.Equal(t, "3", page.Records[0].Key)
+
+		// filters
+		revoked, unrevoked := true, false
+		page, err = revocationServer.IssuanceRecords(&irma.IssuanceRecordsRequest{
+			CredentialType:       revocationTestCred,
+			IssuanceRecordFilter: irma.IssuanceRecordFilter{Revoked: &revoked},
+		})
+		require.NoError(t, err)
+		require.Len(t, page.Records, 1)
+		require.Equal(t, "2", page.Records[0].Key)
+		require.NotZero(t, page.Records[0].RevokedAt)
+		page, err = revocationServer.IssuanceRecords(&irma.IssuanceRecordsRequest{
+			CredentialType:       revocationTestCred,
+			IssuanceRecordFilter: irma.IssuanceRecordFilter{Revoked: &unrevoked},
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2, page.Total)
+		page, err = revocationServer.IssuanceRecords(&irma.IssuanceRecordsRequest{
+			CredentialType:       revocationTestCred,
+			IssuanceRecordFilter: irma.IssuanceRecordFilter{ExpiresBefore: time.Now().UnixNano()},
+		})
+		require.NoError(t, err)
+		require.Zero(t, page.Total)
+
+		// status of a key
+		status, err := revocationServer.RevocationKeyStatus(revocationTestCred, "2")
+		require.NoError(t, err)
+		require.True(t, status.Revoked)
+		require.Len(t, status.Records, 1)
+		status, err = revocationServer.RevocationKeyStatus(revocationTestCred, "1")
+		require.NoError(t, err)
+		require.False(t, status.Revoked)
+		_, err = revocationServer.RevocationKeyStatus(revocationTestCred, "4")
+		require.Equal(t, irma.ErrUnknownRevocationKey, err)
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		startRevocationServer(t, true)
+		defer stopRevocationServer()
+		rev := revocationConfiguration.IrmaConfiguration.Revocation
+		sacc, err := rev.Accumulator(revocationTestCred, revocationPkCounter)
+		require.NoError(t, err)
+		// enough events to be fetched partially from the events endpoint, and partially from the latest update
+		fakeMultipleRevocations(t, 40, rev, sacc.Accumulator)
+
+		client := irma.RevocationClient{Conf: revocationConfiguration.IrmaConfiguration}
+		audit, err := client.Audit(revocationTestCred, "http://localhost:48683")
+		require.NoError(t, err)
+		require.True(t, audit.OK(), "problems: %s", server.ToJson(audit.Problems))
+		var chain *irma.RevocationChainAudit
+		for _, c := range audit.Chains {
+			if c.PKCounter == revocationPkCounter {
+				chain = c
+			}
+		}
+		require.NotNil(t, chain)
+		require.Equal(t, uint64(40), chain.AccumulatorIndex)
+		require.Equal(t, 41, chain.Events)
+
+		// remove an event from the chain
+		g, err := gorm.Open(revocationDbType, revocationDbStr)
+		require.NoError(t, err)
+		require.NoError(t, g.Delete(irma.EventRecord{}, "pk_counter = ? and eventindex = ?", revocationPkCounter, 20).Error)
+		require.NoError(t, g.Close())
+
+		audit, err = client.Audit(revocationTestCred, "http://localhost:48683")
+		require.NoError(t, err)
+		require.False(t, audit.OK())
+		var types []irma.RevocationProblemType
+		for _, p := range audit.Problems {
+			types = append(types, p.Type)
+		}
+		require.Contains(t, types, irma.RevocationProblemGap)
+	})
+
+	t.Run("ExportImport", func(t *testing.T) {
+		startRevocationServer(t, true)
+		rev := revocationConfiguration.IrmaConfiguration.Revocation
+		sacc, err := rev.Accumulator(revocationTestCred, revocationPkCounter)
+		require.NoError(t, err)
+		fakeMultipleRevocations(t, 5, rev, sacc.Accumulator)
+		insertIssuanceRecord(t, "1", rev, sacc.Accumulator)
+		insertIssuanceRecord(t, "2", rev, sacc.Accumulator)
+
+		var older, newer bytes.Buffer
+		require.NoError(t, rev.Export(revocationTestCred, irma.RevocationArchiveCBOR, &older))
+		require.NoError(t, rev.Revoke(revocationTestCred, "2", time.Time{}))
+		require.NoError(t, rev.Export(revocationTestCred, irma.RevocationArchiveJSON, &newer))
+
+		// the database is newer than the older archive
+		_, err = rev.Import(revocationTestCred, bytes.NewReader(older.Bytes()))
+		require.Error(t, err)
+		// tampered archives are rejected
+		tampered := bytes.Replace(newer.Bytes(), []byte(`"Key":"1"`), []byte(`"Key":"3"`), 1)
+		require.NotEqual(t, newer.Bytes(), tampered)
+		_, err = rev.Import(revocationTestCred, bytes.NewReader(tampered))
+		require.Error(t, err)
+		stopRevocationServer()
+
+		// import into an empty database
+		startRevocationServer(t, true)
+		defer stopRevocationServer()
+		rev = revocationConfiguration.IrmaConfiguration.Revocation
+		archive, err := rev.Import(revocationTestCred, bytes.NewReader(newer.Bytes()))
+		require.NoError(t, err)
+		require.Len(t, archive.IssuanceRecords, 2)
+		sacc, err = rev.Accumulator(revocationTestCred, revocationPkCounter)
+		require.NoError(t, err)
+		require.Equal(t, uint64(6), sacc.Accumulator.Index)
+		status, err := revocationServer.RevocationKeyStatus(revocationTestCred, "2")
+		require.NoError(t, err)
+		require.True(t, status.Revoked)
+
+		// importing the same archive again changes nothing, and the older one is still refused
+		_, err = rev.Import(revocationTestCred, bytes.NewReader(newer.Bytes()))
+		require.NoError(t, err)
+		_, err = rev.Import(revocationTestCred, bytes.NewReader(older.Bytes()))
+		require.Error(t, err)
+	})
+
 	t.Run("RevocationTolerance", func(t *testing.T) {
 		client, handler := revocationSetup(t)
 		defer test.ClearTestStorage(t, handler.storage)
@@ -243,6 +243,8 @@ var JwtServerConfiguration = &requestorserver.Configuration{
 	Port:                           48682,
 	DisableRequestorAuthentication: false,
 	MaxRequestAge:                  3,
+	AdminToken:                     "Vh3,Ux5_#yUDdP%nWM.6Nkp)5oqD8G",
+	MetricsPort:                    48687,
 	Permissions: requestorserver.Permissions{
 		Disclosing: []string{"*"},
 		Signing:    []string{"*"},
@@ -256,6 +258,9 @@ var JwtServerConfiguration = &requestorserver.Configuration{
 		"requestor2": {
 			AuthenticationMethod: requestorserver.AuthenticationMethodToken,
 			AuthenticationKey:    "xa6=*&9?8jeUu5>.f-%rVg`f63pHim",
+			Permissions: requestorserver.Permissions{
+				CallbackURLs: []string{"http://localhost:48685/**"},
+			},
 		},
 		"requestor3": {
 			AuthenticationMethod: requestorserver.AuthenticationMethodHmac,
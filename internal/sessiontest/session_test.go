@@ -540,6 +540,42 @@ func TestStaticQRSession(t *testing.T) {
 	require.True(t, received)
 }
 
+func TestStaticQRSessionParameters(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+	conf := reloadServerConfiguration()
+	conf.StaticSessions = map[string]interface{}{
+		"levelsession": map[string]interface{}{
+			"parameters":  map[string]interface{}{"level": map[string]interface{}{"values": []string{"42", "43"}}},
+			"callbackUrl": "http://localhost:48685",
+			"request": map[string]interface{}{
+				"@context": irma.LDContextDisclosureRequest,
+				"disclose": [][][]map[string]string{{{{"type": "irma-demo.RU.studentCard.level", "value": "{{level}}"}}}},
+			},
+		},
+	}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+
+	// Values that are not allowed and missing parameters are refused
+	transport := irma.NewHTTPTransport("http://localhost:48682/irma/session/", false)
+	var qr irma.Qr
+	require.Error(t, transport.Post("levelsession?level=44", &qr, struct{}{}))
+	require.Error(t, transport.Post("levelsession", &qr, struct{}{}))
+	require.NoError(t, transport.Post("levelsession", &qr, map[string]string{"level": "43"}))
+
+	bts, err := json.Marshal(&irma.Qr{
+		Type: irma.ActionRedirect,
+		URL:  "http://localhost:48682/irma/session/levelsession?level=42",
+	})
+	require.NoError(t, err)
+	c := make(chan *SessionResult)
+	client.NewSession(string(bts), &TestHandler{t: t, c: c, client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+}
+
 func TestIssuedCredentialIsStored(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, handler.storage)
@@ -0,0 +1,74 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	conf := reloadServerConfiguration()
+	conf.ShutdownGracePeriod = 10
+	StartRequestorServer(conf)
+
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	var sesPkg server.SessionPackage
+	requestor := requestorTransport(JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	require.NoError(t, requestor.Post("session", &sesPkg, request))
+
+	// The app takes a while to give permission, so that it is connected to the session during shutdown
+	c := make(chan *SessionResult)
+	h := &TestHandler{t: t, c: c, client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration), wait: time.Second}
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+
+	var status irma.ServerStatus
+	for i := 0; i < 50 && status != irma.ServerStatusConnected; i++ {
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, requestor.Get("session/"+string(sesPkg.Token)+"/status", &status))
+	}
+	require.Equal(t, irma.ServerStatusConnected, status)
+
+	stopped := make(chan struct{})
+	go func() {
+		StopRequestorServer()
+		close(stopped)
+	}()
+
+	// The server is no longer ready, and refuses new sessions
+	var readyStatus int
+	for i := 0; i < 50 && readyStatus != http.StatusServiceUnavailable; i++ {
+		time.Sleep(20 * time.Millisecond)
+		res, err := http.Get("http://localhost:48682/ready")
+		require.NoError(t, err)
+		readyStatus = res.StatusCode
+		_ = res.Body.Close()
+	}
+	require.Equal(t, http.StatusServiceUnavailable, readyStatus)
+	err = requestor.Post("session", &sesPkg, request)
+	require.Error(t, err)
+	serr := err.(*irma.SessionError)
+	require.Equal(t, http.StatusServiceUnavailable, serr.RemoteStatus)
+	require.Equal(t, string(server.ErrorShuttingDown.Type), serr.RemoteError.ErrorName)
+
+	// The running session finishes before the server stops
+	select {
+	case <-stopped:
+		require.Fail(t, "server stopped before the running session finished")
+	default:
+	}
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	<-stopped
+}
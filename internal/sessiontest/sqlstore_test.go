@@ -0,0 +1,37 @@
+// +build !local_tests
+
+package sessiontest
+
+import (
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/stretchr/testify/require"
+)
+
+var sessionStoreDbType, sessionStoreDbStr = "postgres", "host=127.0.0.1 port=5432 user=testuser dbname=test password='testpassword' sslmode=disable"
+
+// Start a session at one server instance and perform it at another, both sharing a SQL session store
+func TestSqlSessionStore(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	conf := sessionStoreConfiguration(sessionStoreDbType)
+	conf.StoreDBConnStr = sessionStoreDbStr
+	requestorServ, err := irmaserver.New(conf)
+	require.NoError(t, err)
+	defer requestorServ.Stop()
+
+	conf = sessionStoreConfiguration(sessionStoreDbType)
+	conf.StoreDBConnStr = sessionStoreDbStr
+	clientServ, err := irmaserver.New(conf)
+	require.NoError(t, err)
+	defer clientServ.Stop()
+
+	// The session is performed at clientServ, but its result must be available at requestorServ
+	token := performSessionStoreTest(t, client, requestorServ, func() *irmaserver.Server {
+		return clientServ
+	})
+	requireSessionStoreResult(t, requestorServ, token)
+}
@@ -0,0 +1,101 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/stretchr/testify/require"
+)
+
+func sessionStoreConfiguration(storeType string) *server.Configuration {
+	return &server.Configuration{
+		URL:                   "http://localhost:48680",
+		Logger:                logger,
+		DisableSchemesUpdate:  true,
+		SchemesPath:           filepath.Join(testdata, "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(testdata, "privatekeys"),
+		StoreType:             storeType,
+	}
+}
+
+// performSessionStoreTest starts a disclosure session at requestorServ, and has the client
+// perform it at the server returned by clientServ, which is called after the session is started.
+func performSessionStoreTest(
+	t *testing.T, client *irmaclient.Client, requestorServ *irmaserver.Server, clientServ func() *irmaserver.Server,
+) irma.RequestorToken {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, _, err := requestorServ.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", clientServ().HandlerFunc())
+	serv := &http.Server{Addr: "localhost:48680", Handler: mux}
+	go func() {
+		_ = serv.ListenAndServe()
+	}()
+	defer func() {
+		_ = serv.Close()
+	}()
+
+	clientChan := make(chan *SessionResult)
+	h := &TestHandler{t, clientChan, client, expectedRequestorInfo(t, client.Configuration), 0, "", nil, nil, nil}
+	j, err := json.Marshal(qr)
+	require.NoError(t, err)
+	client.NewSession(string(j), h)
+	if clientResult := <-clientChan; clientResult != nil {
+		require.NoError(t, clientResult.Err)
+	}
+
+	return token
+}
+
+func requireSessionStoreResult(t *testing.T, serv *irmaserver.Server, token irma.RequestorToken) {
+	var result *server.SessionResult
+	for i := 0; i < 20; i++ {
+		if result = serv.GetSessionResult(token); result != nil && result.Status.Finished() {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.NotNil(t, result)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 1)
+	require.Equal(t, "irma-demo.RU.studentCard.studentID", result.Disclosed[0][0].Identifier.String())
+	require.Equal(t, "456", result.Disclosed[0][0].Value["en"])
+}
+
+// Start a session, restart the server, and perform the session at the restarted server
+func TestBoltSessionStore(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	path := filepath.Join(storage, "sessions.db")
+
+	conf := sessionStoreConfiguration("bbolt")
+	conf.StoreBoltPath = path
+	serv, err := irmaserver.New(conf)
+	require.NoError(t, err)
+
+	var restarted *irmaserver.Server
+	token := performSessionStoreTest(t, client, serv, func() *irmaserver.Server {
+		serv.Stop()
+		conf := sessionStoreConfiguration("bbolt")
+		conf.StoreBoltPath = path
+		restarted, err = irmaserver.New(conf)
+		require.NoError(t, err)
+		return restarted
+	})
+	defer restarted.Stop()
+	requireSessionStoreResult(t, restarted, token)
+}
@@ -0,0 +1,140 @@
+package sessiontest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// traceCollector is a stand-in for an OTLP/HTTP collector, keeping the spans it receives.
+type traceCollector struct {
+	sync.Mutex
+	services map[string]bool
+	spans    []*tracepb.Span
+}
+
+func (c *traceCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bts, err := ioutil.ReadAll(r.Body)
+	var req coltracepb.ExportTraceServiceRequest
+	if err != nil || r.URL.Path != "/v1/traces" || proto.Unmarshal(bts, &req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	c.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, attr := range rs.Resource.Attributes {
+			if attr.Key == "service.name" {
+				c.services[attr.Value.GetStringValue()] = true
+			}
+		}
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			c.spans = append(c.spans, ils.Spans...)
+		}
+	}
+	c.Unlock()
+	bts, _ = proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(bts)
+}
+
+func (c *traceCollector) find(name string) *tracepb.Span {
+	c.Lock()
+	defer c.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	collector := &traceCollector{services: map[string]bool{}}
+	collectorServer := httptest.NewServer(collector)
+	defer collectorServer.Close()
+
+	conf := reloadServerConfiguration()
+	conf.TracingEndpoint = collectorServer.URL
+	conf.TracingServiceName = "irma-test"
+	StartRequestorServer(conf)
+	stopped := false
+	defer func() {
+		if !stopped {
+			StopRequestorServer()
+		}
+	}()
+	require.True(t, server.TracingEnabled())
+
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	var sesPkg server.SessionPackage
+	requestor := requestorTransport(JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	require.NoError(t, requestor.Post("session", &sesPkg, request))
+
+	c := make(chan *SessionResult)
+	h := &TestHandler{t: t, c: c, client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)}
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	// Stopping the server exports all pending spans and disables tracing
+	StopRequestorServer()
+	stopped = true
+	require.False(t, server.TracingEnabled())
+	require.True(t, collector.services["irma-test"])
+
+	// The spans of the server handling the requests of the client are part of the trace of the client session
+	session := collector.find("irmaclient.Session")
+	require.NotNil(t, session)
+	get := collector.find("client GET /irma/session/{clientToken}/")
+	require.NotNil(t, get)
+	require.Equal(t, session.TraceId, get.TraceId)
+	proofs := collector.find("irmaserver.Proofs")
+	require.NotNil(t, proofs)
+	require.Equal(t, session.TraceId, proofs.TraceId)
+	require.NotEmpty(t, proofs.ParentSpanId)
+
+	// The server span continues the client span of the HTTP request
+	var httpClientSpan *tracepb.Span
+	collector.Lock()
+	for _, span := range collector.spans {
+		if bytes.Equal(span.SpanId, get.ParentSpanId) {
+			httpClientSpan = span
+		}
+	}
+	collector.Unlock()
+	require.NotNil(t, httpClientSpan)
+	require.Equal(t, tracepb.Span_SPAN_KIND_CLIENT, httpClientSpan.Kind)
+	require.Equal(t, session.SpanId, httpClientSpan.ParentSpanId)
+
+	// No session tokens are exported
+	collector.Lock()
+	defer collector.Unlock()
+	clientToken := sesPkg.SessionPtr.URL[strings.LastIndex(sesPkg.SessionPtr.URL, "/")+1:]
+	for _, span := range collector.spans {
+		require.False(t, strings.Contains(span.Name, string(sesPkg.Token)))
+		require.False(t, strings.Contains(span.Name, clientToken))
+		for _, attr := range span.Attributes {
+			require.NotContains(t, attr.Value.GetStringValue(), string(sesPkg.Token))
+			require.NotContains(t, attr.Value.GetStringValue(), clientToken)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package sessiontest
+
+import (
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateSessionRequest(t *testing.T) {
+	conf := reloadServerConfiguration()
+	conf.Permissions = requestorserver.Permissions{Disclosing: []string{"irma-demo.RU.*"}}
+	StartRequestorServer(conf)
+	defer StopRequestorServer()
+	requestor := requestorTransport(JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+
+	var validation server.RequestValidation
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	require.NoError(t, requestor.Post("session/validate", &validation, request))
+	require.True(t, validation.Valid)
+	require.Empty(t, validation.Problems)
+
+	// All problems are reported at once
+	request = getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"))
+	request.AddSingle(irma.NewAttributeTypeIdentifier("irma-demo.RU.nonexisting.attribute"), nil, nil)
+	require.NoError(t, requestor.Post("session/validate", &validation, irma.ServiceProviderRequest{
+		Request:              request,
+		RequestorBaseRequest: irma.RequestorBaseRequest{CallbackURL: "https://example.com/callback"},
+	}))
+	require.False(t, validation.Valid)
+	problems := map[string]server.RequestProblemType{}
+	for _, p := range validation.Problems {
+		problems[p.Identifier] = p.Type
+	}
+	require.Equal(t, server.ProblemMissingPermission, problems["irma-demo.MijnOverheid.root.BSN"])
+	require.Equal(t, server.ProblemCallbackNotAllowed, problems["https://example.com/callback"])
+	require.Equal(t, server.ProblemUnknownIdentifier, problems["irma-demo.RU.nonexisting"])
+
+	issuanceRequest := getIssuanceRequest(true)
+	require.NoError(t, requestor.Post("session/validate", &validation, issuanceRequest))
+	require.False(t, validation.Valid)
+	require.Equal(t, server.ProblemMissingPermission, validation.Problems[0].Type)
+	require.Equal(t, "irma-demo.RU.studentCard", validation.Problems[0].Identifier)
+
+	require.NoError(t, requestor.Post("session/validate", &validation, map[string]interface{}{"foo": "bar"}))
+	require.False(t, validation.Valid)
+	require.Equal(t, server.ProblemMalformedRequest, validation.Problems[0].Type)
+
+	// Requests that could not be authenticated are refused instead of reported as malformed
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, irma.NewServiceProviderJwt("requestor3", getDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	)))
+	tok.Header["kid"] = "requestor3"
+	j, err := tok.SignedString([]byte("not the key of requestor3"))
+	require.NoError(t, err)
+	err = irma.NewHTTPTransport("http://localhost:48682", false).Post("session/validate", &validation, j)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorUnauthenticated.Status, err.(*irma.SessionError).RemoteStatus)
+	// while the other endpoints keep refusing them as invalid requests
+	err = irma.NewHTTPTransport("http://localhost:48682", false).Post("session", nil, j)
+	require.Error(t, err)
+	require.Equal(t, server.ErrorInvalidRequest.Status, err.(*irma.SessionError).RemoteStatus)
+
+	// No sessions were started
+	admin := irma.NewHTTPTransport("http://localhost:48682", false)
+	admin.SetHeader("Authorization", JwtServerConfiguration.AdminToken)
+	var sessions []*server.SessionInfo
+	require.NoError(t, admin.Get("admin/sessions", &sessions))
+	require.Empty(t, sessions)
+}
@@ -0,0 +1,62 @@
+package sessiontest
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifiablePresentationResult(t *testing.T) {
+	StartRequestorServer(JwtServerConfiguration)
+	defer StopRequestorServer()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, handler.storage)
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	request.AddSingle(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"), nil, nil)
+	var sesPkg server.SessionPackage
+	requestor := requestorTransport(JwtServerConfiguration.Requestors["requestor2"].AuthenticationKey)
+	require.NoError(t, requestor.Post("session", &sesPkg, request))
+
+	c := make(chan *SessionResult)
+	h := &TestHandler{t: t, c: c, client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)}
+	qrjson, err := json.Marshal(sesPkg.SessionPtr)
+	require.NoError(t, err)
+	client.NewSession(string(qrjson), h)
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+
+	path := "session/" + string(sesPkg.Token)
+	var vp server.VerifiablePresentation
+	require.NoError(t, requestor.Get(path+"/result?format=vp", &vp))
+	require.Equal(t, []string{"VerifiablePresentation"}, vp.Type)
+	require.Equal(t, sesPkg.Token, vp.SessionToken)
+	require.Equal(t, irma.ProofStatusValid, vp.ProofStatus)
+	require.Len(t, vp.VerifiableCredential, 1)
+	require.Equal(t, "irma:irma-demo.RU.studentCard", vp.VerifiableCredential[0].CredentialSchema.ID)
+	require.Equal(t, map[string]interface{}{"studentID": "456", "university": "Radboud"},
+		vp.VerifiableCredential[0].CredentialSubject)
+
+	var resultJwt string
+	require.NoError(t, requestor.Get(path+"/result-jwt?format=vp", &resultJwt))
+	var claims struct {
+		jwt.StandardClaims
+		VP *server.VerifiablePresentation `json:"vp"`
+	}
+	_, err = jwt.ParseWithClaims(resultJwt, &claims, func(token *jwt.Token) (interface{}, error) {
+		return &JwtServerConfiguration.JwtRSAPrivateKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, string(sesPkg.Token), claims.Id)
+	require.Equal(t, vp.VerifiableCredential, claims.VP.VerifiableCredential)
+
+	err = requestor.Get(path+"/result?format=unknown", &vp)
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorInvalidRequest.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+}
@@ -42,28 +42,44 @@ func configureEmail() keyshare.EmailConfiguration {
 
 func configureIRMAServer() *server.Configuration {
 	return &server.Configuration{
-		SchemesPath:            viper.GetString("schemes-path"),
-		SchemesAssetsPath:      viper.GetString("schemes-assets-path"),
-		SchemesUpdateInterval:  viper.GetInt("schemes-update"),
-		DisableSchemesUpdate:   viper.GetInt("schemes-update") == 0,
-		IssuerPrivateKeysPath:  viper.GetString("privkeys"),
-		RevocationDBType:       viper.GetString("revocation-db-type"),
-		RevocationDBConnStr:    viper.GetString("revocation-db-str"),
-		RevocationSettings:     irma.RevocationSettings{},
-		URL:                    viper.GetString("url"),
-		DisableTLS:             viper.GetBool("no-tls"),
-		Email:                  viper.GetString("email"),
-		EnableSSE:              viper.GetBool("sse"),
-		Verbose:                viper.GetInt("verbose"),
-		Quiet:                  viper.GetBool("quiet"),
-		LogJSON:                viper.GetBool("log-json"),
-		Logger:                 logger,
-		Production:             viper.GetBool("production"),
-		JwtIssuer:              viper.GetString("jwt-issuer"),
-		JwtPrivateKey:          viper.GetString("jwt-privkey"),
-		JwtPrivateKeyFile:      viper.GetString("jwt-privkey-file"),
-		AllowUnsignedCallbacks: viper.GetBool("allow-unsigned-callbacks"),
-		AugmentClientReturnURL: viper.GetBool("augment-client-return-url"),
+		SchemesPath:               viper.GetString("schemes-path"),
+		SchemesAssetsPath:         viper.GetString("schemes-assets-path"),
+		SchemesUpdateInterval:     viper.GetInt("schemes-update"),
+		DisableSchemesUpdate:      viper.GetInt("schemes-update") == 0,
+		IssuerPrivateKeysPath:     viper.GetString("privkeys"),
+		RevocationDBType:          viper.GetString("revocation-db-type"),
+		RevocationDBConnStr:       viper.GetString("revocation-db-str"),
+		StoreType:                 viper.GetString("store-type"),
+		StoreDBConnStr:            viper.GetString("store-db-str"),
+		StoreBoltPath:             viper.GetString("store-bolt-path"),
+		RevocationSettings:        irma.RevocationSettings{},
+		URL:                       viper.GetString("url"),
+		DisableTLS:                viper.GetBool("no-tls"),
+		Email:                     viper.GetString("email"),
+		EnableSSE:                 viper.GetBool("sse"),
+		SessionLifetime:           viper.GetInt("session-lifetime"),
+		MaxSessionLifetime:        viper.GetInt("max-session-lifetime"),
+		ShutdownGracePeriod:       viper.GetInt("shutdown-grace-period"),
+		CallbackMaxRetryAge:       viper.GetInt("callback-max-retry-age"),
+		CallbackStorePath:         viper.GetString("callback-store-path"),
+		CallbackSecret:            viper.GetString("callback-secret"),
+		DenyPrivateCallbacks:      viper.GetBool("deny-private-callbacks"),
+		AllowedCallbackNetworks:   viper.GetStringSlice("allowed-callback-networks"),
+		ClientRateLimit:           viper.GetInt("client-rate-limit"),
+		Verbose:                   viper.GetInt("verbose"),
+		Quiet:                     viper.GetBool("quiet"),
+		LogJSON:                   viper.GetBool("log-json"),
+		TracingEndpoint:           viper.GetString("tracing-endpoint"),
+		TracingServiceName:        viper.GetString("tracing-service-name"),
+		Logger:                    logger,
+		Production:                viper.GetBool("production"),
+		JwtIssuer:                 viper.GetString("jwt-issuer"),
+		JwtPrivateKey:             viper.GetString("jwt-privkey"),
+		JwtPrivateKeyFile:         viper.GetString("jwt-privkey-file"),
+		JwtPreviousPublicKeys:     viper.GetStringSlice("jwt-previous-pubkeys"),
+		JwtPreviousPublicKeyFiles: viper.GetStringSlice("jwt-previous-pubkey-files"),
+		AllowUnsignedCallbacks:    viper.GetBool("allow-unsigned-callbacks"),
+		AugmentClientReturnURL:    viper.GetBool("augment-client-return-url"),
 	}
 }
 
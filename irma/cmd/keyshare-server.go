@@ -82,6 +82,9 @@ func init() {
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.String("tracing-endpoint", "", "export OpenTelemetry spans to the OTLP/HTTP collector at this URL, e.g. http://localhost:4318")
+	flags.String("tracing-service-name", "keyshareserver", "service name of the exported spans")
+	flags.Int("shutdown-grace-period", server.DefaultShutdownGracePeriod, "when stopping, wait at most this many seconds for running sessions to finish")
 	flags.Bool("production", false, "Production mode")
 	flags.Lookup("verbose").Header = `Other options`
 }
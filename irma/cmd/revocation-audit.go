@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sietseringers/cobra"
+)
+
+var revocationAuditCmd = &cobra.Command{
+	Use:   "audit <credentialtype> [<url>...]",
+	Short: "Verify the revocation events published by revocation servers",
+	Long: `Verify the revocation events published by revocation servers of a credential type: fetch all events
+and accumulators of each issuer key, and check that the accumulators are validly signed, that the
+events form a single unbroken hash chain ending in the accumulator, and that the servers agree on
+the events. If no URLs are given, the revocation servers from the scheme are used.
+
+The value of an accumulator cannot be recomputed from the events, but only verified against an
+earlier accumulator value. This is done only when the servers serve different accumulators of an
+issuer key. When auditing a single server, or servers that all serve the same accumulator, only the
+signatures, indices and event hashes of the accumulators are verified and not their values; the
+output mentions this.
+
+All problems found (gaps, forks, invalid signatures or events, and failed requests) are reported,
+in which case the command exits with a nonzero exit code.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		schemespath, _ := flags.GetString("schemes-path")
+		jsonOutput, _ := flags.GetBool("json")
+		verbosity, _ := flags.GetCount("verbose")
+		logger.Level = server.Verbosity(verbosity)
+		irma.SetLogger(logger)
+
+		conf, err := irma.NewConfiguration(schemespath, irma.ConfigurationOptions{ReadOnly: true})
+		if err != nil {
+			die("failed to open irma_configuration", err)
+		}
+		if err = conf.ParseFolder(); err != nil {
+			die("failed to parse irma_configuration", err)
+		}
+		id := irma.NewCredentialTypeIdentifier(args[0])
+		credtype, known := conf.CredentialTypes[id]
+		if !known {
+			die("unknown credential type", nil)
+		}
+		if !credtype.RevocationSupported() {
+			die("credential type does not support revocation", nil)
+		}
+
+		audit, err := irma.RevocationClient{Conf: conf}.Audit(id, args[1:]...)
+		if err != nil {
+			die("failed to audit revocation", err)
+		}
+
+		if jsonOutput {
+			fmt.Println(prettyprint(audit))
+		} else {
+			printRevocationAudit(audit)
+		}
+		if !audit.OK() {
+			die(fmt.Sprintf("found %d problems", len(audit.Problems)), nil)
+		}
+	},
+}
+
+func printRevocationAudit(audit *irma.RevocationAudit) {
+	fmt.Println("Revocation event chains of", audit.CredentialType)
+	unlinked := 0
+	for _, chain := range audit.Chains {
+		linked := "value verified against an earlier accumulator"
+		if !chain.AccumulatorLinked {
+			linked = "value not verified"
+			unlinked++
+		}
+		fmt.Printf("  %s, key %d: %d events, accumulator index %d of %s (%s)\n",
+			chain.URL, chain.PKCounter, chain.Events, chain.AccumulatorIndex,
+			time.Unix(chain.AccumulatorTime, 0).Format(time.RFC3339), linked)
+	}
+	if unlinked > 0 {
+		fmt.Printf("The values of %d accumulators could not be verified, as no earlier accumulator was available;\n"+
+			"only their signatures, indices and event hashes were verified.\n", unlinked)
+	}
+	if audit.OK() {
+		if unlinked > 0 {
+			fmt.Println("No problems found, but not all accumulator values were verified")
+		} else {
+			fmt.Println("No problems found")
+		}
+		return
+	}
+	fmt.Println("Problems:")
+	for _, p := range audit.Problems {
+		fmt.Printf("  %s, key %d: %s (event %d): %s\n", p.URL, p.PKCounter, p.Type, p.Index, p.Message)
+	}
+}
+
+func init() {
+	flags := revocationAuditCmd.Flags()
+	flags.StringP("schemes-path", "s", irma.DefaultSchemesPath(), "path to irma_configuration")
+	flags.Bool("json", false, "print the results as JSON")
+	flags.CountP("verbose", "v", "verbose (repeatable)")
+
+	revocationCmd.AddCommand(revocationAuditCmd)
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sietseringers/cobra"
+	"github.com/sietseringers/pflag"
+)
+
+var revocationDBExportCmd = &cobra.Command{
+	Use:   "db-export <credentialtype> [<file>]",
+	Short: "Export the revocation state of a credential type from a revocation database",
+	Long: `Export the revocation state of a credential type from the revocation database of its revocation
+authority, i.e. the accumulators and revocation events of all issuer keys and the issuance records,
+to a file (default standard output). The archive is signed with the latest private key of the issuer,
+which is looked for in the scheme and in --privkeys.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		format, _ := flags.GetString("format")
+		if format != string(irma.RevocationArchiveJSON) && format != string(irma.RevocationArchiveCBOR) {
+			die("Invalid format (must be json or cbor)", nil)
+		}
+		id := irma.NewCredentialTypeIdentifier(args[0])
+		conf := openRevocationDB(flags, id)
+		defer closeRevocationDB(conf)
+
+		var w io.Writer = os.Stdout
+		if len(args) == 2 && args[1] != "-" {
+			f, err := os.Create(args[1])
+			if err != nil {
+				die("failed to create output file", err)
+			}
+			defer common.Close(f)
+			w = f
+		}
+		if err := conf.Revocation.Export(id, irma.RevocationArchiveFormat(format), w); err != nil {
+			die("failed to export revocation state", err)
+		}
+	},
+}
+
+var revocationDBImportCmd = &cobra.Command{
+	Use:   "db-import <credentialtype> <file>",
+	Short: "Import the revocation state of a credential type into a revocation database",
+	Long: `Import a revocation archive created with "irma revocation db-export" into a revocation database,
+after verifying its signature and its revocation events. Revocation events of the archive that are
+not yet in the database are added. If the database contains revocation events that are not in the
+archive, i.e. if the revocation state in the database is newer, nothing is imported. Issuance records
+are added, or marked revoked if they are revoked in the archive, but never unrevoked.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[1])
+		if err != nil {
+			die("failed to open archive", err)
+		}
+		defer common.Close(f)
+
+		id := irma.NewCredentialTypeIdentifier(args[0])
+		conf := openRevocationDB(cmd.Flags(), id)
+		defer closeRevocationDB(conf)
+
+		archive, err := conf.Revocation.Import(id, f)
+		if err != nil {
+			die("failed to import revocation state", err)
+		}
+		fmt.Printf("Imported revocation state of %s: %d keys, %d issuance records\n",
+			archive.CredentialType, len(archive.Updates), len(archive.IssuanceRecords))
+	},
+}
+
+// openRevocationDB parses the schemes and connects to the revocation database specified by the
+// flags, acting as revocation authority for the credential type.
+func openRevocationDB(flags *pflag.FlagSet, id irma.CredentialTypeIdentifier) *irma.Configuration {
+	schemespath, _ := flags.GetString("schemes-path")
+	privkeys, _ := flags.GetString("privkeys")
+	dbtype, _ := flags.GetString("db-type")
+	dbstr, _ := flags.GetString("db-str")
+	verbosity, _ := flags.GetCount("verbose")
+	logger.Level = server.Verbosity(verbosity)
+	irma.SetLogger(logger)
+
+	if dbstr == "" {
+		die("--db-str is required", nil)
+	}
+	conf, err := irma.NewConfiguration(schemespath, irma.ConfigurationOptions{
+		ReadOnly:            true,
+		RevocationDBType:    dbtype,
+		RevocationDBConnStr: dbstr,
+		RevocationSettings:  irma.RevocationSettings{id: {Authority: true}},
+	})
+	if err != nil {
+		die("failed to open irma_configuration", err)
+	}
+	if err = conf.ParseFolder(); err != nil {
+		die("failed to parse irma_configuration", err)
+	}
+	credtype, known := conf.CredentialTypes[id]
+	if !known {
+		die("unknown credential type", nil)
+	}
+	if !credtype.RevocationSupported() {
+		die("credential type does not support revocation", nil)
+	}
+	if privkeys != "" {
+		ring, err := irma.NewPrivateKeyRingFolder(privkeys, conf)
+		if err != nil {
+			die("failed to read private keys", err)
+		}
+		if err = conf.AddPrivateKeyRing(ring); err != nil {
+			die("failed to add private keys", err)
+		}
+	}
+	return conf
+}
+
+func closeRevocationDB(conf *irma.Configuration) {
+	if err := conf.Revocation.Close(); err != nil {
+		die("failed to close revocation database", err)
+	}
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{revocationDBExportCmd, revocationDBImportCmd} {
+		flags := cmd.Flags()
+		flags.StringP("schemes-path", "s", irma.DefaultSchemesPath(), "path to irma_configuration")
+		flags.String("db-type", "postgres", "database type of the revocation database (supported: mysql, postgres, sqlite)")
+		flags.String("db-str", "", "connection string of the revocation database")
+		flags.CountP("verbose", "v", "verbose (repeatable)")
+	}
+	revocationDBExportCmd.Flags().String("privkeys", "", "path to folder containing issuer private keys")
+	revocationDBExportCmd.Flags().String("format", "json", "archive format (json, cbor)")
+
+	revocationCmd.AddCommand(revocationDBExportCmd, revocationDBImportCmd)
+}
@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sietseringers/cobra"
+	"github.com/sietseringers/pflag"
+)
+
+var revocationCmd = &cobra.Command{
+	Use:   "revocation",
+	Short: "Query the issuance records of a revocation authority, audit revocation servers and export revocation databases",
+	Long: `Query the issuance records of a revocation authority, i.e. an IRMA server that issues credentials
+supporting revocation, using the list, status and export commands. The server authenticates these
+requests like revocation requests, and only allows requestors to query the records of credential
+types which they are allowed to revoke. Times are specified as RFC 3339 timestamps or as dates
+(YYYY-MM-DD), and are returned in Unix nanoseconds. Issuance records of expired credentials are
+deleted by the server.
+
+The audit command verifies the revocation events published by revocation servers. The db-export and
+db-import commands copy the revocation state of a credential type between revocation databases.`,
+}
+
+var revocationListCmd = &cobra.Command{
+	Use:   "list <credentialtype> <url>",
+	Short: "List a page of the issuance records of a credential type",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		offset, _ := flags.GetInt("offset")
+		limit, _ := flags.GetInt("limit")
+		request := issuanceRecordsRequest(flags, args[0])
+		request.Offset, request.Limit = offset, limit
+
+		var records irma.IssuanceRecords
+		postIssuanceRecordsRequest(flags, args[1], "revocation/records", request, &records)
+		fmt.Println(prettyprint(records))
+	},
+}
+
+var revocationStatusCmd = &cobra.Command{
+	Use:   "status <credentialtype> <key> <url>",
+	Short: "Show the revocation status of the credentials issued with a given key",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		request := &irma.IssuanceRecordsRequest{
+			LDContext:            irma.LDContextIssuanceRecordsRequest,
+			CredentialType:       irma.NewCredentialTypeIdentifier(args[0]),
+			IssuanceRecordFilter: irma.IssuanceRecordFilter{Key: args[1]},
+		}
+
+		var status irma.RevocationKeyStatus
+		postIssuanceRecordsRequest(flags, args[2], "revocation/status", request, &status)
+		fmt.Println(prettyprint(status))
+	},
+}
+
+var revocationExportCmd = &cobra.Command{
+	Use:   "export <credentialtype> <url>",
+	Short: "Export all issuance records of a credential type",
+	Long: `Export all issuance records of a credential type matching the filters, as CSV or as a JSON array.
+The records are retrieved in pages of --page-size records. Records of credentials that are issued
+during the export are not included.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		format, _ := flags.GetString("format")
+		output, _ := flags.GetString("output")
+		pagesize, _ := flags.GetInt("page-size")
+		if format != "csv" && format != "json" {
+			die("Invalid format (must be csv or json)", nil)
+		}
+		if pagesize <= 0 {
+			die("--page-size must be positive", nil)
+		}
+
+		request := issuanceRecordsRequest(flags, args[0])
+		request.Limit = pagesize
+		// exclude credentials issued during the export, so that it ends
+		if request.IssuedBefore == 0 {
+			request.IssuedBefore = time.Now().UnixNano()
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" && output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				die("failed to create output file", err)
+			}
+			defer common.Close(f)
+			w = f
+		}
+		exporter := newRecordsExporter(format, w)
+		for {
+			var records irma.IssuanceRecords
+			postIssuanceRecordsRequest(flags, args[1], "revocation/records", request, &records)
+			for _, record := range records.Records {
+				if err := exporter.write(record); err != nil {
+					die("failed to write issuance record", err)
+				}
+			}
+			request.Offset += len(records.Records)
+			if len(records.Records) == 0 || request.Offset >= records.Total {
+				break
+			}
+		}
+		if err := exporter.close(); err != nil {
+			die("failed to write issuance records", err)
+		}
+	},
+}
+
+// issuanceRecordsRequest returns an issuance records request for the credential type, with the
+// filters specified by the flags.
+func issuanceRecordsRequest(flags *pflag.FlagSet, credtype string) *irma.IssuanceRecordsRequest {
+	request := &irma.IssuanceRecordsRequest{
+		LDContext:      irma.LDContextIssuanceRecordsRequest,
+		CredentialType: irma.NewCredentialTypeIdentifier(credtype),
+	}
+	f := &request.IssuanceRecordFilter
+	f.Key, _ = flags.GetString("revocation-key")
+	f.IssuedAfter = timeFlag(flags, "issued-after")
+	f.IssuedBefore = timeFlag(flags, "issued-before")
+	f.ExpiresAfter = timeFlag(flags, "expires-after")
+	f.ExpiresBefore = timeFlag(flags, "expires-before")
+	f.RevokedAfter = timeFlag(flags, "revoked-after")
+	f.RevokedBefore = timeFlag(flags, "revoked-before")
+
+	revoked, _ := flags.GetBool("revoked")
+	unrevoked, _ := flags.GetBool("unrevoked")
+	if revoked && unrevoked {
+		die("specify at most one of --revoked and --unrevoked", nil)
+	}
+	if revoked || unrevoked {
+		f.Revoked = &revoked
+	}
+	return request
+}
+
+// timeFlag parses the flag as RFC 3339 timestamp or date, returning it in Unix nanoseconds,
+// or 0 if the flag is not set.
+func timeFlag(flags *pflag.FlagSet, name string) int64 {
+	s, _ := flags.GetString(name)
+	if s == "" {
+		return 0
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", s); err != nil {
+			die(fmt.Sprintf("failed to parse --%s (must be an RFC 3339 timestamp or YYYY-MM-DD)", name), nil)
+		}
+	}
+	return t.UnixNano()
+}
+
+func postIssuanceRecordsRequest(
+	flags *pflag.FlagSet, url, path string, request *irma.IssuanceRecordsRequest, result interface{},
+) {
+	authmethod, _ := flags.GetString("auth-method")
+	key, _ := flags.GetString("key")
+	name, _ := flags.GetString("name")
+	verbosity, _ := flags.GetCount("verbose")
+	logger.Level = server.Verbosity(verbosity)
+	irma.SetLogger(logger)
+
+	transport := irma.NewHTTPTransport(url, false)
+	var err error
+	switch authmethod {
+	case "none":
+		err = transport.Post(path, result, request)
+	case "token":
+		transport.SetHeader("Authorization", key)
+		err = transport.Post(path, result, request)
+	case "hmac", "rsa":
+		sk, jwtalg, jwterr := configureJWTKey(authmethod, key)
+		if jwterr != nil {
+			die("failed to configure JWT key", jwterr)
+		}
+		jwtstr, jwterr := irma.NewIssuanceRecordsJwt(name, request).Sign(jwtalg, sk)
+		if jwterr != nil {
+			die("failed to sign JWT", jwterr)
+		}
+		err = transport.Post(path, result, jwtstr)
+	default:
+		die("Invalid authentication method (must be none, token, hmac or rsa)", nil)
+	}
+
+	if err != nil {
+		die("failed to post issuance records request", err)
+	}
+}
+
+// recordsExporter writes issuance records as CSV or as a JSON array.
+type recordsExporter struct {
+	w     io.Writer
+	csv   *csv.Writer
+	count int
+}
+
+func newRecordsExporter(format string, w io.Writer) *recordsExporter {
+	e := &recordsExporter{w: w}
+	if format == "csv" {
+		e.csv = csv.NewWriter(w)
+		// the csv.Writer buffers its output, so errors are reported when flushing
+		_ = e.csv.Write([]string{"revocationKey", "type", "pkCounter", "issued", "validUntil", "revokedAt"})
+	}
+	return e
+}
+
+func (e *recordsExporter) write(record *irma.IssuanceRecordInfo) error {
+	defer func() { e.count++ }()
+	if e.csv != nil {
+		return e.csv.Write([]string{
+			record.Key,
+			record.CredentialType.String(),
+			strconv.FormatUint(uint64(record.PKCounter), 10),
+			strconv.FormatInt(record.Issued, 10),
+			strconv.FormatInt(record.ValidUntil, 10),
+			strconv.FormatInt(record.RevokedAt, 10),
+		})
+	}
+
+	bts, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if e.count == 0 {
+		sep = "[\n  "
+	}
+	_, err = e.w.Write(append([]byte(sep), bts...))
+	return err
+}
+
+func (e *recordsExporter) close() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	end := "\n]\n"
+	if e.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{revocationListCmd, revocationStatusCmd, revocationExportCmd} {
+		flags := cmd.Flags()
+		flags.StringP("auth-method", "a", "none", "Authentication method to server (none, token, rsa, hmac)")
+		flags.String("key", "", "Key to sign request with")
+		flags.String("name", "", "Requestor name")
+		flags.CountP("verbose", "v", "verbose (repeatable)")
+	}
+	for _, cmd := range []*cobra.Command{revocationListCmd, revocationExportCmd} {
+		flags := cmd.Flags()
+		flags.String("revocation-key", "", "only records of credentials issued with this key")
+		flags.String("issued-after", "", "only records of credentials issued at or after this time")
+		flags.String("issued-before", "", "only records of credentials issued before this time")
+		flags.String("expires-after", "", "only records of credentials expiring at or after this time")
+		flags.String("expires-before", "", "only records of credentials expiring before this time")
+		flags.String("revoked-after", "", "only records of credentials revoked at or after this time")
+		flags.String("revoked-before", "", "only records of credentials revoked before this time")
+		flags.Bool("revoked", false, "only records of revoked credentials")
+		flags.Bool("unrevoked", false, "only records of credentials that are not revoked")
+	}
+	revocationListCmd.Flags().Int("offset", 0, "amount of matching records to skip")
+	revocationListCmd.Flags().Int("limit", 0, "maximum amount of records to return (default and maximum depend on server)")
+	revocationExportCmd.Flags().String("format", "csv", "output format (csv, json)")
+	revocationExportCmd.Flags().StringP("output", "o", "", "file to write the records to (default standard output)")
+	revocationExportCmd.Flags().Int("page-size", 1000, "amount of records to retrieve per request")
+
+	revocationCmd.AddCommand(revocationListCmd, revocationStatusCmd, revocationExportCmd)
+	RootCmd.AddCommand(revocationCmd)
+}
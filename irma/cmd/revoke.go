@@ -1,37 +1,113 @@
 package cmd
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sietseringers/cobra"
 )
 
 var revokeCmd = &cobra.Command{
-	Use:   "revoke <credentialtype> <key> <url>",
+	Use:   "revoke <credentialtype> [<key>] <url>",
 	Short: "Revoke a previously issued credential identified by a given key",
-	Args:  cobra.ExactArgs(3),
+	Long: `Revoke a previously issued credential identified by a given key.
+
+Using --keys-file, the credentials of many keys can be revoked at once. The file (or standard input,
+if - is specified) contains one key per line; empty lines and lines starting with # are ignored.
+The keys are revoked in batches of --batch-size keys, each of which is revoked in a single transaction
+and results in a single revocation update per issuer key. Keys that are unknown or already revoked are
+reported and skipped, so that the command can be run again on the same file if it was interrupted.`,
+	Args: cobra.RangeArgs(2, 3),
 	Run: func(cmd *cobra.Command, args []string) {
 		flags := cmd.Flags()
 		schemespath, _ := flags.GetString("schemes-path")
 		authmethod, _ := flags.GetString("auth-method")
 		key, _ := flags.GetString("key")
 		name, _ := flags.GetString("name")
+		keysfile, _ := flags.GetString("keys-file")
+		batchsize, _ := flags.GetInt("batch-size")
 		verbosity, _ := cmd.Flags().GetCount("verbose")
-		url := args[2]
+		url := args[len(args)-1]
+		credtype := irma.NewCredentialTypeIdentifier(args[0])
 
-		request := &irma.RevocationRequest{
-			LDContext:      irma.LDContextRevocationRequest,
-			CredentialType: irma.NewCredentialTypeIdentifier(args[0]),
-			Key:            args[1],
+		if keysfile == "" {
+			if len(args) != 3 {
+				die("specify either a key or --keys-file", nil)
+			}
+			request := &irma.RevocationRequest{
+				LDContext:      irma.LDContextRevocationRequest,
+				CredentialType: credtype,
+				Key:            args[1],
+			}
+			postRevocation([]*irma.RevocationRequest{request}, url, schemespath, authmethod, key, name, verbosity)
+			return
 		}
 
-		postRevocation(request, url, schemespath, authmethod, key, name, verbosity)
+		if len(args) != 2 {
+			die("specify either a key or --keys-file", nil)
+		}
+		if batchsize <= 0 {
+			die("--batch-size must be positive", nil)
+		}
+		keys, err := readRevocationKeys(keysfile)
+		if err != nil {
+			die("failed to read revocation keys", err)
+		}
+		if len(keys) == 0 {
+			die("no revocation keys found in "+keysfile, nil)
+		}
+		var requests []*irma.RevocationRequest
+		for i := 0; i < len(keys); i += batchsize {
+			end := i + batchsize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			requests = append(requests, &irma.RevocationRequest{
+				LDContext:      irma.LDContextRevocationRequest,
+				CredentialType: credtype,
+				Keys:           keys[i:end],
+			})
+		}
+		postRevocation(requests, url, schemespath, authmethod, key, name, verbosity)
 	},
 }
 
-func postRevocation(request *irma.RevocationRequest, url, schemespath, authmethod, key, name string, verbosity int) {
+// readRevocationKeys reads revocation keys, one per line, from the specified file or from
+// standard input if path is -.
+func readRevocationKeys(path string) ([]*irma.RevocationKey, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer common.Close(f)
+		r = f
+	}
+
+	var keys []*irma.RevocationKey
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, &irma.RevocationKey{Key: line})
+	}
+	return keys, scanner.Err()
+}
+
+// postRevocation posts the revocation requests, which must all concern the same credential type,
+// one after the other, stopping at the first failure other than an unknown or already revoked key
+// in a batch.
+func postRevocation(requests []*irma.RevocationRequest, url, schemespath, authmethod, key, name string, verbosity int) {
 	logger.Level = server.Verbosity(verbosity)
 	irma.SetLogger(logger)
 
@@ -43,7 +119,7 @@ func postRevocation(request *irma.RevocationRequest, url, schemespath, authmetho
 		die("failed to parse irma_configuration", err)
 	}
 
-	credtype, known := conf.CredentialTypes[request.CredentialType]
+	credtype, known := conf.CredentialTypes[requests[0].CredentialType]
 	if !known {
 		die("unknown credential type", nil)
 	}
@@ -52,7 +128,68 @@ func postRevocation(request *irma.RevocationRequest, url, schemespath, authmetho
 	}
 
 	transport := irma.NewHTTPTransport(url, false)
+	if len(requests[0].Keys) == 0 {
+		if err = postRevocationRequest(transport, requests[0], authmethod, key, name); err != nil {
+			die("failed to post revocation request", err)
+		}
+		return
+	}
+	revoked, skipped := 0, 0
+	for _, request := range requests {
+		r, s := postRevocationBatch(transport, request, authmethod, key, name)
+		revoked, skipped = revoked+r, skipped+s
+		fmt.Printf("Revoked %d keys, skipped %d keys\n", revoked, skipped)
+	}
+}
 
+// postRevocationBatch posts the revocation request of a batch of keys. If the server reports one
+// of the keys to be unknown or already revoked, that key is left out and the request is posted again.
+// It returns the amount of revoked and of skipped keys.
+func postRevocationBatch(transport *irma.HTTPTransport, request *irma.RevocationRequest, authmethod, key, name string) (int, int) {
+	keys := request.Keys
+	skipped := 0
+	for len(keys) > 0 {
+		err := postRevocationRequest(transport, &irma.RevocationRequest{
+			LDContext:      request.LDContext,
+			CredentialType: request.CredentialType,
+			Keys:           keys,
+		}, authmethod, key, name)
+		if err == nil {
+			return len(keys), skipped
+		}
+		i := unknownRevocationKey(err, keys)
+		if i < 0 {
+			die("failed to post revocation request", err)
+		}
+		fmt.Printf("Skipping unknown or already revoked key %s\n", keys[i].Key)
+		keys = append(append([]*irma.RevocationKey{}, keys[:i]...), keys[i+1:]...)
+		skipped++
+	}
+	return 0, skipped
+}
+
+// unknownRevocationKey returns the index of the key that the server reported as unknown or
+// already revoked in the error, or -1 if the error is not about an unknown key.
+func unknownRevocationKey(err error, keys []*irma.RevocationKey) int {
+	serr, ok := err.(*irma.SessionError)
+	if !ok || serr.RemoteError == nil || serr.RemoteError.ErrorName != string(server.ErrorUnknownRevocationKey.Type) {
+		return -1
+	}
+	if len(keys) == 1 {
+		return 0
+	}
+	// the server prefixes the error with the unknown key
+	unknown := strings.TrimSuffix(serr.RemoteError.Message, ": "+irma.ErrUnknownRevocationKey.Error())
+	for i, k := range keys {
+		if k.Key == unknown {
+			return i
+		}
+	}
+	return -1
+}
+
+func postRevocationRequest(transport *irma.HTTPTransport, request *irma.RevocationRequest, authmethod, key, name string) error {
+	var err error
 	switch authmethod {
 	case "none":
 		err = transport.Post("revocation", nil, request)
@@ -61,6 +198,9 @@ func postRevocation(request *irma.RevocationRequest, url, schemespath, authmetho
 		err = transport.Post("revocation", nil, request)
 	case "hmac", "rsa":
 		sk, jwtalg, err := configureJWTKey(authmethod, key)
+		if err != nil {
+			die("failed to configure JWT key", err)
+		}
 		j := irma.RevocationJwt{
 			ServerJwt: irma.ServerJwt{
 				ServerName: name,
@@ -72,14 +212,11 @@ func postRevocation(request *irma.RevocationRequest, url, schemespath, authmetho
 		if err != nil {
 			die("failed to sign JWT", err)
 		}
-		err = transport.Post("revocation", nil, jwtstr)
+		return transport.Post("revocation", nil, jwtstr)
 	default:
 		die("Invalid authentication method (must be none, token, hmac or rsa)", nil)
 	}
-
-	if err != nil {
-		die("failed to post revocation request", err)
-	}
+	return err
 }
 
 func init() {
@@ -88,6 +225,8 @@ func init() {
 	flags.StringP("auth-method", "a", "none", "Authentication method to server (none, token, rsa, hmac)")
 	flags.String("key", "", "Key to sign request with")
 	flags.String("name", "", "Requestor name")
+	flags.StringP("keys-file", "f", "", "file containing keys to revoke, one per line (- for standard input)")
+	flags.Int("batch-size", 1000, "amount of keys from --keys-file to revoke per request")
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 
 	issuerCmd.AddCommand(revokeCmd)
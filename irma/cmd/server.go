@@ -33,6 +33,8 @@ var serverCmd = &cobra.Command{
 		stopped := make(chan struct{})
 		interrupt := make(chan os.Signal, 1)
 		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
 
 		go func() {
 			if err := serv.Start(conf); err != nil {
@@ -48,10 +50,17 @@ var serverCmd = &cobra.Command{
 				conf.Logger.Debug("Caught interrupt")
 				serv.Stop() // causes serv.Start() above to return
 				conf.Logger.Debug("Sent stop signal to server")
+			case <-reload:
+				conf.Logger.Info("Caught SIGHUP, reloading configuration")
+				if err := serv.ReloadConfiguration(); err != nil {
+					conf.Logger.Error("Failed to reload configuration, keeping current configuration: ", err.Error())
+				}
 			case <-stopped:
 				conf.Logger.Info("Exiting")
+				signal.Stop(reload)
 				close(stopped)
 				close(interrupt)
+				close(reload)
 				return
 			}
 		}
@@ -87,15 +96,29 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("static-path", "", "Host files under this path as static files (leave empty to disable)")
 	flags.String("static-prefix", "/", "Host static files under this URL prefix")
 	flags.StringP("url", "u", defaulturl, "external URL to server to which the IRMA client connects, \":port\" being replaced by --port value")
-	flags.String("revocation-db-type", "", "database type for revocation database (supported: mysql, postgres)")
+	flags.String("revocation-db-type", "", "database type for revocation database (supported: mysql, postgres, sqlite)")
 	flags.String("revocation-db-str", "", "connection string for revocation database")
+	flags.String("store-type", "memory", "where to keep sessions (supported: memory, bbolt, mysql, postgres)")
+	flags.String("store-db-str", "", "connection string for session store database")
+	flags.String("store-bolt-path", "", "path to bbolt file in which to keep sessions")
 	flags.Bool("sse", false, "Enable server sent for status updates (experimental)")
+	flags.Int("session-lifetime", server.DefaultSessionLifetime, "cancel sessions after this many seconds of inactivity")
+	flags.Int("max-session-lifetime", 0, "maximum session lifetime in seconds that session requests may specify (default --session-lifetime)")
+	flags.Int("shutdown-grace-period", server.DefaultShutdownGracePeriod, "when stopping, wait at most this many seconds for running sessions to finish")
+	flags.Int("callback-max-retry-age", server.DefaultCallbackMaxRetryAge, "retry failed result callbacks for this many seconds")
+	flags.String("callback-store-path", "", "path to bbolt file in which undelivered result callbacks are kept across restarts")
+	flags.String("callback-secret", "", "secret with which result callbacks are signed (HMAC-SHA256, in the X-IRMA-Signature header)")
+	flags.Bool("deny-private-callbacks", false, "refuse result callbacks to private, loopback and link-local addresses")
+	flags.StringSlice("allowed-callback-networks", nil, "networks (CIDR) to which result callbacks are allowed despite --deny-private-callbacks")
 
 	flags.IntP("port", "p", 8088, "port at which to listen")
 	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
 	flags.StringP("api-prefix", "a", "/", "prefix API endpoints with this string, e.g. POST /session becomes POST {api-prefix}/session")
 	flags.Int("client-port", 0, "if specified, start a separate server for the IRMA app at this port")
 	flags.String("client-listen-addr", "", "address at which server for IRMA app listens")
+	flags.Int("client-rate-limit", 0, "maximum amount of requests per minute per IP address to IRMA app endpoints (0 means no limit)")
+	flags.Int("metrics-port", 0, "if specified, expose Prometheus metrics at /metrics on a separate server at this port")
+	flags.String("metrics-listen-addr", "", "address at which the metrics server listens")
 	flags.Lookup("port").Header = `Server address and port to listen on`
 
 	flags.Bool("no-auth", !production, "whether or not to authenticate requestors (and reject all authenticated requests)")
@@ -108,16 +131,32 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	}
 	flags.StringSlice("issue-perms", nil, issHelp)
 	flags.StringSlice("revoke-perms", nil, "list of credentials that all requestors may revoke")
+	flags.StringSlice("callback-urls", nil, "list of callback URL patterns that all requestors may use (default any)")
+	flags.Int("sessions-per-minute", 0, "maximum amount of sessions per minute per requestor (0 means no limit)")
+	flags.Int("concurrent-sessions", 0, "maximum amount of unfinished sessions per requestor (0 means no limit)")
+	flags.Int("issuance-sessions-per-day", 0, "maximum amount of issuance sessions per day per requestor (0 means no limit)")
 	flags.Bool("skip-private-keys-check", false, "whether or not to skip checking whether the private keys that requestors have permission for using are present in the configuration")
 	flags.String("static-sessions", "", "preconfigured static sessions (in JSON)")
+	flags.String("admin-token", "", "token with which the admin API is accessed (leave empty to disable the admin API)")
 	flags.Lookup("no-auth").Header = `Requestor authentication and default requestor permissions`
 
+	flags.String("oidc-clients", "", "OpenID Connect clients (in JSON); if specified, an OpenID Connect provider is started at {api-prefix}/oidc")
+	flags.String("oidc-issuer", "", "external URL of {api-prefix}/oidc, used as OpenID Connect issuer identifier")
+	flags.String("oidc-claims", "", "OpenID Connect claims, mapping each claim to the attribute types whose value it may contain (in JSON)")
+	flags.String("oidc-scopes", "", "OpenID Connect scopes, mapping each scope to its claims (in JSON)")
+	flags.Int("oidc-token-validity", requestorserver.DefaultOidcTokenValidity, "validity in seconds of OpenID Connect ID tokens and access tokens")
+	flags.String("oidc-login-template", "", "path to HTML template of the page shown to users during OpenID Connect authentication")
+	flags.Lookup("oidc-clients").Header = `OpenID Connect provider`
+
 	flags.String("revocation-settings", "", "revocation settings (in JSON)")
 
 	flags.StringP("jwt-issuer", "j", "irmaserver", "JWT issuer")
-	flags.String("jwt-privkey", "", "JWT private key")
-	flags.String("jwt-privkey-file", "", "path to JWT private key")
+	flags.String("jwt-privkey", "", "JWT private key (RSA, ECDSA P-256/P-384 or Ed25519)")
+	flags.String("jwt-privkey-file", "", "path to JWT private key (RSA, ECDSA P-256/P-384 or Ed25519)")
+	flags.StringSlice("jwt-previous-pubkeys", nil, "public keys of previous JWT private keys, published at /.well-known/jwks.json")
+	flags.StringSlice("jwt-previous-pubkey-files", nil, "paths to public keys of previous JWT private keys, published at /.well-known/jwks.json")
 	flags.Int("max-request-age", 300, "max age in seconds of a session request JWT")
+	flags.Int("jwks-refresh-interval", requestorserver.DefaultJwksRefreshInterval, "interval in seconds after which the keys at the JWKS URLs of requestors are refetched")
 	flags.Bool("allow-unsigned-callbacks", false, "Allow callbackUrl in session requests when no JWT privatekey is installed (potentially unsafe)")
 	flags.Bool("augment-client-return-url", false, "Augment the client return url with the server session token if present")
 	flags.Lookup("jwt-issuer").Header = `JWT configuration`
@@ -126,6 +165,8 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.String("tls-cert-file", "", "path to TLS certificate (chain)")
 	flags.String("tls-privkey", "", "TLS private key")
 	flags.String("tls-privkey-file", "", "path to TLS private key")
+	flags.String("tls-client-ca", "", "CA certificate(s) against which TLS client certificates of requestors are verified")
+	flags.String("tls-client-ca-file", "", "path to CA certificate(s) against which TLS client certificates of requestors are verified")
 	flags.String("client-tls-cert", "", "TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-cert-file", "", "path to TLS certificate (chain) for IRMA app server")
 	flags.String("client-tls-privkey", "", "TLS private key for IRMA app server")
@@ -140,6 +181,8 @@ func setFlags(cmd *cobra.Command, production bool) error {
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 	flags.BoolP("quiet", "q", false, "quiet")
 	flags.Bool("log-json", false, "Log in JSON format")
+	flags.String("tracing-endpoint", "", "export OpenTelemetry spans to the OTLP/HTTP collector at this URL, e.g. http://localhost:4318")
+	flags.String("tracing-service-name", "irma", "service name of the exported spans")
 	flags.Bool("production", false, "Production mode")
 	flags.Lookup("verbose").Header = `Other options`
 
@@ -161,33 +204,25 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 
 	// Read configuration from flags and/or environmental variables
 	conf := &requestorserver.Configuration{
-		Configuration: configureIRMAServer(),
-		Permissions: requestorserver.Permissions{
-			Disclosing: handlePermission("disclose-perms"),
-			Signing:    handlePermission("sign-perms"),
-			Issuing:    handlePermission("issue-perms"),
-			Revoking:   handlePermission("revoke-perms"),
-		},
+		Configuration:                  configureIRMAServer(),
 		SkipPrivateKeysCheck:           viper.GetBool("skip-private-keys-check"),
 		ListenAddress:                  viper.GetString("listen-addr"),
 		Port:                           viper.GetInt("port"),
 		ApiPrefix:                      viper.GetString("api-prefix"),
 		ClientListenAddress:            viper.GetString("client-listen-addr"),
 		ClientPort:                     viper.GetInt("client-port"),
+		MetricsListenAddress:           viper.GetString("metrics-listen-addr"),
+		MetricsPort:                    viper.GetInt("metrics-port"),
 		DisableRequestorAuthentication: viper.GetBool("no-auth"),
-		Requestors:                     make(map[string]requestorserver.Requestor),
+		AdminToken:                     viper.GetString("admin-token"),
 		MaxRequestAge:                  viper.GetInt("max-request-age"),
+		JwksRefreshInterval:            viper.GetInt("jwks-refresh-interval"),
 		StaticPath:                     viper.GetString("static-path"),
 		StaticPrefix:                   viper.GetString("static-prefix"),
-
-		TlsCertificate:           viper.GetString("tls-cert"),
-		TlsCertificateFile:       viper.GetString("tls-cert-file"),
-		TlsPrivateKey:            viper.GetString("tls-privkey"),
-		TlsPrivateKeyFile:        viper.GetString("tls-privkey-file"),
-		ClientTlsCertificate:     viper.GetString("client-tls-cert"),
-		ClientTlsCertificateFile: viper.GetString("client-tls-cert-file"),
-		ClientTlsPrivateKey:      viper.GetString("client-tls-privkey"),
-		ClientTlsPrivateKeyFile:  viper.GetString("client-tls-privkey-file"),
+		OidcIssuer:                     viper.GetString("oidc-issuer"),
+		OidcTokenValidity:              viper.GetInt("oidc-token-validity"),
+		OidcLoginTemplate:              viper.GetString("oidc-login-template"),
+		Reloader:                       reloadServerConfiguration,
 	}
 
 	if conf.Production {
@@ -199,12 +234,17 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 		}
 	}
 
-	// Handle requestors
 	var err error
-	if err = handleMapOrString("requestors", &conf.Requestors); err != nil {
+	if err = configureReloadable(conf); err != nil {
+		return nil, err
+	}
+	if err = handleMapOrString("oidc-clients", &conf.OidcClients); err != nil {
 		return nil, err
 	}
-	if err = handleMapOrString("static-sessions", &conf.StaticSessions); err != nil {
+	if err = handleMapOrString("oidc-claims", &conf.OidcClaims); err != nil {
+		return nil, err
+	}
+	if err = handleMapOrString("oidc-scopes", &conf.OidcScopes); err != nil {
 		return nil, err
 	}
 	var m map[string]*irma.RevocationSetting
@@ -219,3 +259,54 @@ func configureServer(cmd *cobra.Command) (*requestorserver.Configuration, error)
 
 	return conf, nil
 }
+
+// configureReloadable sets the parts of the configuration that can be reloaded while the
+// server is running (see requestorserver.Server.Reload()).
+func configureReloadable(conf *requestorserver.Configuration) error {
+	conf.Permissions = requestorserver.Permissions{
+		Disclosing: handlePermission("disclose-perms"),
+		Signing:    handlePermission("sign-perms"),
+		Issuing:    handlePermission("issue-perms"),
+		Revoking:   handlePermission("revoke-perms"),
+
+		CallbackURLs: viper.GetStringSlice("callback-urls"),
+	}
+	conf.Limits = requestorserver.Limits{
+		SessionsPerMinute:      viper.GetInt("sessions-per-minute"),
+		ConcurrentSessions:     viper.GetInt("concurrent-sessions"),
+		IssuanceSessionsPerDay: viper.GetInt("issuance-sessions-per-day"),
+	}
+
+	conf.TlsCertificate = viper.GetString("tls-cert")
+	conf.TlsCertificateFile = viper.GetString("tls-cert-file")
+	conf.TlsPrivateKey = viper.GetString("tls-privkey")
+	conf.TlsPrivateKeyFile = viper.GetString("tls-privkey-file")
+	conf.TlsClientCA = viper.GetString("tls-client-ca")
+	conf.TlsClientCAFile = viper.GetString("tls-client-ca-file")
+	conf.ClientTlsCertificate = viper.GetString("client-tls-cert")
+	conf.ClientTlsCertificateFile = viper.GetString("client-tls-cert-file")
+	conf.ClientTlsPrivateKey = viper.GetString("client-tls-privkey")
+	conf.ClientTlsPrivateKeyFile = viper.GetString("client-tls-privkey-file")
+
+	// Handle requestors
+	conf.Requestors = make(map[string]requestorserver.Requestor)
+	if err := handleMapOrString("requestors", &conf.Requestors); err != nil {
+		return err
+	}
+	return handleMapOrString("static-sessions", &conf.StaticSessions)
+}
+
+// reloadServerConfiguration rereads the configuration file, returning a configuration
+// containing the parts of the configuration that can be reloaded.
+func reloadServerConfiguration() (*requestorserver.Configuration, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, notfound := err.(viper.ConfigFileNotFoundError); !notfound {
+			return nil, errors.WrapPrefix(err, "Failed to unmarshal configuration file at "+viper.ConfigFileUsed(), 0)
+		}
+	}
+	conf := &requestorserver.Configuration{Configuration: &server.Configuration{}}
+	if err := configureReloadable(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
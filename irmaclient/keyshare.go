@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
@@ -92,7 +93,9 @@ func (ks *keyshareServer) HashedPin(pin string) string {
 // The user's pin is retrieved using the KeysharePinRequestor, repeatedly, until either it is correct; or the
 // user cancels; or one of the keyshare servers blocks us.
 // Error, blocked or success of the keyshare session is reported back to the keyshareSessionHandler.
+// The span in ctx, if any, is propagated to the keyshare servers.
 func startKeyshareSession(
+	ctx context.Context,
 	sessionHandler keyshareSessionHandler,
 	pin KeysharePinRequestor,
 	builders gabi.ProofBuilderList,
@@ -145,6 +148,7 @@ func startKeyshareSession(
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
 		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
 		transport.SetHeader(kssVersionHeader, "2")
+		transport.SetContext(ctx)
 		ks.transports[managerID] = transport
 
 		// Try to parse token as a jwt to see if it is still valid; if so we don't need to ask for the PIN
@@ -1,6 +1,7 @@
 package irmaclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -14,6 +15,9 @@ import (
 	"github.com/privacybydesign/gabi/big"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // This file contains the logic and state of performing IRMA sessions, communicates
@@ -95,6 +99,8 @@ type session struct {
 	Hostname  string
 	ServerURL string
 	transport *irma.HTTPTransport
+	ctx       context.Context // contains the span of the session, propagated to the servers
+	span      trace.Span
 }
 
 type sessions struct {
@@ -199,6 +205,10 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 	doneChannel := make(chan struct{}, 1)
 	doneChannel <- struct{}{}
 	close(doneChannel)
+	ctx, span := irma.StartSpan(context.Background(), "irmaclient.Session",
+		attribute.String("irma.action", string(qr.Type)),
+		attribute.String("irma.hostname", u.Hostname()),
+	)
 	session := &session{
 		ServerURL:      qr.URL,
 		Hostname:       u.Hostname(),
@@ -209,7 +219,10 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 		client:         client,
 		done:           doneChannel,
 		prepRevocation: make(chan error),
+		ctx:            ctx,
+		span:           span,
 	}
+	session.transport.SetContext(ctx)
 	client.sessions.add(session)
 
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
@@ -493,6 +506,7 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 		}
 		startKeyshareSession(
+			session.ctx,
 			session,
 			session.Handler,
 			session.builders,
@@ -733,6 +747,9 @@ func (session *session) finish(delete bool) bool {
 	// that no further work is needed.
 	if _, ok := <-session.done; ok {
 		session.client.sessions.remove(session.token)
+		if session.span != nil {
+			session.span.End()
+		}
 		// Do actual delete in background, since that can take a while in some circumstances, and
 		// precise moment of completion isn't relevant for frontend.
 		go func() {
@@ -747,6 +764,9 @@ func (session *session) finish(delete bool) bool {
 }
 
 func (session *session) fail(err *irma.SessionError) {
+	if session.span != nil {
+		session.span.SetStatus(codes.Error, string(err.ErrorType))
+	}
 	if session.finish(true) && err.ErrorType != irma.ErrorKeyshareUnenrolled {
 		irma.Logger.Warn("client session error: ", err.Error())
 		err.Err = errors.Wrap(err.Err, 0)
@@ -52,6 +52,8 @@ type Configuration struct {
 
 	// Listeners for configuration changes from initialization and updating of the schemes
 	UpdateListeners []ConfigurationListener
+	// Listeners for the outcome of each scheme update attempt made by UpdateSchemes()
+	SchemeUpdateListeners []SchemeUpdateListener
 
 	// Path to the irma_configuration folder that this instance represents
 	Path        string
@@ -69,6 +71,10 @@ type Configuration struct {
 // ConfigurationListeners are the interface provided to react to changes in schemes.
 type ConfigurationListener func(conf *Configuration)
 
+// SchemeUpdateListeners are called after an attempt to update the specified scheme,
+// with the error that occurred if the update failed.
+type SchemeUpdateListener func(scheme string, err error)
+
 type UnknownIdentifierError struct {
 	ErrorType
 	Missing *IrmaIdentifierSet
@@ -1,13 +1,18 @@
 package irma
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
 	"encoding/xml"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,6 +24,13 @@ import (
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 func init() {
@@ -127,6 +139,34 @@ func TestRetryHTTPRequest(t *testing.T) {
 	require.Equal(t, "42\n", string(bts))
 }
 
+func TestHTTPTransportTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	// Nothing listens on this port, so the request fails
+	token := "vMq6mzxDZR2jWNsJsPaZ"
+	transport := NewHTTPTransport("http://localhost:1/irma/session/"+token+"/", false)
+	transport.client.RetryMax = 0
+	err := transport.Get("status", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), token)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	span := spans[0]
+	require.Equal(t, codes.Error, span.Status().Code)
+	require.Equal(t, string(ErrorTransport), span.Status().Description)
+	for _, attr := range span.Attributes() {
+		require.NotContains(t, attr.Value.Emit(), token)
+	}
+	for _, event := range span.Events() {
+		for _, attr := range event.Attributes {
+			require.NotContains(t, attr.Value.Emit(), token)
+		}
+	}
+}
+
 func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	test.StartSchemeManagerHttpServer()
 	defer test.StopSchemeManagerHttpServer()
@@ -1421,3 +1461,343 @@ func TestCredentialDependencies_UnmarshalXML(t *testing.T) {
 		deps,
 	)
 }
+
+func TestRevocationRequestKeys(t *testing.T) {
+	var request RevocationRequest
+	require.NoError(t, UnmarshalValidate([]byte(`{"@context":"`+LDContextRevocationRequest+`","type":"irma-demo.MijnOverheid.root","revocationKey":"1","issued":2}`), &request))
+	require.Equal(t, []*RevocationKey{{Key: "1", Issued: 2}}, request.RevocationKeys())
+
+	request = RevocationRequest{}
+	require.NoError(t, UnmarshalValidate([]byte(`{"@context":"`+LDContextRevocationRequest+`","type":"irma-demo.MijnOverheid.root","revocationKeys":[{"revocationKey":"1"},{"revocationKey":"2","issued":3}]}`), &request))
+	require.Equal(t, []*RevocationKey{{Key: "1"}, {Key: "2", Issued: 3}}, request.RevocationKeys())
+
+	// either revocationKey or revocationKeys must be used
+	request = RevocationRequest{}
+	require.Error(t, UnmarshalValidate([]byte(`{"@context":"`+LDContextRevocationRequest+`","type":"irma-demo.MijnOverheid.root","revocationKey":"1","revocationKeys":[{"revocationKey":"2"}]}`), &request))
+	request = RevocationRequest{}
+	require.Error(t, UnmarshalValidate([]byte(`{"@context":"`+LDContextRevocationRequest+`","type":"irma-demo.MijnOverheid.root","revocationKeys":[{"revocationKey":""}]}`), &request))
+}
+
+func TestIssuanceRecordFilter(t *testing.T) {
+	var request IssuanceRecordsRequest
+	require.NoError(t, UnmarshalValidate([]byte(`{"@context":"`+LDContextIssuanceRecordsRequest+`","type":"irma-demo.MijnOverheid.root","issuedAfter":1,"revoked":false,"limit":10}`), &request))
+	require.Equal(t, 10, request.Limit)
+
+	id := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	query, args := request.where(id)
+	require.Equal(t, "cred_type = ? AND issued >= ? AND revoked_at = 0", query)
+	require.Equal(t, []interface{}{id, int64(1)}, args)
+
+	// revoked_at < ? also selects unrevoked records, which have revoked_at = 0
+	query, args = (&IssuanceRecordFilter{Key: "1", RevokedBefore: 2}).where(id)
+	require.Equal(t, "cred_type = ? AND revocationkey = ? AND revoked_at < ? AND revoked_at > 0", query)
+	require.Equal(t, []interface{}{id, "1", int64(2)}, args)
+
+	request = IssuanceRecordsRequest{}
+	require.Error(t, UnmarshalValidate([]byte(`{"@context":"`+LDContextIssuanceRecordsRequest+`","type":"irma-demo.MijnOverheid.root","offset":-1}`), &request))
+}
+
+func TestVerifyRevocationEvents(t *testing.T) {
+	conf := parseConfiguration(t)
+	issuer := NewIssuerIdentifier("irma-demo.MijnOverheid")
+	sk, err := conf.PrivateKeys.Get(issuer, 2)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(issuer, 2)
+	require.NoError(t, err)
+
+	// a chain of an initial event and 5 revocations
+	update, err := revocation.NewAccumulator(sk)
+	require.NoError(t, err)
+	acc, err := update.SignedAccumulator.UnmarshalVerify(pk)
+	require.NoError(t, err)
+	events := update.Events
+	for i := int64(0); i < 5; i++ {
+		var event *revocation.Event
+		acc, event, err = acc.Remove(sk, big.NewInt(65537+2*i), events[len(events)-1])
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+	sacc, err := acc.Sign(sk)
+	require.NoError(t, err)
+
+	verified, problems := VerifyRevocationEvents(pk, sacc, events)
+	require.Empty(t, problems)
+	require.Equal(t, uint64(5), verified.Index)
+
+	// events need not be sorted, and duplicates are fine
+	_, problems = VerifyRevocationEvents(pk, sacc, append([]*revocation.Event{events[5], events[2]}, events...))
+	require.Empty(t, problems)
+
+	problemTypes := func(problems []*RevocationProblem) []RevocationProblemType {
+		var types []RevocationProblemType
+		for _, p := range problems {
+			types = append(types, p.Type)
+		}
+		return types
+	}
+
+	// gap
+	gapped := append(append([]*revocation.Event{}, events[:2]...), events[4:]...)
+	_, problems = VerifyRevocationEvents(pk, sacc, gapped)
+	require.Equal(t, []RevocationProblemType{RevocationProblemGap}, problemTypes(problems))
+	require.Equal(t, uint64(2), problems[0].Index)
+
+	// missing events at the end of the chain
+	_, problems = VerifyRevocationEvents(pk, sacc, events[:4])
+	require.Equal(t, []RevocationProblemType{RevocationProblemGap}, problemTypes(problems))
+	require.Equal(t, uint64(4), problems[0].Index)
+
+	// fork: another event 3, to which event 4 does not refer
+	forked := append([]*revocation.Event{}, events...)
+	forked[3] = &revocation.Event{Index: 3, E: big.NewInt(3), ParentHash: events[3].ParentHash}
+	_, problems = VerifyRevocationEvents(pk, sacc, forked)
+	require.Equal(t, []RevocationProblemType{RevocationProblemFork}, problemTypes(problems))
+	require.Equal(t, uint64(4), problems[0].Index)
+	_, problems = VerifyRevocationEvents(pk, sacc, append(forked, events[3]))
+	require.Contains(t, problemTypes(problems), RevocationProblemFork)
+
+	// the accumulator does not sign the last event
+	other, event, err := acc.Remove(sk, big.NewInt(3), events[4])
+	require.NoError(t, err)
+	other.Index = acc.Index
+	osacc, err := other.Sign(sk)
+	require.NoError(t, err)
+	_, problems = VerifyRevocationEvents(pk, osacc, events)
+	require.Equal(t, []RevocationProblemType{RevocationProblemFork}, problemTypes(problems))
+	_, problems = VerifyRevocationEvents(pk, sacc, append(events, event))
+	require.Contains(t, problemTypes(problems), RevocationProblemFork)
+
+	// invalid signature
+	data := append([]byte{}, sacc.Data...)
+	data[len(data)-1] ^= 1
+	verified, problems = VerifyRevocationEvents(pk, &revocation.SignedAccumulator{Data: data, PKCounter: 2}, events)
+	require.Nil(t, verified)
+	require.Equal(t, []RevocationProblemType{RevocationProblemSignature}, problemTypes(problems))
+
+	// the same attribute revoked twice
+	double, event, err := acc.Remove(sk, big.NewInt(65537), events[5])
+	require.NoError(t, err)
+	dsacc, err := double.Sign(sk)
+	require.NoError(t, err)
+	_, problems = VerifyRevocationEvents(pk, dsacc, append(events, event))
+	require.Equal(t, []RevocationProblemType{RevocationProblemEvent}, problemTypes(problems))
+}
+
+func TestVerifyRevocationAccumulators(t *testing.T) {
+	conf := parseConfiguration(t)
+	issuer := NewIssuerIdentifier("irma-demo.MijnOverheid")
+	sk, err := conf.PrivateKeys.Get(issuer, 2)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(issuer, 2)
+	require.NoError(t, err)
+
+	update, err := revocation.NewAccumulator(sk)
+	require.NoError(t, err)
+	older, err := update.SignedAccumulator.UnmarshalVerify(pk)
+	require.NoError(t, err)
+	events := update.Events
+	newer := older
+	for i := int64(0); i < 3; i++ {
+		var event *revocation.Event
+		newer, event, err = newer.Remove(sk, big.NewInt(65537+2*i), events[len(events)-1])
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+
+	require.Empty(t, VerifyRevocationAccumulators(pk, older, newer, events))
+	require.Empty(t, VerifyRevocationAccumulators(pk, newer, older, events))
+	require.Empty(t, VerifyRevocationAccumulators(pk, newer, newer, nil))
+
+	// missing event
+	problems := VerifyRevocationAccumulators(pk, older, newer, append(events[:2:2], events[3]))
+	require.Len(t, problems, 1)
+	require.Equal(t, RevocationProblemGap, problems[0].Type)
+
+	// the events do not link the accumulator values
+	tampered := append([]*revocation.Event{}, events...)
+	tampered[2] = &revocation.Event{Index: 2, E: big.NewInt(3), ParentHash: events[2].ParentHash}
+	problems = VerifyRevocationAccumulators(pk, older, newer, tampered)
+	require.Len(t, problems, 1)
+	require.Equal(t, RevocationProblemAccumulator, problems[0].Type)
+
+	// conflicting accumulators with the same index
+	other := *newer
+	other.Nu = older.Nu
+	problems = VerifyRevocationAccumulators(pk, newer, &other, nil)
+	require.Len(t, problems, 1)
+	require.Equal(t, RevocationProblemFork, problems[0].Type)
+}
+
+func TestRevocationAuditUnknownKey(t *testing.T) {
+	conf := parseConfiguration(t)
+	id := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	sk, err := conf.PrivateKeys.Get(id.IssuerIdentifier(), 2)
+	require.NoError(t, err)
+	update, err := revocation.NewAccumulator(sk)
+	require.NoError(t, err)
+	update.SignedAccumulator.PKCounter = 99
+
+	revServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, _ := MarshalBinary(map[uint]*revocation.Update{99: update})
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(bts)
+	}))
+	defer revServer.Close()
+
+	// The accumulator of the unknown key is reported instead of aborting the audit
+	audit, err := RevocationClient{Conf: conf}.Audit(id, revServer.URL)
+	require.NoError(t, err)
+	require.False(t, audit.OK())
+	require.Len(t, audit.Problems, 1)
+	require.Equal(t, RevocationProblemSignature, audit.Problems[0].Type)
+	require.Equal(t, uint(99), audit.Problems[0].PKCounter)
+	require.Equal(t, revServer.URL, audit.Problems[0].URL)
+}
+
+func TestRevocationArchive(t *testing.T) {
+	conf := parseConfiguration(t)
+	issuer := NewIssuerIdentifier("irma-demo.MijnOverheid")
+	id := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	counter := uint(2)
+	sk, err := conf.PrivateKeys.Get(issuer, counter)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(issuer, counter)
+	require.NoError(t, err)
+
+	update, err := revocation.NewAccumulator(sk)
+	require.NoError(t, err)
+	acc, err := update.SignedAccumulator.UnmarshalVerify(pk)
+	require.NoError(t, err)
+	for i := int64(0); i < 3; i++ {
+		var event *revocation.Event
+		acc, event, err = acc.Remove(sk, big.NewInt(65537+2*i), update.Events[len(update.Events)-1])
+		require.NoError(t, err)
+		update.Events = append(update.Events, event)
+	}
+	update.SignedAccumulator, err = acc.Sign(sk)
+	require.NoError(t, err)
+
+	archive := &RevocationArchive{
+		CredentialType: id,
+		Created:        time.Now().UnixNano(),
+		Updates:        map[uint]*revocation.Update{counter: update},
+		IssuanceRecords: []*IssuanceRecord{{
+			Key:        "1",
+			CredType:   id,
+			Issued:     1,
+			PKCounter:  &counter,
+			Attr:       (*RevocationAttribute)(big.NewInt(65537)),
+			ValidUntil: 2,
+			RevokedAt:  3,
+		}},
+	}
+	require.NoError(t, conf.Revocation.verifyArchive(archive))
+
+	for _, format := range []RevocationArchiveFormat{RevocationArchiveJSON, RevocationArchiveCBOR} {
+		bts, err := signArchive(archive, format, sk)
+		require.NoError(t, err)
+		parsed, err := conf.Revocation.readArchive(bytes.NewReader(bts))
+		require.NoError(t, err, format)
+		require.NoError(t, conf.Revocation.verifyArchive(parsed))
+		require.Equal(t, archive.IssuanceRecords, parsed.IssuanceRecords)
+		require.Len(t, parsed.Updates[counter].Events, 4)
+		require.Equal(t, update.Events[3].E, parsed.Updates[counter].Events[3].E)
+	}
+
+	// tampering invalidates the signature
+	bts, err := signArchive(archive, RevocationArchiveJSON, sk)
+	require.NoError(t, err)
+	tampered := bytes.Replace(bts, []byte(`"Key":"1"`), []byte(`"Key":"2"`), 1)
+	require.NotEqual(t, bts, tampered)
+	_, err = conf.Revocation.readArchive(bytes.NewReader(tampered))
+	require.Error(t, err)
+
+	// the signature cannot be verified with a public key without revocation support
+	ecdsa := pk.ECDSA
+	pk.ECDSA = nil
+	_, err = conf.Revocation.readArchive(bytes.NewReader(bts))
+	pk.ECDSA = ecdsa
+	require.Error(t, err)
+
+	// events must be sorted by index without duplicates
+	events := update.Events
+	update.Events = append(append([]*revocation.Event{}, events...), events[3])
+	require.Error(t, conf.Revocation.verifyArchive(archive))
+	update.Events = []*revocation.Event{events[0], events[2], events[1], events[3]}
+	require.Error(t, conf.Revocation.verifyArchive(archive))
+	update.Events = events
+	require.NoError(t, conf.Revocation.verifyArchive(archive))
+
+	// a gap in the events, which serialization would hide, is detected before signing
+	update.Events = append(update.Events[:2:2], update.Events[3])
+	require.Error(t, conf.Revocation.verifyArchive(archive))
+
+	// issuance records must belong to the credential type
+	archive.Updates = nil
+	archive.IssuanceRecords[0].CredType = NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	require.Error(t, conf.Revocation.verifyArchive(archive))
+}
+
+func TestSqliteRevocationStorage(t *testing.T) {
+	storage, err := ioutil.TempDir("", "revocation")
+	require.NoError(t, err)
+	defer test.ClearTestStorage(t, storage)
+
+	id := NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{
+		RevocationDBType:    "sqlite",
+		RevocationDBConnStr: filepath.Join(storage, "revocation.db"),
+		RevocationSettings:  RevocationSettings{id: {Authority: true}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	rs := conf.Revocation
+	defer func() { require.NoError(t, rs.Close()) }()
+
+	counter := uint(2)
+	sk, err := conf.PrivateKeys.Get(id.IssuerIdentifier(), counter)
+	require.NoError(t, err)
+	pk, err := conf.PublicKey(id.IssuerIdentifier(), counter)
+	require.NoError(t, err)
+	require.NoError(t, rs.EnableRevocation(id, sk))
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		require.NoError(t, rs.AddIssuanceRecord(&IssuanceRecord{
+			Key:        strconv.Itoa(i),
+			CredType:   id,
+			Issued:     time.Now().UnixNano(),
+			PKCounter:  &counter,
+			Attr:       (*RevocationAttribute)(big.NewInt(65537 + 2*int64(i))),
+			ValidUntil: time.Now().Add(time.Hour).UnixNano(),
+		}))
+	}
+
+	// a failing batch revocation is rolled back entirely
+	err = rs.RevokeBatch(id, []*RevocationKey{{Key: "0"}, {Key: "unknown"}})
+	require.Error(t, err)
+	status, err := rs.RevocationKeyStatus(id, "0")
+	require.NoError(t, err)
+	require.False(t, status.Revoked)
+
+	// concurrent revocations are serialized, together forming a single chain
+	var wg sync.WaitGroup
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rs.Revoke(id, strconv.Itoa(i), time.Time{})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	updates, err := rs.UpdateLatest(id, count+1, &counter)
+	require.NoError(t, err)
+	acc, problems := VerifyRevocationEvents(pk, updates[counter].SignedAccumulator, updates[counter].Events)
+	require.Empty(t, problems)
+	require.Equal(t, uint64(count), acc.Index)
+}
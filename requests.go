@@ -23,6 +23,7 @@ const (
 	LDContextSignatureRequest       = "https://irma.app/ld/request/signature/v2"
 	LDContextIssuanceRequest        = "https://irma.app/ld/request/issuance/v2"
 	LDContextRevocationRequest      = "https://irma.app/ld/request/revocation/v1"
+	LDContextIssuanceRecordsRequest = "https://irma.app/ld/request/issuancerecords/v1"
 	LDContextFrontendOptionsRequest = "https://irma.app/ld/request/frontendoptions/v1"
 	LDContextClientSessionRequest   = "https://irma.app/ld/request/client/v1"
 	LDContextSessionOptions         = "https://irma.app/ld/options/v1"
@@ -126,10 +127,12 @@ type ServerJwt struct {
 // RequestorBaseRequest contains fields present in all RequestorRequest types
 // with which the requestor configures an IRMA session.
 type RequestorBaseRequest struct {
-	ResultJwtValidity int              `json:"validity,omitempty"`    // Validity of session result JWT in seconds
-	ClientTimeout     int              `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
-	CallbackURL       string           `json:"callbackUrl,omitempty"` // URL to post session result to
-	NextSession       *NextSessionData `json:"nextSession,omitempty"` // Data about session to start after this one (if any)
+	ResultJwtValidity int              `json:"validity,omitempty"`        // Validity of session result JWT in seconds
+	ClientTimeout     int              `json:"timeout,omitempty"`         // Wait this many seconds for the IRMA app to connect before the session times out
+	SessionLifetime   int              `json:"sessionLifetime,omitempty"` // Cancel the session after this many seconds of inactivity (capped by the server)
+	CallbackURL       string           `json:"callbackUrl,omitempty"`     // URL to post session result to
+	ResultFormat      string           `json:"resultFormat,omitempty"`    // Format of the session result posted to the callback URL: "irma" (default) or "vp"
+	NextSession       *NextSessionData `json:"nextSession,omitempty"`     // Data about session to start after this one (if any)
 }
 
 type NextSessionData struct {
@@ -191,6 +194,12 @@ type RevocationJwt struct {
 	Request *RevocationRequest `json:"revrequest"`
 }
 
+// IssuanceRecordsJwt is a requestor JWT for querying issuance records at the revocation authority.
+type IssuanceRecordsJwt struct {
+	ServerJwt
+	Request *IssuanceRecordsRequest `json:"issrecordsrequest"`
+}
+
 // A RequestorJwt contains an IRMA session object.
 type RequestorJwt interface {
 	Action() Action
@@ -244,6 +253,67 @@ type RevocationRequest struct {
 	CredentialType CredentialTypeIdentifier `json:"type"`
 	Key            string                   `json:"revocationKey,omitempty"`
 	Issued         int64                    `json:"issued,omitempty"`
+	// Instead of Key and Issued, the credentials of many keys can be revoked at once
+	Keys []*RevocationKey `json:"revocationKeys,omitempty"`
+}
+
+// RevocationKey specifies credentials to revoke: those issued with the specified revocation key,
+// or if Issued is not zero, only the one issued at that time (in Unix nanoseconds).
+type RevocationKey struct {
+	Key    string `json:"revocationKey"`
+	Issued int64  `json:"issued,omitempty"`
+}
+
+// IssuanceRecordsRequest queries the issuance records of a credential type at its revocation
+// authority: the credentials that have been issued and not yet expired, and if they were revoked.
+// The matching records are returned ordered by issuance time, in pages of at most Limit records.
+type IssuanceRecordsRequest struct {
+	LDContext      string                   `json:"@context,omitempty"`
+	CredentialType CredentialTypeIdentifier `json:"type"`
+	IssuanceRecordFilter
+	Offset int `json:"offset,omitempty"`
+	Limit  int `json:"limit,omitempty"`
+}
+
+// IssuanceRecordFilter selects issuance records. All times are in Unix nanoseconds; the After
+// bounds are inclusive, the Before bounds exclusive. Zero values are ignored.
+type IssuanceRecordFilter struct {
+	Key           string `json:"revocationKey,omitempty"`
+	IssuedAfter   int64  `json:"issuedAfter,omitempty"`
+	IssuedBefore  int64  `json:"issuedBefore,omitempty"`
+	ExpiresAfter  int64  `json:"expiresAfter,omitempty"`
+	ExpiresBefore int64  `json:"expiresBefore,omitempty"`
+	RevokedAfter  int64  `json:"revokedAfter,omitempty"`
+	RevokedBefore int64  `json:"revokedBefore,omitempty"`
+	// If set, only revoked (true) or unrevoked (false) records are selected
+	Revoked *bool `json:"revoked,omitempty"`
+}
+
+// IssuanceRecords is a page of the issuance records matching an IssuanceRecordsRequest.
+type IssuanceRecords struct {
+	Total   int                   `json:"total"` // amount of matching records on all pages
+	Offset  int                   `json:"offset"`
+	Records []*IssuanceRecordInfo `json:"records"`
+}
+
+// IssuanceRecordInfo describes an issued credential, as stored in its IssuanceRecord.
+// Times are in Unix nanoseconds.
+type IssuanceRecordInfo struct {
+	Key            string                   `json:"revocationKey"`
+	CredentialType CredentialTypeIdentifier `json:"type"`
+	PKCounter      uint                     `json:"pkCounter"`
+	Issued         int64                    `json:"issued"`
+	ValidUntil     int64                    `json:"validUntil"`
+	RevokedAt      int64                    `json:"revokedAt,omitempty"` // 0 if not revoked
+}
+
+// RevocationKeyStatus is the revocation status of the credentials issued with a revocation key.
+type RevocationKeyStatus struct {
+	Key            string                   `json:"revocationKey"`
+	CredentialType CredentialTypeIdentifier `json:"type"`
+	// Revoked is true if all credentials issued with the key are revoked
+	Revoked bool                  `json:"revoked"`
+	Records []*IssuanceRecordInfo `json:"records"`
 }
 
 type NonRevocationRequest struct {
@@ -303,9 +373,35 @@ func (r *RevocationRequest) Validate() error {
 	if r.LDContext != LDContextRevocationRequest {
 		return errors.New("not a revocation request")
 	}
+	if len(r.Keys) > 0 && (r.Key != "" || r.Issued != 0) {
+		return errors.New("revocation request cannot specify both revocationKey and revocationKeys")
+	}
+	for _, key := range r.Keys {
+		if key == nil || key.Key == "" {
+			return errors.New("revocation request contains empty revocationKey")
+		}
+	}
+	return nil
+}
+
+func (r *IssuanceRecordsRequest) Validate() error {
+	if r.LDContext != LDContextIssuanceRecordsRequest {
+		return errors.New("not an issuance records request")
+	}
+	if r.Offset < 0 || r.Limit < 0 {
+		return errors.New("offset and limit cannot be negative")
+	}
 	return nil
 }
 
+// RevocationKeys returns the keys of the credentials to be revoked.
+func (r *RevocationRequest) RevocationKeys() []*RevocationKey {
+	if len(r.Keys) > 0 {
+		return r.Keys
+	}
+	return []*RevocationKey{{Key: r.Key, Issued: r.Issued}}
+}
+
 var (
 	bigZero = big.NewInt(0)
 	bigOne  = big.NewInt(1)
@@ -1089,6 +1185,9 @@ func (claims *RevocationJwt) Valid() error {
 	if time.Time(claims.IssuedAt).After(time.Now()) {
 		return errors.New("Signature jwt not yet valid")
 	}
+	if claims.Request == nil {
+		return errors.New("Revocation jwt contains no revocation request")
+	}
 	return nil
 }
 
@@ -1096,6 +1195,35 @@ func (claims *RevocationJwt) Sign(method jwt.SigningMethod, key interface{}) (st
 	return jwt.NewWithClaims(method, claims).SignedString(key)
 }
 
+// NewIssuanceRecordsJwt returns a new IssuanceRecordsJwt.
+func NewIssuanceRecordsJwt(servername string, rr *IssuanceRecordsRequest) *IssuanceRecordsJwt {
+	return &IssuanceRecordsJwt{
+		ServerJwt: ServerJwt{
+			ServerName: servername,
+			IssuedAt:   Timestamp(time.Now()),
+			Type:       "issuance_records_request",
+		},
+		Request: rr,
+	}
+}
+
+func (claims *IssuanceRecordsJwt) Valid() error {
+	if claims.Type != "issuance_records_request" {
+		return errors.New("Issuance records jwt has invalid subject")
+	}
+	if time.Time(claims.IssuedAt).After(time.Now()) {
+		return errors.New("Issuance records jwt not yet valid")
+	}
+	if claims.Request == nil {
+		return errors.New("Issuance records jwt contains no request")
+	}
+	return claims.Request.Validate()
+}
+
+func (claims *IssuanceRecordsJwt) Sign(method jwt.SigningMethod, key interface{}) (string, error) {
+	return jwt.NewWithClaims(method, claims).SignedString(key)
+}
+
 func (claims *ServiceProviderJwt) Action() Action { return ActionDisclosing }
 
 func (claims *SignatureRequestorJwt) Action() Action { return ActionSigning }
@@ -22,6 +22,7 @@ import (
 	"github.com/privacybydesign/gabi/revocation"
 	"github.com/privacybydesign/gabi/signed"
 	sseclient "github.com/sietseringers/go-sse"
+	"go.opentelemetry.io/otel/attribute"
 
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -42,6 +43,9 @@ type (
 		client RevocationClient
 
 		ServerSentEvents *sse.Server
+		// SyncListener, if set, is called after each attempt to fetch revocation updates
+		// from the revocation server in SyncDB(), with the error that occurred if any.
+		SyncListener func(id CredentialTypeIdentifier, err error)
 
 		close  chan struct{}
 		events chan *sseclient.Event
@@ -158,6 +162,11 @@ var RevocationParameters = struct {
 	// Cache-control: max-age HTTP return header (in seconds)
 	EventsCacheMaxAge uint64
 
+	// IssuanceRecordsDefaultLimit is the amount of issuance records returned per page if the
+	// request does not specify it; at most IssuanceRecordsMaxLimit are returned.
+	IssuanceRecordsDefaultLimit int
+	IssuanceRecordsMaxLimit     int
+
 	UpdateMinCount      uint64
 	UpdateMaxCount      uint64
 	UpdateMinCountPower int
@@ -173,6 +182,8 @@ var RevocationParameters = struct {
 	UpdateMinCountPower:           4,
 	UpdateMaxCountPower:           9,
 	EventsCacheMaxAge:             60 * 60,
+	IssuanceRecordsDefaultLimit:   100,
+	IssuanceRecordsMaxLimit:       1000,
 }
 
 func init() {
@@ -214,6 +225,14 @@ func (rs *RevocationStorage) Exists(id CredentialTypeIdentifier, counter uint) (
 // Revocation update message methods
 
 func (rs *RevocationStorage) Events(id CredentialTypeIdentifier, pkcounter uint, from, to uint64) (*revocation.EventList, error) {
+	return rs.EventsContext(context.Background(), id, pkcounter, from, to)
+}
+
+// EventsContext is like Events, recording its span as child of the span in ctx, if any.
+func (rs *RevocationStorage) EventsContext(ctx context.Context, id CredentialTypeIdentifier, pkcounter uint, from, to uint64) (_ *revocation.EventList, err error) {
+	_, span := StartSpan(ctx, "RevocationStorage.Events", attribute.String("irma.credtype", id.String()))
+	defer func() { EndSpan(span, err) }()
+
 	if from >= to || from%RevocationParameters.UpdateMinCount != 0 || to%RevocationParameters.UpdateMinCount != 0 {
 		return nil, errors.New("illegal update interval")
 	}
@@ -245,6 +264,14 @@ func (rs *RevocationStorage) Events(id CredentialTypeIdentifier, pkcounter uint,
 }
 
 func (rs *RevocationStorage) UpdateLatest(id CredentialTypeIdentifier, count uint64, counter *uint) (map[uint]*revocation.Update, error) {
+	return rs.UpdateLatestContext(context.Background(), id, count, counter)
+}
+
+// UpdateLatestContext is like UpdateLatest, recording its span as child of the span in ctx, if any.
+func (rs *RevocationStorage) UpdateLatestContext(ctx context.Context, id CredentialTypeIdentifier, count uint64, counter *uint) (_ map[uint]*revocation.Update, err error) {
+	_, span := StartSpan(ctx, "RevocationStorage.UpdateLatest", attribute.String("irma.credtype", id.String()))
+	defer func() { EndSpan(span, err) }()
+
 	var updates map[uint]*revocation.Update
 	if rs.sqlMode {
 		if err := rs.sqldb.Transaction(func(tx sqlRevStorage) error {
@@ -309,6 +336,14 @@ func (*RevocationStorage) newUpdates(records []*AccumulatorRecord, events []*Eve
 }
 
 func (rs *RevocationStorage) AddUpdate(id CredentialTypeIdentifier, record *revocation.Update) error {
+	return rs.AddUpdateContext(context.Background(), id, record)
+}
+
+// AddUpdateContext is like AddUpdate, recording its span as child of the span in ctx, if any.
+func (rs *RevocationStorage) AddUpdateContext(ctx context.Context, id CredentialTypeIdentifier, record *revocation.Update) (err error) {
+	_, span := StartSpan(ctx, "RevocationStorage.AddUpdate", attribute.String("irma.credtype", id.String()))
+	defer func() { EndSpan(span, err) }()
+
 	if rs.sqlMode {
 		return rs.sqldb.Transaction(func(tx sqlRevStorage) error {
 			return rs.addUpdate(tx, id, record, false)
@@ -375,6 +410,114 @@ func (rs *RevocationStorage) IssuanceRecords(id CredentialTypeIdentifier, key st
 	return r, nil
 }
 
+// ListIssuanceRecords returns the issuance records of the credential type that match the filter,
+// ordered by issuance time, skipping the first offset of them and returning at most limit (which is
+// capped at RevocationParameters.IssuanceRecordsMaxLimit), and the total amount of matching records.
+func (rs *RevocationStorage) ListIssuanceRecords(
+	id CredentialTypeIdentifier, filter *IssuanceRecordFilter, offset, limit int,
+) ([]*IssuanceRecord, int, error) {
+	if !rs.settings.Get(id).Authority {
+		return nil, 0, errors.Errorf("not the revocation authority of %s", id)
+	}
+	if limit <= 0 {
+		limit = RevocationParameters.IssuanceRecordsDefaultLimit
+	}
+	if limit > RevocationParameters.IssuanceRecordsMaxLimit {
+		limit = RevocationParameters.IssuanceRecordsMaxLimit
+	}
+	if filter == nil {
+		filter = &IssuanceRecordFilter{}
+	}
+
+	query, args := filter.where(id)
+	var r []*IssuanceRecord
+	total, err := rs.sqldb.Page(&r, "issued, revocationkey", offset, limit, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, total, nil
+}
+
+// RevocationKeyStatus returns the revocation status of all credentials of the credential type
+// issued with the specified key, or ErrUnknownRevocationKey if there are none (left).
+func (rs *RevocationStorage) RevocationKeyStatus(id CredentialTypeIdentifier, key string) (*RevocationKeyStatus, error) {
+	if !rs.settings.Get(id).Authority {
+		return nil, errors.Errorf("not the revocation authority of %s", id)
+	}
+	var r []*IssuanceRecord
+	if err := rs.sqldb.Find(&r, map[string]interface{}{"cred_type": id, "revocationkey": key}); err != nil {
+		return nil, err
+	}
+	if len(r) == 0 {
+		return nil, ErrUnknownRevocationKey
+	}
+
+	status := &RevocationKeyStatus{Key: key, CredentialType: id, Revoked: true}
+	for _, record := range r {
+		status.Records = append(status.Records, record.Info())
+		if record.RevokedAt == 0 {
+			status.Revoked = false
+		}
+	}
+	return status, nil
+}
+
+// Info returns the information about the issued credential contained in the issuance record.
+func (r *IssuanceRecord) Info() *IssuanceRecordInfo {
+	info := &IssuanceRecordInfo{
+		Key:            r.Key,
+		CredentialType: r.CredType,
+		Issued:         r.Issued,
+		ValidUntil:     r.ValidUntil,
+		RevokedAt:      r.RevokedAt,
+	}
+	if r.PKCounter != nil {
+		info.PKCounter = *r.PKCounter
+	}
+	return info
+}
+
+// where returns the SQL conditions and arguments selecting the issuance records of the
+// credential type matching the filter.
+func (f *IssuanceRecordFilter) where(id CredentialTypeIdentifier) (string, []interface{}) {
+	conds := []string{"cred_type = ?"}
+	args := []interface{}{id}
+	add := func(cond string, arg interface{}) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+
+	if f.Key != "" {
+		add("revocationkey = ?", f.Key)
+	}
+	if f.IssuedAfter != 0 {
+		add("issued >= ?", f.IssuedAfter)
+	}
+	if f.IssuedBefore != 0 {
+		add("issued < ?", f.IssuedBefore)
+	}
+	if f.ExpiresAfter != 0 {
+		add("valid_until >= ?", f.ExpiresAfter)
+	}
+	if f.ExpiresBefore != 0 {
+		add("valid_until < ?", f.ExpiresBefore)
+	}
+	if f.RevokedAfter != 0 {
+		add("revoked_at >= ?", f.RevokedAfter)
+	}
+	if f.RevokedBefore != 0 {
+		add("revoked_at < ?", f.RevokedBefore)
+	}
+	// revoked_at is 0 for unrevoked records, so they also satisfy revoked_at < RevokedBefore
+	if f.RevokedBefore != 0 || f.Revoked != nil && *f.Revoked {
+		conds = append(conds, "revoked_at > 0")
+	}
+	if f.Revoked != nil && !*f.Revoked {
+		conds = append(conds, "revoked_at = 0")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
 // Revocation methods
 
 // Revoke revokes the credential(s) specified by key and issued, if found within the current database,
@@ -382,23 +525,50 @@ func (rs *RevocationStorage) IssuanceRecords(id CredentialTypeIdentifier, key st
 // and updating the revocation database on disk.
 // If issued is not specified, i.e. passed the zero value, all credentials specified by key are revoked.
 func (rs *RevocationStorage) Revoke(id CredentialTypeIdentifier, key string, issued time.Time) error {
+	revkey := &RevocationKey{Key: key}
+	if !issued.IsZero() {
+		revkey.Issued = issued.UnixNano()
+	}
+	return rs.RevokeBatch(id, []*RevocationKey{revkey})
+}
+
+// RevokeBatch revokes the credentials specified by each of the keys like Revoke, within a single
+// database transaction: if any of the keys is unknown or already revoked, nothing is revoked.
+// Instead of one revocation update per revoked credential, one update is added per key counter
+// of the issuer, containing the events of all credentials revoked against that key.
+func (rs *RevocationStorage) RevokeBatch(id CredentialTypeIdentifier, keys []*RevocationKey) error {
+	return rs.RevokeBatchContext(context.Background(), id, keys)
+}
+
+// RevokeBatchContext is like RevokeBatch, recording its span as child of the span in ctx, if any.
+func (rs *RevocationStorage) RevokeBatchContext(ctx context.Context, id CredentialTypeIdentifier, keys []*RevocationKey) (err error) {
+	_, span := StartSpan(ctx, "RevocationStorage.RevokeBatch",
+		attribute.String("irma.credtype", id.String()), attribute.Int("irma.revocation_keys", len(keys)))
+	defer func() { EndSpan(span, err) }()
+
 	if !rs.settings.Get(id).Authority {
 		return errors.Errorf("cannot revoke %s", id)
 	}
+	if len(keys) == 0 {
+		return errors.New("no revocation keys specified")
+	}
 	return rs.sqldb.Transaction(func(tx sqlRevStorage) error {
-		return rs.revoke(tx, id, key, issued)
+		return rs.revoke(tx, id, keys)
 	})
 }
 
-func (rs *RevocationStorage) revoke(tx sqlRevStorage, id CredentialTypeIdentifier, key string, issued time.Time) error {
+func (rs *RevocationStorage) revoke(tx sqlRevStorage, id CredentialTypeIdentifier, keys []*RevocationKey) error {
 	var err error
-	issrecords, err := rs.IssuanceRecords(id, key, issued)
+	issrecords, err := rs.revokeIssuanceRecords(tx, id, keys)
 	if err != nil {
 		return err
 	}
 
 	// get all relevant accumulators and events from the database
 	accs, events, err := rs.revokeReadRecords(tx, id, issrecords)
+	if err != nil {
+		return err
+	}
 
 	// For each issuance record, perform revocation, adding an Event and advancing the accumulator
 	for _, issrecord := range issrecords {
@@ -431,14 +601,56 @@ func (rs *RevocationStorage) revoke(tx sqlRevStorage, id CredentialTypeIdentifie
 	return nil
 }
 
+// revokeIssuanceRecords returns the unrevoked issuance records specified by the keys, each of
+// them once, returning ErrUnknownRevocationKey (prefixed with the key, if there are multiple
+// keys) if there are none for one of the keys.
+func (rs *RevocationStorage) revokeIssuanceRecords(
+	tx sqlRevStorage,
+	id CredentialTypeIdentifier,
+	keys []*RevocationKey,
+) ([]*IssuanceRecord, error) {
+	var issrecords []*IssuanceRecord
+	seen := map[string]struct{}{}
+	for _, key := range keys {
+		where := map[string]interface{}{"cred_type": id, "revocationkey": key.Key, "revoked_at": 0}
+		if key.Issued != 0 {
+			where["issued"] = key.Issued
+		}
+		var r []*IssuanceRecord
+		if err := tx.Find(&r, where); err != nil {
+			return nil, err
+		}
+		if len(r) == 0 {
+			if len(keys) == 1 {
+				return nil, ErrUnknownRevocationKey
+			}
+			return nil, errors.WrapPrefix(ErrUnknownRevocationKey, key.Key, 0)
+		}
+		for _, issrecord := range r {
+			// the same credential may be specified more than once, but must be revoked only once
+			if _, ok := seen[(*big.Int)(issrecord.Attr).String()]; ok {
+				continue
+			}
+			seen[(*big.Int)(issrecord.Attr).String()] = struct{}{}
+			issrecords = append(issrecords, issrecord)
+		}
+	}
+	return issrecords, nil
+}
+
 func (rs *RevocationStorage) revokeReadRecords(
 	tx sqlRevStorage,
 	id CredentialTypeIdentifier,
 	issrecords []*IssuanceRecord,
 ) (map[uint]*revocation.Accumulator, map[uint][]*revocation.Event, error) {
-	// gather all keys used in the issuance requests
+	// gather all keys used in the issuance requests, each of them once
 	var keycounters []uint
+	seen := map[uint]struct{}{}
 	for _, issrecord := range issrecords {
+		if _, ok := seen[*issrecord.PKCounter]; ok {
+			continue
+		}
+		seen[*issrecord.PKCounter] = struct{}{}
 		keycounters = append(keycounters, *issrecord.PKCounter)
 	}
 
@@ -448,7 +660,7 @@ func (rs *RevocationStorage) revokeReadRecords(
 		return nil, nil, err
 	}
 	var eventrecords []EventRecord
-	err := tx.Find(&eventrecords, "eventindex = (?)", tx.gorm.
+	err := tx.Find(&eventrecords, "cred_type = ? and pk_counter in (?) and eventindex = (?)", id, keycounters, tx.gorm.
 		Table("event_records e2").
 		Select("max(e2.eventindex)").
 		Where("e2.cred_type = event_records.cred_type and e2.pk_counter = event_records.pk_counter").
@@ -587,7 +799,10 @@ func (rs *RevocationStorage) updateAccumulatorTimes() error {
 
 // Methods to update from remote revocation server
 
-func (rs *RevocationStorage) SyncDB(id CredentialTypeIdentifier) error {
+func (rs *RevocationStorage) SyncDB(id CredentialTypeIdentifier) (err error) {
+	ctx, span := StartSpan(context.Background(), "RevocationStorage.SyncDB", attribute.String("irma.credtype", id.String()))
+	defer func() { EndSpan(span, err) }()
+
 	ct := rs.conf.CredentialTypes[id]
 	if ct == nil {
 		return ErrorUnknownCredentialType
@@ -598,11 +813,14 @@ func (rs *RevocationStorage) SyncDB(id CredentialTypeIdentifier) error {
 
 	Logger.WithField("credtype", id).Tracef("fetching revocation updates")
 	updates, err := rs.client.FetchUpdatesLatest(id, ct.RevocationUpdateCount)
+	if rs.SyncListener != nil {
+		rs.SyncListener(id, err)
+	}
 	if err != nil {
 		return err
 	}
 	for _, u := range updates {
-		if err = rs.AddUpdate(id, u); err != nil {
+		if err = rs.AddUpdateContext(ctx, id, u); err != nil {
 			return err
 		}
 	}
@@ -622,7 +840,10 @@ func (rs *RevocationStorage) SyncIfOld(id CredentialTypeIdentifier, maxage uint6
 
 // SaveIssuanceRecord either stores the issuance record locally, if we are the revocation server of
 // the crecential type, or it signs and sends it to the remote revocation server.
-func (rs *RevocationStorage) SaveIssuanceRecord(id CredentialTypeIdentifier, rec *IssuanceRecord, sk *gabikeys.PrivateKey) error {
+func (rs *RevocationStorage) SaveIssuanceRecord(id CredentialTypeIdentifier, rec *IssuanceRecord, sk *gabikeys.PrivateKey) (err error) {
+	_, span := StartSpan(context.Background(), "RevocationStorage.SaveIssuanceRecord", attribute.String("irma.credtype", id.String()))
+	defer func() { EndSpan(span, err) }()
+
 	credtype := rs.conf.CredentialTypes[id]
 	if credtype == nil {
 		return ErrorUnknownCredentialType
@@ -794,6 +1015,11 @@ func (rs *RevocationStorage) Load(debug bool, dbtype, connstr string, settings R
 	return nil
 }
 
+// Ping checks that the revocation database, if any, is reachable.
+func (rs *RevocationStorage) Ping() error {
+	return rs.sqldb.Ping()
+}
+
 func (rs *RevocationStorage) Close() error {
 	if rs.close != nil {
 		close(rs.close)
@@ -1065,7 +1291,7 @@ func (signedMessage) GormDataType(dialect gorm.Dialect) string {
 	switch dialect.GetName() {
 	case "postgres":
 		return "bytea"
-	case "mysql":
+	case "mysql", "sqlite3":
 		return "blob"
 	default:
 		return ""
@@ -1091,7 +1317,7 @@ func (RevocationAttribute) GormDataType(dialect gorm.Dialect) string {
 	switch dialect.GetName() {
 	case "postgres":
 		return "bytea"
-	case "mysql":
+	case "mysql", "sqlite3":
 		return "blob"
 	default:
 		return ""
@@ -1106,6 +1332,14 @@ func (i *RevocationAttribute) UnmarshalCBOR(data []byte) error {
 	return cbor.Unmarshal(data, (*big.Int)(i))
 }
 
+func (i *RevocationAttribute) MarshalJSON() ([]byte, error) {
+	return json.Marshal((*big.Int)(i))
+}
+
+func (i *RevocationAttribute) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, (*big.Int)(i))
+}
+
 func (rs RevocationSettings) Get(id CredentialTypeIdentifier) *RevocationSetting {
 	if rs[id] == nil {
 		rs[id] = &RevocationSetting{}
@@ -1151,7 +1385,7 @@ func (eventHash) GormDataType(dialect gorm.Dialect) string {
 	switch dialect.GetName() {
 	case "postgres":
 		return "bytea"
-	case "mysql":
+	case "mysql", "sqlite3":
 		return "blob"
 	default:
 		return ""
@@ -0,0 +1,314 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	"github.com/go-errors/errors"
+	"github.com/jinzhu/gorm"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/revocation"
+	"github.com/privacybydesign/gabi/signed"
+)
+
+// Revocation archives contain the complete revocation state of a credential type in a revocation
+// authority's database, for backups and for moving the state to another database. They are signed
+// with the issuer private key, so that the state cannot be altered between export and import.
+
+// RevocationArchiveFormat is the encoding of a revocation archive.
+type RevocationArchiveFormat string
+
+const (
+	RevocationArchiveJSON RevocationArchiveFormat = "json"
+	RevocationArchiveCBOR RevocationArchiveFormat = "cbor"
+)
+
+type (
+	// RevocationArchive contains the accumulators, events and issuance records of a credential type.
+	RevocationArchive struct {
+		CredentialType  CredentialTypeIdentifier    `json:"type"`
+		Created         int64                       `json:"created"` // Unix nanoseconds
+		Updates         map[uint]*revocation.Update `json:"updates"` // per key: accumulator and all events
+		IssuanceRecords []*IssuanceRecord           `json:"issuanceRecords"`
+	}
+
+	// signedRevocationArchive contains a serialized RevocationArchive and the signature over it
+	// made with the issuer private key with the specified counter.
+	signedRevocationArchive struct {
+		PKCounter uint            `json:"pk"`
+		Archive   json.RawMessage `json:"archive"`
+		Signature []byte          `json:"signature"`
+	}
+)
+
+// Export writes the revocation state of the credential type to w, as a revocation archive encoded
+// in the specified format and signed with the latest private key of the issuer.
+func (rs *RevocationStorage) Export(id CredentialTypeIdentifier, format RevocationArchiveFormat, w io.Writer) error {
+	if !rs.settings.Get(id).Authority {
+		return errors.Errorf("not the revocation authority of %s", id)
+	}
+	if !rs.sqlMode {
+		return errors.New("cannot export revocation state without database")
+	}
+	sk, err := rs.Keys.PrivateKeyLatest(id.IssuerIdentifier())
+	if err != nil {
+		return err
+	}
+
+	archive := &RevocationArchive{CredentialType: id, Created: time.Now().UnixNano()}
+	if err = rs.sqldb.Transaction(func(tx sqlRevStorage) error {
+		var (
+			records []*AccumulatorRecord
+			events  []*EventRecord
+		)
+		where := map[string]interface{}{"cred_type": id}
+		if err := tx.Find(&records, where); err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return ErrRevocationStateNotFound
+		}
+		if err := tx.Find(&events, where); err != nil {
+			return err
+		}
+		if err := tx.Find(&archive.IssuanceRecords, where); err != nil {
+			return err
+		}
+		archive.Updates = rs.newUpdates(records, events)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Events are compressed when serialized, which would hide gaps in the chain
+	if err = rs.verifyArchive(archive); err != nil {
+		return err
+	}
+
+	bts, err := signArchive(archive, format, sk)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bts)
+	return err
+}
+
+// Import reads a revocation archive of the credential type from r, in either format, verifies it
+// and stores its contents.
+// For each issuer key, the events of the archive beyond the accumulator in the database are added;
+// importing the archive fails if the database contains events that are not in the archive. Issuance
+// records not in the database are added, and records revoked in the archive are marked revoked in
+// the database; records are never unrevoked. It returns the imported archive.
+func (rs *RevocationStorage) Import(id CredentialTypeIdentifier, r io.Reader) (*RevocationArchive, error) {
+	if !rs.settings.Get(id).Authority {
+		return nil, errors.Errorf("not the revocation authority of %s", id)
+	}
+	if !rs.sqlMode {
+		return nil, errors.New("cannot import revocation state without database")
+	}
+	archive, err := rs.readArchive(r)
+	if err != nil {
+		return nil, err
+	}
+	if archive.CredentialType != id {
+		return nil, errors.Errorf("revocation archive is of credential type %s", archive.CredentialType)
+	}
+	if err = rs.verifyArchive(archive); err != nil {
+		return nil, err
+	}
+
+	err = rs.sqldb.Transaction(func(tx sqlRevStorage) error {
+		for _, update := range archive.Updates {
+			if err := rs.importUpdate(tx, id, update); err != nil {
+				return err
+			}
+		}
+		for _, record := range archive.IssuanceRecords {
+			if err := rs.importIssuanceRecord(tx, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// readArchive parses a signed revocation archive and verifies its signature.
+func (rs *RevocationStorage) readArchive(r io.Reader) (*RevocationArchive, error) {
+	bts, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	unmarshal := cbor.Unmarshal
+	if trimmed := bytes.TrimSpace(bts); len(trimmed) > 0 && trimmed[0] == '{' {
+		unmarshal = json.Unmarshal
+	}
+
+	var s signedRevocationArchive
+	if err = unmarshal(bts, &s); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse revocation archive", 0)
+	}
+	// Parse the archive before verifying it to find out which issuer signed it
+	archive := &RevocationArchive{}
+	if err = unmarshal(s.Archive, archive); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse revocation archive", 0)
+	}
+	pk, err := rs.Keys.PublicKey(archive.CredentialType.IssuerIdentifier(), s.PKCounter)
+	if err != nil {
+		return nil, err
+	}
+	if pk.ECDSA == nil {
+		return nil, errors.Errorf("public key %d of %s does not support revocation",
+			s.PKCounter, archive.CredentialType.IssuerIdentifier())
+	}
+	if err = signed.Verify(pk.ECDSA, s.Archive, s.Signature); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid revocation archive signature", 0)
+	}
+	return archive, nil
+}
+
+// verifyArchive checks that the event chains of the archive are complete, match their accumulators
+// and are in canonical form, i.e. sorted by index without duplicates as written by Export, and
+// that the issuance records belong to the credential type of the archive.
+func (rs *RevocationStorage) verifyArchive(archive *RevocationArchive) error {
+	id := archive.CredentialType
+	for counter, update := range archive.Updates {
+		if update == nil || update.SignedAccumulator == nil || update.SignedAccumulator.PKCounter != counter {
+			return errors.Errorf("revocation archive contains invalid accumulator for key %d", counter)
+		}
+		pk, err := rs.Keys.PublicKey(id.IssuerIdentifier(), counter)
+		if err != nil {
+			return err
+		}
+		acc, problems := VerifyRevocationEvents(pk, update.SignedAccumulator, update.Events)
+		if len(problems) > 0 {
+			return errors.Errorf("revocation archive contains invalid events for key %d: %s (event %d)",
+				counter, problems[0].Message, problems[0].Index)
+		}
+		// importUpdate indexes the events by their index
+		if uint64(len(update.Events)) != acc.Index+1 {
+			return errors.Errorf("revocation archive contains %d events for key %d instead of %d",
+				len(update.Events), counter, acc.Index+1)
+		}
+		for i, event := range update.Events {
+			if event.Index != uint64(i) {
+				return errors.Errorf("revocation archive contains event %d of key %d at position %d",
+					event.Index, counter, i)
+			}
+		}
+	}
+	for _, record := range archive.IssuanceRecords {
+		if record.CredType != id || record.PKCounter == nil || record.Attr == nil {
+			return errors.Errorf("revocation archive contains invalid issuance record %s", record.Key)
+		}
+	}
+	return nil
+}
+
+// importUpdate adds the events of the update beyond the current accumulator of the key, if any,
+// and replaces the accumulator with the one from the update. The update must have been verified.
+func (rs *RevocationStorage) importUpdate(tx sqlRevStorage, id CredentialTypeIdentifier, update *revocation.Update) error {
+	counter := update.SignedAccumulator.PKCounter
+	pk, err := rs.Keys.PublicKey(id.IssuerIdentifier(), counter)
+	if err != nil {
+		return err
+	}
+	acc, err := update.SignedAccumulator.UnmarshalVerify(pk)
+	if err != nil {
+		return err
+	}
+
+	var from uint64
+	sacc, err := rs.accumulator(tx, id, counter)
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		// no state for this key yet, import all events
+	case err != nil:
+		return err
+	default:
+		current, err := sacc.UnmarshalVerify(pk)
+		if err != nil {
+			return err
+		}
+		if current.Index > acc.Index {
+			return errors.Errorf("revocation state of key %d is newer than the archive (event %d, archive has %d)",
+				counter, current.Index, acc.Index)
+		}
+		// The event at the current index must be in the archive, otherwise the chains have forked.
+		// The events of the archive have been verified to be sorted by index, starting at 0.
+		if !eventHashEquals(update.Events[current.Index], current.EventHash) {
+			return errors.Errorf("revocation state of key %d does not match the archive at event %d",
+				counter, current.Index)
+		}
+		if current.Index == acc.Index {
+			return nil
+		}
+		from = current.Index + 1
+	}
+
+	if err = tx.Save(new(AccumulatorRecord).Convert(id, update.SignedAccumulator)); err != nil {
+		return err
+	}
+	for _, event := range update.Events[from:] {
+		if err = tx.Insert(new(EventRecord).Convert(id, counter, event)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importIssuanceRecord adds the issuance record if it does not exist, or marks the existing record
+// as revoked if it is revoked in the archive.
+func (rs *RevocationStorage) importIssuanceRecord(tx sqlRevStorage, record *IssuanceRecord) error {
+	var existing []*IssuanceRecord
+	if err := tx.Find(&existing, map[string]interface{}{
+		"cred_type": record.CredType, "revocationkey": record.Key, "issued": record.Issued,
+	}); err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return tx.Insert(record)
+	}
+	if record.RevokedAt == 0 || existing[0].RevokedAt != 0 {
+		return nil
+	}
+	existing[0].RevokedAt = record.RevokedAt
+	return tx.Save(existing[0])
+}
+
+// signArchive serializes the archive in the specified format and signs it with the private key.
+func signArchive(archive *RevocationArchive, format RevocationArchiveFormat, sk *gabikeys.PrivateKey) ([]byte, error) {
+	marshal, err := archiveMarshaler(format)
+	if err != nil {
+		return nil, err
+	}
+	bts, err := marshal(archive)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := signed.Sign(sk.ECDSA, bts)
+	if err != nil {
+		return nil, err
+	}
+	return marshal(&signedRevocationArchive{PKCounter: sk.Counter, Archive: bts, Signature: sig})
+}
+
+func archiveMarshaler(format RevocationArchiveFormat) (func(interface{}) ([]byte, error), error) {
+	switch format {
+	case RevocationArchiveJSON:
+		return json.Marshal, nil
+	case RevocationArchiveCBOR:
+		return func(v interface{}) ([]byte, error) {
+			return cbor.Marshal(v, cbor.EncOptions{})
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported revocation archive format %s", format)
+	}
+}
@@ -0,0 +1,426 @@
+package irma
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/revocation"
+)
+
+// Revocation audits verify the complete revocation event chains of a credential type, as published
+// by revocation servers, independently of the revocation authority.
+//
+// Each event refers to the hash of its parent event, and the signed accumulator refers to the hash
+// of the last event; so the signature over the accumulator covers the entire chain. The accumulator
+// value itself cannot be recomputed from the events without the initial accumulator value, which is
+// not published; instead, its index and event hash are recomputed from the chain. The value can
+// only be verified against an earlier accumulator value: as revoking e replaces the value nu by
+// nu^(1/e), the later value raised to each e revoked in between must equal the earlier value.
+// Audits of a single revocation server, or of servers that all serve the same accumulator, therefore
+// verify only the signatures, indices and event hashes of the accumulators, and not their values.
+
+type RevocationProblemType string
+
+const (
+	// RevocationProblemSignature means the accumulator is missing or its signature is invalid.
+	RevocationProblemSignature RevocationProblemType = "signature"
+	// RevocationProblemGap means events are missing from the chain.
+	RevocationProblemGap RevocationProblemType = "gap"
+	// RevocationProblemFork means events do not form a single chain ending in the accumulator,
+	// or revocation servers disagree on the chain.
+	RevocationProblemFork RevocationProblemType = "fork"
+	// RevocationProblemEvent means an event is invalid by itself.
+	RevocationProblemEvent RevocationProblemType = "event"
+	// RevocationProblemFetch means events or accumulators could not be fetched.
+	RevocationProblemFetch RevocationProblemType = "fetch"
+	// RevocationProblemAccumulator means an accumulator value does not follow from an earlier
+	// accumulator value and the events in between.
+	RevocationProblemAccumulator RevocationProblemType = "accumulator"
+)
+
+type (
+	// RevocationAudit contains the results of auditing the revocation event chains of a credential type.
+	RevocationAudit struct {
+		CredentialType CredentialTypeIdentifier `json:"type"`
+		Chains         []*RevocationChainAudit  `json:"chains"`
+		Problems       []*RevocationProblem     `json:"problems"`
+	}
+
+	// RevocationChainAudit summarizes the event chain of one issuer key, as served by one server.
+	RevocationChainAudit struct {
+		URL              string `json:"url,omitempty"`
+		PKCounter        uint   `json:"pkCounter"`
+		Events           int    `json:"events"` // amount of events received
+		AccumulatorIndex uint64 `json:"accumulatorIndex"`
+		AccumulatorTime  int64  `json:"accumulatorTime"`
+		// Whether the accumulator value was verified against an earlier accumulator value
+		AccumulatorLinked bool `json:"accumulatorLinked"`
+	}
+
+	// RevocationProblem is a problem found by a revocation audit.
+	RevocationProblem struct {
+		Type      RevocationProblemType `json:"type"`
+		URL       string                `json:"url,omitempty"`
+		PKCounter uint                  `json:"pkCounter"`
+		Index     uint64                `json:"index"` // index of the (first) event concerned
+		Message   string                `json:"message"`
+	}
+)
+
+// OK returns whether the audit found no problems.
+func (audit *RevocationAudit) OK() bool {
+	return len(audit.Problems) == 0
+}
+
+func (audit *RevocationAudit) problem(typ RevocationProblemType, url string, counter uint, index uint64, format string, args ...interface{}) {
+	audit.Problems = append(audit.Problems, &RevocationProblem{
+		Type:      typ,
+		URL:       url,
+		PKCounter: counter,
+		Index:     index,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// VerifyRevocationEvents verifies the chain of revocation events of an issuer key against its
+// signed accumulator: it checks the signature of the accumulator, that the events start with the
+// initial event and that each of them refers to its parent, that no events are missing, and that
+// the index and event hash of the accumulator match the last event. The events need not be sorted.
+// It returns the accumulator, if its signature is valid, and all problems found.
+func VerifyRevocationEvents(
+	pk *gabikeys.PublicKey, sacc *revocation.SignedAccumulator, events []*revocation.Event,
+) (*revocation.Accumulator, []*RevocationProblem) {
+	audit := &RevocationAudit{}
+	report := func(typ RevocationProblemType, index uint64, format string, args ...interface{}) {
+		audit.problem(typ, "", pk.Counter, index, format, args...)
+	}
+
+	var acc *revocation.Accumulator
+	var err error
+	switch {
+	case sacc == nil:
+		report(RevocationProblemSignature, 0, "no accumulator")
+	case sacc.PKCounter != pk.Counter:
+		report(RevocationProblemSignature, 0, "accumulator belongs to key %d", sacc.PKCounter)
+	default:
+		if acc, err = sacc.UnmarshalVerify(pk); err != nil {
+			report(RevocationProblemSignature, 0, "invalid accumulator signature: %v", err)
+			acc = nil
+		}
+	}
+
+	sorted := make([]*revocation.Event, 0, len(events))
+	for _, event := range events {
+		if event == nil || event.E == nil {
+			report(RevocationProblemEvent, 0, "event without revocation attribute")
+			continue
+		}
+		sorted = append(sorted, event)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Index < sorted[j].Index })
+
+	var (
+		prev    *revocation.Event
+		next    uint64
+		revoked = map[string]uint64{}
+	)
+	for _, event := range sorted {
+		if prev != nil && event.Index == prev.Index {
+			if event.E.Cmp(prev.E) != 0 || !bytes.Equal(event.ParentHash, prev.ParentHash) {
+				report(RevocationProblemFork, event.Index, "conflicting events with index %d", event.Index)
+			}
+			continue
+		}
+		if event.Index > next {
+			report(RevocationProblemGap, next, "events %d to %d are missing", next, event.Index-1)
+		}
+
+		if event.Index == 0 {
+			if event.E.Cmp(bigOne) != 0 {
+				report(RevocationProblemEvent, 0, "initial event has revocation attribute %s instead of 1", event.E)
+			}
+		} else {
+			if prev != nil && prev.Index == event.Index-1 && !eventHashEquals(prev, event.ParentHash) {
+				report(RevocationProblemFork, event.Index, "parent hash of event %d is not the hash of event %d",
+					event.Index, prev.Index)
+			}
+			if first, ok := revoked[event.E.String()]; ok {
+				report(RevocationProblemEvent, event.Index, "event %d revokes the same revocation attribute as event %d",
+					event.Index, first)
+			} else {
+				revoked[event.E.String()] = event.Index
+			}
+		}
+		prev, next = event, event.Index+1
+	}
+
+	if acc == nil {
+		return nil, audit.Problems
+	}
+	switch {
+	case next <= acc.Index:
+		report(RevocationProblemGap, next, "events %d to %d (the accumulator index) are missing", next, acc.Index)
+	case next > acc.Index+1:
+		report(RevocationProblemFork, acc.Index+1, "events %d to %d are beyond the accumulator index %d",
+			acc.Index+1, next-1, acc.Index)
+	}
+	for _, event := range sorted {
+		if event.Index == acc.Index && !eventHashEquals(event, acc.EventHash) {
+			report(RevocationProblemFork, acc.Index, "accumulator event hash is not the hash of event %d", acc.Index)
+			break
+		}
+	}
+
+	return acc, audit.Problems
+}
+
+// VerifyRevocationAccumulators verifies the value of the newer accumulator against the older one,
+// of the same issuer key, using the events in between (those with index above that of the older
+// accumulator, up to and including that of the newer one): the newer value raised to the revocation
+// attributes of these events must equal the older value. The events need not be sorted, and they
+// should be verified using VerifyRevocationEvents against the newer accumulator.
+func VerifyRevocationAccumulators(
+	pk *gabikeys.PublicKey, older, newer *revocation.Accumulator, events []*revocation.Event,
+) []*RevocationProblem {
+	audit := &RevocationAudit{}
+	if older.Index > newer.Index {
+		older, newer = newer, older
+	}
+	if older.Index == newer.Index {
+		if older.Nu.Cmp(newer.Nu) != 0 || !bytes.Equal(older.EventHash, newer.EventHash) {
+			audit.problem(RevocationProblemFork, "", pk.Counter, newer.Index, "conflicting accumulators with index %d", newer.Index)
+		}
+		return audit.Problems
+	}
+
+	between := map[uint64]*revocation.Event{}
+	for _, event := range events {
+		if event != nil && event.E != nil && event.Index > older.Index && event.Index <= newer.Index {
+			between[event.Index] = event
+		}
+	}
+	if uint64(len(between)) != newer.Index-older.Index {
+		audit.problem(RevocationProblemGap, "", pk.Counter, older.Index+1,
+			"events %d to %d are needed to verify accumulator %d against accumulator %d",
+			older.Index+1, newer.Index, newer.Index, older.Index)
+		return audit.Problems
+	}
+
+	nu := new(big.Int).Set(newer.Nu)
+	for i := older.Index + 1; i <= newer.Index; i++ {
+		nu.Exp(nu, between[i].E, pk.N)
+	}
+	if nu.Cmp(older.Nu) != 0 {
+		audit.problem(RevocationProblemAccumulator, "", pk.Counter, newer.Index,
+			"accumulator %d does not follow from accumulator %d and the events in between", newer.Index, older.Index)
+	}
+	return audit.Problems
+}
+
+// eventHashEquals returns whether the hash of the event equals h.
+func eventHashEquals(event *revocation.Event, h revocation.Hash) bool {
+	// EventList.Verify checks the hash of the last event against the accumulator
+	return revocation.NewEventList(event).Verify(&revocation.Accumulator{EventHash: h}) == nil
+}
+
+// Audit fetches the complete revocation event chains of all issuer keys of the credential type from
+// each of the specified revocation servers (by default those of the credential type, or the one from
+// the revocation settings), verifies them using VerifyRevocationEvents, and checks that the servers
+// agree on the events. If the servers serve different accumulators of an issuer key (e.g. because
+// some of them lag behind), their values are verified against each other using
+// VerifyRevocationAccumulators; otherwise, the accumulator values are not verified (see
+// RevocationChainAudit.AccumulatorLinked). All problems found, including accumulators of issuer keys
+// that are not in the configuration, are included in the audit; an error is returned only if the
+// audit could not be performed at all.
+//
+// The events endpoints of revocation servers only transmit the parent hash of the first event of
+// each requested interval, so the chain can be broken only between intervals.
+func (client RevocationClient) Audit(id CredentialTypeIdentifier, urls ...string) (*RevocationAudit, error) {
+	if len(urls) == 0 {
+		var err error
+		if urls, err = updateURL(id, client.Conf, client.Settings); err != nil {
+			return nil, err
+		}
+	}
+	if len(urls) == 0 {
+		return nil, errors.Errorf("no revocation server known for %s", id)
+	}
+
+	audit := &RevocationAudit{CredentialType: id, Chains: []*RevocationChainAudit{}, Problems: []*RevocationProblem{}}
+	transport := client.transport(false)
+	chains := map[uint]map[string][]*revocation.Event{}
+	accs := map[uint]map[string]*revocation.Accumulator{}
+	links := map[uint]map[string]*RevocationChainAudit{}
+	pks := map[uint]*gabikeys.PublicKey{}
+	for _, url := range urls {
+		updates := map[uint]*revocation.Update{}
+		path := fmt.Sprintf("/revocation/%s/update/%d", id, RevocationParameters.UpdateMinCount)
+		if err := auditGet(transport, url, path, &updates); err != nil {
+			audit.problem(RevocationProblemFetch, url, 0, 0, "failed to fetch accumulators: %v", err)
+			continue
+		}
+
+		counters := make([]uint, 0, len(updates))
+		for counter := range updates {
+			counters = append(counters, counter)
+		}
+		sort.Slice(counters, func(i, j int) bool { return counters[i] < counters[j] })
+		for _, counter := range counters {
+			pk, err := RevocationKeys{client.Conf}.PublicKey(id.IssuerIdentifier(), counter)
+			if err != nil {
+				audit.problem(RevocationProblemSignature, url, counter, 0, "cannot verify accumulator of unknown key: %v", err)
+				continue
+			}
+			pks[counter] = pk
+			events := auditFetchEvents(audit, transport, url, id, pk, updates[counter].SignedAccumulator)
+			acc, problems := VerifyRevocationEvents(pk, updates[counter].SignedAccumulator, events)
+			for _, p := range problems {
+				p.URL = url
+			}
+			audit.Problems = append(audit.Problems, problems...)
+
+			chain := &RevocationChainAudit{URL: url, PKCounter: counter, Events: len(events)}
+			audit.Chains = append(audit.Chains, chain)
+			if chains[counter] == nil {
+				chains[counter] = map[string][]*revocation.Event{}
+				accs[counter] = map[string]*revocation.Accumulator{}
+				links[counter] = map[string]*RevocationChainAudit{}
+			}
+			chains[counter][url] = events
+			if acc != nil {
+				chain.AccumulatorIndex, chain.AccumulatorTime = acc.Index, acc.Time
+				accs[counter][url] = acc
+				links[counter][url] = chain
+			}
+		}
+	}
+
+	for counter, c := range chains {
+		auditCompareChains(audit, counter, urls, c)
+		auditLinkAccumulators(audit, pks[counter], urls, accs[counter], c, links[counter])
+	}
+	return audit, nil
+}
+
+// auditLinkAccumulators verifies each accumulator against the next older one served by any of the
+// servers, using the events served along with the newer accumulator.
+func auditLinkAccumulators(
+	audit *RevocationAudit, pk *gabikeys.PublicKey, urls []string,
+	accs map[string]*revocation.Accumulator, chains map[string][]*revocation.Event,
+	links map[string]*RevocationChainAudit,
+) {
+	var served []string
+	for _, url := range urls {
+		if accs[url] != nil {
+			served = append(served, url)
+		}
+	}
+	sort.SliceStable(served, func(i, j int) bool { return accs[served[i]].Index < accs[served[j]].Index })
+	for i := 1; i < len(served); i++ {
+		older, newer := accs[served[i-1]], accs[served[i]]
+		problems := VerifyRevocationAccumulators(pk, older, newer, chains[served[i]])
+		for _, p := range problems {
+			p.URL = served[i]
+		}
+		audit.Problems = append(audit.Problems, problems...)
+		if older.Index < newer.Index && len(problems) == 0 {
+			links[served[i]].AccumulatorLinked = true
+		}
+	}
+}
+
+// auditFetchEvents fetches the events of the issuer key up to the index of the accumulator, in
+// intervals of decreasing size as supported by the events endpoint; the remaining events, which are
+// too few to form such an interval, are taken from the latest update. Intervals that cannot be
+// fetched or are incomplete are reported and skipped, so that they result in a gap.
+func auditFetchEvents(
+	audit *RevocationAudit, transport *HTTPTransport, url string, id CredentialTypeIdentifier,
+	pk *gabikeys.PublicKey, sacc *revocation.SignedAccumulator,
+) []*revocation.Event {
+	if sacc == nil {
+		return nil
+	}
+	acc, err := sacc.UnmarshalVerify(pk)
+	if err != nil {
+		return nil // reported by VerifyRevocationEvents
+	}
+
+	var events []*revocation.Event
+	from := uint64(0)
+	for size := RevocationParameters.UpdateMaxCount; size >= RevocationParameters.UpdateMinCount; {
+		if from+size-1 > acc.Index {
+			size /= 2
+			continue
+		}
+		el := &revocation.EventList{}
+		path := fmt.Sprintf("/revocation/%s/events/%d/%d/%d", id, pk.Counter, from, from+size)
+		if err = auditGet(transport, url, path, el); err != nil {
+			audit.problem(RevocationProblemFetch, url, pk.Counter, from, "failed to fetch events %d to %d: %v", from, from+size-1, err)
+		} else if uint64(len(el.Events)) != size || el.Events[0].Index != from {
+			audit.problem(RevocationProblemGap, url, pk.Counter, from, "server returned %d events instead of events %d to %d",
+				len(el.Events), from, from+size-1)
+		} else {
+			events = append(events, el.Events...)
+		}
+		from += size
+	}
+
+	if from > acc.Index {
+		return events
+	}
+	update := &revocation.Update{}
+	path := fmt.Sprintf("/revocation/%s/update/%d/%d", id, RevocationParameters.UpdateMinCount, pk.Counter)
+	if err = auditGet(transport, url, path, &update); err != nil {
+		audit.problem(RevocationProblemFetch, url, pk.Counter, from, "failed to fetch events %d to %d: %v", from, acc.Index, err)
+		return events
+	}
+	for _, event := range update.Events {
+		if event.Index >= from && event.Index <= acc.Index {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// auditCompareChains reports the first event on which each server disagrees with the first server.
+func auditCompareChains(audit *RevocationAudit, counter uint, urls []string, chains map[string][]*revocation.Event) {
+	var reference string
+	for _, url := range urls {
+		if _, ok := chains[url]; ok {
+			reference = url
+			break
+		}
+	}
+	ours := map[uint64]*revocation.Event{}
+	for _, event := range chains[reference] {
+		ours[event.Index] = event
+	}
+
+	for _, url := range urls {
+		if url == reference || chains[url] == nil {
+			continue
+		}
+		theirs := chains[url]
+		sort.SliceStable(theirs, func(i, j int) bool { return theirs[i].Index < theirs[j].Index })
+		for _, event := range theirs {
+			other := ours[event.Index]
+			if other == nil || event.E == nil || other.E == nil {
+				continue
+			}
+			if event.E.Cmp(other.E) != 0 || !bytes.Equal(event.ParentHash, other.ParentHash) {
+				audit.problem(RevocationProblemFork, url, counter, event.Index,
+					"event %d differs from the one served by %s", event.Index, reference)
+				break
+			}
+		}
+	}
+}
+
+func auditGet(transport *HTTPTransport, url, path string, dest interface{}) error {
+	transport.Server = url
+	return transport.Get(path, dest)
+}
@@ -2,6 +2,7 @@ package irma
 
 import (
 	"log"
+	"strings"
 	"sync"
 
 	"github.com/go-errors/errors"
@@ -32,6 +33,9 @@ type (
 func newSqlStorage(debug bool, dbtype, connstr string) (sqlRevStorage, error) {
 	switch dbtype {
 	case "postgres", "mysql":
+	case "sqlite", "sqlite3":
+		// The SQLite driver requires cgo, so it is not registered here but by the server package
+		dbtype, connstr = "sqlite3", sqliteConnStr(connstr)
 	default:
 		return sqlRevStorage{}, errors.New("unsupported database type")
 	}
@@ -40,6 +44,12 @@ func newSqlStorage(debug bool, dbtype, connstr string) (sqlRevStorage, error) {
 	if err != nil {
 		return sqlRevStorage{}, err
 	}
+	if dbtype == "sqlite3" {
+		// SQLite allows only one writer at a time, which would make concurrent transactions fail
+		// with "database is locked" errors; instead, they wait for each other in the connection pool.
+		// This also keeps in-memory databases alive, which exist only as long as their connection.
+		g.DB().SetMaxOpenConns(1)
+	}
 
 	if debug {
 		g.LogMode(true)
@@ -58,6 +68,20 @@ func newSqlStorage(debug bool, dbtype, connstr string) (sqlRevStorage, error) {
 	return sqlRevStorage{gorm: g}, nil
 }
 
+// sqliteConnStr makes transactions on the SQLite database take the write lock when they start
+// (unless specified otherwise in the connection string). By default a transaction that reads before
+// it writes acquires the lock only when writing, failing if another process has written meanwhile.
+func sqliteConnStr(connstr string) string {
+	if strings.Contains(connstr, "_txlock=") {
+		return connstr
+	}
+	sep := "?"
+	if strings.Contains(connstr, "?") {
+		sep = "&"
+	}
+	return connstr + sep + "_txlock=immediate"
+}
+
 func (s sqlRevStorage) Close() error {
 	if s.gorm == nil {
 		return nil
@@ -66,6 +90,13 @@ func (s sqlRevStorage) Close() error {
 	return s.gorm.Close()
 }
 
+func (s sqlRevStorage) Ping() error {
+	if s.gorm == nil {
+		return nil
+	}
+	return s.gorm.DB().Ping()
+}
+
 func (s sqlRevStorage) Transaction(f func(tx sqlRevStorage) error) (err error) {
 	tx := sqlRevStorage{gorm: s.gorm.Begin()}
 	defer func() {
@@ -121,6 +152,17 @@ func (s sqlRevStorage) Find(dest interface{}, query interface{}, args ...interfa
 		Find(dest).Error
 }
 
+// Page finds the records matching the query in the specified order, skipping the first offset
+// records and returning at most limit of them, and returns the total amount of matching records.
+func (s sqlRevStorage) Page(dest interface{}, order string, offset, limit int, query interface{}, args ...interface{}) (int, error) {
+	var total int
+	db := s.gorm.Model(dest).Where(query, args...)
+	if err := db.Count(&total).Error; err != nil {
+		return 0, err
+	}
+	return total, db.Order(order).Offset(offset).Limit(limit).Find(dest).Error
+}
+
 func (s sqlRevStorage) Latest(dest interface{}, count uint64, query interface{}, args ...interface{}) error {
 	return s.gorm.
 		Where(query, args...).
@@ -157,18 +157,26 @@ func (conf *Configuration) AutoUpdateSchemes(interval uint) {
 
 func (conf *Configuration) UpdateSchemes() error {
 	for _, scheme := range conf.SchemeManagers {
-		if err := conf.UpdateScheme(scheme, nil); err != nil {
+		if err := conf.updateSchemeAndNotify(scheme); err != nil {
 			return err
 		}
 	}
 	for _, scheme := range conf.RequestorSchemes {
-		if err := conf.UpdateScheme(scheme, nil); err != nil {
+		if err := conf.updateSchemeAndNotify(scheme); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (conf *Configuration) updateSchemeAndNotify(scheme Scheme) error {
+	err := conf.UpdateScheme(scheme, nil)
+	for _, listener := range conf.SchemeUpdateListeners {
+		listener(scheme.id(), err)
+	}
+	return err
+}
+
 // UpdateScheme syncs the stored version within the irma_configuration directory
 // with the remote version at the scheme's URL, downloading and storing
 // new and modified files, according to the index files of both versions.
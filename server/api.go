@@ -2,7 +2,7 @@ package server
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"crypto"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -65,6 +65,18 @@ type LegacySessionResult struct {
 	Err         *irma.RemoteError          `json:"error,omitempty"`
 }
 
+// SessionInfo contains information on a session for administrative purposes.
+// It does not contain any attribute values.
+type SessionInfo struct {
+	Token           irma.RequestorToken   `json:"token"`
+	Action          irma.Action           `json:"action"`
+	Requestor       string                `json:"requestor,omitempty"`
+	Status          irma.ServerStatus     `json:"status"`
+	Started         time.Time             `json:"started"`
+	Age             int64                 `json:"age"` // in seconds
+	ProtocolVersion *irma.ProtocolVersion `json:"protocolVersion,omitempty"`
+}
+
 const (
 	ComponentRevocation      = "revocation"
 	ComponentSession         = "session"
@@ -78,6 +90,13 @@ const (
 	WriteTimeout  = 2 * ReadTimeout
 )
 
+// DefaultSessionLifetime is the default amount of seconds of inactivity after which sessions are cancelled.
+const DefaultSessionLifetime = 300
+
+// DefaultShutdownGracePeriod is the default amount of seconds that the IRMA server, when run from
+// the command line, waits for running sessions to finish when it is stopped.
+const DefaultShutdownGracePeriod = 30
+
 // Remove this when dropping support for legacy pre-condiscon session requests
 func (r *SessionResult) Legacy() *LegacySessionResult {
 	var disclosed []*irma.DisclosedAttribute
@@ -90,6 +109,7 @@ func (r *SessionResult) Legacy() *LegacySessionResult {
 // RemoteError converts an error and an explaining message to an *irma.RemoteError.
 func RemoteError(err Error, message string) *irma.RemoteError {
 	var stack string
+	metricErrors.WithLabelValues(string(err.Type)).Inc()
 	Logger.WithFields(logrus.Fields{
 		"status":      err.Status,
 		"description": err.Description,
@@ -287,7 +307,7 @@ func TypeString(x interface{}) string {
 	return reflect.TypeOf(x).String()
 }
 
-func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) (string, error) {
+func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privatekey crypto.Signer) (string, error) {
 	standardclaims := jwt.StandardClaims{
 		Issuer:   issuer,
 		IssuedAt: time.Now().Unix(),
@@ -309,11 +329,12 @@ func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privat
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(privatekey)
+	return SignJwt(claims, privatekey)
 }
 
-func DoResultCallback(callbackUrl string, result *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) {
+// DoResultCallback POSTs the session result to the specified callback URL once, logging any failure.
+// The irmaserver package instead uses a queue that retries failed callbacks.
+func DoResultCallback(callbackUrl string, result *SessionResult, issuer string, validity int, privatekey crypto.Signer) {
 	logger := Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
 	if !strings.HasPrefix(callbackUrl, "https") {
 		logger.Warn("POSTing session result to callback URL without TLS: attributes are unencrypted in traffic")
@@ -324,7 +345,7 @@ func DoResultCallback(callbackUrl string, result *SessionResult, issuer string,
 	var res interface{}
 	if privatekey != nil {
 		var err error
-		res, err = ResultJwt(result, issuer, validity, privatekey)
+		res, err = FormattedResultJwt(result, ResultFormatIrma, issuer, validity, privatekey)
 		if err != nil {
 			_ = LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
 			return
@@ -459,10 +480,10 @@ func TimeoutMiddleware(except []string, timeout time.Duration) func(http.Handler
 	}
 }
 
-// LogMiddleware is middleware for logging HTTP requests and responses.
+// LogMiddleware is middleware for logging HTTP requests and responses. It includes TracingMiddleware.
 func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		return TracingMiddleware(typ)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			var message []byte
 			var err error
 
@@ -514,7 +535,7 @@ func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Han
 			// start timer and preform request
 			start = time.Now()
 			next.ServeHTTP(ww, r)
-		})
+		}))
 	}
 }
 
@@ -2,14 +2,24 @@ package server
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/privacybydesign/irmago"
 	"github.com/stretchr/testify/require"
 )
@@ -168,3 +178,227 @@ func stopServer(t *testing.T, server *http.Server) {
 	require.NoError(t, server.Shutdown(ctx))
 	cancel()
 }
+
+func TestCheckCallbackIP(t *testing.T) {
+	conf := &Configuration{DenyPrivateCallbacks: true, AllowedCallbackNetworks: []string{"10.1.0.0/16"}}
+	require.NoError(t, conf.verifyCallbacks())
+
+	for ip, allowed := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"192.168.1.1":      false,
+		"172.20.0.1":       false,
+		"169.254.169.254":  false,
+		"fd00::1":          false,
+		"10.0.0.1":         false,
+		"10.1.2.3":         true,
+	} {
+		err := conf.CheckCallbackIP(net.ParseIP(ip))
+		if allowed {
+			require.NoError(t, err, ip)
+		} else {
+			require.Error(t, err, ip)
+		}
+	}
+
+	require.Error(t, conf.CheckCallbackURL("http://localhost:8080/callback"))
+	require.NoError(t, conf.CheckCallbackURL("http://10.1.0.1/callback"))
+
+	conf.DenyPrivateCallbacks = false
+	require.NoError(t, conf.CheckCallbackIP(net.ParseIP("127.0.0.1")))
+
+	conf.AllowedCallbackNetworks = []string{"10.1.0.0"}
+	require.Error(t, conf.verifyCallbacks())
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(200 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("a", 2)
+		require.True(t, ok)
+	}
+	ok, retryAfter := l.Allow("a", 2)
+	require.False(t, ok)
+	require.True(t, retryAfter > 0 && retryAfter <= 200*time.Millisecond)
+
+	// Other keys and no limit are not affected, and checking does not record events
+	for i := 0; i < 3; i++ {
+		ok, _ = l.Check("b", 1)
+		require.True(t, ok)
+	}
+	ok, _ = l.Allow("b", 2)
+	require.True(t, ok)
+	ok, _ = l.Allow("a", 0)
+	require.True(t, ok)
+
+	time.Sleep(retryAfter)
+	ok, _ = l.Allow("a", 2)
+	require.True(t, ok)
+}
+
+func TestJwtKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for alg, key := range map[string]crypto.Signer{"RS256": rsaKey, "ES256": p256Key, "ES384": p384Key, "EdDSA": edKey} {
+		t.Run(alg, func(t *testing.T) {
+			bts, err := x509.MarshalPKCS8PrivateKey(key)
+			require.NoError(t, err)
+			parsed, err := ParseJwtPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bts}))
+			require.NoError(t, err)
+
+			j, err := SignJwt(&jwt.StandardClaims{Issuer: "irmaserver"}, parsed)
+			require.NoError(t, err)
+
+			// Verify the JWT using the key from the JWK
+			jwk, err := NewJWK(key.Public())
+			require.NoError(t, err)
+			require.Equal(t, alg, jwk.Algorithm)
+			jwkbts, err := json.Marshal(jwk)
+			require.NoError(t, err)
+			jwk = &JWK{}
+			require.NoError(t, json.Unmarshal(jwkbts, jwk))
+			pk, err := jwk.PublicKey()
+			require.NoError(t, err)
+			token, err := jwt.Parse(j, func(token *jwt.Token) (interface{}, error) { return pk, nil })
+			require.NoError(t, err)
+			require.Equal(t, alg, token.Header["alg"])
+			require.Equal(t, jwk.ID, token.Header["kid"])
+
+			pkbts, err := x509.MarshalPKIXPublicKey(key.Public())
+			require.NoError(t, err)
+			pk, err = ParseJwtPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts}))
+			require.NoError(t, err)
+			jwk2, err := NewJWK(pk)
+			require.NoError(t, err)
+			require.Equal(t, jwk.ID, jwk2.ID)
+		})
+	}
+
+	// Example from RFC 8037, appendix A.3
+	jwk := &JWK{KeyType: "OKP", Curve: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	thumbprint, err := jwk.Thumbprint()
+	require.NoError(t, err)
+	require.Equal(t, "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k", thumbprint)
+
+	p521Key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	require.NoError(t, err)
+	bts, err := x509.MarshalPKCS8PrivateKey(p521Key)
+	require.NoError(t, err)
+	_, err = ParseJwtPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: bts}))
+	require.Error(t, err)
+}
+
+func TestVerifiablePresentation(t *testing.T) {
+	format, err := ParseResultFormat("vp")
+	require.NoError(t, err)
+	require.Equal(t, ResultFormatVP, format)
+	format, err = ParseResultFormat("")
+	require.NoError(t, err)
+	require.Equal(t, ResultFormatIrma, format)
+	_, err = ParseResultFormat("xml")
+	require.Error(t, err)
+
+	str := func(s string) *string { return &s }
+	issued := irma.Timestamp(time.Unix(1600000000, 0))
+	result := &SessionResult{
+		Token:       "token",
+		Type:        irma.ActionDisclosing,
+		Status:      irma.ServerStatusDone,
+		ProofStatus: irma.ProofStatusValid,
+		Disclosed: [][]*irma.DisclosedAttribute{
+			{{RawValue: str("456"), IssuanceTime: issued, NotRevoked: true, NotRevokedBefore: &issued,
+				Identifier: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")}},
+			{{RawValue: str("Radboud"), IssuanceTime: issued,
+				Identifier: irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university")}},
+			{{RawValue: nil, Identifier: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")}},
+		},
+	}
+
+	// Attributes of the same credential are grouped, and absent attributes are omitted
+	vp := NewVerifiablePresentation(result)
+	require.Equal(t, []string{"VerifiablePresentation"}, vp.Type)
+	require.Len(t, vp.VerifiableCredential, 1)
+	vc := vp.VerifiableCredential[0]
+	require.Equal(t, "irma:irma-demo.RU", vc.Issuer)
+	require.Equal(t, "2020-09-13T12:26:40Z", vc.IssuanceDate)
+	require.Equal(t, "irma:irma-demo.RU.studentCard", vc.CredentialSchema.ID)
+	require.Equal(t, map[string]interface{}{"studentID": "456", "university": "Radboud"}, vc.CredentialSubject)
+	require.True(t, vc.CredentialStatus.NotRevoked)
+
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	j, err := FormattedResultJwt(result, ResultFormatVP, "testserver", 120, sk)
+	require.NoError(t, err)
+	var claims struct {
+		jwt.StandardClaims
+		VP *VerifiablePresentation `json:"vp"`
+	}
+	_, err = jwt.ParseWithClaims(j, &claims, func(*jwt.Token) (interface{}, error) { return sk.Public(), nil })
+	require.NoError(t, err)
+	require.Equal(t, "testserver", claims.Issuer)
+	require.Equal(t, "token", claims.Id)
+	require.Equal(t, vp, claims.VP)
+}
+
+func TestStaticSessionTemplate(t *testing.T) {
+	var request map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"parameters": {
+			"level": {"values": ["PhD", "Master"]},
+			"path": {"pattern": "[a-z0-9/]+", "default": "done"},
+			"validity": {"type": "integer", "pattern": "[1-9][0-9]{0,2}"}
+		},
+		"callbackUrl": "https://example.com/callback",
+		"validity": "{{validity}}",
+		"request": {
+			"@context": "https://irma.app/ld/request/disclosure/v2",
+			"clientReturnUrl": "https://example.com/{{path}}?validity={{validity}}",
+			"disclose": [[[{"type": "irma-demo.RU.studentCard.level", "value": "{{level}}"}]]]
+		}
+	}`), &request))
+	template, err := ParseStaticSessionTemplate("test", request)
+	require.NoError(t, err)
+
+	rrequest, err := template.Request(map[string]string{"level": "PhD", "validity": "60"})
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/done?validity=60", rrequest.SessionRequest().Base().ClientReturnURL)
+	require.Equal(t, 60, rrequest.Base().ResultJwtValidity)
+	require.Equal(t, "PhD", *rrequest.SessionRequest().Disclosure().Disclose[0][0][0].Value)
+
+	for _, params := range []map[string]string{
+		{"level": "Bachelor", "validity": "60"},
+		{"level": "PhD", "validity": "0"},
+		{"level": "PhD", "validity": "60", "path": "../evil?"},
+		{"level": "PhD", "validity": "60", "unknown": "x"},
+		{"validity": "60"},
+	} {
+		_, err = template.Request(params)
+		require.Error(t, err, params)
+	}
+
+	// Templates with undeclared or unrestricted parameters are refused
+	request["callbackUrl"] = "https://example.com/{{undeclared}}"
+	_, err = ParseStaticSessionTemplate("test", request)
+	require.Error(t, err)
+	request["callbackUrl"] = "https://example.com/callback"
+	request["parameters"].(map[string]interface{})["free"] = map[string]interface{}{"type": "string"}
+	_, err = ParseStaticSessionTemplate("test", request)
+	require.Error(t, err)
+}
+
+func TestSchemeUpdateListener(t *testing.T) {
+	conf := &irma.Configuration{}
+	addSchemeUpdateListener(conf)
+	addSchemeUpdateListener(conf)
+	require.Len(t, conf.SchemeUpdateListeners, 1)
+}
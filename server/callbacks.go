@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+const (
+	// CallbackSignatureHeader is the HTTP header containing the HMAC signature of a result callback,
+	// if a callback secret is configured. See VerifyCallbackSignature().
+	CallbackSignatureHeader = "X-IRMA-Signature"
+	// CallbackDeliveryHeader is the HTTP header containing the ID of a result callback delivery.
+	// Retries of the same callback have the same ID, so that receivers can ignore duplicates.
+	CallbackDeliveryHeader = "X-IRMA-Delivery"
+
+	DefaultCallbackMaxRetryAge = 3600 // seconds
+)
+
+// CallbackInfo contains information on a result callback that could not be delivered.
+// It does not contain the session result itself.
+type CallbackInfo struct {
+	ID          string              `json:"id"`
+	URL         string              `json:"url"`
+	Session     irma.RequestorToken `json:"session"`
+	Created     time.Time           `json:"created"`
+	Attempts    int                 `json:"attempts"`
+	LastAttempt time.Time           `json:"lastAttempt"`
+	LastError   string              `json:"lastError,omitempty"`
+}
+
+// CallbackPayload returns the body of a result callback: the session result in the specified format
+// as a JWT if a private key is given (in which case the second return parameter is true), or as JSON otherwise.
+func CallbackPayload(result *SessionResult, format ResultFormat, issuer string, validity int, privatekey crypto.Signer) ([]byte, bool, error) {
+	if privatekey != nil {
+		j, err := FormattedResultJwt(result, format, issuer, validity, privatekey)
+		if err != nil {
+			return nil, false, errors.WrapPrefix(err, "Failed to create JWT for result callback", 0)
+		}
+		return []byte(j), true, nil
+	}
+	var res interface{} = result
+	if format == ResultFormatVP {
+		res = NewVerifiablePresentation(result)
+	}
+	bts, err := json.Marshal(res)
+	if err != nil {
+		return nil, false, err
+	}
+	return bts, false, nil
+}
+
+// SignCallback computes the value of the CallbackSignatureHeader for the specified callback body,
+// of the form "t=<unix timestamp>,v1=<hex HMAC-SHA256 of the timestamp, a dot and the body>".
+func SignCallback(secret []byte, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(callbackMac(secret, t, body)))
+}
+
+// VerifyCallbackSignature verifies the CallbackSignatureHeader of a received result callback
+// against its body, and checks that it was created at most maxAge ago (if maxAge is nonzero).
+func VerifyCallbackSignature(secret []byte, header string, body []byte, maxAge time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return errors.New("malformed callback signature header")
+		}
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+	if t == "" || v1 == "" {
+		return errors.New("malformed callback signature header")
+	}
+	timestamp, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return errors.New("malformed callback signature timestamp")
+	}
+	mac, err := hex.DecodeString(v1)
+	if err != nil {
+		return errors.New("malformed callback signature")
+	}
+	if !hmac.Equal(mac, callbackMac(secret, t, body)) {
+		return errors.New("invalid callback signature")
+	}
+	if maxAge != 0 && time.Since(time.Unix(timestamp, 0)) > maxAge {
+		return errors.New("callback signature too old")
+	}
+	return nil
+}
+
+func callbackMac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	_, _ = h.Write([]byte(timestamp + "."))
+	_, _ = h.Write(body)
+	return h.Sum(nil)
+}
+
+// privateNetworks are the address ranges to which result callbacks are refused
+// if Configuration.DenyPrivateCallbacks is enabled.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		networks = append(networks, n)
+	}
+	return networks
+}()
+
+// CheckCallbackIP returns an error if result callbacks may not be sent to the specified IP address,
+// i.e. if DenyPrivateCallbacks is enabled and the address is private, loopback or link-local,
+// and not within AllowedCallbackNetworks.
+func (conf *Configuration) CheckCallbackIP(ip net.IP) error {
+	if !conf.DenyPrivateCallbacks {
+		return nil
+	}
+	if ip == nil {
+		return errors.New("invalid callback IP address")
+	}
+	for _, n := range conf.allowedCallbackNetworks {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return errors.Errorf("callback address %s is in private network %s", ip, n)
+		}
+	}
+	return nil
+}
+
+// CheckCallbackURL returns an error if result callbacks may not be sent to the specified URL,
+// because its host resolves to an address refused by CheckCallbackIP(). As DNS responses may
+// change in between, the addresses are checked again when the callback is sent.
+func (conf *Configuration) CheckCallbackURL(callbackUrl string) error {
+	if !conf.DenyPrivateCallbacks {
+		return nil
+	}
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		return err
+	}
+	if u.Hostname() == "" {
+		return errors.New("callback URL has no host")
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err = conf.CheckCallbackIP(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
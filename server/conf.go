@@ -1,20 +1,24 @@
 package server
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
+	"net"
 	"regexp"
 	"strconv"
 	"strings"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi/gabikeys"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/sirupsen/logrus"
+
+	// Registers the SQLite driver for the revocation database; it is not registered by package irma
+	// as it requires cgo, which would otherwise be needed by all users of that package
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 // Configuration contains configuration for the irmaserver library and irmad.
@@ -33,6 +37,9 @@ type Configuration struct {
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
+	// Result of loading the private keys from IssuerPrivateKeysPath, reported by the readiness
+	// check so that it doesn't read the private keys from disk at each request
+	privateKeysErr error
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
@@ -45,19 +52,37 @@ type Configuration struct {
 	Email string `json:"email" mapstructure:"email"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool `json:"enable_sse" mapstructure:"enable_sse"`
-
-	// Static session requests that can be created by POST /session/{name}
+	// Cancel sessions after this many seconds of inactivity (default value 0 means 300)
+	SessionLifetime int `json:"session_lifetime" mapstructure:"session_lifetime"`
+	// Maximum value in seconds that session requests may specify as their sessionLifetime
+	// (default value 0 means SessionLifetime)
+	MaxSessionLifetime int `json:"max_session_lifetime" mapstructure:"max_session_lifetime"`
+	// When stopping, wait at most this many seconds for sessions to which an IRMA app is connected to
+	// finish (default value 0 means that running sessions are not waited for)
+	ShutdownGracePeriod int `json:"shutdown_grace_period" mapstructure:"shutdown_grace_period"`
+
+	// Static session requests that can be created by POST /session/{name}. They may declare
+	// parameters that are specified when the session is created (see StaticSessionTemplate).
 	StaticSessions map[string]interface{} `json:"static_sessions"`
 	// Static session requests after parsing
-	StaticSessionRequests map[string]irma.RequestorRequest `json:"-"`
+	StaticSessionTemplates map[string]*StaticSessionTemplate `json:"-"`
 
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
-	// Private key to sign result JWTs with. If absent, /result-jwt and /getproof are disabled.
+	// Private key to sign result JWTs with: an RSA, ECDSA (P-256 or P-384) or Ed25519 key, used with
+	// the RS256, ES256/ES384 or EdDSA algorithm respectively. If absent, /result-jwt and /getproof are disabled.
 	JwtPrivateKey     string `json:"jwt_privkey" mapstructure:"jwt_privkey"`
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
+	// Public keys of previously used JWT private keys, which are published along with the current
+	// key at /.well-known/jwks.json so that JWTs signed before a key rotation can still be verified
+	JwtPreviousPublicKeys     []string `json:"jwt_previous_pubkeys" mapstructure:"jwt_previous_pubkeys"`
+	JwtPreviousPublicKeyFiles []string `json:"jwt_previous_pubkey_files" mapstructure:"jwt_previous_pubkey_files"`
 	// Parsed JWT private key
+	JwtSigningKey crypto.Signer `json:"-"`
+	// Parsed JWT private key, if it is an RSA key
 	JwtRSAPrivateKey *rsa.PrivateKey `json:"-"`
+	// Public keys of the current and previous JWT private keys, see JwtKeySet()
+	jwks *JWKS
 	// Whether to allow callbackUrl to be set in session requests when no JWT privatekey is installed
 	// (which is potentially unsafe depending on the setup)
 	AllowUnsignedCallbacks bool `json:"allow_unsigned_callbacks" mapstructure:"allow_unsigned_callbacks"`
@@ -76,11 +101,49 @@ type Configuration struct {
 
 	// Connection string for revocation database
 	RevocationDBConnStr string `json:"revocation_db_str" mapstructure:"revocation_db_str"`
-	// Database type for revocation database, supported: postgres, mysql
+	// Database type for revocation database, supported: postgres, mysql, sqlite (connection string is the path of the database file)
 	RevocationDBType string `json:"revocation_db_type" mapstructure:"revocation_db_type"`
 	// Credentials types for which revocation database should be hosted
 	RevocationSettings irma.RevocationSettings `json:"revocation_settings" mapstructure:"revocation_settings"`
 
+	// Where to keep sessions, supported: memory (default), bbolt, postgres, mysql. Using bbolt allows
+	// sessions to survive a restart of the server; using a database additionally allows multiple
+	// server instances (e.g. behind a load balancer) to share sessions.
+	StoreType string `json:"store_type" mapstructure:"store_type"`
+	// Connection string for session store database (only used if StoreType is postgres or mysql)
+	StoreDBConnStr string `json:"store_db_str" mapstructure:"store_db_str"`
+	// Path to the bbolt file in which sessions are kept (only used if StoreType is bbolt)
+	StoreBoltPath string `json:"store_bolt_path" mapstructure:"store_bolt_path"`
+
+	// Failed result callbacks are retried with exponential backoff until they are older than this
+	// many seconds (default 3600), after which they are logged and kept as dead letters.
+	CallbackMaxRetryAge int `json:"callback_max_retry_age" mapstructure:"callback_max_retry_age"`
+	// Path to a bbolt file in which undelivered result callbacks are kept, so that they survive a
+	// restart of the server. If empty, they are kept in memory.
+	CallbackStorePath string `json:"callback_store_path" mapstructure:"callback_store_path"`
+	// If specified, result callbacks carry an HMAC-SHA256 signature using this secret in the
+	// X-IRMA-Signature HTTP header (see VerifyCallbackSignature()).
+	CallbackSecret string `json:"callback_secret" mapstructure:"callback_secret"`
+	// Refuse to POST result callbacks to private, loopback and link-local addresses, except
+	// those within AllowedCallbackNetworks
+	DenyPrivateCallbacks bool `json:"deny_private_callbacks" mapstructure:"deny_private_callbacks"`
+	// Networks in CIDR notation (e.g. 10.1.0.0/16) to which result callbacks are allowed
+	// even if DenyPrivateCallbacks is enabled
+	AllowedCallbackNetworks []string `json:"allowed_callback_networks" mapstructure:"allowed_callback_networks"`
+	// Parsed AllowedCallbackNetworks
+	allowedCallbackNetworks []*net.IPNet
+
+	// Maximum amount of requests per minute per client IP address to the /session/{clientToken} endpoints
+	// and to static sessions (0 means no limit). Note that IRMA frontends that cannot use server-sent events
+	// poll the session status once or twice per second.
+	ClientRateLimit int `json:"client_rate_limit" mapstructure:"client_rate_limit"`
+
+	// URL of an OpenTelemetry OTLP/HTTP collector (e.g. http://localhost:4318) to which spans
+	// of HTTP requests, sessions and revocation are exported; tracing is disabled if empty
+	TracingEndpoint string `json:"tracing_endpoint" mapstructure:"tracing_endpoint"`
+	// Service name under which spans are exported (default "irma")
+	TracingServiceName string `json:"tracing_service_name" mapstructure:"tracing_service_name"`
+
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
 }
@@ -100,8 +163,12 @@ func (conf *Configuration) Check() error {
 		conf.verifyURL,
 		conf.verifyEmail,
 		conf.verifyRevocation,
+		conf.verifySessionStore,
+		conf.verifySessionLifetime,
+		conf.verifyCallbacks,
 		conf.verifyJwtPrivateKey,
 		conf.verifyStaticSessions,
+		conf.verifyTracing,
 	} {
 		if err := f(); err != nil {
 			_ = LogError(err)
@@ -117,6 +184,17 @@ func (conf *Configuration) Check() error {
 	return nil
 }
 
+func (conf *Configuration) verifyTracing() error {
+	if conf.TracingEndpoint == "" {
+		return nil
+	}
+	if err := StartTracing(conf.TracingEndpoint, conf.TracingServiceName); err != nil {
+		return err
+	}
+	conf.Logger.WithField("endpoint", conf.TracingEndpoint).Info("Exporting spans to OpenTelemetry collector")
+	return nil
+}
+
 func (conf *Configuration) HavePrivateKeys() bool {
 	var err error
 	for id := range conf.IrmaConfiguration.Issuers {
@@ -133,33 +211,29 @@ func (conf *Configuration) HavePrivateKeys() bool {
 // helpers
 
 func (conf *Configuration) verifyStaticSessions() error {
-	conf.StaticSessionRequests = make(map[string]irma.RequestorRequest)
-	if len(conf.StaticSessions) > 0 && conf.JwtRSAPrivateKey == nil && !conf.AllowUnsignedCallbacks {
-		return errors.New("static sessions configured but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration")
+	templates, err := conf.ParseStaticSessions(conf.StaticSessions)
+	if err != nil {
+		return err
 	}
-	for name, r := range conf.StaticSessions {
-		if !regexp.MustCompile("^[a-zA-Z0-9_]+$").MatchString(name) {
-			return errors.Errorf("static session name %s not allowed, must be alphanumeric", name)
-		}
-		j, err := json.Marshal(r)
-		if err != nil {
-			return errors.WrapPrefix(err, "failed to parse static session request "+name, 0)
-		}
-		rrequest, err := ParseSessionRequest(j)
+	conf.StaticSessionTemplates = templates
+	return nil
+}
+
+// ParseStaticSessions parses and validates the specified static session requests
+// (see StaticSessions), without modifying the configuration.
+func (conf *Configuration) ParseStaticSessions(sessions map[string]interface{}) (map[string]*StaticSessionTemplate, error) {
+	templates := make(map[string]*StaticSessionTemplate)
+	if len(sessions) > 0 && conf.JwtSigningKey == nil && !conf.AllowUnsignedCallbacks {
+		return nil, errors.New("static sessions configured but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration")
+	}
+	for name, r := range sessions {
+		t, err := ParseStaticSessionTemplate(name, r)
 		if err != nil {
-			return errors.WrapPrefix(err, "failed to parse static session request "+name, 0)
+			return nil, err
 		}
-		action := rrequest.SessionRequest().Action()
-		if action != irma.ActionDisclosing && action != irma.ActionSigning {
-			return errors.Errorf("static session %s must be either a disclosing or signing session", name)
-		}
-		base := rrequest.Base()
-		if base.CallbackURL == "" && (base.NextSession == nil || base.NextSession.URL == "") {
-			return errors.Errorf("static session %s has no callback URL or next session URL", name)
-		}
-		conf.StaticSessionRequests[name] = rrequest
+		templates[name] = t
 	}
-	return nil
+	return templates, nil
 }
 
 func (conf *Configuration) verifyIrmaConf() error {
@@ -201,6 +275,10 @@ func (conf *Configuration) verifyIrmaConf() error {
 	if conf.SchemesUpdateInterval == 0 {
 		conf.SchemesUpdateInterval = 60
 	}
+	addSchemeUpdateListener(conf.IrmaConfiguration)
+	if conf.IrmaConfiguration.Revocation != nil {
+		conf.IrmaConfiguration.Revocation.SyncListener = revocationUpdateFetched
+	}
 	if !conf.DisableSchemesUpdate {
 		conf.IrmaConfiguration.AutoUpdateSchemes(uint(conf.SchemesUpdateInterval))
 	}
@@ -216,7 +294,11 @@ func (conf *Configuration) verifyPrivateKeys() error {
 	if err != nil {
 		return err
 	}
-	return conf.IrmaConfiguration.AddPrivateKeyRing(ring)
+	if err = conf.IrmaConfiguration.AddPrivateKeyRing(ring); err != nil {
+		return err
+	}
+	conf.privateKeysErr = conf.loadPrivateKeys()
+	return nil
 }
 
 func (conf *Configuration) prepareRevocation(credid irma.CredentialTypeIdentifier) error {
@@ -305,6 +387,65 @@ func (conf *Configuration) verifyRevocation() error {
 	return nil
 }
 
+func (conf *Configuration) verifySessionStore() error {
+	switch conf.StoreType {
+	case "":
+		conf.StoreType = "memory"
+	case "memory":
+	case "bbolt":
+		if conf.StoreBoltPath == "" {
+			return errors.New("session store type bbolt requires a path to the bbolt file")
+		}
+	case "postgres", "mysql":
+		if conf.StoreDBConnStr == "" {
+			return errors.Errorf("session store type %s requires a database connection string", conf.StoreType)
+		}
+	default:
+		return errors.Errorf("unsupported session store type %s", conf.StoreType)
+	}
+	return nil
+}
+
+func (conf *Configuration) verifySessionLifetime() error {
+	if conf.SessionLifetime < 0 || conf.MaxSessionLifetime < 0 {
+		return errors.New("session lifetime must not be negative")
+	}
+	if conf.SessionLifetime == 0 {
+		conf.SessionLifetime = DefaultSessionLifetime
+	}
+	if conf.MaxSessionLifetime == 0 {
+		conf.MaxSessionLifetime = conf.SessionLifetime
+	}
+	if conf.MaxSessionLifetime < conf.SessionLifetime {
+		return errors.New("max_session_lifetime must not be smaller than session_lifetime")
+	}
+	if conf.ShutdownGracePeriod < 0 {
+		return errors.New("shutdown_grace_period must not be negative")
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyCallbacks() error {
+	if conf.CallbackMaxRetryAge < 0 {
+		return errors.New("callback_max_retry_age must not be negative")
+	}
+	if conf.CallbackMaxRetryAge == 0 {
+		conf.CallbackMaxRetryAge = DefaultCallbackMaxRetryAge
+	}
+	conf.allowedCallbackNetworks = nil
+	for _, network := range conf.AllowedCallbackNetworks {
+		_, n, err := net.ParseCIDR(network)
+		if err != nil {
+			return errors.WrapPrefix(err, "invalid network in allowed_callback_networks", 0)
+		}
+		conf.allowedCallbackNetworks = append(conf.allowedCallbackNetworks, n)
+	}
+	if len(conf.AllowedCallbackNetworks) > 0 && !conf.DenyPrivateCallbacks {
+		conf.Logger.Warn("allowed_callback_networks has no effect without deny_private_callbacks")
+	}
+	return nil
+}
+
 func (conf *Configuration) verifyURL() error {
 	if conf.URL != "" {
 		if !strings.HasSuffix(conf.URL, "/") {
@@ -353,18 +494,61 @@ func (conf *Configuration) verifyEmail() error {
 }
 
 func (conf *Configuration) verifyJwtPrivateKey() error {
-	if conf.JwtPrivateKey == "" && conf.JwtPrivateKeyFile == "" {
-		return nil
+	if conf.JwtPrivateKey != "" || conf.JwtPrivateKeyFile != "" {
+		keybytes, err := common.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read private key", 0)
+		}
+		if conf.JwtSigningKey, err = ParseJwtPrivateKey(keybytes); err != nil {
+			return err
+		}
+		conf.JwtRSAPrivateKey, _ = conf.JwtSigningKey.(*rsa.PrivateKey)
+		conf.Logger.Info("Private key parsed, JWT endpoints enabled")
+	} else if conf.JwtSigningKey == nil && conf.JwtRSAPrivateKey != nil {
+		conf.JwtSigningKey = conf.JwtRSAPrivateKey
 	}
 
-	keybytes, err := common.ReadKey(conf.JwtPrivateKey, conf.JwtPrivateKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "failed to read private key", 0)
+	conf.jwks = &JWKS{Keys: []*JWK{}}
+	if conf.JwtSigningKey != nil {
+		jwk, err := NewJWK(conf.JwtSigningKey.Public())
+		if err != nil {
+			return err
+		}
+		conf.jwks.Keys = append(conf.jwks.Keys, jwk)
+	}
+	addPrevious := func(key, file string) error {
+		keybytes, err := common.ReadKey(key, file)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read previous JWT public key", 0)
+		}
+		pk, err := ParseJwtPublicKey(keybytes)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to parse previous JWT public key", 0)
+		}
+		jwk, err := NewJWK(pk)
+		if err != nil {
+			return err
+		}
+		conf.jwks.Keys = append(conf.jwks.Keys, jwk)
+		return nil
 	}
+	for _, key := range conf.JwtPreviousPublicKeys {
+		if err := addPrevious(key, ""); err != nil {
+			return err
+		}
+	}
+	for _, file := range conf.JwtPreviousPublicKeyFiles {
+		if err := addPrevious("", file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	conf.JwtRSAPrivateKey, err = jwt.ParseRSAPrivateKeyFromPEM(keybytes)
-	conf.Logger.Info("Private key parsed, JWT endpoints enabled")
-	return err
+// JwtKeySet returns a JSON Web Key Set containing the public keys of the current JWT private key
+// (first, if any) and of the previous JWT private keys, with which result JWTs can be verified.
+func (conf *Configuration) JwtKeySet() *JWKS {
+	return conf.jwks
 }
 
 // ReplacePortString is a helper that returns a copy of the specified url of the form
@@ -21,6 +21,8 @@ var (
 	ErrorCannotIssue               Error = Error{Type: "CANNOT_ISSUE", Status: 500, Description: "Cannot issue this credential"}
 
 	ErrorIrmaUnauthorized     Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to access the session"}
+	ErrorAdminUnauthorized    Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to access the admin API"}
+	ErrorUnauthenticated      Error = Error{Type: "UNAUTHORIZED", Status: 401, Description: "Request could not be authenticated"}
 	ErrorPairingRequired      Error = Error{Type: "PAIRING_REQUIRED", Status: 403, Description: "Pairing is required first"}
 	ErrorIssuanceFailed       Error = Error{Type: "ISSUANCE_FAILED", Status: 500, Description: "Failed to create credential(s)"}
 	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
@@ -35,6 +37,12 @@ var (
 	ErrorNextSession          Error = Error{Type: "NEXT_SESSION", Status: 500, Description: "Error starting next session"}
 	ErrorRevocation           Error = Error{Type: "REVOCATION", Status: 500, Description: "Revocation error"}
 	ErrorUnknownRevocationKey Error = Error{Type: "UNKNOWN_REVOCATION_KEY", Status: 404, Description: "No issuance records correspond to the given revocationKey"}
+	ErrorCallbackUnknown      Error = Error{Type: "CALLBACK_UNKNOWN", Status: 404, Description: "Unknown result callback"}
+	ErrorCallbackNotAllowed   Error = Error{Type: "CALLBACK_NOT_ALLOWED", Status: 403, Description: "You are not allowed to use this callback URL"}
+	ErrorTooManyRequests      Error = Error{Type: "TOO_MANY_REQUESTS", Status: 429, Description: "Rate limit or quota exceeded"}
+	ErrorReloadFailed         Error = Error{Type: "RELOAD_FAILED", Status: 500, Description: "Failed to reload configuration"}
+	ErrorShuttingDown         Error = Error{Type: "SHUTTING_DOWN", Status: 503, Description: "Server is shutting down"}
+	ErrorSessionConflict      Error = Error{Type: "SESSION_CONFLICT", Status: 409, Description: "Session was modified concurrently"}
 
 	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
 	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// HealthStatus is the status of a server or of one of its components.
+type HealthStatus string
+
+const (
+	HealthStatusOK    HealthStatus = "OK"
+	HealthStatusError HealthStatus = "ERROR"
+)
+
+// Health is the response of the /health and /ready endpoints of the servers.
+type Health struct {
+	Status     HealthStatus                `json:"status"`
+	Components map[string]*ComponentHealth `json:"components,omitempty"`
+}
+
+// ComponentHealth is the status of a component of a server.
+type ComponentHealth struct {
+	Status HealthStatus `json:"status"`
+}
+
+// HealthCheck checks a component of a server, returning an error if it is not ready.
+type HealthCheck func() error
+
+// CheckHealth runs the specified checks, returning the status of each component. The server is
+// ready only if all of its components are. Errors are only logged, as they may contain internal details.
+func CheckHealth(checks map[string]HealthCheck) *Health {
+	health := &Health{Status: HealthStatusOK, Components: map[string]*ComponentHealth{}}
+	for name, check := range checks {
+		if err := check(); err != nil {
+			Logger.WithField("component", name).Warn("Component not ready: ", err.Error())
+			health.Status = HealthStatusError
+			health.Components[name] = &ComponentHealth{Status: HealthStatusError}
+		} else {
+			health.Components[name] = &ComponentHealth{Status: HealthStatusOK}
+		}
+	}
+	return health
+}
+
+// WriteHealth writes the health as JSON to the http.ResponseWriter, with status 503 if
+// the server is not ready.
+func WriteHealth(w http.ResponseWriter, health *Health) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if health.Status != HealthStatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write([]byte(ToJson(health)))
+}
+
+// HandleHealth handles GET /health, which indicates that the server is alive.
+func HandleHealth(w http.ResponseWriter, _ *http.Request) {
+	WriteHealth(w, &Health{Status: HealthStatusOK})
+}
+
+// ReadinessHandler returns a handler for GET /ready, which indicates whether all components
+// of the server are ready, as determined by the specified checks.
+func ReadinessHandler(checks func() map[string]HealthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		WriteHealth(w, CheckHealth(checks()))
+	}
+}
+
+// HealthChecks returns the checks of the components of the IRMA server: the schemes,
+// the issuer private keys and the revocation database.
+func (conf *Configuration) HealthChecks() map[string]HealthCheck {
+	checks := map[string]HealthCheck{
+		"schemes":      conf.checkSchemes,
+		"private_keys": conf.checkPrivateKeys,
+	}
+	if conf.RevocationDBConnStr != "" {
+		checks["revocation_db"] = conf.IrmaConfiguration.Revocation.Ping
+	}
+	return checks
+}
+
+func (conf *Configuration) checkSchemes() error {
+	invalid := map[string]irma.SchemeManagerStatus{}
+	for id, scheme := range conf.IrmaConfiguration.SchemeManagers {
+		if scheme.Status != irma.SchemeManagerStatusValid {
+			invalid[id.String()] = scheme.Status
+		}
+	}
+	for id, scheme := range conf.IrmaConfiguration.RequestorSchemes {
+		if scheme.Status != irma.SchemeManagerStatusValid {
+			invalid[id.String()] = scheme.Status
+		}
+	}
+	for id, e := range conf.IrmaConfiguration.DisabledSchemeManagers {
+		invalid[id.String()] = e.Status
+	}
+	for id, e := range conf.IrmaConfiguration.DisabledRequestorSchemes {
+		invalid[id.String()] = e.Status
+	}
+	if len(invalid) > 0 {
+		var schemes []string
+		for id, status := range invalid {
+			schemes = append(schemes, id+" ("+string(status)+")")
+		}
+		sort.Strings(schemes)
+		return errors.Errorf("invalid schemes: %s", strings.Join(schemes, ", "))
+	}
+	if len(conf.IrmaConfiguration.SchemeManagers) == 0 {
+		return errors.New("no schemes loaded")
+	}
+	return nil
+}
+
+func (conf *Configuration) checkPrivateKeys() error {
+	return conf.privateKeysErr
+}
+
+// loadPrivateKeys checks that a private key of at least one issuer can be loaded from
+// IssuerPrivateKeysPath. It is called once when the private keys are added, as key rings read the
+// private keys from disk each time they are used.
+func (conf *Configuration) loadPrivateKeys() error {
+	for id := range conf.IrmaConfiguration.Issuers {
+		if _, err := conf.IrmaConfiguration.PrivateKeys.Latest(id); err == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("no private keys loaded from %s", conf.IssuerPrivateKeysPath)
+}
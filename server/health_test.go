@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivateKeysHealthCheck(t *testing.T) {
+	testdata := test.FindTestdataFolder(t)
+	// Ignore the private keys in the schemes, so that only those in the folder are used
+	irmaconf, err := irma.NewConfiguration(filepath.Join(testdata, "irma_configuration"), irma.ConfigurationOptions{ReadOnly: true, IgnorePrivateKeys: true})
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+
+	dir, err := ioutil.TempDir("", "privatekeys")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bts, err := ioutil.ReadFile(filepath.Join(testdata, "privatekeys", "irma-demo.MijnOverheid.xml"))
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "irma-demo.MijnOverheid.xml"), bts, 0600))
+
+	conf := &Configuration{IrmaConfiguration: irmaconf, IssuerPrivateKeysPath: dir}
+	require.NoError(t, conf.verifyPrivateKeys())
+	check := conf.HealthChecks()["private_keys"]
+	require.NoError(t, check())
+
+	// The private keys are not read again at each check
+	require.NoError(t, os.Remove(filepath.Join(dir, "irma-demo.MijnOverheid.xml")))
+	require.NoError(t, check())
+
+	irmaconf, err = irma.NewConfiguration(filepath.Join(testdata, "irma_configuration"), irma.ConfigurationOptions{ReadOnly: true, IgnorePrivateKeys: true})
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+	conf = &Configuration{IrmaConfiguration: irmaconf, IssuerPrivateKeysPath: dir}
+	require.NoError(t, conf.verifyPrivateKeys())
+	require.Error(t, conf.HealthChecks()["private_keys"]())
+}
@@ -5,7 +5,10 @@
 package irmaserver
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
@@ -21,12 +24,27 @@ type Server struct {
 	conf             *server.Configuration
 	router           *chi.Mux
 	sessions         sessionStore
+	callbacks        *callbackQueue
 	scheduler        *gocron.Scheduler
 	stopScheduler    chan bool
 	handlers         map[irma.RequestorToken]server.SessionHandler
 	serverSentEvents *sse.Server
+
+	// Protects the static sessions, which can be replaced using SetStaticSessions()
+	staticSessionsLock sync.RWMutex
+
+	// Set when Stop() is called, after which no new sessions are started
+	stopping     bool
+	stoppingLock sync.RWMutex
+	stopOnce     sync.Once
 }
 
+// ErrShuttingDown is returned when starting a session while the server is being stopped.
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// drainInterval is the interval at which Stop() checks whether running sessions have finished.
+var drainInterval = 100 * time.Millisecond
+
 // Default server instance
 var s *Server
 
@@ -46,14 +64,41 @@ func New(conf *server.Configuration) (*Server, error) {
 	}
 	conf.IrmaConfiguration.Revocation.ServerSentEvents = e
 
-	s := &Server{
-		conf:      conf,
-		scheduler: gocron.NewScheduler(),
-		sessions: &memorySessionStore{
+	var sessions sessionStore
+	switch conf.StoreType {
+	case "memory":
+		sessions = &memorySessionStore{
 			requestor: make(map[irma.RequestorToken]*session),
 			client:    make(map[irma.ClientToken]*session),
 			conf:      conf,
-		},
+		}
+	case "bbolt":
+		store, err := newBoltSessionStore(conf, e)
+		if err != nil {
+			return nil, server.LogError(errors.WrapPrefix(err, "failed to open session store", 0))
+		}
+		sessions = store
+	case "postgres", "mysql":
+		store, err := newSqlSessionStore(conf, e)
+		if err != nil {
+			return nil, server.LogError(errors.WrapPrefix(err, "failed to open session store", 0))
+		}
+		sessions = store
+	default:
+		return nil, server.LogError(errors.Errorf("unsupported session store type %s", conf.StoreType))
+	}
+
+	callbacks, err := newCallbackQueue(conf)
+	if err != nil {
+		sessions.stop()
+		return nil, server.LogError(errors.WrapPrefix(err, "failed to open callback store", 0))
+	}
+
+	s := &Server{
+		conf:             conf,
+		scheduler:        gocron.NewScheduler(),
+		sessions:         sessions,
+		callbacks:        callbacks,
 		handlers:         make(map[irma.RequestorToken]server.SessionHandler),
 		serverSentEvents: e,
 	}
@@ -99,6 +144,8 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	if s.conf.Verbose >= 2 {
 		opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 		r.Use(server.LogMiddleware("client", opts))
+	} else {
+		r.Use(server.TracingMiddleware("client"))
 	}
 
 	r.Use(server.SizeLimitMiddleware)
@@ -109,7 +156,13 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	r.NotFound(errorWriter(notfound, server.WriteResponse))
 	r.MethodNotAllowed(errorWriter(notallowed, server.WriteResponse))
 
+	ratelimit := func(next http.Handler) http.Handler { return next }
+	if s.conf.ClientRateLimit > 0 {
+		ratelimit = server.ClientRateLimitMiddleware(s.conf.ClientRateLimit)
+	}
+
 	r.Route("/session/{clientToken}", func(r chi.Router) {
+		r.Use(ratelimit)
 		r.Use(s.sessionMiddleware)
 		r.Delete("/", s.handleSessionDelete)
 		r.Get("/status", s.handleSessionStatus)
@@ -132,7 +185,7 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 			})
 		})
 	})
-	r.Post("/session/{name}", s.handleStaticMessage)
+	r.With(ratelimit).Post("/session/{name}", s.handleStaticMessage)
 
 	r.Route("/revocation/{id}", func(r chi.Router) {
 		r.NotFound(errorWriter(notfound, server.WriteBinaryResponse))
@@ -147,16 +200,85 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	return s.router.ServeHTTP
 }
 
-// Stop the server.
+// Stop the server. From then on no new sessions can be started, while sessions to which an IRMA app
+// is connected are given server.Configuration.ShutdownGracePeriod seconds to finish. Afterwards,
+// pending result callbacks are delivered and the session store, the server-sent events server and
+// the revocation storage are closed.
 func Stop() {
 	s.Stop()
 }
 func (s *Server) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *Server) stop() {
+	s.stoppingLock.Lock()
+	s.stopping = true
+	s.stoppingLock.Unlock()
+
+	s.drain()
+	s.stopScheduler <- true
+	s.callbacks.stop()
+	s.sessions.stop()
+	if s.serverSentEvents != nil {
+		s.serverSentEvents.Shutdown()
+	}
 	if err := s.conf.IrmaConfiguration.Revocation.Close(); err != nil {
 		server.LogWarning(err)
 	}
-	s.stopScheduler <- true
-	s.sessions.stop()
+	if err := server.StopTracing(); err != nil {
+		server.LogWarning(err)
+	}
+}
+
+// isStopping returns whether Stop() has been called.
+func (s *Server) isStopping() bool {
+	s.stoppingLock.RLock()
+	defer s.stoppingLock.RUnlock()
+	return s.stopping
+}
+
+// CheckStopping returns an error if Stop() has been called, for use as server.HealthCheck.
+func (s *Server) CheckStopping() error {
+	if s.isStopping() {
+		return ErrShuttingDown
+	}
+	return nil
+}
+
+// drain waits until no IRMA app is connected to any session anymore, or until the shutdown
+// grace period has passed. Sessions in a database are not waited for, as other server instances
+// sharing the database can finish them.
+func (s *Server) drain() {
+	if s.conf.ShutdownGracePeriod == 0 || s.conf.StoreType == "postgres" || s.conf.StoreType == "mysql" {
+		return
+	}
+	deadline := time.Now().Add(time.Duration(s.conf.ShutdownGracePeriod) * time.Second)
+	for logged := false; ; logged = true {
+		running := s.runningSessions()
+		if running == 0 {
+			return
+		}
+		if !logged {
+			s.conf.Logger.Infof("Waiting at most %d seconds for %d running sessions to finish", s.conf.ShutdownGracePeriod, running)
+		}
+		if time.Now().After(deadline) {
+			s.conf.Logger.Warnf("Stopping with %d running sessions", running)
+			return
+		}
+		time.Sleep(drainInterval)
+	}
+}
+
+// runningSessions returns the amount of sessions to which an IRMA app is connected.
+func (s *Server) runningSessions() int {
+	running := 0
+	for _, session := range s.sessions.list() {
+		if session.Status == irma.ServerStatusConnected || session.Status == irma.ServerStatusPairing {
+			running++
+		}
+	}
+	return running
 }
 
 // StartSession starts an IRMA session, running the handler on completion, if specified.
@@ -165,11 +287,60 @@ func (s *Server) Stop() {
 // by frontend clients (i.e. browser libraries) to POST to the '/frontend' endpoints of the IRMA protocol.
 // The request parameter can be an irma.RequestorRequest, or an irma.SessionRequest, or a
 // ([]byte or string) JSON representation of one of those (for more details, see server.ParseSessionRequest().)
+// If the request specifies a callbackUrl, the session result is POSTed to it when the session completes,
+// retrying failed deliveries until server.Configuration.CallbackMaxRetryAge has passed.
+// Note that the handler is kept in memory: if the session store is shared with other server instances
+// (see server.Configuration.StoreType), it is only invoked if the session completes at this instance.
 func StartSession(request interface{}, handler server.SessionHandler,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
 	return s.StartSession(request, handler)
 }
 func (s *Server) StartSession(req interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.StartSessionFor("", req, handler)
+}
+
+// CheckSessionRequest performs the checks that StartSession does on the request without starting
+// a session, returning all problems found (or none if a session can be started with the request).
+// The request parameter can be anything that StartSession accepts.
+func CheckSessionRequest(request interface{}) []*server.RequestProblem {
+	return s.CheckSessionRequest(request)
+}
+func (s *Server) CheckSessionRequest(req interface{}) []*server.RequestProblem {
+	// Check a copy, as some checks set defaults in the request
+	switch req.(type) {
+	case []byte, string:
+	default:
+		bts, err := json.Marshal(req)
+		if err != nil {
+			return []*server.RequestProblem{{Type: server.ProblemMalformedRequest, Message: err.Error()}}
+		}
+		req = bts
+	}
+	rrequest, err := server.ParseSessionRequest(req)
+	if err != nil {
+		return []*server.RequestProblem{{Type: server.ProblemMalformedRequest, Message: err.Error()}}
+	}
+	return s.requestProblems(rrequest)
+}
+
+// StartSessionFor is like StartSession, but additionally records the name of the requestor
+// on whose behalf the session is started, for use in ActiveSessions().
+func StartSessionFor(requestor string, request interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.StartSessionFor(requestor, request, handler)
+}
+func (s *Server) StartSessionFor(requestor string, req interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	if s.isStopping() {
+		return nil, "", nil, ErrShuttingDown
+	}
+	return s.startSession(requestor, req, handler)
+}
+
+// startSession starts a session like StartSessionFor, also while the server is being stopped,
+// so that running sessions can start their next session.
+func (s *Server) startSession(requestor string, req interface{}, handler server.SessionHandler,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
 	rrequest, err := server.ParseSessionRequest(req)
 	if err != nil {
@@ -182,6 +353,12 @@ func (s *Server) StartSession(req interface{}, handler server.SessionHandler,
 	if err := s.validateRequest(request); err != nil {
 		return nil, "", nil, err
 	}
+	if rrequest.Base().SessionLifetime < 0 {
+		return nil, "", nil, errors.New("session lifetime must not be negative")
+	}
+	if _, err := server.ParseResultFormat(rrequest.Base().ResultFormat); err != nil {
+		return nil, "", nil, err
+	}
 	if action == irma.ActionIssuing {
 		// Include the AttributeTypeIdentifiers of random blind attributes to each CredentialRequest.
 		// This way, the client can check prematurely, i.e., before the session,
@@ -213,8 +390,14 @@ func (s *Server) StartSession(req interface{}, handler server.SessionHandler,
 		pairingRecommended = true
 	}
 
+	if lifetime := rrequest.Base().SessionLifetime; lifetime > s.conf.MaxSessionLifetime {
+		s.conf.Logger.Warnf("Session lifetime of %d seconds exceeds maximum, using %d seconds instead", lifetime, s.conf.MaxSessionLifetime)
+		rrequest.Base().SessionLifetime = s.conf.MaxSessionLifetime
+	}
+
 	request.Base().DevelopmentMode = !s.conf.Production
-	session := s.newSession(action, rrequest)
+	session := s.newSession(action, rrequest, requestor)
+	server.SessionStarted(action, requestor)
 	s.conf.Logger.WithFields(logrus.Fields{"action": action, "session": session.requestorToken}).Infof("Session started")
 	if s.conf.Logger.IsLevelEnabled(logrus.DebugLevel) {
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.requestorToken, "clienttoken": session.clientToken}).Info("Session request: ", server.ToJson(rrequest))
@@ -251,6 +434,63 @@ func (s *Server) GetSessionResult(requestorToken irma.RequestorToken) *server.Se
 	return session.result
 }
 
+// ActiveSessions returns information on all sessions that are not yet finished.
+func ActiveSessions() []*server.SessionInfo {
+	return s.ActiveSessions()
+}
+func (s *Server) ActiveSessions() []*server.SessionInfo {
+	return s.sessions.list()
+}
+
+// DeadCallbacks returns information on the result callbacks that could not be delivered
+// before the maximum retry age (see server.Configuration.CallbackMaxRetryAge) passed.
+func DeadCallbacks() []*server.CallbackInfo {
+	return s.DeadCallbacks()
+}
+func (s *Server) DeadCallbacks() []*server.CallbackInfo {
+	return s.callbacks.deadCallbacks()
+}
+
+// RetryCallback puts the specified undelivered result callback back into the delivery queue.
+func RetryCallback(id string) error {
+	return s.RetryCallback(id)
+}
+func (s *Server) RetryCallback(id string) error {
+	return s.callbacks.retry(id)
+}
+
+// DiscardCallback removes the specified undelivered result callback.
+func DiscardCallback(id string) error {
+	return s.DiscardCallback(id)
+}
+func (s *Server) DiscardCallback(id string) error {
+	return s.callbacks.discard(id)
+}
+
+// SetStaticSessions replaces the static session requests of the server (see
+// server.Configuration.StaticSessions). If any of the new requests is invalid, an error
+// is returned and the current static sessions are kept.
+func SetStaticSessions(sessions map[string]interface{}) error {
+	return s.SetStaticSessions(sessions)
+}
+func (s *Server) SetStaticSessions(sessions map[string]interface{}) error {
+	templates, err := s.conf.ParseStaticSessions(sessions)
+	if err != nil {
+		return err
+	}
+	s.staticSessionsLock.Lock()
+	defer s.staticSessionsLock.Unlock()
+	s.conf.StaticSessions = sessions
+	s.conf.StaticSessionTemplates = templates
+	return nil
+}
+
+func (s *Server) staticSessionTemplate(name string) *server.StaticSessionTemplate {
+	s.staticSessionsLock.RLock()
+	defer s.staticSessionsLock.RUnlock()
+	return s.conf.StaticSessionTemplates[name]
+}
+
 // GetRequest retrieves the request submitted by the requestor that started the specified IRMA session.
 func GetRequest(token irma.RequestorToken) irma.RequestorRequest {
 	return s.GetRequest(token)
@@ -289,7 +529,14 @@ func (s *Server) SetFrontendOptions(requestorToken irma.RequestorToken, request
 	if session == nil {
 		return nil, server.LogError(errors.Errorf("can't set frontend options of unknown session %s", requestorToken))
 	}
-	return session.updateFrontendOptions(request)
+	options, err := session.updateFrontendOptions(request)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.sessions.update(session); err != nil {
+		return nil, err
+	}
+	return options, nil
 }
 
 // Complete pairing between the irma client and the frontend. Returns
@@ -315,6 +562,52 @@ func (s *Server) Revoke(credid irma.CredentialTypeIdentifier, key string, issued
 	return s.conf.IrmaConfiguration.Revocation.Revoke(credid, key, issued)
 }
 
+// RevokeBatch revokes the credentials specified by each of the keys in a single transaction,
+// publishing one revocation update per key counter of the issuer (see
+// irma.RevocationStorage.RevokeBatch()).
+func RevokeBatch(credid irma.CredentialTypeIdentifier, keys []*irma.RevocationKey) error {
+	return s.RevokeBatch(credid, keys)
+}
+func (s *Server) RevokeBatch(credid irma.CredentialTypeIdentifier, keys []*irma.RevocationKey) error {
+	return s.conf.IrmaConfiguration.Revocation.RevokeBatch(credid, keys)
+}
+
+// RevokeBatchContext is like RevokeBatch, recording its span as child of the span in ctx, if any.
+func RevokeBatchContext(ctx context.Context, credid irma.CredentialTypeIdentifier, keys []*irma.RevocationKey) error {
+	return s.RevokeBatchContext(ctx, credid, keys)
+}
+func (s *Server) RevokeBatchContext(ctx context.Context, credid irma.CredentialTypeIdentifier, keys []*irma.RevocationKey) error {
+	return s.conf.IrmaConfiguration.Revocation.RevokeBatchContext(ctx, credid, keys)
+}
+
+// IssuanceRecords returns a page of the issuance records matching the request, if this server
+// is the revocation authority of its credential type.
+func IssuanceRecords(request *irma.IssuanceRecordsRequest) (*irma.IssuanceRecords, error) {
+	return s.IssuanceRecords(request)
+}
+func (s *Server) IssuanceRecords(request *irma.IssuanceRecordsRequest) (*irma.IssuanceRecords, error) {
+	records, total, err := s.conf.IrmaConfiguration.Revocation.ListIssuanceRecords(
+		request.CredentialType, &request.IssuanceRecordFilter, request.Offset, request.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	page := &irma.IssuanceRecords{Total: total, Offset: request.Offset, Records: []*irma.IssuanceRecordInfo{}}
+	for _, record := range records {
+		page.Records = append(page.Records, record.Info())
+	}
+	return page, nil
+}
+
+// RevocationKeyStatus returns the revocation status of the credentials issued with the specified
+// key, if this server is the revocation authority of the credential type.
+func RevocationKeyStatus(credid irma.CredentialTypeIdentifier, key string) (*irma.RevocationKeyStatus, error) {
+	return s.RevocationKeyStatus(credid, key)
+}
+func (s *Server) RevocationKeyStatus(credid irma.CredentialTypeIdentifier, key string) (*irma.RevocationKeyStatus, error) {
+	return s.conf.IrmaConfiguration.Revocation.RevocationKeyStatus(credid, key)
+}
+
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
 // of the specified IRMA session.
 func SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token string, requestor bool) error {
@@ -0,0 +1,219 @@
+package irmaserver
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alexandrevicenzi/go-sse"
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+// boltSessionStore keeps sessions in memory like the memorySessionStore, but additionally
+// writes them to a bbolt file, so that they survive a restart of the server.
+type boltSessionStore struct {
+	*memorySessionStore
+
+	path   string
+	dbLock sync.RWMutex // protects db against being swapped out during compaction
+	db     *bbolt.DB
+}
+
+var boltSessionsBucket = []byte("sessions") // Key: requestor token, value: *sessionData
+
+func newBoltSessionStore(conf *server.Configuration, e *sse.Server) (*boltSessionStore, error) {
+	db, err := bbolt.Open(conf.StoreBoltPath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &boltSessionStore{
+		memorySessionStore: &memorySessionStore{
+			requestor: make(map[irma.RequestorToken]*session),
+			client:    make(map[irma.ClientToken]*session),
+			conf:      conf,
+		},
+		path: conf.StoreBoltPath,
+		db:   db,
+	}
+	if err = s.restore(e); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore loads the sessions that were persisted by a previous run of the server. Their expiry
+// is determined by their last activity, so deleteExpired() handles them as if the server never stopped.
+func (s *boltSessionStore) restore(e *sse.Server) error {
+	var corrupt [][]byte
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(boltSessionsBucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			ses := &session{conf: s.conf, sessions: s, sse: e}
+			var d sessionData
+			if err := json.Unmarshal(v, &d); err != nil {
+				_ = server.LogError(errors.WrapPrefix(err, "failed to restore session "+string(k), 0))
+				corrupt = append(corrupt, k)
+				return nil
+			}
+			if err := ses.restore(&d); err != nil {
+				_ = server.LogError(errors.WrapPrefix(err, "failed to restore session "+string(k), 0))
+				corrupt = append(corrupt, k)
+				return nil
+			}
+			s.requestor[ses.requestorToken] = ses
+			s.client[ses.clientToken] = ses
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	s.conf.Logger.Infof("Restored %d sessions from %s", len(s.requestor), s.path)
+	if len(corrupt) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltSessionsBucket)
+		for _, k := range corrupt {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltSessionStore) add(session *session) {
+	s.memorySessionStore.add(session)
+	if err := s.update(session); err != nil {
+		_ = server.LogError(err)
+	}
+}
+
+func (s *boltSessionStore) update(session *session) error {
+	d, err := session.data()
+	if err != nil {
+		return err
+	}
+	bts, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	s.dbLock.RLock()
+	defer s.dbLock.RUnlock()
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltSessionsBucket).Put([]byte(session.requestorToken), bts)
+	})
+}
+
+func (s *boltSessionStore) deleteExpired() {
+	deleted := s.deleteExpiredSessions()
+	if len(deleted) == 0 {
+		return
+	}
+
+	s.dbLock.RLock()
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltSessionsBucket)
+		for _, session := range deleted {
+			if err := b.Delete([]byte(session.requestorToken)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.dbLock.RUnlock()
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+
+	if err = s.compact(); err != nil {
+		_ = server.LogError(errors.WrapPrefix(err, "failed to compact session store", 0))
+	}
+}
+
+// compact rewrites the bbolt file if most of it is unused, as bbolt never shrinks
+// its file by itself after deleting data.
+func (s *boltSessionStore) compact() error {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	var size int64
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		size = tx.Size()
+		return nil
+	}); err != nil {
+		return err
+	}
+	stats := s.db.Stats()
+	free := int64(stats.FreePageN+stats.PendingPageN) * int64(s.db.Info().PageSize)
+	if free < size/2 {
+		return nil
+	}
+
+	s.conf.Logger.WithFields(logrus.Fields{"size": size, "free": free}).Debug("Compacting session store")
+	tmp := s.path + ".compact"
+	_ = os.Remove(tmp)
+	dst, err := bbolt.Open(tmp, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	// The source transaction must outlive the destination transaction, as bbolt values
+	// are only valid during the transaction in which they were retrieved.
+	err = s.db.View(func(src *bbolt.Tx) error {
+		return dst.Update(func(tx *bbolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(boltSessionsBucket)
+			if err != nil {
+				return err
+			}
+			return src.Bucket(boltSessionsBucket).ForEach(b.Put)
+		})
+	})
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// Keep using the current file until the compacted file has taken its place, so that
+	// the store remains usable if any of the following fails
+	db, err := bbolt.Open(tmp, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		_ = db.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	old := s.db
+	s.db = db
+	if err = old.Close(); err != nil {
+		server.LogWarning(err)
+	}
+	return nil
+}
+
+func (s *boltSessionStore) stop() {
+	s.memorySessionStore.stop()
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+	if err := s.db.Close(); err != nil {
+		server.LogWarning(err)
+	}
+}
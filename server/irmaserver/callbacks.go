@@ -0,0 +1,444 @@
+package irmaserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+// callbackQueue delivers result callbacks to the callback URLs of session requests. Failed
+// deliveries are retried with exponential backoff until they are older than the configured
+// maximum retry age, after which they are logged and kept as dead letters. If a store path is
+// configured, undelivered callbacks are kept in a bbolt file so that they survive a restart.
+type callbackQueue struct {
+	sync.Mutex
+	conf     *server.Configuration
+	pending  map[string]*callback
+	inflight map[string]struct{}
+	dead     []*callback
+	db       *bbolt.DB
+	client   *http.Client
+
+	wake     chan struct{}
+	stopping chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// callback contains the session result instead of the callback body, so that a result JWT with
+// a fresh expiry can be created for each delivery attempt.
+type callback struct {
+	ID          string                `json:"id"`
+	URL         string                `json:"url"`
+	Session     irma.RequestorToken   `json:"session"`
+	Result      *server.SessionResult `json:"result"`
+	Legacy      bool                  `json:"legacy,omitempty"` // SessionResult.LegacySession, which is not serialized
+	Format      server.ResultFormat   `json:"format,omitempty"`
+	JwtValidity int                   `json:"jwtValidity,omitempty"`
+	Created     time.Time             `json:"created"`
+	Attempts    int                   `json:"attempts"`
+	LastAttempt time.Time             `json:"lastAttempt"`
+	NextAttempt time.Time             `json:"nextAttempt"`
+	LastError   string                `json:"lastError,omitempty"`
+}
+
+var (
+	callbacksPendingBucket = []byte("pending") // Key: callback ID, value: *callback
+	callbacksDeadBucket    = []byte("dead")    // Key: callback ID, value: *callback
+
+	callbackInitialBackoff = 1 * time.Second
+	callbackMaxBackoff     = 10 * time.Minute
+	callbackTimeout        = 10 * time.Second
+)
+
+// maxDeadCallbacks is the amount of dead letters that are kept; older ones are discarded.
+const maxDeadCallbacks = 1000
+
+func newCallbackQueue(conf *server.Configuration) (*callbackQueue, error) {
+	q := &callbackQueue{
+		conf:     conf,
+		pending:  map[string]*callback{},
+		inflight: map[string]struct{}{},
+		client:   callbackClient(conf),
+		wake:     make(chan struct{}, 1),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if conf.CallbackStorePath != "" {
+		db, err := bbolt.Open(conf.CallbackStorePath, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+		if err != nil {
+			return nil, err
+		}
+		q.db = db
+		if err = q.restore(); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	go q.run()
+	return q, nil
+}
+
+// callbackClient returns a HTTP client that, if the configuration denies callbacks to private networks,
+// checks the address of every connection it makes, so that DNS changes cannot circumvent the check.
+func callbackClient(conf *server.Configuration) *http.Client {
+	client := &http.Client{Timeout: callbackTimeout}
+	if !conf.DenyPrivateCallbacks {
+		return client
+	}
+	dialer := &net.Dialer{
+		Timeout: callbackTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return conf.CheckCallbackIP(net.ParseIP(host))
+		},
+	}
+	client.Transport = &http.Transport{DialContext: dialer.DialContext}
+	return client
+}
+
+func (q *callbackQueue) restore() error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{callbacksPendingBucket, callbacksDeadBucket} {
+			b, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+			err = b.ForEach(func(k, v []byte) error {
+				cb := &callback{}
+				if err := json.Unmarshal(v, cb); err != nil {
+					_ = server.LogError(errors.WrapPrefix(err, "failed to restore result callback "+string(k), 0))
+					return nil
+				}
+				if cb.Result == nil {
+					_ = server.LogError(errors.Errorf("failed to restore result callback %s: no session result", k))
+					return nil
+				}
+				cb.Result.LegacySession = cb.Legacy
+				if bytes.Equal(name, callbacksPendingBucket) {
+					q.pending[cb.ID] = cb
+				} else {
+					q.dead = append(q.dead, cb)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		sort.Slice(q.dead, func(i, j int) bool { return q.dead[i].LastAttempt.Before(q.dead[j].LastAttempt) })
+		if len(q.pending) > 0 {
+			q.conf.Logger.Infof("Restored %d undelivered result callbacks", len(q.pending))
+		}
+		return nil
+	})
+}
+
+// enqueue schedules the delivery of the session result in the specified format to the specified
+// callback URL. If a JWT private key is configured, the result is sent as a JWT with the specified
+// validity, which is created anew at each delivery attempt.
+func (q *callbackQueue) enqueue(url string, result *server.SessionResult, format server.ResultFormat, validity int) {
+	logger := q.conf.Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": url})
+	if !strings.HasPrefix(url, "https") {
+		logger.Warn("POSTing session result to callback URL without TLS: attributes are unencrypted in traffic")
+	} else {
+		logger.Debug("POSTing session result")
+	}
+
+	now := time.Now()
+	cb := &callback{
+		ID:          common.NewSessionToken(),
+		URL:         url,
+		Session:     result.Token,
+		Result:      result,
+		Legacy:      result.LegacySession,
+		Format:      format,
+		JwtValidity: validity,
+		Created:     now,
+		NextAttempt: now,
+	}
+	q.Lock()
+	q.pending[cb.ID] = cb
+	q.persist(callbacksPendingBucket, cb)
+	q.Unlock()
+	q.signal()
+}
+
+func (q *callbackQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *callbackQueue) run() {
+	defer close(q.done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-q.stopping:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		next := q.deliverDue()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// deliverDue starts delivery of all callbacks whose next attempt is due, and returns how long
+// to wait before the next attempt of the remaining callbacks is due.
+func (q *callbackQueue) deliverDue() time.Duration {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	wait := callbackMaxBackoff
+	for id, cb := range q.pending {
+		if _, ok := q.inflight[id]; ok {
+			continue
+		}
+		if d := cb.NextAttempt.Sub(now); d > 0 {
+			if d < wait {
+				wait = d
+			}
+			continue
+		}
+		q.inflight[id] = struct{}{}
+		q.wg.Add(1)
+		go q.deliver(cb)
+	}
+	return wait
+}
+
+func (q *callbackQueue) deliver(cb *callback) {
+	defer q.wg.Done()
+	err := q.post(cb)
+
+	q.Lock()
+	defer q.Unlock()
+	delete(q.inflight, cb.ID)
+	now := time.Now()
+	cb.Attempts++
+	cb.LastAttempt = now
+	logger := q.conf.Logger.WithFields(logrus.Fields{
+		"session": cb.Session, "callbackUrl": cb.URL, "callback": cb.ID, "attempts": cb.Attempts,
+	})
+
+	if err == nil {
+		delete(q.pending, cb.ID)
+		q.remove(callbacksPendingBucket, cb.ID)
+		server.CallbackDelivered("success")
+		logger.Debug("Result callback delivered")
+		q.signal()
+		return
+	}
+
+	cb.LastError = err.Error()
+	backoff := callbackInitialBackoff << uint(cb.Attempts-1)
+	if backoff > callbackMaxBackoff || backoff <= 0 {
+		backoff = callbackMaxBackoff
+	}
+	if now.Add(backoff).Sub(cb.Created) > time.Duration(q.conf.CallbackMaxRetryAge)*time.Second {
+		delete(q.pending, cb.ID)
+		q.remove(callbacksPendingBucket, cb.ID)
+		q.addDead(cb)
+		server.CallbackDelivered("dead")
+		logger.WithField("error", cb.LastError).Error("Giving up on delivering result callback")
+		return
+	}
+	cb.NextAttempt = now.Add(backoff)
+	q.persist(callbacksPendingBucket, cb)
+	server.CallbackDelivered("retry")
+	logger.WithField("error", cb.LastError).Warnf("Failed to POST session result to callback URL, retrying in %s", backoff)
+	q.signal()
+}
+
+// post POSTs the callback once. Any 2xx response status counts as a successful delivery.
+func (q *callbackQueue) post(cb *callback) error {
+	body, jwt, err := server.CallbackPayload(cb.Result, cb.Format, q.conf.JwtIssuer, cb.JwtValidity, q.conf.JwtSigningKey)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cb.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if jwt {
+		req.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	} else {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	req.Header.Set("User-Agent", "irmago")
+	req.Header.Set(server.CallbackDeliveryHeader, cb.ID)
+	if q.conf.CallbackSecret != "" {
+		req.Header.Set(server.CallbackSignatureHeader, server.SignCallback([]byte(q.conf.CallbackSecret), time.Now(), body))
+	}
+
+	res, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Errorf("callback URL responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (q *callbackQueue) addDead(cb *callback) {
+	q.dead = append(q.dead, cb)
+	q.persist(callbacksDeadBucket, cb)
+	for len(q.dead) > maxDeadCallbacks {
+		q.remove(callbacksDeadBucket, q.dead[0].ID)
+		q.dead = q.dead[1:]
+	}
+}
+
+func (q *callbackQueue) deadCallbacks() []*server.CallbackInfo {
+	q.Lock()
+	defer q.Unlock()
+	infos := make([]*server.CallbackInfo, 0, len(q.dead))
+	for _, cb := range q.dead {
+		infos = append(infos, &server.CallbackInfo{
+			ID:          cb.ID,
+			URL:         cb.URL,
+			Session:     cb.Session,
+			Created:     cb.Created,
+			Attempts:    cb.Attempts,
+			LastAttempt: cb.LastAttempt,
+			LastError:   cb.LastError,
+		})
+	}
+	return infos
+}
+
+// takeDead removes the specified dead letter, returning nil if it does not exist.
+// The caller must hold the lock.
+func (q *callbackQueue) takeDead(id string) *callback {
+	for i, cb := range q.dead {
+		if cb.ID == id {
+			q.dead = append(q.dead[:i], q.dead[i+1:]...)
+			q.remove(callbacksDeadBucket, id)
+			return cb
+		}
+	}
+	return nil
+}
+
+func (q *callbackQueue) discard(id string) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.takeDead(id) == nil {
+		return errors.New("unknown callback")
+	}
+	return nil
+}
+
+// retry moves the specified dead letter back into the queue, after which it is retried
+// as if it were a new callback.
+func (q *callbackQueue) retry(id string) error {
+	q.Lock()
+	cb := q.takeDead(id)
+	if cb == nil {
+		q.Unlock()
+		return errors.New("unknown callback")
+	}
+	now := time.Now()
+	cb.Created, cb.NextAttempt, cb.Attempts = now, now, 0
+	q.pending[cb.ID] = cb
+	q.persist(callbacksPendingBucket, cb)
+	q.Unlock()
+	q.signal()
+	return nil
+}
+
+// persist writes the callback to the specified bucket, if a store is configured.
+// The caller must hold the lock.
+func (q *callbackQueue) persist(bucket []byte, cb *callback) {
+	if q.db == nil {
+		return
+	}
+	bts, err := json.Marshal(cb)
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+	if err = q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(cb.ID), bts)
+	}); err != nil {
+		_ = server.LogError(err)
+	}
+}
+
+// remove deletes the callback from the specified bucket, if a store is configured.
+// The caller must hold the lock.
+func (q *callbackQueue) remove(bucket []byte, id string) {
+	if q.db == nil {
+		return
+	}
+	if err := q.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(id))
+	}); err != nil {
+		_ = server.LogError(err)
+	}
+}
+
+// stop flushes the queue, attempting to deliver all pending callbacks once more regardless of
+// their backoff, waits for the deliveries to finish and stops the queue. Callbacks that are still
+// undelivered are retried after a restart if a store is configured, and are lost otherwise.
+// Calling it more than once has no effect.
+func (q *callbackQueue) stop() {
+	q.stopOnce.Do(q.doStop)
+}
+
+func (q *callbackQueue) doStop() {
+	close(q.stopping)
+	<-q.done
+
+	q.Lock()
+	now := time.Now()
+	for _, cb := range q.pending {
+		cb.NextAttempt = now
+	}
+	q.Unlock()
+	q.deliverDue()
+	q.wg.Wait()
+
+	q.Lock()
+	defer q.Unlock()
+	if len(q.pending) > 0 && q.db == nil {
+		q.conf.Logger.Warnf("Stopping with %d undelivered result callbacks", len(q.pending))
+	}
+	if q.db != nil {
+		if err := q.db.Close(); err != nil {
+			server.LogWarning(err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package irmaserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+// callbackReceiver is a callback URL that fails the first failures requests.
+type callbackReceiver struct {
+	sync.Mutex
+	failures   int
+	requests   int
+	deliveries []string
+	bodies     []string
+	signatures []string
+}
+
+func (c *callbackReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.Lock()
+	defer c.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	c.requests++
+	c.deliveries = append(c.deliveries, r.Header.Get(server.CallbackDeliveryHeader))
+	c.bodies = append(c.bodies, string(body))
+	c.signatures = append(c.signatures, r.Header.Get(server.CallbackSignatureHeader))
+	if c.requests <= c.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *callbackReceiver) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.requests
+}
+
+func callbackConfiguration(maxAge int, path string) *server.Configuration {
+	logger := logrus.New()
+	logger.Level = logrus.FatalLevel
+	return &server.Configuration{Logger: logger, CallbackMaxRetryAge: maxAge, CallbackStorePath: path, CallbackSecret: "secret"}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Fail(t, "condition not met in time")
+}
+
+func setCallbackBackoff(t *testing.T) {
+	backoff := callbackInitialBackoff
+	callbackInitialBackoff = 10 * time.Millisecond
+	t.Cleanup(func() { callbackInitialBackoff = backoff })
+}
+
+func TestCallbackRetry(t *testing.T) {
+	setCallbackBackoff(t)
+	receiver := &callbackReceiver{failures: 2}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	q, err := newCallbackQueue(callbackConfiguration(60, ""))
+	require.NoError(t, err)
+	defer q.stop()
+
+	q.enqueue(ts.URL, &server.SessionResult{Token: "token"}, server.ResultFormatIrma, 0)
+	waitFor(t, func() bool { return receiver.count() == 3 })
+	waitFor(t, func() bool {
+		q.Lock()
+		defer q.Unlock()
+		return len(q.pending) == 0
+	})
+
+	receiver.Lock()
+	defer receiver.Unlock()
+	for i := 0; i < 3; i++ {
+		require.Equal(t, receiver.deliveries[0], receiver.deliveries[i])
+		require.Equal(t, `{"token":"token","status":"","type":""}`, receiver.bodies[i])
+		require.NoError(t, server.VerifyCallbackSignature([]byte("secret"), receiver.signatures[i], []byte(receiver.bodies[i]), time.Minute))
+	}
+	require.Error(t, server.VerifyCallbackSignature([]byte("secret"), receiver.signatures[0], []byte(`{"token":"other"}`), time.Minute))
+	require.Error(t, server.VerifyCallbackSignature([]byte("other"), receiver.signatures[0], []byte(receiver.bodies[0]), time.Minute))
+	require.Empty(t, q.deadCallbacks())
+}
+
+func TestCallbackDeadLetter(t *testing.T) {
+	setCallbackBackoff(t)
+	receiver := &callbackReceiver{failures: 1000}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	q, err := newCallbackQueue(callbackConfiguration(1, ""))
+	require.NoError(t, err)
+	defer q.stop()
+
+	q.enqueue(ts.URL, &server.SessionResult{Token: "token"}, server.ResultFormatIrma, 0)
+	waitFor(t, func() bool { return len(q.deadCallbacks()) == 1 })
+	dead := q.deadCallbacks()[0]
+	require.Equal(t, ts.URL, dead.URL)
+	require.Equal(t, receiver.count(), dead.Attempts)
+	require.Greater(t, dead.Attempts, 1)
+	require.NotEmpty(t, dead.LastError)
+
+	// Retrying a dead letter puts it back into the queue
+	receiver.Lock()
+	receiver.failures = 0
+	receiver.Unlock()
+	require.NoError(t, q.retry(dead.ID))
+	require.Empty(t, q.deadCallbacks())
+	waitFor(t, func() bool { return receiver.count() == dead.Attempts+1 })
+
+	require.Error(t, q.discard(dead.ID))
+	require.Error(t, q.retry("nonexisting"))
+}
+
+func TestCallbackPersistence(t *testing.T) {
+	setCallbackBackoff(t)
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	path := filepath.Join(storage, "callbacks.db")
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	url := failing.URL
+
+	q, err := newCallbackQueue(callbackConfiguration(60, path))
+	require.NoError(t, err)
+	q.enqueue(url, &server.SessionResult{Token: "token"}, server.ResultFormatIrma, 0)
+	waitFor(t, func() bool {
+		q.Lock()
+		defer q.Unlock()
+		for _, cb := range q.pending {
+			return cb.Attempts > 0
+		}
+		return false
+	})
+	q.stop()
+	failing.Close()
+
+	// Listen at the same address at which the callback failed, after restarting the queue
+	receiver := &callbackReceiver{}
+	ts := httptest.NewUnstartedServer(receiver)
+	listener, err := net.Listen("tcp", strings.TrimPrefix(url, "http://"))
+	require.NoError(t, err)
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	q, err = newCallbackQueue(callbackConfiguration(60, path))
+	require.NoError(t, err)
+	defer q.stop()
+	waitFor(t, func() bool { return receiver.count() == 1 })
+}
+
+func TestCallbackDenyPrivate(t *testing.T) {
+	setCallbackBackoff(t)
+	receiver := &callbackReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	conf := callbackConfiguration(1, "")
+	conf.DenyPrivateCallbacks = true
+	q, err := newCallbackQueue(conf)
+	require.NoError(t, err)
+	defer q.stop()
+
+	q.enqueue(ts.URL, &server.SessionResult{Token: "token"}, server.ResultFormatIrma, 0)
+	waitFor(t, func() bool { return len(q.deadCallbacks()) == 1 })
+	require.Zero(t, receiver.count())
+	require.Contains(t, q.deadCallbacks()[0].LastError, "private network")
+}
+
+func TestCallbackFlush(t *testing.T) {
+	receiver := &callbackReceiver{failures: 1}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	q, err := newCallbackQueue(callbackConfiguration(60, ""))
+	require.NoError(t, err)
+	q.enqueue(ts.URL, &server.SessionResult{Token: "token"}, server.ResultFormatIrma, 0)
+	waitFor(t, func() bool {
+		q.Lock()
+		defer q.Unlock()
+		for _, cb := range q.pending {
+			return cb.Attempts > 0
+		}
+		return false
+	})
+
+	// Stopping the queue delivers the callback without waiting for its backoff to pass
+	q.stop()
+	require.Equal(t, 2, receiver.count())
+	require.Empty(t, q.pending)
+	q.stop()
+}
+
+func TestCallbackJwt(t *testing.T) {
+	// JWTs have a resolution of one second
+	backoff := callbackInitialBackoff
+	callbackInitialBackoff = 1100 * time.Millisecond
+	t.Cleanup(func() { callbackInitialBackoff = backoff })
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+
+	receiver := &callbackReceiver{failures: 1}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	conf := callbackConfiguration(60, filepath.Join(storage, "callbacks.db"))
+	conf.JwtIssuer, conf.JwtSigningKey = "irmaserver", sk
+	q, err := newCallbackQueue(conf)
+	require.NoError(t, err)
+	defer q.stop()
+
+	q.enqueue(ts.URL, &server.SessionResult{Token: "token", Status: irma.ServerStatusDone}, server.ResultFormatIrma, 120)
+	waitFor(t, func() bool { return receiver.count() == 2 })
+
+	// Each attempt gets a freshly signed JWT
+	receiver.Lock()
+	defer receiver.Unlock()
+	var issued []int64
+	for _, body := range receiver.bodies {
+		claims := &struct {
+			jwt.StandardClaims
+			*server.SessionResult
+		}{}
+		_, err := jwt.ParseWithClaims(body, claims, func(*jwt.Token) (interface{}, error) {
+			return &sk.PublicKey, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, irma.RequestorToken("token"), claims.Token)
+		require.Equal(t, claims.IssuedAt+120, claims.ExpiresAt)
+		issued = append(issued, claims.IssuedAt)
+	}
+	require.Greater(t, issued[1], issued[0])
+}
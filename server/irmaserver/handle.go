@@ -18,6 +18,7 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-errors/errors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // This file contains the handler functions for the protocol messages.
@@ -255,12 +256,12 @@ func (session *session) nextSession() (irma.RequestorRequest, irma.AttributeConD
 
 	var res interface{}
 	var err error
-	if session.conf.JwtRSAPrivateKey != nil {
+	if session.conf.JwtSigningKey != nil {
 		res, err = server.ResultJwt(
 			session.result,
 			session.conf.JwtIssuer,
 			base.ResultJwtValidity,
-			session.conf.JwtRSAPrivateKey,
+			session.conf.JwtSigningKey,
 		)
 	} else {
 		res = session.result
@@ -305,7 +306,7 @@ func (s *Server) startNext(session *session, res *irma.ServerSessionResponse) er
 	if next == nil {
 		return nil
 	}
-	qr, token, _, err := s.StartSession(next, nil)
+	qr, token, _, err := s.startSession("", next, nil)
 	if err != nil {
 		return err
 	}
@@ -317,6 +318,9 @@ func (s *Server) startNext(session *session, res *irma.ServerSessionResponse) er
 	newsession := s.sessions.get(token)
 	newsession.implicitDisclosure = disclosed
 	newsession.frontendAuth = session.frontendAuth
+	if err = s.sessions.update(newsession); err != nil {
+		return err
+	}
 	res.NextSession = qr
 
 	return nil
@@ -334,7 +338,11 @@ func (s *Server) handleSessionCommitments(w http.ResponseWriter, r *http.Request
 		return
 	}
 	session := r.Context().Value("session").(*session)
+	start := time.Now()
+	span := session.startSpan(r, "irmaserver.IssuanceCommitments")
 	res, rerr := session.handlePostCommitments(commitments)
+	server.EndSpan(span, rerr)
+	server.ProofsVerified(session.action, time.Since(start))
 	if rerr != nil {
 		server.WriteResponse(w, nil, rerr)
 		return
@@ -356,6 +364,9 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 	var res *irma.ServerSessionResponse
 	var rerr *irma.RemoteError
+	start := time.Now()
+	span := session.startSpan(r, "irmaserver.Proofs")
+	defer func() { server.EndSpan(span, rerr) }()
 	switch session.action {
 	case irma.ActionDisclosing:
 		disclosure := &irma.Disclosure{}
@@ -374,6 +385,7 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 	default:
 		rerr = server.RemoteError(server.ErrorInvalidRequest, "")
 	}
+	server.ProofsVerified(session.action, time.Since(start))
 	if rerr != nil {
 		server.WriteResponse(w, nil, rerr)
 		return
@@ -406,7 +418,10 @@ func (s *Server) handleSessionStatusEvents(w http.ResponseWriter, r *http.Reques
 }
 
 func (s *Server) handleSessionDelete(w http.ResponseWriter, r *http.Request) {
-	r.Context().Value("session").(*session).handleDelete()
+	session := r.Context().Value("session").(*session)
+	span := session.startSpan(r, "irmaserver.Delete")
+	session.handleDelete()
+	span.End()
 	w.WriteHeader(200)
 }
 
@@ -422,7 +437,9 @@ func (s *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
 	}
 	session := r.Context().Value("session").(*session)
 	clientAuth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
+	span := session.startSpan(r, "irmaserver.ClientRequest")
 	res, err := session.handleGetClientRequest(&min, &max, clientAuth)
+	server.EndSpan(span, err)
 	server.WriteResponse(w, res, err)
 }
 
@@ -433,10 +450,12 @@ func (s *Server) handleSessionGetRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	var rerr *irma.RemoteError
+	span := session.startSpan(r, "irmaserver.Request")
 	request, err := session.getRequest()
 	if err != nil {
 		rerr = session.fail(server.ErrorRevocation, err.Error())
 	}
+	server.EndSpan(span, rerr)
 	server.WriteResponse(w, request, rerr)
 }
 
@@ -492,12 +511,29 @@ func (s *Server) handleFrontendPairingCompleted(w http.ResponseWriter, r *http.R
 }
 
 func (s *Server) handleStaticMessage(w http.ResponseWriter, r *http.Request) {
-	rrequest := s.conf.StaticSessionRequests[chi.URLParam(r, "name")]
-	if rrequest == nil {
+	name := chi.URLParam(r, "name")
+	r, span := server.StartSpan(r, "irmaserver.StaticSession", attribute.String("irma.static_session", name))
+	defer span.End()
+	template := s.staticSessionTemplate(name)
+	if template == nil {
 		server.WriteResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "unknown static session"))
 		return
 	}
-	qr, _, _, err := s.StartSession(rrequest, s.doResultCallback)
+	params, err := staticSessionParameters(r)
+	if err != nil {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
+		return
+	}
+	rrequest, err := template.Request(params)
+	if err != nil {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, err.Error()))
+		return
+	}
+	qr, _, _, err := s.StartSession(rrequest, nil)
+	if err == ErrShuttingDown {
+		server.WriteResponse(w, nil, server.RemoteError(server.ErrorShuttingDown, ""))
+		return
+	}
 	if err != nil {
 		server.WriteResponse(w, nil, server.RemoteError(server.ErrorMalformedInput, err.Error()))
 		return
@@ -516,7 +552,7 @@ func (s *Server) handleRevocationGetEvents(w http.ResponseWriter, r *http.Reques
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "not supported by this server"))
 		return
 	}
-	events, err := s.conf.IrmaConfiguration.Revocation.Events(cred, uint(pkcounter), min, max)
+	events, err := s.conf.IrmaConfiguration.Revocation.EventsContext(r.Context(), cred, uint(pkcounter), min, max)
 	if err != nil {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorRevocation, err.Error()))
 		return
@@ -556,7 +592,7 @@ func (s *Server) handleRevocationGetUpdateLatest(w http.ResponseWriter, r *http.
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorInvalidRequest, "not supported by this server"))
 		return
 	}
-	updates, err := s.conf.IrmaConfiguration.Revocation.UpdateLatest(cred, count, counter)
+	updates, err := s.conf.IrmaConfiguration.Revocation.UpdateLatestContext(r.Context(), cred, count, counter)
 	if err != nil {
 		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorRevocation, err.Error()))
 		return
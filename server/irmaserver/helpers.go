@@ -9,7 +9,11 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
@@ -25,6 +29,8 @@ import (
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Session helpers
@@ -39,7 +45,13 @@ func (session *session) setStatus(status irma.ServerStatus) {
 		Info("Session status updated")
 	session.status = status
 	session.result.Status = status
-	session.sessions.update(session)
+	if err := session.sessions.update(session); err != nil {
+		_ = server.LogError(err)
+	}
+	if status.Finished() {
+		server.SessionFinished(session.action, session.requestor, status, session.result.Err)
+	}
+	session.onUpdate()
 }
 
 func (session *session) onUpdate() {
@@ -96,8 +108,8 @@ func (session *session) pairingCompleted() error {
 
 func (session *session) fail(err server.Error, message string) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
-	session.setStatus(irma.ServerStatusCancelled)
 	session.result = &server.SessionResult{Err: rerr, Token: session.requestorToken, Status: irma.ServerStatusCancelled, Type: session.action}
+	session.setStatus(irma.ServerStatusCancelled)
 	return rerr
 }
 
@@ -137,15 +149,15 @@ const retryTimeLimit = 10 * time.Second
 // - last time was not more than 10 seconds ago (retryablehttp client gives up before this)
 // - the session status is what it is expected to be when receiving the request for a second time.
 func (session *session) checkCache(endpoint string, message []byte) (int, []byte) {
-	if session.responseCache.endpoint != endpoint ||
-		len(session.responseCache.response) == 0 ||
-		session.responseCache.sessionStatus != session.status ||
+	if session.responseCache.Endpoint != endpoint ||
+		len(session.responseCache.Response) == 0 ||
+		session.responseCache.SessionStatus != session.status ||
 		session.lastActive.Before(time.Now().Add(-retryTimeLimit)) ||
-		sha256.Sum256(session.responseCache.message) != sha256.Sum256(message) {
+		sha256.Sum256(session.responseCache.Message) != sha256.Sum256(message) {
 		session.responseCache = responseCache{}
 		return 0, nil
 	}
-	return session.responseCache.status, session.responseCache.response
+	return session.responseCache.Status, session.responseCache.Response
 }
 
 // Issuance helpers
@@ -231,54 +243,158 @@ func (session *session) computeAttributes(
 
 func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 	for _, cred := range request.Credentials {
-		// Check that we have the appropriate private key
-		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.IrmaConfiguration.PrivateKeys.Latest(iss)
-		if err != nil {
+		if err := s.validateCredentialRequest(cred); err != nil {
 			return err
 		}
-		if privatekey == nil {
-			return errors.Errorf("missing private key of issuer %s", iss.String())
-		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, privatekey.Counter)
-		if err != nil {
-			return err
-		}
-		if pubkey == nil {
-			return errors.Errorf("missing public key of issuer %s", iss.String())
+	}
+	return nil
+}
+
+// validateCredentialRequest checks that the credential can be issued, and sets its key counter
+// and default validity. Missing keys and revocation misconfiguration are returned as *server.RequestProblem.
+func (s *Server) validateCredentialRequest(cred *irma.CredentialRequest) error {
+	// Check that we have the appropriate private key
+	iss := cred.CredentialTypeID.IssuerIdentifier()
+	privatekey, err := s.conf.IrmaConfiguration.PrivateKeys.Latest(iss)
+	if err != nil {
+		return err
+	}
+	if privatekey == nil {
+		return &server.RequestProblem{Type: server.ProblemMissingPrivateKey, Identifier: iss.String(),
+			Message: "missing private key of issuer " + iss.String()}
+	}
+	pkid := fmt.Sprintf("%s-%d", iss.String(), privatekey.Counter)
+	pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, privatekey.Counter)
+	if err != nil {
+		return err
+	}
+	if pubkey == nil {
+		return &server.RequestProblem{Type: server.ProblemInvalidPublicKey, Identifier: pkid,
+			Message: "missing public key of issuer " + iss.String()}
+	}
+	now := time.Now()
+	if now.Unix() > pubkey.ExpiryDate {
+		return &server.RequestProblem{Type: server.ProblemInvalidPublicKey, Identifier: pkid,
+			Message: "cannot issue using expired public key " + pkid}
+	}
+	cred.KeyCounter = privatekey.Counter
+
+	if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
+		settings := s.conf.RevocationSettings[cred.CredentialTypeID]
+		if settings == nil || (settings.RevocationServerURL == "" && !settings.Server) {
+			return &server.RequestProblem{Type: server.ProblemRevocation, Identifier: cred.CredentialTypeID.String(),
+				Message: fmt.Sprintf("revocation enabled for %s but no revocation server configured", cred.CredentialTypeID)}
 		}
-		now := time.Now()
-		if now.Unix() > pubkey.ExpiryDate {
-			return errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), privatekey.Counter)
+		if cred.RevocationKey == "" {
+			return &server.RequestProblem{Type: server.ProblemRevocation, Identifier: cred.CredentialTypeID.String(),
+				Message: fmt.Sprintf("revocation enabled for %s but no revocationKey specified", cred.CredentialTypeID)}
 		}
-		cred.KeyCounter = privatekey.Counter
+	}
 
-		if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
-			settings := s.conf.RevocationSettings[cred.CredentialTypeID]
-			if settings == nil || (settings.RevocationServerURL == "" && !settings.Server) {
-				return errors.Errorf("revocation enabled for %s but no revocation server configured", cred.CredentialTypeID)
-			}
-			if cred.RevocationKey == "" {
-				return errors.Errorf("revocation enabled for %s but no revocationKey specified", cred.CredentialTypeID)
-			}
+	// Check that the credential is consistent with irma_configuration
+	if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
+		return err
+	}
+
+	// Ensure the credential has an expiry date
+	defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
+	if cred.Validity == nil {
+		cred.Validity = &defaultValidity
+	}
+	if cred.Validity.Before(irma.Timestamp(now)) {
+		return errors.New("cannot issue expired credentials")
+	}
+	return nil
+}
+
+// requestProblems returns all problems that prevent a session from being started with the request,
+// performing the same checks as StartSession.
+func (s *Server) requestProblems(rrequest irma.RequestorRequest) []*server.RequestProblem {
+	var problems []*server.RequestProblem
+	add := func(typ server.RequestProblemType, identifier string, err error) {
+		if p, ok := err.(*server.RequestProblem); ok {
+			problems = append(problems, p)
+		} else {
+			problems = append(problems, &server.RequestProblem{Type: typ, Identifier: identifier, Message: err.Error()})
 		}
+	}
 
-		// Check that the credential is consistent with irma_configuration
-		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
-			return err
+	base := rrequest.Base()
+	if _, err := server.ParseResultFormat(base.ResultFormat); err != nil {
+		add(server.ProblemInvalidRequest, base.ResultFormat, err)
+	}
+
+	// The remaining checks require all identifiers in the request to be known
+	request := rrequest.SessionRequest()
+	if _, err := s.conf.IrmaConfiguration.Download(request); err != nil {
+		switch e := err.(type) {
+		case *irma.UnknownIdentifierError:
+			problems = append(problems, identifierProblems(server.ProblemUnknownIdentifier, "unknown", e.Missing)...)
+		case *irma.RequiredAttributeMissingError:
+			problems = append(problems, identifierProblems(server.ProblemRequiredAttributeMissing, "missing required", e.Missing)...)
+		default:
+			add(server.ProblemInvalidRequest, "", err)
 		}
+		return problems
+	}
 
-		// Ensure the credential has an expiry date
-		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
-		if cred.Validity == nil {
-			cred.Validity = &defaultValidity
+	if err := request.Base().Validate(s.conf.IrmaConfiguration); err != nil {
+		add(server.ProblemRevocation, "", err)
+	}
+	if request.Base().AugmentReturnURL {
+		if !s.conf.AugmentClientReturnURL {
+			add(server.ProblemUnsupported, "", errors.New("augmenting client return url not enabled in server configuration"))
+		}
+		if request.Base().ClientReturnURL == "" {
+			add(server.ProblemInvalidRequest, "", errors.New("cannot augment empty client return url"))
 		}
-		if cred.Validity.Before(irma.Timestamp(now)) {
-			return errors.New("cannot issue expired credentials")
+	}
+	if err := request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration); err != nil {
+		add(server.ProblemInvalidRequest, "", err)
+	}
+	if request.Action() == irma.ActionIssuing {
+		for _, cred := range request.(*irma.IssuanceRequest).Credentials {
+			cred.RandomBlindAttributeTypeIDs = s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeNames()
+			if err := s.validateCredentialRequest(cred); err != nil {
+				add(server.ProblemInvalidRequest, cred.CredentialTypeID.String(), err)
+			}
 		}
 	}
+	return problems
+}
 
-	return nil
+// identifierProblems returns a problem of the specified type for each identifier in the set.
+func identifierProblems(typ server.RequestProblemType, description string, set *irma.IrmaIdentifierSet) []*server.RequestProblem {
+	var problems []*server.RequestProblem
+	add := func(kind, identifier string) {
+		problems = append(problems, &server.RequestProblem{
+			Type: typ, Identifier: identifier, Message: fmt.Sprintf("%s %s %s", description, kind, identifier),
+		})
+	}
+	for id := range set.SchemeManagers {
+		add("scheme", id.String())
+	}
+	for id := range set.RequestorSchemes {
+		add("requestor scheme", id.String())
+	}
+	for id := range set.Issuers {
+		add("issuer", id.String())
+	}
+	for id := range set.CredentialTypes {
+		add("credential type", id.String())
+	}
+	for id := range set.AttributeTypes {
+		add("attribute type", id.String())
+	}
+	for id, counters := range set.PublicKeys {
+		for _, counter := range counters {
+			add("public key", fmt.Sprintf("%s-%d", id.String(), counter))
+		}
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Identifier < problems[j].Identifier
+	})
+	return problems
 }
 
 func (session *session) getProofP(commitments *irma.IssueCommitmentMessage, scheme irma.SchemeManagerIdentifier) (*gabi.ProofP, error) {
@@ -345,17 +461,16 @@ func (session *session) getRequest() (irma.SessionRequest, error) {
 
 // Other
 
-func (s *Server) doResultCallback(result *server.SessionResult) {
-	url := s.GetRequest(result.Token).Base().CallbackURL
-	if url == "" {
+func (s *Server) doResultCallback(base *irma.RequestorBaseRequest, result *server.SessionResult) {
+	if base.CallbackURL == "" {
 		return
 	}
-	server.DoResultCallback(url,
-		result,
-		s.conf.JwtIssuer,
-		s.GetRequest(result.Token).Base().ResultJwtValidity,
-		s.conf.JwtRSAPrivateKey,
-	)
+	format, err := server.ParseResultFormat(base.ResultFormat)
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+	s.callbacks.enqueue(base.CallbackURL, result, format, base.ResultJwtValidity)
 }
 
 func (s *Server) validateRequest(request irma.SessionRequest) error {
@@ -377,6 +492,48 @@ func (s *Server) validateRequest(request irma.SessionRequest) error {
 	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
 }
 
+// staticSessionParameters returns the parameters of a static session, which are specified
+// as URL query parameters and/or as a JSON object in the request body.
+func staticSessionParameters(r *http.Request) (map[string]string, error) {
+	params := map[string]string{}
+	for name, values := range r.URL.Query() {
+		if len(values) != 1 {
+			return nil, errors.Errorf("parameter %s specified more than once", name)
+		}
+		params[name] = values[0]
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if body = bytes.TrimSpace(body); len(body) == 0 || string(body) == "null" {
+		return params, nil
+	}
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err = dec.Decode(&fields); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse static session parameters", 0)
+	}
+	for name, value := range fields {
+		if _, ok := params[name]; ok {
+			return nil, errors.Errorf("parameter %s specified more than once", name)
+		}
+		switch v := value.(type) {
+		case string:
+			params[name] = v
+		case json.Number:
+			params[name] = v.String()
+		case bool:
+			params[name] = strconv.FormatBool(v)
+		default:
+			return nil, errors.Errorf("parameter %s must be a string, number or boolean", name)
+		}
+	}
+	return params, nil
+}
+
 func copyObject(i interface{}) (interface{}, error) {
 	cpy := reflect.New(reflect.TypeOf(i).Elem()).Interface()
 	bts, err := json.Marshal(i)
@@ -494,11 +651,11 @@ func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(ww, r)
 
 		session.responseCache = responseCache{
-			endpoint:      r.URL.Path,
-			message:       message,
-			response:      buf.Bytes(),
-			status:        ww.Status(),
-			sessionStatus: session.status,
+			Endpoint:      r.URL.Path,
+			Message:       message,
+			Response:      buf.Bytes(),
+			Status:        ww.Status(),
+			SessionStatus: session.status,
 		}
 	})
 }
@@ -515,31 +672,143 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 		ctx := r.Context()
 		session.Lock()
 		session.locked = true
+		sw := &sessionResponseWriter{ResponseWriter: w, session: session}
 		defer func() {
-			if session.prevStatus != session.status {
+			// The server-sent event handlers unlock the session while streaming
+			streamed := !session.locked
+			if streamed {
+				session.Lock()
+				session.locked = true
+			}
+
+			// Record the status change, if any, while locked, so that it is handled only once.
+			// Status requests don't change the session, so they are not stored; if the session is
+			// shared with other server instances, they leave handling status changes made elsewhere
+			// (e.g. timeouts) to the next request that does change it.
+			var result *server.SessionResult
+			_, shared := s.sessions.(*sqlSessionStore)
+			if session.prevStatus != session.status && !(shared && isStatusRequest(r)) {
 				session.prevStatus = session.status
-				result := session.result
-				r := ctx.Value("sessionresult")
-				if r != nil {
+				result = session.result
+				if r := ctx.Value("sessionresult"); r != nil {
 					*r.(*server.SessionResult) = *result
 				}
-				if session.status.Finished() {
-					if handler := s.handlers[result.Token]; handler != nil {
-						go handler(result)
-						delete(s.handlers, result.Token)
-					}
+			}
+			err := s.sessions.update(session)
+
+			var (
+				handler  server.SessionHandler
+				callback *irma.RequestorBaseRequest
+			)
+			if err == nil && result != nil && session.status.Finished() {
+				if handler = s.handlers[result.Token]; handler != nil {
+					delete(s.handlers, result.Token)
+				}
+				if base := session.rrequest.Base(); base.CallbackURL != "" {
+					callback = base
 				}
 			}
-			if session.locked {
-				session.locked = false
-				session.Unlock()
+			session.locked = false
+			session.Unlock()
+
+			if err != nil {
+				_ = server.LogError(err)
+				if streamed {
+					return
+				}
+				// Don't send a response for changes that were not stored
+				sw.discard()
+				if err == errSessionConflict {
+					server.WriteError(w, server.ErrorSessionConflict, "")
+				} else {
+					server.WriteError(w, server.ErrorInternal, "")
+				}
+				return
+			}
+			sw.flush()
+			if handler != nil {
+				go handler(result)
+			}
+			if callback != nil {
+				go s.doResultCallback(callback, result)
 			}
 		}()
 
-		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "session", session)))
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(ctx, "session", session)))
 	})
 }
 
+// isStatusRequest returns whether the request only reads the status of the session.
+func isStatusRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.HasPrefix(path.Base(r.URL.Path), "status")
+}
+
+// sessionResponseWriter holds back the response while the session is locked by the
+// sessionMiddleware, so that it is only sent once the changes to the session are stored.
+// Handlers that unlock the session themselves (i.e. the server-sent event handlers) write
+// directly to the underlying http.ResponseWriter.
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	session *session
+	status  int
+	buf     bytes.Buffer
+}
+
+func (w *sessionResponseWriter) WriteHeader(status int) {
+	if !w.session.locked {
+		w.flush()
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *sessionResponseWriter) Write(bts []byte) (int, error) {
+	if !w.session.locked {
+		w.flush()
+		return w.ResponseWriter.Write(bts)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buf.Write(bts)
+}
+
+func (w *sessionResponseWriter) Flush() {
+	if w.session.locked {
+		return
+	}
+	w.flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify is required by the server-sent events library.
+func (w *sessionResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// flush writes the response held back so far to the underlying http.ResponseWriter.
+func (w *sessionResponseWriter) flush() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.status = 0
+	}
+	if w.buf.Len() > 0 {
+		_, _ = w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+// discard drops the response held back so far.
+func (w *sessionResponseWriter) discard() {
+	w.status = 0
+	w.buf.Reset()
+}
+
 func (s *Server) pairingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session := r.Context().Value("session").(*session)
@@ -564,3 +833,17 @@ func (s *Server) pairingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// startSpan starts a span for a step of the session, as child of the span of the HTTP request.
+// The session tokens are not recorded in the span.
+func (session *session) startSpan(r *http.Request, name string) trace.Span {
+	attrs := []attribute.KeyValue{attribute.String("irma.action", string(session.action))}
+	if session.requestor != "" {
+		attrs = append(attrs, attribute.String("irma.requestor", session.requestor))
+	}
+	if session.version != nil {
+		attrs = append(attrs, attribute.String("irma.version", session.version.String()))
+	}
+	_, span := server.StartSpan(r, name, attrs...)
+	return span
+}
@@ -1,11 +1,13 @@
 package irmaserver
 
 import (
+	"encoding/json"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
+	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	irma "github.com/privacybydesign/irmago"
@@ -20,6 +22,7 @@ type session struct {
 	locked bool
 
 	action             irma.Action
+	requestor          string
 	requestorToken     irma.RequestorToken
 	clientToken        irma.ClientToken
 	frontendAuth       irma.FrontendAuthorization
@@ -38,6 +41,7 @@ type session struct {
 	responseCache  responseCache
 
 	clientAuth irma.ClientAuthorization
+	created    time.Time
 	lastActive time.Time
 	result     *server.SessionResult
 
@@ -48,18 +52,50 @@ type session struct {
 }
 
 type responseCache struct {
-	endpoint      string
-	message       []byte
-	response      []byte
-	status        int
-	sessionStatus irma.ServerStatus
+	Endpoint      string            `json:"endpoint"`
+	Message       []byte            `json:"message"`
+	Response      []byte            `json:"response"`
+	Status        int               `json:"status"`
+	SessionStatus irma.ServerStatus `json:"sessionStatus"`
+}
+
+// sessionData contains the state of a session that is persisted by session stores that keep
+// their sessions outside of memory. The remaining fields of session (the lock, status channels,
+// SSE server and configuration) only make sense within a single server instance.
+type sessionData struct {
+	Action             irma.Action                                   `json:"action"`
+	Requestor          string                                        `json:"requestor,omitempty"`
+	RequestorToken     irma.RequestorToken                           `json:"requestorToken"`
+	ClientToken        irma.ClientToken                              `json:"clientToken"`
+	FrontendAuth       irma.FrontendAuthorization                    `json:"frontendAuth"`
+	Version            *irma.ProtocolVersion                         `json:"version,omitempty"`
+	Rrequest           json.RawMessage                               `json:"rrequest"`
+	LegacyCompatible   bool                                          `json:"legacyCompatible"`
+	LegacySession      bool                                          `json:"legacySession"`
+	ImplicitDisclosure irma.AttributeConDisCon                       `json:"implicitDisclosure,omitempty"`
+	Next               *irma.Qr                                      `json:"next,omitempty"`
+	Options            irma.SessionOptions                           `json:"options"`
+	Status             irma.ServerStatus                             `json:"status"`
+	PrevStatus         irma.ServerStatus                             `json:"prevStatus"`
+	ResponseCache      responseCache                                 `json:"responseCache"`
+	ClientAuth         irma.ClientAuthorization                      `json:"clientAuth"`
+	Created            time.Time                                     `json:"created"`
+	LastActive         time.Time                                     `json:"lastActive"`
+	Result             *server.SessionResult                         `json:"result"`
+	KssProofs          map[irma.SchemeManagerIdentifier]*gabi.ProofP `json:"kssProofs,omitempty"`
 }
 
 type sessionStore interface {
 	get(token irma.RequestorToken) *session
 	clientGet(token irma.ClientToken) *session
 	add(session *session)
-	update(session *session)
+	// update persists any changes made to the session. It does not notify status listeners;
+	// use session.setStatus() for that. If the session was modified elsewhere since it was
+	// retrieved, the update is not stored and errSessionConflict is returned; the session is
+	// then reloaded the next time it is retrieved.
+	update(session *session) error
+	// list returns information on all sessions that are not yet finished.
+	list() []*server.SessionInfo
 	deleteExpired()
 	stop()
 }
@@ -72,10 +108,6 @@ type memorySessionStore struct {
 	client    map[irma.ClientToken]*session
 }
 
-const (
-	maxSessionLifetime = 5 * time.Minute // After this a session is cancelled
-)
-
 var (
 	minProtocolVersion = irma.NewVersion(2, 4)
 	maxProtocolVersion = irma.NewVersion(2, 8)
@@ -103,8 +135,28 @@ func (s *memorySessionStore) add(session *session) {
 	s.client[session.clientToken] = session
 }
 
-func (s *memorySessionStore) update(session *session) {
-	session.onUpdate()
+func (s *memorySessionStore) update(*session) error {
+	// Nothing to do: the session pointer in our maps already points to the updated session
+	return nil
+}
+
+func (s *memorySessionStore) list() []*server.SessionInfo {
+	s.RLock()
+	sessions := make([]*session, 0, len(s.requestor))
+	for _, session := range s.requestor {
+		sessions = append(sessions, session)
+	}
+	s.RUnlock()
+
+	infos := make([]*server.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		session.Lock()
+		if !session.status.Finished() {
+			infos = append(infos, session.info())
+		}
+		session.Unlock()
+	}
+	return infos
 }
 
 func (s *memorySessionStore) stop() {
@@ -120,6 +172,12 @@ func (s *memorySessionStore) stop() {
 }
 
 func (s *memorySessionStore) deleteExpired() {
+	s.deleteExpiredSessions()
+}
+
+// deleteExpiredSessions times out expired sessions that are not yet finished, and deletes
+// expired sessions that are. It returns the deleted sessions.
+func (s *memorySessionStore) deleteExpiredSessions() []*session {
 	// First check which sessions have expired
 	// We don't need a write lock for this yet, so postpone that for actual deleting
 	s.RLock()
@@ -132,12 +190,7 @@ func (s *memorySessionStore) deleteExpired() {
 	expired := make([]irma.RequestorToken, 0, len(toCheck))
 	for token, session := range toCheck {
 		session.Lock()
-		timeout := maxSessionLifetime
-		if session.status == irma.ServerStatusInitialized && session.rrequest.Base().ClientTimeout != 0 {
-			timeout = time.Duration(session.rrequest.Base().ClientTimeout) * time.Second
-		}
-
-		if session.lastActive.Add(timeout).Before(time.Now()) {
+		if session.expiry().Before(time.Now()) {
 			if !session.status.Finished() {
 				s.conf.Logger.WithFields(logrus.Fields{"session": session.requestorToken}).Infof("Session expired")
 				session.markAlive()
@@ -152,6 +205,7 @@ func (s *memorySessionStore) deleteExpired() {
 
 	// Using a write lock, delete the expired sessions
 	s.Lock()
+	deleted := make([]*session, 0, len(expired))
 	for _, token := range expired {
 		session := s.requestor[token]
 		if session.sse != nil {
@@ -161,13 +215,115 @@ func (s *memorySessionStore) deleteExpired() {
 		}
 		delete(s.client, session.clientToken)
 		delete(s.requestor, token)
+		deleted = append(deleted, session)
 	}
 	s.Unlock()
+
+	return deleted
+}
+
+// timeout returns the duration after the last activity in the session after which it expires.
+func (session *session) timeout() time.Duration {
+	base := session.rrequest.Base()
+	if session.status == irma.ServerStatusInitialized && base.ClientTimeout != 0 {
+		return time.Duration(base.ClientTimeout) * time.Second
+	}
+	if base.SessionLifetime != 0 {
+		return time.Duration(base.SessionLifetime) * time.Second
+	}
+	return time.Duration(session.conf.SessionLifetime) * time.Second
+}
+
+func (session *session) expiry() time.Time {
+	return session.lastActive.Add(session.timeout())
+}
+
+func (session *session) info() *server.SessionInfo {
+	return &server.SessionInfo{
+		Token:           session.requestorToken,
+		Action:          session.action,
+		Requestor:       session.requestor,
+		Status:          session.status,
+		Started:         session.created,
+		Age:             int64(time.Since(session.created).Seconds()),
+		ProtocolVersion: session.version,
+	}
+}
+
+// data returns the state of the session that session stores need to persist.
+func (session *session) data() (*sessionData, error) {
+	rrequest, err := json.Marshal(session.rrequest)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionData{
+		Action:             session.action,
+		Requestor:          session.requestor,
+		RequestorToken:     session.requestorToken,
+		ClientToken:        session.clientToken,
+		FrontendAuth:       session.frontendAuth,
+		Version:            session.version,
+		Rrequest:           rrequest,
+		LegacyCompatible:   session.legacyCompatible,
+		LegacySession:      session.result.LegacySession,
+		ImplicitDisclosure: session.implicitDisclosure,
+		Next:               session.next,
+		Options:            session.options,
+		Status:             session.status,
+		PrevStatus:         session.prevStatus,
+		ResponseCache:      session.responseCache,
+		ClientAuth:         session.clientAuth,
+		Created:            session.created,
+		LastActive:         session.lastActive,
+		Result:             session.result,
+		KssProofs:          session.kssProofs,
+	}, nil
+}
+
+// restore overwrites the persisted state of the session with the specified data.
+func (session *session) restore(d *sessionData) error {
+	var rrequest irma.RequestorRequest
+	switch d.Action {
+	case irma.ActionDisclosing:
+		rrequest = &irma.ServiceProviderRequest{}
+	case irma.ActionSigning:
+		rrequest = &irma.SignatureRequestorRequest{}
+	case irma.ActionIssuing:
+		rrequest = &irma.IdentityProviderRequest{}
+	default:
+		return errors.Errorf("cannot restore session of unknown type %s", d.Action)
+	}
+	if err := json.Unmarshal(d.Rrequest, rrequest); err != nil {
+		return err
+	}
+
+	session.action = d.Action
+	session.requestor = d.Requestor
+	session.requestorToken = d.RequestorToken
+	session.clientToken = d.ClientToken
+	session.frontendAuth = d.FrontendAuth
+	session.version = d.Version
+	session.rrequest = rrequest
+	session.request = rrequest.SessionRequest()
+	session.legacyCompatible = d.LegacyCompatible
+	session.implicitDisclosure = d.ImplicitDisclosure
+	session.next = d.Next
+	session.options = d.Options
+	session.status = d.Status
+	session.prevStatus = d.PrevStatus
+	session.responseCache = d.ResponseCache
+	session.clientAuth = d.ClientAuth
+	session.created = d.Created
+	session.lastActive = d.LastActive
+	session.result = d.Result
+	session.result.LegacySession = d.LegacySession
+	session.kssProofs = d.KssProofs
+	return nil
 }
 
 var one *big.Int = big.NewInt(1)
 
-func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *session {
+func (s *Server) newSession(action irma.Action, request irma.RequestorRequest, requestor string) *session {
 	clientToken := irma.ClientToken(common.NewSessionToken())
 	requestorToken := irma.RequestorToken(common.NewSessionToken())
 	frontendAuth := irma.FrontendAuthorization(common.NewSessionToken())
@@ -182,13 +338,15 @@ func (s *Server) newSession(action irma.Action, request irma.RequestorRequest) *
 	}
 
 	ses := &session{
-		action:   action,
-		rrequest: request,
-		request:  request.SessionRequest(),
+		action:    action,
+		requestor: requestor,
+		rrequest:  request,
+		request:   request.SessionRequest(),
 		options: irma.SessionOptions{
 			LDContext:     irma.LDContextSessionOptions,
 			PairingMethod: irma.PairingMethodNone,
 		},
+		created:        time.Now(),
 		lastActive:     time.Now(),
 		requestorToken: requestorToken,
 		clientToken:    clientToken,
@@ -1,12 +1,23 @@
 package irmaserver
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
-	"testing"
-	"time"
+	"go.etcd.io/bbolt"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 func TestMemoryStoreNoDeadlock(t *testing.T) {
@@ -18,7 +29,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	req, err := server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
 	require.NoError(t, err)
-	session := s.newSession(irma.ActionDisclosing, req)
+	session := s.newSession(irma.ActionDisclosing, req, "")
 
 	session.Lock()
 	deletingCompleted := false
@@ -40,7 +51,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	// Make a new session; this involves adding it to the memory session store.
 	go func() {
-		_ = s.newSession(irma.ActionDisclosing, req)
+		_ = s.newSession(irma.ActionDisclosing, req, "")
 		addingCompleted = true
 	}()
 
@@ -49,3 +60,216 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 	require.True(t, addingCompleted)
 	require.False(t, deletingCompleted)
 }
+
+func TestSessionLifetime(t *testing.T) {
+	req, err := server.ParseSessionRequest(`{"timeout":30,"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
+	require.NoError(t, err)
+	session := &session{
+		rrequest:   req,
+		status:     irma.ServerStatusInitialized,
+		lastActive: time.Now(),
+		conf:       &server.Configuration{SessionLifetime: 300},
+	}
+
+	// Before the client connects, the client timeout applies
+	require.Equal(t, 30*time.Second, session.timeout())
+
+	// Afterwards, the server-wide session lifetime applies unless the request specifies its own
+	session.status = irma.ServerStatusConnected
+	require.Equal(t, 300*time.Second, session.timeout())
+	req.Base().SessionLifetime = 60
+	require.Equal(t, 60*time.Second, session.timeout())
+	require.Equal(t, session.lastActive.Add(60*time.Second), session.expiry())
+}
+
+// conflictingSessionStore fails all updates, as if the sessions were modified elsewhere
+type conflictingSessionStore struct {
+	*memorySessionStore
+}
+
+func (conflictingSessionStore) update(*session) error {
+	return errSessionConflict
+}
+
+func TestSessionConflict(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.FatalLevel
+	conf := &server.Configuration{Logger: logger}
+	store := conflictingSessionStore{&memorySessionStore{
+		conf:      conf,
+		requestor: map[irma.RequestorToken]*session{},
+		client:    map[irma.ClientToken]*session{},
+	}}
+	s := &Server{conf: conf, sessions: store, handlers: map[irma.RequestorToken]server.SessionHandler{}}
+	store.add(&session{
+		requestorToken: "requestortoken",
+		clientToken:    "clienttoken",
+		status:         irma.ServerStatusInitialized,
+		result:         &server.SessionResult{},
+		conf:           conf,
+		sessions:       store,
+	})
+
+	router := chi.NewRouter()
+	router.With(s.sessionMiddleware).Get("/session/{clientToken}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("response"))
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/clienttoken", nil))
+
+	// The response of the handler must not be sent, since the session could not be stored
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.NotContains(t, w.Body.String(), "response")
+	require.Contains(t, w.Body.String(), string(server.ErrorSessionConflict.Type))
+}
+
+func TestSessionStatusChangeHandledOnce(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.FatalLevel
+	conf := &server.Configuration{Logger: logger}
+	store := &memorySessionStore{
+		conf:      conf,
+		requestor: map[irma.RequestorToken]*session{},
+		client:    map[irma.ClientToken]*session{},
+	}
+	called := make(chan struct{}, 10)
+	s := &Server{conf: conf, sessions: store, handlers: map[irma.RequestorToken]server.SessionHandler{
+		"requestortoken": func(*server.SessionResult) {
+			called <- struct{}{}
+		},
+	}}
+	store.add(&session{
+		requestorToken: "requestortoken",
+		clientToken:    "clienttoken",
+		prevStatus:     irma.ServerStatusConnected,
+		status:         irma.ServerStatusDone,
+		result:         &server.SessionResult{Token: "requestortoken", Status: irma.ServerStatusDone},
+		rrequest:       &irma.ServiceProviderRequest{},
+		conf:           conf,
+		sessions:       store,
+	})
+
+	router := chi.NewRouter()
+	router.With(s.sessionMiddleware).Get("/session/{clientToken}/status", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	var requests sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/session/clienttoken/status", nil))
+		}()
+	}
+	requests.Wait()
+	<-called
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, called, 0)
+}
+
+func TestSqlStoreStatusRequests(t *testing.T) {
+	logger := logrus.New()
+	logger.Level = logrus.FatalLevel
+	conf := &server.Configuration{Logger: logger, StoreType: "sqlite3", StoreDBConnStr: "file::memory:?cache=shared"}
+	store, err := newSqlSessionStore(conf, nil)
+	require.NoError(t, err)
+	defer store.db.Close()
+	s := &Server{conf: conf, sessions: store, handlers: map[irma.RequestorToken]server.SessionHandler{}}
+	store.add(&session{
+		requestorToken: "requestortoken",
+		clientToken:    "clienttoken",
+		prevStatus:     irma.ServerStatusConnected,
+		status:         irma.ServerStatusCancelled,
+		result:         &server.SessionResult{Token: "requestortoken", Status: irma.ServerStatusCancelled},
+		rrequest:       &irma.ServiceProviderRequest{Request: irma.NewDisclosureRequest()},
+		action:         irma.ActionDisclosing,
+		conf:           conf,
+		sessions:       store,
+	})
+	revision := func() int64 {
+		var record sessionRecord
+		require.NoError(t, store.db.Where("requestor_token = ?", "requestortoken").First(&record).Error)
+		return record.Revision
+	}
+
+	router := chi.NewRouter()
+	router.With(s.sessionMiddleware).Get("/session/{clientToken}/status", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	router.With(s.sessionMiddleware).Delete("/session/{clientToken}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// Status requests never write to the database, not even to record the status change
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/session/clienttoken/status", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	require.Equal(t, int64(0), revision())
+
+	// Other requests record the status change once
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/session/clienttoken", nil))
+		require.Equal(t, http.StatusNoContent, w.Code)
+	}
+	require.Equal(t, int64(1), revision())
+}
+
+func TestBoltStoreCompact(t *testing.T) {
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, storage)
+	logger := logrus.New()
+	logger.Level = logrus.FatalLevel
+	path := filepath.Join(storage, "sessions.db")
+	s, err := newBoltSessionStore(&server.Configuration{Logger: logger, StoreBoltPath: path}, nil)
+	require.NoError(t, err)
+	defer s.stop()
+
+	// Fill the file and then free most of it
+	put := func(keys ...string) error {
+		return s.db.Update(func(tx *bbolt.Tx) error {
+			for _, k := range keys {
+				if err := tx.Bucket(boltSessionsBucket).Put([]byte(k), make([]byte, 1<<20)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	require.NoError(t, put("a", "b", "c", "d"))
+	require.NoError(t, s.db.Update(func(tx *bbolt.Tx) error {
+		for _, k := range []string{"b", "c", "d"} {
+			if err := tx.Bucket(boltSessionsBucket).Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	size := info.Size()
+
+	// If the compacted file cannot be created, the current file remains in use
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".compact", "dir"), 0700))
+	require.Error(t, s.compact())
+	require.NoError(t, put("e"))
+	require.NoError(t, os.RemoveAll(path+".compact"))
+
+	require.NoError(t, s.compact())
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), size)
+	require.NoError(t, put("f"))
+	require.NoError(t, s.db.View(func(tx *bbolt.Tx) error {
+		var keys []string
+		err := tx.Bucket(boltSessionsBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		require.Equal(t, []string{"a", "e", "f"}, keys)
+		return err
+	}))
+}
@@ -0,0 +1,376 @@
+package irmaserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/alexandrevicenzi/go-sse"
+	"github.com/go-errors/errors"
+	"github.com/jinzhu/gorm"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+)
+
+var errSessionConflict = errors.New("session was modified or deleted by another server instance")
+
+type (
+	// sqlSessionStore keeps sessions in a SQL database, so that multiple server instances
+	// (e.g. behind a load balancer) can share them. Each instance keeps the sessions it has
+	// seen in a local cache, which is kept in sync with the database using a revision number
+	// that is increased at each update.
+	sqlSessionStore struct {
+		sync.Mutex
+		db   *gorm.DB
+		conf *server.Configuration
+		sse  *sse.Server
+
+		requestor map[irma.RequestorToken]*sqlSession
+		client    map[irma.ClientToken]irma.RequestorToken
+	}
+
+	// sqlSession is a session in the local cache of a sqlSessionStore, along with the revision
+	// and the data of the database record that it reflects.
+	// The revision and data are protected by the lock of the session.
+	sqlSession struct {
+		*session
+		revision int64
+		data     []byte
+	}
+
+	// sessionRecord is the database representation of a session.
+	sessionRecord struct {
+		RequestorToken string `gorm:"primary_key"`
+		ClientToken    string `gorm:"unique_index"`
+		Revision       int64
+		Expires        int64 `gorm:"index"`
+		Data           []byte
+	}
+)
+
+func (sessionRecord) TableName() string {
+	return "irma_sessions"
+}
+
+func newSqlSessionStore(conf *server.Configuration, e *sse.Server) (*sqlSessionStore, error) {
+	g, err := gorm.Open(conf.StoreType, conf.StoreDBConnStr)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Verbose >= 2 {
+		g.LogMode(true)
+		g.SetLogger(gorm.Logger{LogWriter: log.New(conf.Logger.WriterLevel(logrus.TraceLevel), "db: ", 0)})
+	}
+	if g.AutoMigrate(&sessionRecord{}); g.Error != nil {
+		return nil, g.Error
+	}
+
+	return &sqlSessionStore{
+		db:        g,
+		conf:      conf,
+		sse:       e,
+		requestor: make(map[irma.RequestorToken]*sqlSession),
+		client:    make(map[irma.ClientToken]irma.RequestorToken),
+	}, nil
+}
+
+func (s *sqlSessionStore) get(t irma.RequestorToken) *session {
+	return s.find("requestor_token = ?", string(t))
+}
+
+func (s *sqlSessionStore) clientGet(t irma.ClientToken) *session {
+	return s.find("client_token = ?", string(t))
+}
+
+func (s *sqlSessionStore) find(query string, token string) *session {
+	var record sessionRecord
+	err := s.db.Where(query, token).First(&record).Error
+	if gorm.IsRecordNotFoundError(err) {
+		s.forget(query, token)
+		return nil
+	}
+	if err != nil {
+		_ = server.LogError(err)
+		return nil
+	}
+	ses, err := s.load(&record)
+	if err != nil {
+		_ = server.LogError(err)
+		return nil
+	}
+	return ses
+}
+
+// load returns the cached session corresponding to the record, first creating or
+// refreshing it if the record is newer than the cached session.
+func (s *sqlSessionStore) load(record *sessionRecord) (*session, error) {
+	s.Lock()
+	cached := s.requestor[irma.RequestorToken(record.RequestorToken)]
+	if cached == nil {
+		cached = &sqlSession{
+			session: &session{
+				conf:     s.conf,
+				sessions: s,
+				sse:      s.sse,
+			},
+			revision: -1,
+		}
+		s.requestor[irma.RequestorToken(record.RequestorToken)] = cached
+		s.client[irma.ClientToken(record.ClientToken)] = irma.RequestorToken(record.RequestorToken)
+	}
+	s.Unlock()
+
+	cached.Lock()
+	defer cached.Unlock()
+	if record.Revision <= cached.revision {
+		return cached.session, nil
+	}
+	var d sessionData
+	if err := json.Unmarshal(record.Data, &d); err != nil {
+		return nil, err
+	}
+	if err := cached.restore(&d); err != nil {
+		return nil, err
+	}
+	// Marshal the restored session, so that update can compare it byte for byte
+	bts, err := s.marshal(cached.session)
+	if err != nil {
+		return nil, err
+	}
+	cached.revision = record.Revision
+	cached.data = bts
+	return cached.session, nil
+}
+
+// forget removes the specified session from the local cache.
+func (s *sqlSessionStore) forget(query string, token string) {
+	s.Lock()
+	defer s.Unlock()
+	t := irma.RequestorToken(token)
+	if query == "client_token = ?" {
+		t = s.client[irma.ClientToken(token)]
+	}
+	if cached := s.requestor[t]; cached != nil {
+		s.remove(cached.session)
+	}
+}
+
+// remove removes the session from the local cache. The caller must hold the lock of the store.
+func (s *sqlSessionStore) remove(session *session) {
+	if session.sse != nil {
+		session.sse.CloseChannel("session/" + string(session.requestorToken))
+		session.sse.CloseChannel("session/" + string(session.clientToken))
+		session.sse.CloseChannel("frontendsession/" + string(session.clientToken))
+	}
+	delete(s.client, session.clientToken)
+	delete(s.requestor, session.requestorToken)
+}
+
+func (s *sqlSessionStore) add(session *session) {
+	bts, err := s.marshal(session)
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+	err = s.db.Create(&sessionRecord{
+		RequestorToken: string(session.requestorToken),
+		ClientToken:    string(session.clientToken),
+		Revision:       0,
+		Expires:        session.expiry().Unix(),
+		Data:           bts,
+	}).Error
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.requestor[session.requestorToken] = &sqlSession{session: session, revision: 0, data: bts}
+	s.client[session.clientToken] = session.requestorToken
+}
+
+func (s *sqlSessionStore) update(session *session) error {
+	s.Lock()
+	cached := s.requestor[session.requestorToken]
+	s.Unlock()
+	if cached == nil {
+		return errors.Errorf("can't update unknown session %s", session.requestorToken)
+	}
+
+	bts, err := s.marshal(session)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(bts, cached.data) {
+		// Nothing changed, e.g. in status requests; writing would needlessly conflict with
+		// requests to other server instances
+		return nil
+	}
+	// Only overwrite the record if nobody else did so since we last read it
+	res := s.db.Model(&sessionRecord{}).
+		Where("requestor_token = ? AND revision = ?", string(session.requestorToken), cached.revision).
+		Updates(map[string]interface{}{
+			"revision": cached.revision + 1,
+			"expires":  session.expiry().Unix(),
+			"data":     bts,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		// The cached revision is left as is, so that the session is reloaded from the
+		// database the next time it is retrieved
+		s.conf.Logger.WithFields(logrus.Fields{"session": session.requestorToken}).
+			Warn("Session was modified or deleted by another server instance")
+		return errSessionConflict
+	}
+	cached.revision++
+	cached.data = bts
+	return nil
+}
+
+func (s *sqlSessionStore) list() []*server.SessionInfo {
+	var records []sessionRecord
+	if err := s.db.Find(&records).Error; err != nil {
+		_ = server.LogError(err)
+		return nil
+	}
+
+	infos := make([]*server.SessionInfo, 0, len(records))
+	for _, record := range records {
+		var d sessionData
+		if err := json.Unmarshal(record.Data, &d); err != nil {
+			_ = server.LogError(err)
+			continue
+		}
+		ses := &session{conf: s.conf}
+		if err := ses.restore(&d); err != nil {
+			_ = server.LogError(err)
+			continue
+		}
+		if !ses.status.Finished() {
+			infos = append(infos, ses.info())
+		}
+	}
+	return infos
+}
+
+func (s *sqlSessionStore) marshal(session *session) ([]byte, error) {
+	d, err := session.data()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(d)
+}
+
+func (s *sqlSessionStore) stop() {
+	s.Lock()
+	for _, cached := range s.requestor {
+		s.remove(cached.session)
+	}
+	s.Unlock()
+	if err := s.db.Close(); err != nil {
+		server.LogWarning(err)
+	}
+}
+
+func (s *sqlSessionStore) deleteExpired() {
+	now := time.Now()
+	var records []sessionRecord
+	if err := s.db.Where("expires < ?", now.Unix()).Find(&records).Error; err != nil {
+		_ = server.LogError(err)
+		return
+	}
+
+	for i := range records {
+		ses, err := s.load(&records[i])
+		if err != nil {
+			_ = server.LogError(err)
+			continue
+		}
+		ses.Lock()
+		if ses.expiry().Before(now) {
+			if !ses.status.Finished() {
+				s.conf.Logger.WithFields(logrus.Fields{"session": ses.requestorToken}).Infof("Session expired")
+				ses.markAlive()
+				ses.setStatus(irma.ServerStatusTimeout)
+			} else {
+				s.conf.Logger.WithFields(logrus.Fields{"session": ses.requestorToken}).Infof("Deleting session")
+				s.delete(ses)
+			}
+		}
+		ses.Unlock()
+	}
+
+	s.pruneCache(now)
+}
+
+// delete removes the session from the database and from the local cache.
+// The caller must hold the lock of the session.
+func (s *sqlSessionStore) delete(session *session) {
+	s.Lock()
+	defer s.Unlock()
+	cached := s.requestor[session.requestorToken]
+	if cached == nil {
+		return
+	}
+	err := s.db.
+		Where("requestor_token = ? AND revision = ?", string(session.requestorToken), cached.revision).
+		Delete(&sessionRecord{}).Error
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+	s.remove(session)
+}
+
+// pruneCache removes expired sessions from the local cache that have been deleted from
+// the database by another server instance.
+func (s *sqlSessionStore) pruneCache(now time.Time) {
+	s.Lock()
+	toCheck := make(map[irma.RequestorToken]*sqlSession, len(s.requestor))
+	for token, cached := range s.requestor {
+		toCheck[token] = cached
+	}
+	s.Unlock()
+
+	candidates := make([]string, 0, len(toCheck))
+	for token, cached := range toCheck {
+		cached.Lock()
+		if cached.expiry().Before(now) {
+			candidates = append(candidates, string(token))
+		}
+		cached.Unlock()
+	}
+	if len(candidates) == 0 {
+		return
+	}
+
+	var existing []string
+	err := s.db.Model(&sessionRecord{}).
+		Where("requestor_token IN (?)", candidates).
+		Pluck("requestor_token", &existing).Error
+	if err != nil {
+		_ = server.LogError(err)
+		return
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, token := range existing {
+		exists[token] = true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, token := range candidates {
+		if cached := s.requestor[irma.RequestorToken(token)]; cached != nil && !exists[token] {
+			s.remove(cached.session)
+		}
+	}
+}
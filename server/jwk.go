@@ -0,0 +1,284 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+)
+
+// JWK is a JSON Web Key (RFC 7517) containing an RSA, ECDSA or Ed25519 public key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+
+	// RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ECDSA and Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+	Y     string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set (RFC 7517).
+type JWKS struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// SigningMethodEdDSA signs JWTs using Ed25519 keys (RFC 8037), which jwt-go does not support itself.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+type signingMethodEdDSA struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+func (*signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+func (*signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	sk, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(sk, []byte(signingString))), nil
+}
+
+func (*signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pk, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pk, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// JwtSigningMethod returns the JWT signing method for the key: RS256 for RSA keys, ES256 or ES384
+// for ECDSA keys on the P-256 or P-384 curves, and EdDSA for Ed25519 keys.
+func JwtSigningMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		}
+		return nil, errors.Errorf("unsupported elliptic curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return SigningMethodEdDSA, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %T", key)
+	}
+}
+
+// SignJwt signs the claims with the private key, using the signing method returned by
+// JwtSigningMethod(), and including the key identifier of the key (see NewJWK()) in the
+// kid header.
+func SignJwt(claims jwt.Claims, privatekey crypto.Signer) (string, error) {
+	jwk, err := NewJWK(privatekey.Public())
+	if err != nil {
+		return "", err
+	}
+	method, err := JwtSigningMethod(privatekey.Public())
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = jwk.ID
+	return token.SignedString(privatekey)
+}
+
+// NewJWK returns a JWK for the specified public key. Its key identifier is the JWK thumbprint
+// of the key (RFC 7638), so that it identifies the key without needing to be configured.
+func NewJWK(key crypto.PublicKey) (*JWK, error) {
+	method, err := JwtSigningMethod(key)
+	if err != nil {
+		return nil, err
+	}
+	jwk := &JWK{Use: "sig", Algorithm: method.Alg()}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = k.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	}
+	if jwk.ID, err = jwk.Thumbprint(); err != nil {
+		return nil, err
+	}
+	return jwk, nil
+}
+
+// Thumbprint computes the JWK thumbprint of the key (RFC 7638), using SHA-256.
+func (jwk *JWK) Thumbprint() (string, error) {
+	// The required members of each key type, in lexicographic order
+	var members []string
+	switch jwk.KeyType {
+	case "RSA":
+		members = []string{"e", jwk.E, "kty", jwk.KeyType, "n", jwk.N}
+	case "EC":
+		members = []string{"crv", jwk.Curve, "kty", jwk.KeyType, "x", jwk.X, "y", jwk.Y}
+	case "OKP":
+		members = []string{"crv", jwk.Curve, "kty", jwk.KeyType, "x", jwk.X}
+	default:
+		return "", errors.Errorf("unsupported key type %s", jwk.KeyType)
+	}
+
+	buf := []byte("{")
+	for i := 0; i < len(members); i += 2 {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		name, _ := json.Marshal(members[i])
+		value, _ := json.Marshal(members[i+1])
+		buf = append(append(append(buf, name...), ':'), value...)
+	}
+	buf = append(buf, '}')
+	hash := sha256.Sum256(buf)
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
+
+// PublicKey returns the public key contained in the JWK.
+func (jwk *JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid RSA modulus", 0)
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid RSA exponent", 0)
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.Errorf("unsupported elliptic curve %s", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid EC x coordinate", 0)
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid EC y coordinate", 0)
+		}
+		pk := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pk.X, pk.Y) {
+			return nil, errors.New("EC point not on curve")
+		}
+		return pk, nil
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, errors.Errorf("unsupported curve %s", jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.Errorf("unsupported key type %s", jwk.KeyType)
+	}
+}
+
+// ParseJwtPrivateKey parses a PEM-encoded RSA, ECDSA (P-256 or P-384) or Ed25519 private key
+// with which JWTs can be signed.
+func ParseJwtPrivateKey(bts []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("private key is not PEM-encoded")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse private key", 0)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type %T", key)
+	}
+	if _, err = JwtSigningMethod(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// ParseJwtPublicKey parses a PEM-encoded RSA, ECDSA (P-256 or P-384) or Ed25519 public key.
+func ParseJwtPublicKey(bts []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(bts)
+	if block == nil {
+		return nil, errors.New("public key is not PEM-encoded")
+	}
+
+	var key crypto.PublicKey
+	var err error
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse public key", 0)
+	}
+	if _, err = JwtSigningMethod(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -3,7 +3,10 @@ package keyshare
 import (
 	"bytes"
 	"html/template"
+	"net"
 	"net/smtp"
+	"sync"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/server"
@@ -88,26 +91,68 @@ func (conf EmailConfiguration) SendEmail(
 	return nil
 }
 
+const (
+	// emailServerTimeout bounds the time that VerifyEmailServer may take.
+	emailServerTimeout = 10 * time.Second
+	// emailServerCheckInterval is the minimum time between the connections to the email server
+	// made by the health check returned by EmailServerHealthCheck.
+	emailServerCheckInterval = time.Minute
+)
+
+// VerifyEmailServer connects and, if configured, authenticates to the email server.
 func (conf EmailConfiguration) VerifyEmailServer() error {
 	if conf.EmailServer == "" {
 		return nil
 	}
 
-	client, err := smtp.Dial(conf.EmailServer)
+	host, _, err := net.SplitHostPort(conf.EmailServer)
+	if err != nil {
+		return errors.Errorf("invalid email server address: %v", err)
+	}
+	conn, err := net.DialTimeout("tcp", conf.EmailServer, emailServerTimeout)
+	if err != nil {
+		return errors.Errorf("failed to connect to email server: %v", err)
+	}
+	if err = conn.SetDeadline(time.Now().Add(emailServerTimeout)); err != nil {
+		_ = conn.Close()
+		return errors.Errorf("failed to connect to email server: %v", err)
+	}
+	client, err := smtp.NewClient(conn, host)
 	if err != nil {
+		_ = conn.Close()
 		return errors.Errorf("failed to connect to email server: %v", err)
 	}
+	defer client.Close()
 	if conf.EmailAuth != nil {
 		if err = client.Auth(conf.EmailAuth); err != nil {
 			return errors.Errorf("failed to authenticate to email server: %v", err)
 		}
 	}
-	if err = client.Close(); err != nil {
+	if err = client.Quit(); err != nil {
 		return errors.Errorf("failed to close connection to email server: %v", err)
 	}
 	return nil
 }
 
+// EmailServerHealthCheck returns a health check of the email server, which verifies it using
+// VerifyEmailServer at most once per emailServerCheckInterval, returning the previous result in between.
+func (conf EmailConfiguration) EmailServerHealthCheck() server.HealthCheck {
+	var (
+		lock    sync.Mutex
+		checked time.Time
+		err     error
+	)
+	return func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		if time.Since(checked) >= emailServerCheckInterval {
+			err = conf.VerifyEmailServer()
+			checked = time.Now()
+		}
+		return err
+	}
+}
+
 func sendHTMLEmail(addr string, a smtp.Auth, from, to, subject string, msg []byte) error {
 	headers := []byte("To: " + to + "\r\n" +
 		"From: " + from + "\r\n" +
@@ -1,8 +1,12 @@
 package keyshare
 
 import (
+	"bufio"
 	"bytes"
+	"net"
+	"net/smtp"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/privacybydesign/irmago/internal/test"
@@ -46,3 +50,67 @@ func TestParseEmailTemplates(t *testing.T) {
 	require.NoError(t, templ[lang].Execute(&msg, map[string]string{"VerificationURL": "123"}))
 	require.Equal(t, "This is a test template 123", msg.String())
 }
+
+// smtpServer is a minimal SMTP server that refuses all authentication attempts, sending on
+// the closed channel when a client closes its connection.
+func smtpServer(t *testing.T) (net.Listener, <-chan struct{}) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	closed := make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte("220 localhost ESMTP\r\n"))
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						closed <- struct{}{}
+						return
+					}
+					switch strings.Fields(line)[0] {
+					case "EHLO":
+						_, _ = conn.Write([]byte("250-localhost\r\n250 AUTH PLAIN\r\n"))
+					case "AUTH":
+						_, _ = conn.Write([]byte("535 authentication failed\r\n"))
+					case "QUIT":
+						_, _ = conn.Write([]byte("221 bye\r\n"))
+					default:
+						_, _ = conn.Write([]byte("502 not implemented\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return l, closed
+}
+
+func TestEmailServerHealthCheck(t *testing.T) {
+	l, closed := smtpServer(t)
+	defer l.Close()
+
+	conf := EmailConfiguration{EmailServer: l.Addr().String()}
+	require.NoError(t, conf.VerifyEmailServer())
+	<-closed
+
+	// After failed authentication the connection is closed as well
+	conf.EmailAuth = smtp.PlainAuth("", "user", "password", "localhost")
+	require.Error(t, conf.VerifyEmailServer())
+	<-closed
+
+	// The health check reuses its result instead of connecting again
+	check := conf.EmailServerHealthCheck()
+	require.Error(t, check())
+	<-closed
+	require.Error(t, check())
+	select {
+	case <-closed:
+		require.Fail(t, "health check connected to email server again")
+	default:
+	}
+}
@@ -50,6 +50,9 @@ type DB interface {
 
 	// Store email verification tokens on registration
 	addEmailVerification(user *User, emailAddress, token string) error
+
+	// ping checks whether the database is reachable.
+	ping() error
 }
 
 // User represents a user of this server.
@@ -85,3 +85,7 @@ func (db *memoryDB) addEmailVerification(user *User, emailAddress, token string)
 	// We don't need to do anything here, as this information cannot be extracted locally
 	return nil
 }
+
+func (db *memoryDB) ping() error {
+	return nil
+}
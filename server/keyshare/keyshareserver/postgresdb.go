@@ -209,3 +209,7 @@ func (db *postgresDB) addEmailVerification(user *User, emailAddress, token strin
 		time.Now().Add(emailTokenValidity*time.Hour).Unix())
 	return err
 }
+
+func (db *postgresDB) ping() error {
+	return db.db.Ping()
+}
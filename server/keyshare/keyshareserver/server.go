@@ -38,6 +38,9 @@ type Server struct {
 
 	// Session data, keeping track of current keyshare protocol session state for each user
 	store sessionStore
+
+	// Health check of the email server, caching its result between readiness probes
+	emailCheck server.HealthCheck
 }
 
 var errMissingCommitment = errors.New("missing previous call to getCommitments")
@@ -49,6 +52,7 @@ func New(conf *Configuration) (*Server, error) {
 		store:     newMemorySessionStore(10 * time.Second),
 		scheduler: gocron.NewScheduler(),
 	}
+	s.emailCheck = conf.EmailServerHealthCheck()
 
 	// Setup IRMA session server
 	s.irmaserv, err = irmaserver.New(conf.Configuration)
@@ -97,6 +101,18 @@ func (s *Server) Stop() {
 	s.irmaserv.Stop()
 }
 
+// healthChecks returns the checks of the components of the keyshare server: those of the IRMA server,
+// the database and, if configured, the email server.
+func (s *Server) healthChecks() map[string]server.HealthCheck {
+	checks := s.conf.Configuration.HealthChecks()
+	checks["db"] = s.db.ping
+	checks["sessions"] = s.irmaserv.CheckStopping
+	if s.conf.EmailServer != "" {
+		checks["email"] = s.emailCheck
+	}
+	return checks
+}
+
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
 
@@ -107,6 +123,8 @@ func (s *Server) Handler() http.Handler {
 		if s.conf.Verbose >= 2 {
 			opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 			router.Use(server.LogMiddleware("keyshareserver", opts))
+		} else {
+			router.Use(server.TracingMiddleware("keyshareserver"))
 		}
 
 		// Registration
@@ -125,6 +143,10 @@ func (s *Server) Handler() http.Handler {
 		})
 	})
 
+	// Health checks
+	router.Get("/health", server.HandleHealth)
+	router.Get("/ready", server.ReadinessHandler(s.healthChecks))
+
 	// IRMA server for issuing myirma credential during registration
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
 	return router
@@ -169,7 +191,9 @@ func (s *Server) handleCommitments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, span := irma.StartSpan(r.Context(), "keyshareserver.Commitments")
 	commitments, err := s.generateCommitments(user, authorization, keys)
+	irma.EndSpan(span, err)
 	if err != nil && (err == keysharecore.ErrInvalidChallenge || err == keysharecore.ErrInvalidJWT) {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -232,7 +256,9 @@ func (s *Server) handleResponse(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// And do the actual responding
+	_, span := irma.StartSpan(r.Context(), "keyshareserver.Response")
 	proofResponse, err := s.generateResponse(user, authorization, challenge)
+	irma.EndSpan(span, err)
 	if err != nil &&
 		(err == keysharecore.ErrInvalidChallenge ||
 			err == keysharecore.ErrInvalidJWT ||
@@ -298,7 +324,9 @@ func (s *Server) handleVerifyPin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// and verify pin
+	_, span := irma.StartSpan(r.Context(), "keyshareserver.VerifyPin")
 	result, err := s.verifyPin(user, msg.Pin)
+	irma.EndSpan(span, err)
 	if err != nil {
 		// already logged
 		server.WriteError(w, server.ErrorInternal, err.Error())
@@ -382,7 +410,9 @@ func (s *Server) handleChangePin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, span := irma.StartSpan(r.Context(), "keyshareserver.ChangePin")
 	result, err := s.updatePin(user, msg.OldPin, msg.NewPin)
+	irma.EndSpan(span, err)
 	if err != nil {
 		// already logged
 		server.WriteError(w, server.ErrorInternal, err.Error())
@@ -440,7 +470,9 @@ func (s *Server) handleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, span := irma.StartSpan(r.Context(), "keyshareserver.Register")
 	sessionptr, err := s.register(msg)
+	irma.EndSpan(span, err)
 	if err != nil && err == keysharecore.ErrPinTooLong {
 		// Too long pin is not an internal error
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
@@ -3,11 +3,13 @@ package keyshareserver
 import (
 	"context"
 	"encoding/base64"
+	"net"
 	"net/http"
 	"path/filepath"
 	"testing"
 
 	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/internal/test"
@@ -74,6 +76,31 @@ func TestServerHandleRegister(t *testing.T) {
 	)
 }
 
+func TestServerHealth(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var health server.Health
+	test.HTTPGet(t, nil, "http://localhost:8080/irma_keyshare_server/api/v1/health", nil, 200, &health)
+	assert.Equal(t, server.HealthStatusOK, health.Status)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/irma_keyshare_server/api/v1/ready", nil, 200, &health)
+	assert.Equal(t, server.HealthStatusOK, health.Status)
+	for _, component := range []string{"schemes", "private_keys", "db"} {
+		require.Contains(t, health.Components, component)
+		assert.Equal(t, server.HealthStatusOK, health.Components[component].Status)
+	}
+	assert.NotContains(t, health.Components, "email")
+
+	// Unreachable database
+	keyshareServer.db = &unreachableDB{keyshareServer.db}
+	health = server.Health{}
+	test.HTTPGet(t, nil, "http://localhost:8080/irma_keyshare_server/api/v1/ready", nil, 503, &health)
+	assert.Equal(t, server.HealthStatusError, health.Status)
+	assert.Equal(t, server.HealthStatusError, health.Components["db"].Status)
+	assert.Equal(t, server.HealthStatusOK, health.Components["schemes"].Status)
+}
+
 func TestPinTries(t *testing.T) {
 	db := createDB(t)
 	keyshareServer, httpServer := StartKeyshareServer(t, &testDB{db: db, ok: true, tries: 1, wait: 0, err: nil}, "")
@@ -262,8 +289,11 @@ func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *htt
 		Handler: r,
 	}
 
+	// listen before returning, so that the server is reachable as soon as the test starts
+	listener, err := net.Listen("tcp", serv.Addr)
+	require.NoError(t, err)
 	go func() {
-		err := serv.ListenAndServe()
+		err := serv.Serve(listener)
 		if err == http.ErrServerClosed {
 			err = nil
 		}
@@ -277,6 +307,8 @@ func StopKeyshareServer(t *testing.T, keyshareServer *Server, httpServer *http.S
 	keyshareServer.Stop()
 	err := httpServer.Shutdown(context.Background())
 	assert.NoError(t, err)
+	// prevent the next test from reusing connections to this server
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
 }
 
 type testDB struct {
@@ -319,6 +351,18 @@ func (db *testDB) addEmailVerification(user *User, email, token string) error {
 	return db.db.addEmailVerification(user, email, token)
 }
 
+func (db *testDB) ping() error {
+	return db.db.ping()
+}
+
+type unreachableDB struct {
+	DB
+}
+
+func (db *unreachableDB) ping() error {
+	return errors.New("connection refused")
+}
+
 func createDB(t *testing.T) DB {
 	db := NewMemoryDB()
 	err := db.AddUser(&User{
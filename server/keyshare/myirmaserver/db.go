@@ -23,6 +23,8 @@ type db interface {
 	scheduleEmailRemoval(id int64, email string, delay time.Duration) error
 
 	setSeen(id int64) error
+
+	ping() error
 }
 
 type userEmail struct {
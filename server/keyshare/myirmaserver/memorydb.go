@@ -225,3 +225,7 @@ func (db *memoryDB) setSeen(id int64) error {
 	}
 	return keyshare.ErrUserNotFound
 }
+
+func (db *memoryDB) ping() error {
+	return nil
+}
@@ -237,3 +237,7 @@ func (db *postgresDB) setSeen(id int64) error {
 		time.Now().Unix(), id,
 	)
 }
+
+func (db *postgresDB) ping() error {
+	return db.db.Ping()
+}
@@ -28,6 +28,7 @@ type Server struct {
 	db            db
 	scheduler     *gocron.Scheduler
 	schedulerStop chan<- bool
+	emailCheck    server.HealthCheck // caches its result between readiness probes
 }
 
 var (
@@ -45,11 +46,12 @@ func New(conf *Configuration) (*Server, error) {
 	}
 
 	s := &Server{
-		conf:      conf,
-		irmaserv:  irmaserv,
-		store:     newMemorySessionStore(time.Duration(conf.SessionLifetime) * time.Second),
-		db:        conf.DB,
-		scheduler: gocron.NewScheduler(),
+		conf:       conf,
+		irmaserv:   irmaserv,
+		store:      newMemorySessionStore(time.Duration(conf.SessionLifetime) * time.Second),
+		db:         conf.DB,
+		scheduler:  gocron.NewScheduler(),
+		emailCheck: conf.EmailServerHealthCheck(),
 	}
 
 	s.scheduler.Every(10).Seconds().Do(s.store.flush)
@@ -70,6 +72,18 @@ func (s *Server) Stop() {
 	s.schedulerStop <- true
 }
 
+// healthChecks returns the checks of the components of the MyIRMA server: those of the IRMA server,
+// the database and, if configured, the email server.
+func (s *Server) healthChecks() map[string]server.HealthCheck {
+	checks := s.conf.Configuration.HealthChecks()
+	checks["db"] = s.db.ping
+	checks["sessions"] = s.irmaserv.CheckStopping
+	if s.conf.EmailServer != "" {
+		checks["email"] = s.emailCheck
+	}
+	return checks
+}
+
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
 
@@ -87,6 +101,8 @@ func (s *Server) Handler() http.Handler {
 		if s.conf.Verbose >= 2 {
 			opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: false}
 			router.Use(server.LogMiddleware("keyshare-myirma", opts))
+		} else {
+			router.Use(server.TracingMiddleware("keyshare-myirma"))
 		}
 
 		// Login/logout
@@ -116,6 +132,10 @@ func (s *Server) Handler() http.Handler {
 		})
 	})
 
+	// Health checks
+	router.Get("/health", server.HandleHealth)
+	router.Get("/ready", server.ReadinessHandler(s.healthChecks))
+
 	// IRMA session server
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
 
@@ -2,6 +2,7 @@ package myirmaserver
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"path/filepath"
 	"testing"
@@ -252,15 +253,16 @@ func StartMyIrmaServer(t *testing.T, db db, emailserver string) (*Server, *http.
 	r := chi.NewRouter()
 	r.Mount("/", s.Handler())
 
-	s.Stop()
-
 	serv := &http.Server{
 		Addr:    "localhost:8080",
 		Handler: r,
 	}
 
+	// listen before returning, so that the server is reachable as soon as the test starts
+	listener, err := net.Listen("tcp", serv.Addr)
+	require.NoError(t, err)
 	go func() {
-		err := serv.ListenAndServe()
+		err := serv.Serve(listener)
 		if err == http.ErrServerClosed {
 			err = nil
 		}
@@ -274,4 +276,6 @@ func StopMyIrmaServer(t *testing.T, myirmaServer *Server, httpServer *http.Serve
 	myirmaServer.Stop()
 	err := httpServer.Shutdown(context.Background())
 	assert.NoError(t, err)
+	// prevent the next test from reusing connections to this server
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
 }
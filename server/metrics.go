@@ -0,0 +1,110 @@
+package server
+
+import (
+	"reflect"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the IRMA server. They are registered with the default Prometheus registry,
+// and exposed by the requestorserver if a metrics port is configured.
+var (
+	metricSessionsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "irma_server_sessions_started_total",
+		Help: "Number of sessions started",
+	}, []string{"action", "requestor"})
+
+	metricSessionsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "irma_server_sessions_finished_total",
+		Help: "Number of sessions finished, by outcome (completed, cancelled, timeout, failed)",
+	}, []string{"action", "requestor", "outcome"})
+
+	metricErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "irma_server_errors_total",
+		Help: "Number of errors returned, by error type",
+	}, []string{"type"})
+
+	metricProofVerification = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "irma_server_proof_verification_duration_seconds",
+		Help:    "Time taken to verify the proofs sent by IRMA apps",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"action"})
+
+	metricRevocationUpdateFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "irma_server_revocation_update_fetches_total",
+		Help: "Number of revocation updates fetched from revocation servers, by outcome (success, failure)",
+	}, []string{"credtype", "outcome"})
+
+	metricCallbackDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "irma_server_callback_deliveries_total",
+		Help: "Number of result callback delivery attempts, by outcome (success, retry, dead)",
+	}, []string{"outcome"})
+
+	metricSchemeUpdates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "irma_server_scheme_updates_total",
+		Help: "Number of scheme update attempts, by outcome (success, failure)",
+	}, []string{"scheme", "outcome"})
+)
+
+// SessionStarted records the start of a session in the metrics.
+func SessionStarted(action irma.Action, requestor string) {
+	metricSessionsStarted.WithLabelValues(string(action), requestor).Inc()
+}
+
+// SessionFinished records the outcome of a finished session in the metrics.
+func SessionFinished(action irma.Action, requestor string, status irma.ServerStatus, err *irma.RemoteError) {
+	var outcome string
+	switch {
+	case err != nil:
+		outcome = "failed"
+	case status == irma.ServerStatusDone:
+		outcome = "completed"
+	case status == irma.ServerStatusCancelled:
+		outcome = "cancelled"
+	case status == irma.ServerStatusTimeout:
+		outcome = "timeout"
+	default:
+		return
+	}
+	metricSessionsFinished.WithLabelValues(string(action), requestor, outcome).Inc()
+}
+
+// ProofsVerified records in the metrics how long it took to verify the proofs of a session.
+func ProofsVerified(action irma.Action, duration time.Duration) {
+	metricProofVerification.WithLabelValues(string(action)).Observe(duration.Seconds())
+}
+
+// CallbackDelivered records the outcome of a result callback delivery attempt in the metrics.
+func CallbackDelivered(outcome string) {
+	metricCallbackDeliveries.WithLabelValues(outcome).Inc()
+}
+
+func revocationUpdateFetched(id irma.CredentialTypeIdentifier, err error) {
+	metricRevocationUpdateFetches.WithLabelValues(id.String(), outcome(err)).Inc()
+}
+
+func schemeUpdated(id string, err error) {
+	metricSchemeUpdates.WithLabelValues(id, outcome(err)).Inc()
+}
+
+// addSchemeUpdateListener adds schemeUpdated to the scheme update listeners of the configuration,
+// unless it was already added by an earlier check of a server configuration using it.
+func addSchemeUpdateListener(conf *irma.Configuration) {
+	ptr := reflect.ValueOf(schemeUpdated).Pointer()
+	for _, listener := range conf.SchemeUpdateListeners {
+		if reflect.ValueOf(listener).Pointer() == ptr {
+			return
+		}
+	}
+	conf.SchemeUpdateListeners = append(conf.SchemeUpdateListeners, schemeUpdated)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
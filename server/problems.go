@@ -0,0 +1,45 @@
+package server
+
+// RequestProblemType is the kind of a problem found in a session request.
+type RequestProblemType string
+
+const (
+	ProblemMalformedRequest         RequestProblemType = "MALFORMED_REQUEST"          // Request could not be parsed
+	ProblemInvalidRequest           RequestProblemType = "INVALID_REQUEST"            // Request is inconsistent or otherwise invalid
+	ProblemUnknownIdentifier        RequestProblemType = "UNKNOWN_IDENTIFIER"         // Scheme, issuer, credential type, attribute type or public key unknown
+	ProblemRequiredAttributeMissing RequestProblemType = "REQUIRED_ATTRIBUTE_MISSING" // Attribute required by its credential type not requested
+	ProblemMissingPermission        RequestProblemType = "MISSING_PERMISSION"         // Requestor may not issue, disclose or sign with the identifier
+	ProblemMissingPrivateKey        RequestProblemType = "MISSING_PRIVATE_KEY"        // Server has no private key of the issuer
+	ProblemInvalidPublicKey         RequestProblemType = "INVALID_PUBLIC_KEY"         // Public key of the issuer is missing or expired
+	ProblemRevocation               RequestProblemType = "REVOCATION"                 // Revocation is misconfigured or not supported
+	ProblemCallbackNotAllowed       RequestProblemType = "CALLBACK_NOT_ALLOWED"       // Callback URL may not be used
+	ProblemUnsupported              RequestProblemType = "UNSUPPORTED"                // Request uses a feature not enabled in the server
+)
+
+// RequestProblem is a problem found in a session request, which would prevent a session from
+// being started with it. As error, it is returned by some of the checks done when starting sessions.
+type RequestProblem struct {
+	Type RequestProblemType `json:"type"`
+	// Identifier of the scheme, issuer, credential, attribute or public key concerned (if any)
+	Identifier string `json:"identifier,omitempty"`
+	Message    string `json:"message"`
+}
+
+// RequestValidation is the result of checking a session request without starting a session,
+// as returned by POST /session/validate of the requestor server.
+type RequestValidation struct {
+	Valid    bool              `json:"valid"`
+	Problems []*RequestProblem `json:"problems"`
+}
+
+func (p *RequestProblem) Error() string {
+	return p.Message
+}
+
+// NewRequestValidation returns a RequestValidation containing the specified problems.
+func NewRequestValidation(problems []*RequestProblem) *RequestValidation {
+	if problems == nil {
+		problems = []*RequestProblem{}
+	}
+	return &RequestValidation{Valid: len(problems) == 0, Problems: problems}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the amount of events per key (e.g. a requestor name or IP address)
+// within a sliding time window. It is safe for concurrent use.
+type RateLimiter struct {
+	sync.Mutex
+	window      time.Duration
+	events      map[string][]time.Time
+	lastCleanup time.Time
+}
+
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		window:      window,
+		events:      map[string][]time.Time{},
+		lastCleanup: time.Now(),
+	}
+}
+
+// Allow records an event for the specified key and returns true if less than limit events
+// occurred for the key within the window. Otherwise, the event is not recorded, and the
+// second return parameter specifies how long it takes until the next event is allowed.
+// A limit of 0 or less means no limit.
+func (l *RateLimiter) Allow(key string, limit int) (bool, time.Duration) {
+	return l.check(key, limit, true)
+}
+
+// Check is like Allow, but does not record an event.
+func (l *RateLimiter) Check(key string, limit int) (bool, time.Duration) {
+	return l.check(key, limit, false)
+}
+
+func (l *RateLimiter) check(key string, limit int, record bool) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastCleanup) > l.window {
+		for k := range l.events {
+			l.prune(k, now)
+		}
+		l.lastCleanup = now
+	}
+
+	events := l.prune(key, now)
+	if len(events) >= limit {
+		return false, events[len(events)-limit].Add(l.window).Sub(now)
+	}
+	if record {
+		l.events[key] = append(events, now)
+	}
+	return true, 0
+}
+
+// prune removes the events of the key that are older than the window, and returns the remaining events.
+func (l *RateLimiter) prune(key string, now time.Time) []time.Time {
+	events := l.events[key]
+	i := 0
+	for i < len(events) && now.Sub(events[i]) >= l.window {
+		i++
+	}
+	if i == len(events) {
+		delete(l.events, key)
+		return nil
+	}
+	events = events[i:]
+	l.events[key] = events
+	return events
+}
+
+// WriteTooManyRequests writes an ErrorTooManyRequests, including a Retry-After header.
+func WriteTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	WriteError(w, ErrorTooManyRequests, message)
+}
+
+// ClientRateLimitMiddleware limits the amount of requests per client IP address per minute
+// to the specified limit.
+func ClientRateLimitMiddleware(limit int) func(http.Handler) http.Handler {
+	limiter := NewRateLimiter(time.Minute)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			if ok, retryAfter := limiter.Allow(ip, limit); !ok {
+				Logger.WithField("ip", ip).Warn("Client exceeded rate limit")
+				WriteTooManyRequests(w, retryAfter, "")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,7 +1,11 @@
 package requestorserver
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"net/http"
+	"path"
 	"strings"
 	"time"
 
@@ -32,6 +36,12 @@ type Authenticator interface {
 	AuthenticateRevocation(
 		headers http.Header, body []byte,
 	) (applies bool, request *irma.RevocationRequest, requestor string, err *irma.RemoteError)
+
+	// AuthenticateIssuanceRecords is like AuthenticateRevocation, for requests to the revocation
+	// administration API querying issuance records.
+	AuthenticateIssuanceRecords(
+		headers http.Header, body []byte,
+	) (applies bool, request *irma.IssuanceRecordsRequest, requestor string, err *irma.RemoteError)
 }
 
 type AuthenticationMethod string
@@ -42,21 +52,54 @@ const (
 	AuthenticationMethodPublicKey = "publickey"
 	AuthenticationMethodToken     = "token"
 	AuthenticationMethodNone      = "none"
+
+	// AuthenticationMethodClientCertificate authenticates requestors by the TLS client certificate
+	// with which they connect, which must be issued by the CA configured with tls_client_ca.
+	// The keys of the requestor are the SHA-256 fingerprints of its certificates (in hex,
+	// optionally separated by colons); alternatively, Requestor.ClientCertificateNames specifies
+	// patterns of the names in its certificates.
+	AuthenticationMethodClientCertificate = "clientcert"
 )
 
+// PeerCertificateAuthenticator is implemented by authenticators that authenticate requestors by
+// their TLS client certificate. As this is not part of the HTTP headers and body passed to the
+// Authenticator methods, the server first obtains an Authenticator for the current request using
+// WithPeerCertificates, passing it the verified certificate chains of the TLS connection.
+type PeerCertificateAuthenticator interface {
+	Authenticator
+	WithPeerCertificates(chains [][]*x509.Certificate) Authenticator
+}
+
 type HmacAuthenticator struct {
-	hmackeys      map[string]interface{}
+	hmackeys      map[string][]requestorKey
 	maxRequestAge int
 }
 type PublicKeyAuthenticator struct {
-	publickeys    map[string]interface{}
+	publickeys    map[string][]requestorKey
+	jwks          map[string]*jwksKeys
+	jwksRefresh   time.Duration
+	production    bool
 	maxRequestAge int
 }
 type PresharedKeyAuthenticator struct {
-	presharedkeys map[string]string
+	presharedkeys map[string]requestorKey
+}
+type ClientCertificateAuthenticator struct {
+	fingerprints map[string]requestorKey
+	names        map[string][]string
+	chains       [][]*x509.Certificate
 }
 type NilAuthenticator struct{}
 
+// requestorKey is a parsed key of a requestor.
+type requestorKey struct {
+	requestor string
+	id        string
+	key       interface{}
+	notBefore time.Time
+	notAfter  time.Time
+}
+
 var authenticators map[AuthenticationMethod]Authenticator
 
 func (NilAuthenticator) AuthenticateSession(
@@ -83,6 +126,17 @@ func (NilAuthenticator) AuthenticateRevocation(headers http.Header, body []byte)
 	return true, r, "", nil
 }
 
+func (NilAuthenticator) AuthenticateIssuanceRecords(headers http.Header, body []byte) (bool, *irma.IssuanceRecordsRequest, string, *irma.RemoteError) {
+	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return false, nil, "", nil
+	}
+	r := &irma.IssuanceRecordsRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, "", nil
+}
+
 func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 	return nil
 }
@@ -97,46 +151,87 @@ func (hauth *HmacAuthenticator) AuthenticateRevocation(headers http.Header, body
 	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
 }
 
-func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
-	}
+func (hauth *HmacAuthenticator) AuthenticateIssuanceRecords(headers http.Header, body []byte) (bool, *irma.IssuanceRecordsRequest, string, *irma.RemoteError) {
+	return jwtAuthenticateIssuanceRecords(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+}
 
-	// We accept any of the base64 encodings
-	bts, err = common.Base64Decode(bts)
+func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
+	keys, err := parseRequestorKeys(name, requestor, func(bts []byte) (interface{}, error) {
+		// We accept any of the base64 encodings
+		bts, err := common.Base64Decode(bts)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to base64 decode hmac key of requestor "+name, 0)
+		}
+		return bts, nil
+	})
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to base64 decode hmac key of requestor "+name, 0)
+		return err
 	}
-
-	hauth.hmackeys[name] = bts
-	return nil
-
+	return addRequestorKeys(hauth.hmackeys, name, keys)
 }
 
 func (pkauth *PublicKeyAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.keys(body), pkauth.maxRequestAge)
 }
 
 func (pkauth *PublicKeyAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
-	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.keys(body), pkauth.maxRequestAge)
+}
+
+func (pkauth *PublicKeyAuthenticator) AuthenticateIssuanceRecords(headers http.Header, body []byte) (bool, *irma.IssuanceRecordsRequest, string, *irma.RemoteError) {
+	return jwtAuthenticateIssuanceRecords(headers, body, jwt.SigningMethodRS256.Name, pkauth.keys(body), pkauth.maxRequestAge)
 }
 
 func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
-	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+	if requestor.JwksURL != "" {
+		jwks, err := newJwksKeys(name, requestor.JwksURL, pkauth.jwksRefresh, pkauth.production)
+		if err != nil {
+			return err
+		}
+		pkauth.jwks[name] = jwks
+		if len(requestor.keys()) == 0 {
+			pkauth.publickeys[name] = nil
+			return nil
+		}
 	}
 
-	pk, err := jwt.ParseRSAPublicKeyFromPEM(bts)
+	keys, err := parseRequestorKeys(name, requestor, func(bts []byte) (interface{}, error) {
+		return jwt.ParseRSAPublicKeyFromPEM(bts)
+	})
 	if err != nil {
 		return err
 	}
-	pkauth.publickeys[name] = pk
+	return addRequestorKeys(pkauth.publickeys, name, keys)
+}
 
-	return nil
+// keys returns the configured keys of all requestors, together with the keys fetched from the JWKS
+// URL of the requestor that (according to its unverified kid header or iss field) sent the JWT.
+func (pkauth *PublicKeyAuthenticator) keys(j []byte) map[string][]requestorKey {
+	if len(pkauth.jwks) == 0 {
+		return pkauth.publickeys
+	}
+	token, _, err := new(jwt.Parser).ParseUnverified(string(j), &jwt.StandardClaims{})
+	if err != nil {
+		return pkauth.publickeys
+	}
+	requestor := token.Claims.(*jwt.StandardClaims).Issuer
+	kid, _ := token.Header["kid"].(string)
+	if _, ok := pkauth.jwks[kid]; ok {
+		requestor, kid = kid, ""
+	}
+	source, ok := pkauth.jwks[requestor]
+	if !ok {
+		return pkauth.publickeys
+	}
+
+	keys := make(map[string][]requestorKey, len(pkauth.publickeys))
+	for name, k := range pkauth.publickeys {
+		keys[name] = k
+	}
+	keys[requestor] = append(append([]requestorKey{}, pkauth.publickeys[requestor]...), source.get(kid)...)
+	return keys
 }
 
 func (pskauth *PresharedKeyAuthenticator) AuthenticateSession(
@@ -146,9 +241,9 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateSession(
 	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	requestor, ok := pskauth.presharedkeys[auth]
-	if !ok {
-		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
+	requestor, rerr := pskauth.requestor(auth)
+	if rerr != nil {
+		return true, nil, "", rerr
 	}
 	request, err := server.ParseSessionRequest(body)
 	if err != nil {
@@ -162,9 +257,9 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateRevocation(headers http.He
 	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	requestor, ok := pskauth.presharedkeys[auth]
-	if !ok {
-		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
+	requestor, rerr := pskauth.requestor(auth)
+	if rerr != nil {
+		return true, nil, "", rerr
 	}
 	r := &irma.RevocationRequest{}
 	if err := irma.UnmarshalValidate(body, r); err != nil {
@@ -173,40 +268,394 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateRevocation(headers http.He
 	return true, r, requestor, nil
 }
 
+func (pskauth *PresharedKeyAuthenticator) AuthenticateIssuanceRecords(headers http.Header, body []byte) (bool, *irma.IssuanceRecordsRequest, string, *irma.RemoteError) {
+	auth := headers.Get("Authorization")
+	if auth == "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
+		return false, nil, "", nil
+	}
+	requestor, rerr := pskauth.requestor(auth)
+	if rerr != nil {
+		return true, nil, "", rerr
+	}
+	r := &irma.IssuanceRecordsRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, requestor, nil
+}
+
 func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requestor) error {
-	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
+	keys, err := parseRequestorKeys(name, requestor, func(bts []byte) (interface{}, error) {
+		return string(bts), nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		pskauth.presharedkeys[key.key.(string)] = key
+	}
+	return nil
+}
+
+// requestor returns the name of the requestor to which the specified token belongs,
+// if the token exists and is currently active.
+func (pskauth *PresharedKeyAuthenticator) requestor(token string) (string, *irma.RemoteError) {
+	key, ok := pskauth.presharedkeys[token]
+	if !ok || !key.active(time.Now()) {
+		return "", server.RemoteError(server.ErrorUnauthorized, "")
+	}
+	return key.requestor, nil
+}
+
+func (ccauth *ClientCertificateAuthenticator) WithPeerCertificates(chains [][]*x509.Certificate) Authenticator {
+	auth := *ccauth
+	auth.chains = chains
+	return &auth
+}
+
+func (ccauth *ClientCertificateAuthenticator) AuthenticateSession(
+	headers http.Header, body []byte,
+) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
+	if !ccauth.applies(headers) {
+		return false, nil, "", nil
+	}
+	requestor, rerr := ccauth.requestor(time.Now())
+	if rerr != nil {
+		return true, nil, "", rerr
+	}
+	request, err := server.ParseSessionRequest(body)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, request, requestor, nil
+}
+
+func (ccauth *ClientCertificateAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
+	if !ccauth.applies(headers) {
+		return false, nil, "", nil
+	}
+	requestor, rerr := ccauth.requestor(time.Now())
+	if rerr != nil {
+		return true, nil, "", rerr
+	}
+	r := &irma.RevocationRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, requestor, nil
+}
+
+func (ccauth *ClientCertificateAuthenticator) AuthenticateIssuanceRecords(headers http.Header, body []byte) (bool, *irma.IssuanceRecordsRequest, string, *irma.RemoteError) {
+	if !ccauth.applies(headers) {
+		return false, nil, "", nil
+	}
+	requestor, rerr := ccauth.requestor(time.Now())
+	if rerr != nil {
+		return true, nil, "", rerr
+	}
+	r := &irma.IssuanceRecordsRequest{}
+	if err := irma.UnmarshalValidate(body, r); err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	return true, r, requestor, nil
+}
+
+func (ccauth *ClientCertificateAuthenticator) Initialize(name string, requestor Requestor) error {
+	for _, pattern := range requestor.ClientCertificateNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("Requestor %s has invalid client certificate name pattern %s", name, pattern)
+		}
+	}
+	ccauth.names[name] = requestor.ClientCertificateNames
+	if len(requestor.keys()) == 0 {
+		if len(requestor.ClientCertificateNames) == 0 {
+			return errors.Errorf("Requestor %s has no certificate fingerprints or client certificate names", name)
+		}
+		return nil
+	}
+
+	keys, err := parseRequestorKeys(name, requestor, func(bts []byte) (interface{}, error) {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(string(bts)), ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			return nil, errors.Errorf("Requestor %s has invalid certificate fingerprint (should be a hex-encoded SHA-256 hash)", name)
+		}
+		return hex.EncodeToString(fingerprint), nil
+	})
 	if err != nil {
-		return errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		return err
+	}
+	for _, key := range keys {
+		if _, exists := ccauth.fingerprints[key.key.(string)]; exists {
+			return errors.Errorf("Certificate fingerprint of requestor %s is not unique", name)
+		}
+		ccauth.fingerprints[key.key.(string)] = key
 	}
-	pskauth.presharedkeys[string(bts)] = name
 	return nil
 }
 
+// applies returns whether the request was made using a verified client certificate, and not
+// authenticated in another way.
+func (ccauth *ClientCertificateAuthenticator) applies(headers http.Header) bool {
+	return len(ccauth.chains) > 0 &&
+		headers.Get("Authorization") == "" &&
+		strings.HasPrefix(headers.Get("Content-Type"), "application/json")
+}
+
+// requestor returns the name of the requestor to which the client certificate belongs: the
+// requestor having its fingerprint as an active key or, if there is none, the only requestor
+// having a pattern matching one of its names.
+func (ccauth *ClientCertificateAuthenticator) requestor(now time.Time) (string, *irma.RemoteError) {
+	cert := ccauth.chains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	if key, ok := ccauth.fingerprints[hex.EncodeToString(fingerprint[:])]; ok {
+		if !key.active(now) {
+			return "", server.RemoteError(server.ErrorUnauthorized, "client certificate is not active")
+		}
+		return key.requestor, nil
+	}
+
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	var matches []string
+	for requestor, patterns := range ccauth.names {
+		if matchesAny(patterns, names) {
+			matches = append(matches, requestor)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", server.RemoteError(server.ErrorUnauthorized, "unknown client certificate")
+	case 1:
+		return matches[0], nil
+	default:
+		return "", server.RemoteError(server.ErrorUnauthorized, "client certificate matches multiple requestors")
+	}
+}
+
 // Helper functions
 
-// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
-func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (interface{}, error) {
-	return func(token *jwt.Token) (interface{}, error) {
-		var ok bool
-		kid, ok := token.Header["kid"]
-		if !ok {
-			kid = token.Claims.(*jwt.StandardClaims).Issuer
+func matchesAny(patterns, names []string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); matched && name != "" {
+				return true
+			}
 		}
-		requestor, ok := kid.(string)
-		if !ok {
+	}
+	return false
+}
+
+// keys returns the configured keys of the requestor: the key specified by AuthenticationKey or
+// AuthenticationKeyFile, if any, followed by those in AuthenticationKeys.
+func (requestor Requestor) keys() []RequestorKey {
+	if requestor.AuthenticationKey == "" && requestor.AuthenticationKeyFile == "" {
+		return requestor.AuthenticationKeys
+	}
+	return append([]RequestorKey{{
+		Key:     requestor.AuthenticationKey,
+		KeyFile: requestor.AuthenticationKeyFile,
+	}}, requestor.AuthenticationKeys...)
+}
+
+// parseRequestorKeys reads the keys of the requestor, and parses them using the parse function.
+func parseRequestorKeys(name string, requestor Requestor, parse func([]byte) (interface{}, error)) ([]requestorKey, error) {
+	configured := requestor.keys()
+	if len(configured) == 0 {
+		return nil, errors.Errorf("Requestor %s has no key", name)
+	}
+
+	var keys []requestorKey
+	for _, k := range configured {
+		bts, err := common.ReadKey(k.Key, k.KeyFile)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read key of requestor "+name, 0)
+		}
+		key, err := parse(bts)
+		if err != nil {
+			return nil, err
+		}
+		notBefore, err := parseKeyTime(k.NotBefore)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse not_before of key of requestor "+name, 0)
+		}
+		notAfter, err := parseKeyTime(k.NotAfter)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to parse not_after of key of requestor "+name, 0)
+		}
+		if !notBefore.IsZero() && !notAfter.IsZero() && !notBefore.Before(notAfter) {
+			return nil, errors.Errorf("Key of requestor %s has not_before after not_after", name)
+		}
+		keys = append(keys, requestorKey{
+			requestor: name,
+			id:        k.ID,
+			key:       key,
+			notBefore: notBefore,
+			notAfter:  notAfter,
+		})
+	}
+	return keys, nil
+}
+
+// parseKeyTime parses an RFC 3339 timestamp or a date (YYYY-MM-DD); the empty string yields
+// the zero time.
+func parseKeyTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// addRequestorKeys adds the keys of the requestor to the keys of the other requestors, ensuring
+// that key identifiers are unique.
+func addRequestorKeys(all map[string][]requestorKey, name string, keys []requestorKey) error {
+	for i, key := range keys {
+		if key.id == "" {
+			continue
+		}
+		if _, exists := findKey(all, key.id); exists || keyIndex(keys[:i], key.id) >= 0 {
+			return errors.Errorf("Key identifier %s of requestor %s is not unique", key.id, name)
+		}
+	}
+	all[name] = keys
+	return nil
+}
+
+func findKey(all map[string][]requestorKey, id string) (requestorKey, bool) {
+	for _, keys := range all {
+		if i := keyIndex(keys, id); i >= 0 {
+			return keys[i], true
+		}
+	}
+	return requestorKey{}, false
+}
+
+func keyIndex(keys []requestorKey, id string) int {
+	for i, key := range keys {
+		if key.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// active returns whether the key may be used at the specified time.
+func (key requestorKey) active(t time.Time) bool {
+	return (key.notBefore.IsZero() || !t.Before(key.notBefore)) &&
+		(key.notAfter.IsZero() || t.Before(key.notAfter))
+}
+
+// jwtKeys returns the keys against which the given (unverified) JWT may be verified: if its
+// "kid" header equals the identifier of a key, that key; otherwise, the active keys of the
+// requestor whose name is in the "kid" header or, if absent, in the "iss" field.
+func jwtKeys(token *jwt.Token, keys map[string][]requestorKey) ([]requestorKey, error) {
+	now := time.Now()
+	var requestor string
+	if kid, ok := token.Header["kid"]; ok {
+		if requestor, ok = kid.(string); !ok {
 			return nil, errors.New("requestor name was not a string")
 		}
-		token.Claims.(*jwt.StandardClaims).Issuer = requestor
-		if pk, ok := publickeys[requestor]; ok {
-			return pk, nil
+		if key, ok := findKey(keys, requestor); ok && requestor != "" {
+			if !key.active(now) {
+				return nil, errors.Errorf("Key %s is not active", requestor)
+			}
+			return []requestorKey{key}, nil
 		}
+	} else {
+		requestor = token.Claims.(*jwt.StandardClaims).Issuer
+	}
+
+	requestorKeys, ok := keys[requestor]
+	if !ok {
 		return nil, errors.Errorf("Unknown requestor: %s", requestor)
 	}
+	var active []requestorKey
+	for _, key := range requestorKeys {
+		if key.active(now) {
+			active = append(active, key)
+		}
+	}
+	if len(active) == 0 {
+		return nil, errors.Errorf("Requestor %s has no active keys", requestor)
+	}
+	return active, nil
+}
+
+// jwtAuthenticationError is returned by jwtVerify if the JWT could not be authenticated, as opposed
+// to a JWT that was authenticated but whose claims are invalid.
+type jwtAuthenticationError struct {
+	error
+}
+
+// jwtVerify verifies the JWT against the keys returned by jwtKeys, trying each of them in turn,
+// and parses its contents into the claims. It returns the name of the requestor owning the key
+// that verified the JWT.
+func jwtVerify(j string, claims jwt.Claims, keys map[string][]requestorKey) (string, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(j, &jwt.StandardClaims{})
+	if err != nil {
+		return "", jwtAuthenticationError{err}
+	}
+	candidates, err := jwtKeys(token, keys)
+	if err != nil {
+		return "", jwtAuthenticationError{err}
+	}
+	for _, key := range candidates {
+		k := key.key
+		_, err = jwt.ParseWithClaims(j, claims, func(*jwt.Token) (interface{}, error) { return k, nil })
+		if err == nil {
+			return key.requestor, nil
+		}
+		verr, ok := err.(*jwt.ValidationError)
+		if !ok {
+			return "", err
+		}
+		// Only if the signature is invalid, another key may be able to verify the JWT
+		if verr.Errors&jwt.ValidationErrorSignatureInvalid == 0 {
+			if verr.Errors&(jwt.ValidationErrorMalformed|jwt.ValidationErrorUnverifiable) != 0 {
+				return "", jwtAuthenticationError{err}
+			}
+			return "", err
+		}
+	}
+	return "", jwtAuthenticationError{err}
+}
+
+// jwtVerifier is implemented by the JWT authenticators, so that handleValidateSession can tell
+// session requests that could not be authenticated apart from malformed ones.
+type jwtVerifier interface {
+	// verifyJwt returns whether the authenticator applies to the request and, if so, a
+	// jwtAuthenticationError if the JWT could not be authenticated.
+	verifyJwt(headers http.Header, body []byte) (bool, error)
+}
+
+func (hauth *HmacAuthenticator) verifyJwt(headers http.Header, body []byte) (bool, error) {
+	return jwtAuthenticates(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys)
+}
+
+func (pkauth *PublicKeyAuthenticator) verifyJwt(headers http.Header, body []byte) (bool, error) {
+	return jwtAuthenticates(headers, body, jwt.SigningMethodRS256.Name, pkauth.keys(body))
+}
+
+func jwtAuthenticates(headers http.Header, body []byte, signatureAlg string, keys map[string][]requestorKey) (bool, error) {
+	if !jwtApplies(headers, body, signatureAlg) {
+		return false, nil
+	}
+	if _, err := jwtVerify(string(body), &jwt.StandardClaims{}, keys); err != nil {
+		if _, ok := err.(jwtAuthenticationError); ok {
+			return true, err
+		}
+	}
+	return true, nil
 }
 
 // jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
 func jwtAuthenticate(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlg string, keys map[string][]requestorKey, maxRequestAge int,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
@@ -216,7 +665,7 @@ func jwtAuthenticate(
 	// before we can construct a struct instance of the appropriate type into which to unmarshal the JWT contents.
 	claims := &jwt.StandardClaims{}
 	requestorJwt := string(body)
-	_, err := jwt.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
+	requestor, err := jwtVerify(requestorJwt, claims, keys)
 	if err != nil {
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
@@ -233,24 +682,41 @@ func jwtAuthenticate(
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 
-	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
 	return true, parsedJwt.RequestorRequest(), requestor, nil
 }
 
 func jwtAutheticateRevocation(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlg string, keys map[string][]requestorKey, maxRequestAge int,
 ) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
 	}
 	s := &irma.RevocationJwt{}
-	if _, err := jwt.ParseWithClaims(string(body), s, jwtKeyExtractor(keys)); err != nil {
+	requestor, err := jwtVerify(string(body), s, keys)
+	if err != nil {
 		return false, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 	if time.Unix(time.Time(s.IssuedAt).Unix(), 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
-	return true, s.Request, s.ServerName, nil
+	return true, s.Request, requestor, nil
+}
+
+func jwtAuthenticateIssuanceRecords(
+	headers http.Header, body []byte, signatureAlg string, keys map[string][]requestorKey, maxRequestAge int,
+) (bool, *irma.IssuanceRecordsRequest, string, *irma.RemoteError) {
+	if !jwtApplies(headers, body, signatureAlg) {
+		return false, nil, "", nil
+	}
+	s := &irma.IssuanceRecordsJwt{}
+	requestor, err := jwtVerify(string(body), s, keys)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	}
+	if time.Unix(time.Time(s.IssuedAt).Unix(), 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
+		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "jwt too old")
+	}
+	return true, s.Request, requestor, nil
 }
 
 func jwtApplies(headers http.Header, body []byte, signatureAlg string) bool {
@@ -1,7 +1,24 @@
 package requestorserver
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -13,8 +30,8 @@ import (
 )
 
 func TestPresharedKeyAuthenticator_Authenticate(t *testing.T) {
-	authenticator := PresharedKeyAuthenticator{presharedkeys: map[string]string{
-		"token": "my_requestor",
+	authenticator := PresharedKeyAuthenticator{presharedkeys: map[string]requestorKey{
+		"token": {requestor: "my_requestor", key: "token"},
 	}}
 
 	validRequestBody := []byte(`{"request": {"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
@@ -86,8 +103,8 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 	key := []byte("953BCAB6F25F3622619A9A16BE895")
 	invalidKey := []byte("A5BB219FFB6199756DF8A284A3392")
 	authenticator := HmacAuthenticator{
-		hmackeys: map[string]interface{}{
-			"my_requestor": key,
+		hmackeys: map[string][]requestorKey{
+			"my_requestor": {{requestor: "my_requestor", key: key}},
 		},
 		maxRequestAge: 500,
 	}
@@ -168,5 +185,407 @@ func TestHmacAuthenticator_Authenticate(t *testing.T) {
 		applies, _, _, err := authenticator.AuthenticateSession(requestHeaders, []byte(invalidJwtData))
 		require.True(t, applies)
 		require.Error(t, err)
+		require.Equal(t, server.ErrorInvalidRequest.Status, err.Status)
+	})
+}
+
+func TestAuthenticatorMultipleKeys(t *testing.T) {
+	oldKey, newKey, otherKey := []byte("953BCAB6F25F3622619A9A16BE895"), []byte("A5BB219FFB6199756DF8A284A3392"), []byte("2D3F5E8C1B7A9046E1C2D3B4A5968")
+	encode := base64.StdEncoding.EncodeToString
+	authenticator := &HmacAuthenticator{hmackeys: map[string][]requestorKey{}, maxRequestAge: 500}
+	require.NoError(t, authenticator.Initialize("my_requestor", Requestor{
+		AuthenticationKey: encode(oldKey),
+		AuthenticationKeys: []RequestorKey{
+			{ID: "new", Key: encode(newKey), NotBefore: "2000-01-01"},
+			{ID: "expired", Key: encode(otherKey), NotAfter: "2001-01-01T00:00:00Z"},
+		},
+	}))
+
+	disclosureRequest := &irma.DisclosureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`), disclosureRequest))
+	sign := func(key []byte, kid string) []byte {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, irma.NewServiceProviderJwt("my_requestor", disclosureRequest))
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		j, err := token.SignedString(key)
+		require.NoError(t, err)
+		return []byte(j)
+	}
+	requestHeaders := map[string][]string{"Content-Type": {"text/plain"}}
+
+	server.Logger.SetLevel(logrus.ErrorLevel)
+	for name, test := range map[string]struct {
+		body    []byte
+		success bool
+	}{
+		"old key without kid":      {sign(oldKey, ""), true},
+		"new key without kid":      {sign(newKey, ""), true},
+		"new key with kid":         {sign(newKey, "new"), true},
+		"requestor name as kid":    {sign(newKey, "my_requestor"), true},
+		"old key with new kid":     {sign(oldKey, "new"), false},
+		"expired key with kid":     {sign(otherKey, "expired"), false},
+		"expired key without kid":  {sign(otherKey, ""), false},
+		"unknown key with kid":     {sign(newKey, "unknown"), false},
+		"unknown key without kids": {sign([]byte("unknown"), ""), false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			applies, _, requestor, err := authenticator.AuthenticateSession(requestHeaders, test.body)
+			require.True(t, applies)
+			if test.success {
+				require.Nil(t, err)
+				require.Equal(t, "my_requestor", requestor)
+			} else {
+				require.NotNil(t, err)
+			}
+		})
+	}
+
+	t.Run("preshared keys", func(t *testing.T) {
+		authenticator := &PresharedKeyAuthenticator{presharedkeys: map[string]requestorKey{}}
+		require.NoError(t, authenticator.Initialize("my_requestor", Requestor{
+			AuthenticationKeys: []RequestorKey{
+				{Key: "token1"},
+				{Key: "token2", NotAfter: "2001-01-01"},
+				{Key: "token3", NotBefore: time.Now().Add(time.Hour).Format(time.RFC3339)},
+			},
+		}))
+		body := []byte(`{"request": {"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`)
+		for token, valid := range map[string]bool{"token1": true, "token2": false, "token3": false} {
+			headers := map[string][]string{"Authorization": {token}, "Content-Type": {"application/json"}}
+			_, _, _, err := authenticator.AuthenticateSession(headers, body)
+			require.Equal(t, valid, err == nil, token)
+		}
+	})
+
+	t.Run("invalid keys", func(t *testing.T) {
+		authenticator := &HmacAuthenticator{hmackeys: map[string][]requestorKey{}}
+		require.Error(t, authenticator.Initialize("no_keys", Requestor{}))
+		require.Error(t, authenticator.Initialize("invalid_date", Requestor{
+			AuthenticationKeys: []RequestorKey{{Key: encode(newKey), NotBefore: "yesterday"}},
+		}))
+		require.Error(t, authenticator.Initialize("invalid_period", Requestor{
+			AuthenticationKeys: []RequestorKey{{Key: encode(newKey), NotBefore: "2002-01-01", NotAfter: "2001-01-01"}},
+		}))
+		require.NoError(t, authenticator.Initialize("requestor1", Requestor{
+			AuthenticationKeys: []RequestorKey{{ID: "key", Key: encode(newKey)}},
+		}))
+		require.Error(t, authenticator.Initialize("requestor2", Requestor{
+			AuthenticationKeys: []RequestorKey{{ID: "key", Key: encode(oldKey)}},
+		}))
+		require.Error(t, authenticator.Initialize("requestor3", Requestor{
+			AuthenticationKeys: []RequestorKey{{ID: "samekey", Key: encode(oldKey)}, {ID: "samekey", Key: encode(newKey)}},
+		}))
+	})
+}
+
+func TestPublicKeyAuthenticatorJwks(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwk1, err := server.NewJWK(&key1.PublicKey)
+	require.NoError(t, err)
+	jwk2, err := server.NewJWK(&key2.PublicKey)
+	require.NoError(t, err)
+
+	var (
+		lock    sync.Mutex
+		jwks    = &server.JWKS{Keys: []*server.JWK{jwk1}}
+		fetches  int
+		requests int
+		block    = make(chan struct{})
+	)
+	close(block)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		b := block
+		lock.Unlock()
+		<-b
+		lock.Lock()
+		defer lock.Unlock()
+		fetches++
+		server.WriteJson(w, jwks)
+	}))
+	defer ts.Close()
+
+	conf := &Configuration{
+		Configuration:       &server.Configuration{Logger: server.Logger},
+		MaxRequestAge:       500,
+		JwksRefreshInterval: 300,
+		Requestors: map[string]Requestor{
+			"my_requestor": {AuthenticationMethod: AuthenticationMethodPublicKey, JwksURL: ts.URL},
+		},
+	}
+	auths, err := conf.newAuthenticators()
+	require.NoError(t, err)
+	authenticator := auths[AuthenticationMethodPublicKey].(*PublicKeyAuthenticator)
+
+	disclosureRequest := &irma.DisclosureRequest{}
+	require.NoError(t, json.Unmarshal([]byte(`{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`), disclosureRequest))
+	authenticate := func(key *rsa.PrivateKey, kid string) *irma.RemoteError {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, irma.NewServiceProviderJwt("my_requestor", disclosureRequest))
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		j, err := token.SignedString(key)
+		require.NoError(t, err)
+		applies, _, requestor, rerr := authenticator.AuthenticateSession(map[string][]string{"Content-Type": {"text/plain"}}, []byte(j))
+		require.True(t, applies)
+		if rerr == nil {
+			require.Equal(t, "my_requestor", requestor)
+		}
+		return rerr
+	}
+
+	server.Logger.SetLevel(logrus.ErrorLevel)
+	require.Nil(t, authenticate(key1, jwk1.ID))
+	require.Nil(t, authenticate(key1, ""))
+	require.NotNil(t, authenticate(key2, ""))
+	require.Equal(t, 1, fetches)
+
+	// The requestor rotates its key. JWTs referring to the new key identifier cause the JWKS to
+	// be refetched, but not more often than minJwksRefreshInterval.
+	lock.Lock()
+	jwks = &server.JWKS{Keys: []*server.JWK{jwk2}}
+	lock.Unlock()
+	require.NotNil(t, authenticate(key2, jwk2.ID))
+	require.Equal(t, 1, fetches)
+	authenticator.jwks["my_requestor"].attempted = time.Time{}
+	require.Nil(t, authenticate(key2, jwk2.ID))
+	require.Nil(t, authenticate(key2, ""))
+	require.Equal(t, 2, fetches)
+	require.NotNil(t, authenticate(key1, ""))
+
+	// While the JWKS is being fetched, the previously fetched keys are used
+	lock.Lock()
+	block = make(chan struct{})
+	lock.Unlock()
+	authenticator.jwks["my_requestor"].attempted = time.Time{}
+	fetched := make(chan struct{})
+	go func() {
+		authenticator.jwks["my_requestor"].get("unknown")
+		close(fetched)
+	}()
+	require.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests == 3
+	}, time.Second, 10*time.Millisecond)
+	got := make(chan []requestorKey)
+	go func() { got <- authenticator.jwks["my_requestor"].get("") }()
+	select {
+	case keys := <-got:
+		require.Len(t, keys, 1)
+	case <-time.After(time.Second):
+		require.Fail(t, "keys not returned while the JWKS is being fetched")
+	}
+	close(block)
+	<-fetched
+
+	// The JWKS URL must be a HTTP(S) URL, and a HTTPS URL in production mode
+	conf.Requestors["my_requestor"] = Requestor{AuthenticationMethod: AuthenticationMethodPublicKey, JwksURL: "file:///etc/passwd"}
+	_, err = conf.newAuthenticators()
+	require.Error(t, err)
+	conf.Requestors["my_requestor"] = Requestor{AuthenticationMethod: AuthenticationMethodPublicKey, JwksURL: ts.URL}
+	conf.Production = true
+	_, err = conf.newAuthenticators()
+	require.Error(t, err)
+	conf.Requestors["my_requestor"] = Requestor{AuthenticationMethod: AuthenticationMethodPublicKey, JwksURL: "https://example.com/jwks.json"}
+	_, err = conf.newAuthenticators()
+	require.NoError(t, err)
+}
+
+func TestClientCertificateAuthenticator(t *testing.T) {
+	ca, caKey := newTestCertificate(t, "ca", nil, nil)
+	serverCert, serverKey := newTestCertificate(t, "localhost", ca, caKey)
+	cert1, key1 := newTestCertificate(t, "requestor1.requestors.example.com", ca, caKey)
+	cert2, key2 := newTestCertificate(t, "requestor2.example.com", ca, caKey)
+	cert3, key3 := newTestCertificate(t, "unknown.example.com", ca, caKey)
+	otherCa, otherCaKey := newTestCertificate(t, "other ca", nil, nil)
+	untrusted, untrustedKey := newTestCertificate(t, "requestor1.requestors.example.com", otherCa, otherCaKey)
+	fingerprint := sha256.Sum256(cert2.Raw)
+
+	conf := &Configuration{
+		Configuration:  &server.Configuration{Logger: server.Logger},
+		TlsCertificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Raw})),
+		TlsPrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: serverKey})),
+		TlsClientCA:    string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		Requestors: map[string]Requestor{
+			"requestor1": {
+				AuthenticationMethod:   AuthenticationMethodClientCertificate,
+				ClientCertificateNames: []string{"*.requestors.example.com"},
+			},
+			"requestor2": {
+				AuthenticationMethod: AuthenticationMethodClientCertificate,
+				AuthenticationKey:    strings.ToUpper(hex.EncodeToString(fingerprint[:])),
+			},
+		},
+	}
+	auths, err := conf.newAuthenticators()
+	require.NoError(t, err)
+	tlsConf, err := conf.tlsConfig()
+	require.NoError(t, err)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		auth := auths[AuthenticationMethodClientCertificate].(PeerCertificateAuthenticator).WithPeerCertificates(r.TLS.VerifiedChains)
+		applies, _, requestor, rerr := auth.AuthenticateSession(r.Header, body)
+		if !applies {
+			w.WriteHeader(http.StatusNotFound)
+		} else if rerr != nil {
+			w.WriteHeader(rerr.Status)
+		} else {
+			_, _ = w.Write([]byte(requestor))
+		}
+	}))
+	ts.TLS = tlsConf
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	post := func(cert *x509.Certificate, key []byte) (int, string, error) {
+		clientTls := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if cert != nil {
+			keypair, err := tls.X509KeyPair(
+				pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+				pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+			)
+			require.NoError(t, err)
+			// Always send the certificate, even if it is not issued by a CA accepted by the server
+			clientTls.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &keypair, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTls}}
+		res, err := client.Post(ts.URL, "application/json", strings.NewReader(
+			`{"request": {"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}}`,
+		))
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body), nil
+	}
+
+	status, requestor, err := post(cert1, key1)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "requestor1", requestor)
+
+	status, requestor, err = post(cert2, key2)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "requestor2", requestor)
+
+	status, _, err = post(cert3, key3)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusForbidden, status)
+
+	// Without client certificate the authenticator does not apply
+	status, _, err = post(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// Certificates not issued by the configured CA are refused during the TLS handshake
+	_, _, err = post(untrusted, untrustedKey)
+	require.Error(t, err)
+
+	// The CA is required when requestors use client certificates
+	conf.TlsClientCA = ""
+	_, err = conf.newAuthenticators()
+	require.Error(t, err)
+}
+
+// newTestCertificate creates a certificate for the specified name, signed by the parent or
+// self-signed if parent is nil, returning the certificate and its DER-encoded EC private key.
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey []byte) (*x509.Certificate, []byte) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer := sk
+	if parent == nil {
+		parent = template
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, err = x509.ParseECPrivateKey(parentKey)
+		require.NoError(t, err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &sk.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	skbts, err := x509.MarshalECPrivateKey(sk)
+	require.NoError(t, err)
+	return cert, skbts
+}
+
+func TestHmacAuthenticator_AuthenticateIssuanceRecords(t *testing.T) {
+	key := []byte("953BCAB6F25F3622619A9A16BE895")
+	authenticator := HmacAuthenticator{
+		hmackeys: map[string][]requestorKey{
+			"my_requestor": {{requestor: "my_requestor", key: key}},
+		},
+		maxRequestAge: 500,
+	}
+	request := &irma.IssuanceRecordsRequest{
+		LDContext:            irma.LDContextIssuanceRecordsRequest,
+		CredentialType:       irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"),
+		IssuanceRecordFilter: irma.IssuanceRecordFilter{Key: "12345"},
+	}
+	requestHeaders := map[string][]string{
+		"Content-Type": {"text/plain"},
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		j, err := irma.NewIssuanceRecordsJwt("my_requestor", request).Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		applies, parsed, requestor, rerr := authenticator.AuthenticateIssuanceRecords(requestHeaders, []byte(j))
+		require.Nil(t, rerr)
+		require.True(t, applies)
+		require.Equal(t, request, parsed)
+		require.Equal(t, "my_requestor", requestor)
+	})
+
+	server.Logger.SetLevel(logrus.ErrorLevel)
+	t.Run("revocation jwt", func(t *testing.T) {
+		j, err := (&irma.RevocationJwt{
+			ServerJwt: irma.ServerJwt{ServerName: "my_requestor", IssuedAt: irma.Timestamp(time.Now())},
+			Request:   &irma.RevocationRequest{LDContext: irma.LDContextRevocationRequest, Key: "12345"},
+		}).Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		applies, _, _, rerr := authenticator.AuthenticateIssuanceRecords(requestHeaders, []byte(j))
+		require.True(t, applies)
+		require.NotNil(t, rerr)
+		require.Equal(t, string(server.ErrorInvalidRequest.Type), rerr.ErrorName)
+	})
+
+	t.Run("issuance records jwt as revocation jwt", func(t *testing.T) {
+		j, err := irma.NewIssuanceRecordsJwt("my_requestor", request).Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		_, _, _, rerr := authenticator.AuthenticateRevocation(requestHeaders, []byte(j))
+		require.NotNil(t, rerr)
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		invalid := *request
+		invalid.Limit = -1
+		j, err := irma.NewIssuanceRecordsJwt("my_requestor", &invalid).Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		applies, _, _, rerr := authenticator.AuthenticateIssuanceRecords(requestHeaders, []byte(j))
+		require.True(t, applies)
+		require.NotNil(t, rerr)
 	})
 }
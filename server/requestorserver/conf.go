@@ -2,8 +2,12 @@ package requestorserver
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
@@ -15,7 +19,9 @@ type Configuration struct {
 	*server.Configuration `mapstructure:",squash"`
 
 	// Disclosing, signing or issuance permissions that apply to all requestors
-	Permissions          `mapstructure:",squash"`
+	Permissions `mapstructure:",squash"`
+	// Limits that apply to each requestor that does not specify its own limits
+	Limits               `mapstructure:",squash"`
 	SkipPrivateKeysCheck bool `json:"skip_private_keys_check" mapstructure:"skip_private_keys_check"`
 
 	// Whether or not incoming session requests should be authenticated. If false, anyone
@@ -35,6 +41,10 @@ type Configuration struct {
 	TlsCertificateFile string `json:"tls_cert_file" mapstructure:"tls_cert_file"`
 	TlsPrivateKey      string `json:"tls_privkey" mapstructure:"tls_privkey"`
 	TlsPrivateKeyFile  string `json:"tls_privkey_file" mapstructure:"tls_privkey_file"`
+	// CA certificates against which TLS client certificates are verified, required by requestors
+	// authenticating with their TLS client certificate (see AuthenticationMethodClientCertificate)
+	TlsClientCA     string `json:"tls_client_ca" mapstructure:"tls_client_ca"`
+	TlsClientCAFile string `json:"tls_client_ca_file" mapstructure:"tls_client_ca_file"`
 
 	// If specified, start a separate server for the IRMA app at his port
 	ClientPort int `json:"client_port" mapstructure:"client_port"`
@@ -46,11 +56,47 @@ type Configuration struct {
 	ClientTlsPrivateKey      string `json:"client_tls_privkey" mapstructure:"client_tls_privkey"`
 	ClientTlsPrivateKeyFile  string `json:"client_tls_privkey_file" mapstructure:"client_tls_privkey_file"`
 
+	// If specified, start a separate server at this port exposing Prometheus metrics at /metrics
+	MetricsPort int `json:"metrics_port" mapstructure:"metrics_port"`
+	// If metrics_port is specified, the metrics server listens at this address
+	MetricsListenAddress string `json:"metrics_listen_addr" mapstructure:"metrics_listen_addr"`
+
 	// Requestor-specific permission and authentication configuration
 	Requestors map[string]Requestor `json:"requestors"`
 
+	// Clients of the OpenID Connect provider at {ApiPrefix}oidc/, which authenticates users using
+	// disclosure sessions; if empty, the OpenID Connect provider is disabled
+	OidcClients map[string]OidcClient `json:"oidc_clients" mapstructure:"oidc_clients"`
+	// URL at which the OpenID Connect provider is reachable for users and clients, i.e. the external
+	// URL of {ApiPrefix}oidc; used as issuer identifier and to construct the endpoint URLs
+	OidcIssuer string `json:"oidc_issuer" mapstructure:"oidc_issuer"`
+	// Claims that the OpenID Connect provider can issue, each of which contains the value of one of
+	// the specified attribute types, disclosed by the user. The sub claim is required: it is the
+	// subject identifier by which clients recognize users, and it is included in all authentications.
+	OidcClaims map[string][]string `json:"oidc_claims" mapstructure:"oidc_claims"`
+	// OpenID Connect scopes, each of which consists of the specified claims. The claims of the openid
+	// scope (if configured) are included in all authentications.
+	OidcScopes map[string][]string `json:"oidc_scopes" mapstructure:"oidc_scopes"`
+	// Validity in seconds of ID tokens and access tokens (default DefaultOidcTokenValidity)
+	OidcTokenValidity int `json:"oidc_token_validity" mapstructure:"oidc_token_validity"`
+	// Path to a html/template of the page shown to users during authentication, which is passed
+	// the session pointer and the URL to poll to obtain the URL to redirect to (see oidcPageData)
+	OidcLoginTemplate string `json:"oidc_login_template" mapstructure:"oidc_login_template"`
+
+	// Token with which the admin API (e.g. GET /admin/sessions) is accessed, using the
+	// Authorization HTTP header. If empty, the admin API is disabled.
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+
+	// If specified, used by Server.ReloadConfiguration() to obtain the new configuration, e.g. by
+	// rereading the configuration file. Only the parts of the configuration that Server.Reload()
+	// supports are used from the returned configuration.
+	Reloader func() (*Configuration, error) `json:"-" mapstructure:"-"`
+
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
+	// Interval in seconds after which the keys fetched from the JWKS URLs of requestors are
+	// refetched (default DefaultJwksRefreshInterval)
+	JwksRefreshInterval int `json:"jwks_refresh_interval" mapstructure:"jwks_refresh_interval"`
 
 	// Host files under this path as static files (leave empty to disable)
 	StaticPath string `json:"static_path" mapstructure:"static_path"`
@@ -64,16 +110,61 @@ type Permissions struct {
 	Signing    []string `json:"sign_perms" mapstructure:"sign_perms"`
 	Issuing    []string `json:"issue_perms" mapstructure:"issue_perms"`
 	Revoking   []string `json:"revoke_perms" mapstructure:"revoke_perms"`
+
+	// Patterns of the callback URLs that may be used in session requests. In a pattern, * matches
+	// any sequence of characters not containing /, ?, #, @ or \, and ** matches any sequence of
+	// characters. For example, https://*.example.com/irma/** allows all paths under /irma/ at
+	// all subdomains of example.com. The patterns of a requestor are combined with the global patterns;
+	// if neither specify any patterns, any callback URL is allowed.
+	CallbackURLs []string `json:"callback_urls" mapstructure:"callback_urls"`
+}
+
+// Limits restrict the amount of sessions that a requestor may start. A limit of 0 means no limit.
+// The limits are enforced per server instance.
+type Limits struct {
+	// Maximum amount of sessions started per minute
+	SessionsPerMinute int `json:"sessions_per_minute" mapstructure:"sessions_per_minute"`
+	// Maximum amount of sessions that are not yet finished at the same time
+	ConcurrentSessions int `json:"concurrent_sessions" mapstructure:"concurrent_sessions"`
+	// Maximum amount of issuance sessions started per 24 hours
+	IssuanceSessionsPerDay int `json:"issuance_sessions_per_day" mapstructure:"issuance_sessions_per_day"`
 }
 
 // Requestor contains all configuration (disclosure or verification permissions and authentication)
 // for a requestor.
 type Requestor struct {
 	Permissions `mapstructure:",squash"`
+	Limits      `mapstructure:",squash"`
 
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+	// Additional keys of the requestor, all of which are accepted, e.g. to rotate keys without downtime
+	AuthenticationKeys []RequestorKey `json:"keys" mapstructure:"keys"`
+	// For requestors using the publickey authentication method: URL of a JSON Web Key Set containing
+	// the (RSA) public keys of the requestor, which is refetched periodically and whenever a JWT refers
+	// to an unknown key identifier. JWTs signed with these keys must name the requestor in their iss field.
+	// In production mode, this must be a HTTPS URL.
+	JwksURL string `json:"jwks_url" mapstructure:"jwks_url"`
+	// Patterns of the names in the TLS client certificate of the requestor, for requestors using
+	// the clientcert authentication method that do not use certificate fingerprints as keys.
+	// A pattern is matched against the common name of the subject and the DNS names, email addresses
+	// and URIs of the certificate, as in path.Match(); e.g. *.requestors.example.com.
+	ClientCertificateNames []string `json:"client_cert_names" mapstructure:"client_cert_names"`
+}
+
+// RequestorKey is a key with which a requestor authenticates, optionally with an identifier
+// and a period during which it is accepted.
+type RequestorKey struct {
+	// Identifier of the key. If the kid header of a requestor JWT equals it, only this key is used
+	// to verify the JWT; otherwise, each of the keys of the requestor is tried in turn.
+	ID      string `json:"kid" mapstructure:"kid"`
+	Key     string `json:"key" mapstructure:"key"`
+	KeyFile string `json:"key_file" mapstructure:"key_file"`
+	// Start and end of the period during which the key is accepted, as RFC 3339 timestamp or as
+	// date (YYYY-MM-DD); if empty, the period is unbounded at that side
+	NotBefore string `json:"not_before" mapstructure:"not_before"`
+	NotAfter  string `json:"not_after" mapstructure:"not_after"`
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -101,6 +192,59 @@ func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRe
 	return true, ""
 }
 
+// RequestorLimits returns the limits that apply to the specified requestor: the limits configured for
+// the requestor, or the global limits for those that are not configured for the requestor.
+func (conf *Configuration) RequestorLimits(requestor string) Limits {
+	limits := conf.Requestors[requestor].Limits
+	if limits.SessionsPerMinute == 0 {
+		limits.SessionsPerMinute = conf.SessionsPerMinute
+	}
+	if limits.ConcurrentSessions == 0 {
+		limits.ConcurrentSessions = conf.ConcurrentSessions
+	}
+	if limits.IssuanceSessionsPerDay == 0 {
+		limits.IssuanceSessionsPerDay = conf.IssuanceSessionsPerDay
+	}
+	return limits
+}
+
+// CanUseCallbackURL returns whether or not the specified requestor may use the specified
+// callback URL in its session requests.
+func (conf *Configuration) CanUseCallbackURL(requestor, callbackUrl string) bool {
+	requestorPatterns := conf.Requestors[requestor].CallbackURLs
+	if len(requestorPatterns) == 0 && len(conf.CallbackURLs) == 0 {
+		return true
+	}
+	// Don't append one to the other, as that may write into the backing array of the
+	// requestor patterns while other goroutines are reading it
+	for _, patterns := range [][]string{requestorPatterns, conf.CallbackURLs} {
+		for _, pattern := range patterns {
+			if callbackURLPattern(pattern).MatchString(callbackUrl) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func callbackURLPattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, part := range strings.Split(pattern, "**") {
+		if i > 0 {
+			expr.WriteString(".*")
+		}
+		for j, subpart := range strings.Split(part, "*") {
+			if j > 0 {
+				expr.WriteString(`[^/?#@\\]*`)
+			}
+			expr.WriteString(regexp.QuoteMeta(subpart))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
+
 // CanVerifyOrSign returns whether or not the specified requestor may use the selected attributes
 // in any of the supported session types.
 func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action, disjunctions irma.AttributeConDisCon) (bool, string) {
@@ -154,7 +298,6 @@ func (conf *Configuration) CanRevoke(requestor string, cred irma.CredentialTypeI
 
 func (conf *Configuration) initialize() error {
 	if conf.DisableRequestorAuthentication {
-		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys := conf.HavePrivateKeys()
 		if len(conf.Permissions.Issuing) > 0 && havekeys {
@@ -164,35 +307,18 @@ func (conf *Configuration) initialize() error {
 				return errors.New("If issuing is enabled in production mode, requestor authentication must be enabled, or client_listen_addr and client_port must be used")
 			}
 		}
-	} else {
-		if len(conf.Requestors) == 0 {
-			revServer := false
-			for _, s := range conf.RevocationSettings {
-				if s.Server {
-					revServer = true
-				}
-			}
-			if !revServer {
-				return errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
-			}
-		}
-		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
-		}
+	}
 
-		// Initialize authenticators
-		for name, requestor := range conf.Requestors {
-			authenticator, ok := authenticators[requestor.AuthenticationMethod]
-			if !ok {
-				return errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s)",
-					name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey)
-			}
-			if err := authenticator.Initialize(name, requestor); err != nil {
-				return err
-			}
-		}
+	if conf.JwksRefreshInterval < 0 {
+		return errors.New("jwks_refresh_interval must not be negative")
+	}
+	if conf.JwksRefreshInterval == 0 {
+		conf.JwksRefreshInterval = DefaultJwksRefreshInterval
+	}
+
+	var err error
+	if authenticators, err = conf.newAuthenticators(); err != nil {
+		return err
 	}
 
 	if conf.Port <= 0 || conf.Port > 65535 {
@@ -208,6 +334,15 @@ func (conf *Configuration) initialize() error {
 	if conf.ClientListenAddress != "" && conf.ClientPort == 0 {
 		return errors.New("client_listen_addr must be combined with a nonzero client_port")
 	}
+	if conf.MetricsPort != 0 && (conf.MetricsPort == conf.Port || conf.MetricsPort == conf.ClientPort) {
+		return errors.New("If metrics_port is given it must be different from port and client_port")
+	}
+	if conf.MetricsPort < 0 || conf.MetricsPort > 65535 {
+		return errors.Errorf("metrics_port must be between 0 and 65535 (was %d)", conf.MetricsPort)
+	}
+	if conf.MetricsListenAddress != "" && conf.MetricsPort == 0 {
+		return errors.New("metrics_listen_addr must be combined with a nonzero metrics_port")
+	}
 
 	tlsConf, err := conf.tlsConfig()
 	if err != nil {
@@ -221,6 +356,12 @@ func (conf *Configuration) initialize() error {
 	if err := conf.validatePermissions(); err != nil {
 		return err
 	}
+	if err := conf.validateLimits(); err != nil {
+		return err
+	}
+	if err := conf.validateOidc(); err != nil {
+		return err
+	}
 
 	if conf.StaticPath != "" {
 		if err := common.AssertPathExists(conf.StaticPath); err != nil {
@@ -268,21 +409,81 @@ func (conf *Configuration) initialize() error {
 		conf.Logger.Warnf("Are the URL and API-prefix set correctly?: %s does not end with %s.", conf.URL, conf.ApiPrefix+"irma/")
 	}
 
-	if len(conf.StaticSessions) != 0 && conf.JwtRSAPrivateKey == nil {
+	if len(conf.StaticSessions) != 0 && conf.JwtSigningKey == nil {
 		conf.Logger.Warn("Static sessions enabled and no JWT private key installed. Ensure that POSTs to the callback URLs of static sessions are trustworthy by keeping the callback URLs secret and by using HTTPS.")
 	}
 
 	return nil
 }
 
+// newAuthenticators returns the authenticators for the configured requestors, after initializing
+// them with the requestors using Authenticator.Initialize().
+func (conf *Configuration) newAuthenticators() (map[AuthenticationMethod]Authenticator, error) {
+	if conf.DisableRequestorAuthentication {
+		return map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}, nil
+	}
+
+	if len(conf.Requestors) == 0 {
+		revServer := false
+		for _, s := range conf.RevocationSettings {
+			if s.Server {
+				revServer = true
+			}
+		}
+		if !revServer {
+			return nil, errors.New("No requestors configured; either configure one or more requestors or disable requestor authentication")
+		}
+	}
+	auths := map[AuthenticationMethod]Authenticator{
+		AuthenticationMethodHmac: &HmacAuthenticator{hmackeys: map[string][]requestorKey{}, maxRequestAge: conf.MaxRequestAge},
+		AuthenticationMethodPublicKey: &PublicKeyAuthenticator{
+			publickeys:    map[string][]requestorKey{},
+			jwks:          map[string]*jwksKeys{},
+			jwksRefresh:   time.Duration(conf.JwksRefreshInterval) * time.Second,
+			production:    conf.Production,
+			maxRequestAge: conf.MaxRequestAge,
+		},
+		AuthenticationMethodToken: &PresharedKeyAuthenticator{presharedkeys: map[string]requestorKey{}},
+		AuthenticationMethodClientCertificate: &ClientCertificateAuthenticator{
+			fingerprints: map[string]requestorKey{},
+			names:        map[string][]string{},
+		},
+	}
+	for name, requestor := range conf.Requestors {
+		authenticator, ok := auths[requestor.AuthenticationMethod]
+		if !ok {
+			return nil, errors.Errorf("Requestor %s has unsupported authentication type %s (supported methods: %s, %s, %s, %s)",
+				name, requestor.AuthenticationMethod, AuthenticationMethodToken, AuthenticationMethodHmac, AuthenticationMethodPublicKey,
+				AuthenticationMethodClientCertificate)
+		}
+		if requestor.AuthenticationMethod == AuthenticationMethodClientCertificate && conf.TlsClientCA == "" && conf.TlsClientCAFile == "" {
+			return nil, errors.Errorf("Requestor %s uses authentication type %s, which requires tls_client_ca or tls_client_ca_file",
+				name, AuthenticationMethodClientCertificate)
+		}
+		if err := authenticator.Initialize(name, requestor); err != nil {
+			return nil, err
+		}
+		if conf.AdminToken != "" && requestor.AuthenticationMethod == AuthenticationMethodToken {
+			for _, key := range requestor.keys() {
+				if key.Key == conf.AdminToken {
+					return nil, errors.Errorf("admin_token must differ from the keys of requestor %s", name)
+				}
+			}
+		}
+	}
+	return auths, nil
+}
+
 func (conf *Configuration) validatePermissions() error {
 	if conf.DisableRequestorAuthentication && len(conf.Requestors) != 0 {
 		return errors.New("Requestors must not be configured when requestor authentication is disabled")
 	}
 
 	errs := conf.validatePermissionSet("Global", conf.Permissions)
+	errs = append(errs, validateCallbackURLs("Global", conf.CallbackURLs)...)
 	for name, requestor := range conf.Requestors {
 		errs = append(errs, conf.validatePermissionSet("Requestor "+name, requestor.Permissions)...)
+		errs = append(errs, validateCallbackURLs("Requestor "+name, requestor.CallbackURLs)...)
 	}
 	if len(errs) != 0 {
 		return errors.New("Errors encountered in permissions:\n" + strings.Join(errs, "\n"))
@@ -290,6 +491,108 @@ func (conf *Configuration) validatePermissions() error {
 	return nil
 }
 
+func (conf *Configuration) validateLimits() error {
+	check := func(name string, limits Limits) error {
+		if limits.SessionsPerMinute < 0 || limits.ConcurrentSessions < 0 || limits.IssuanceSessionsPerDay < 0 {
+			return errors.Errorf("%s limits must not be negative", name)
+		}
+		return nil
+	}
+	if err := check("Global", conf.Limits); err != nil {
+		return err
+	}
+	for name, requestor := range conf.Requestors {
+		if err := check("Requestor "+name, requestor.Limits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) oidcEnabled() bool {
+	return len(conf.OidcClients) > 0
+}
+
+func (conf *Configuration) validateOidc() error {
+	if !conf.oidcEnabled() {
+		return nil
+	}
+	if conf.JwtSigningKey == nil {
+		return errors.New("The OpenID Connect provider requires a JWT private key")
+	}
+	if !strings.HasPrefix(conf.OidcIssuer, "https://") && !strings.HasPrefix(conf.OidcIssuer, "http://") {
+		return errors.New("oidc_issuer must be specified, starting with https:// or http://")
+	}
+	if conf.Production && !strings.HasPrefix(conf.OidcIssuer, "https://") {
+		return errors.New("In production mode, oidc_issuer must start with https://")
+	}
+	conf.OidcIssuer = strings.TrimSuffix(conf.OidcIssuer, "/")
+	if conf.OidcTokenValidity < 0 {
+		return errors.New("oidc_token_validity must not be negative")
+	}
+	if conf.OidcTokenValidity == 0 {
+		conf.OidcTokenValidity = DefaultOidcTokenValidity
+	}
+
+	var errs []string
+	if _, ok := conf.OidcClaims["sub"]; !ok {
+		errs = append(errs, "OpenID Connect claim sub must be configured, as it identifies users to clients")
+	}
+	for claim, attrs := range conf.OidcClaims {
+		switch claim {
+		case "iss", "aud", "exp", "iat", "auth_time", "nonce", "azp":
+			errs = append(errs, fmt.Sprintf("OpenID Connect claim %s is reserved", claim))
+		}
+		if len(attrs) == 0 {
+			errs = append(errs, fmt.Sprintf("OpenID Connect claim %s has no attribute types", claim))
+		}
+		for _, attr := range attrs {
+			if conf.IrmaConfiguration.AttributeTypes[irma.NewAttributeTypeIdentifier(attr)] == nil {
+				errs = append(errs, fmt.Sprintf("OpenID Connect claim %s: unknown attribute type %s", claim, attr))
+			}
+		}
+	}
+	for scope, claims := range conf.OidcScopes {
+		for _, claim := range claims {
+			if _, ok := conf.OidcClaims[claim]; !ok {
+				errs = append(errs, fmt.Sprintf("OpenID Connect scope %s: unknown claim %s", scope, claim))
+			}
+		}
+	}
+	for name, client := range conf.OidcClients {
+		if client.Secret == "" {
+			errs = append(errs, fmt.Sprintf("OpenID Connect client %s has no secret", name))
+		}
+		if len(client.RedirectURIs) == 0 {
+			errs = append(errs, fmt.Sprintf("OpenID Connect client %s has no redirect URIs", name))
+		}
+		for _, uri := range client.RedirectURIs {
+			if u, err := url.Parse(uri); err != nil || !u.IsAbs() || u.Fragment != "" {
+				errs = append(errs, fmt.Sprintf("OpenID Connect client %s: redirect URI %s must be absolute and without fragment", name, uri))
+			}
+		}
+		for _, scope := range client.Scopes {
+			if _, ok := conf.OidcScopes[scope]; !ok && scope != "openid" {
+				errs = append(errs, fmt.Sprintf("OpenID Connect client %s: unknown scope %s", name, scope))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New("Errors encountered in OpenID Connect configuration:\n" + strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+func validateCallbackURLs(requestor string, patterns []string) []string {
+	var errs []string
+	for _, pattern := range patterns {
+		if !strings.HasPrefix(pattern, "https://") && !strings.HasPrefix(pattern, "http://") {
+			errs = append(errs, fmt.Sprintf("%s callback URL pattern '%s' must start with https:// or http://", requestor, pattern))
+		}
+	}
+	return errs
+}
+
 func (conf *Configuration) validatePermissionSet(requestor string, requestorperms Permissions) []string {
 	var errs []string
 	perms := map[string][]string{
@@ -377,13 +680,37 @@ func (conf *Configuration) clientTlsConfig() (*tls.Config, error) {
 }
 
 func (conf *Configuration) tlsConfig() (*tls.Config, error) {
-	return server.TLSConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
+	tlsConf, err := server.TLSConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
+	if err != nil || (conf.TlsClientCA == "" && conf.TlsClientCAFile == "") {
+		return tlsConf, err
+	}
+	if tlsConf == nil {
+		return nil, errors.New("tls_client_ca requires a TLS certificate and private key")
+	}
+
+	cabts, err := common.ReadKey(conf.TlsClientCA, conf.TlsClientCAFile)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to read TLS client CA", 0)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(cabts) {
+		return nil, errors.New("TLS client CA contains no PEM-encoded certificates")
+	}
+	// Client certificates are optional, as the IRMA app and requestors using other authentication
+	// methods do not present one; requestor authentication is done by the ClientCertificateAuthenticator
+	tlsConf.ClientCAs = pool
+	tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConf, nil
 }
 
 func (conf *Configuration) separateClientServer() bool {
 	return conf.ClientPort != 0
 }
 
+func (conf *Configuration) metricsServer() bool {
+	return conf.MetricsPort != 0
+}
+
 // Return true iff query equals an element of strings.
 func contains(strings []string, query string) bool {
 	for _, s := range strings {
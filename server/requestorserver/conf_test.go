@@ -219,3 +219,89 @@ func TestCanVerifyOrSign(t *testing.T) {
 		}
 	}
 }
+
+func TestCanUseCallbackURL(t *testing.T) {
+	confJSON := `{
+		"callback_urls": [ "https://global.example.com/callback" ],
+		"requestors": {
+			"myapp": {
+				"callback_urls": [ "https://*.example.com/irma/**", "http://localhost:8080/*" ],
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			},
+			"otherapp": {
+				"auth_method": "token",
+				"key": "Ba2b6bnLd4kaHS5iS9U"
+			}
+		}
+	}`
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+
+	for url, allowed := range map[string]bool{
+		"https://backend.example.com/irma/callback":        true,
+		"https://backend.example.com/irma/session/result":  true,
+		"https://backend.example.com/other":                false,
+		"https://example.com/irma/callback":                false,
+		"https://evil.com?.example.com/irma/callback":      false,
+		"https://x@evil.com#.example.com/irma/callback":    false,
+		"http://localhost:8080/callback":                   true,
+		"http://localhost:8080/callback/nested":            false,
+		"https://global.example.com/callback":              true,
+		"https://global.example.com/callback/other":        false,
+		"https://backend.example.com.evil.com/irma/result": false,
+	} {
+		require.Equal(t, allowed, conf.CanUseCallbackURL("myapp", url), url)
+	}
+
+	require.True(t, conf.CanUseCallbackURL("otherapp", "https://global.example.com/callback"))
+	require.False(t, conf.CanUseCallbackURL("otherapp", "https://backend.example.com/irma/callback"))
+
+	// The patterns of the requestor must not be modified
+	requestor := conf.Requestors["myapp"]
+	requestor.CallbackURLs = append(make([]string, 0, 3), requestor.CallbackURLs...)
+	conf.Requestors["myapp"] = requestor
+	require.True(t, conf.CanUseCallbackURL("myapp", "https://global.example.com/callback"))
+	require.Equal(t, []string{"https://*.example.com/irma/**", "http://localhost:8080/*", ""},
+		requestor.CallbackURLs[:3])
+
+	// Without any patterns, any callback URL is allowed
+	conf.CallbackURLs = nil
+	require.True(t, conf.CanUseCallbackURL("otherapp", "https://backend.example.com/irma/callback"))
+}
+
+func TestRequestorLimits(t *testing.T) {
+	confJSON := `{
+		"sessions_per_minute": 10,
+		"issuance_sessions_per_day": 100,
+		"requestors": {
+			"myapp": {
+				"sessions_per_minute": 20,
+				"concurrent_sessions": 5,
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			}
+		}
+	}`
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+
+	require.Equal(t, Limits{SessionsPerMinute: 20, ConcurrentSessions: 5, IssuanceSessionsPerDay: 100}, conf.RequestorLimits("myapp"))
+	require.Equal(t, Limits{SessionsPerMinute: 10, IssuanceSessionsPerDay: 100}, conf.RequestorLimits("other"))
+}
+
+func TestOidcClaims(t *testing.T) {
+	conf := &Configuration{OidcScopes: map[string][]string{"openid": nil, "student": {"university"}}}
+	p := &oidcProvider{conf: conf}
+
+	// The sub claim is always included, even if the openid scope does not contain it
+	claims, err := p.claims(OidcClient{}, []string{"openid"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"sub"}, claims)
+	claims, err = p.claims(OidcClient{}, []string{"student", "openid"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"sub", "university"}, claims)
+
+	_, err = p.claims(OidcClient{}, []string{"student"})
+	require.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package requestorserver
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultJwksRefreshInterval is the default interval after which the keys fetched from the JWKS URL
+// of a requestor are refetched (see Configuration.JwksRefreshInterval).
+const DefaultJwksRefreshInterval = 300
+
+// minJwksRefreshInterval is the minimum time between two attempts to fetch the keys of a requestor,
+// so that JWTs containing unknown key identifiers cannot be used to flood the JWKS URL with requests.
+const minJwksRefreshInterval = 10 * time.Second
+
+// jwksKeys are the keys of a requestor that are fetched from its JWKS URL. They are refetched when
+// they are older than the refresh interval, or when a JWT refers to a key identifier that is not
+// among them, so that requestors can rotate their keys without the server configuration changing.
+type jwksKeys struct {
+	requestor string
+	url       string
+	refresh   time.Duration
+	transport *irma.HTTPTransport
+
+	sync.Mutex
+	keys      []requestorKey
+	fetched   time.Time
+	attempted time.Time
+}
+
+// newJwksKeys returns the keys at the JWKS URL of the requestor, which must be a HTTPS URL
+// in production mode, and a HTTP(S) URL otherwise.
+func newJwksKeys(requestor, url string, refresh time.Duration, production bool) (*jwksKeys, error) {
+	if !strings.HasPrefix(url, "https://") {
+		if production {
+			return nil, errors.Errorf("JWKS URL of requestor %s must start with https://", requestor)
+		}
+		if !strings.HasPrefix(url, "http://") {
+			return nil, errors.Errorf("JWKS URL of requestor %s must start with https:// or http://", requestor)
+		}
+		server.Logger.WithFields(logrus.Fields{"requestor": requestor, "url": url}).
+			Warn("JWKS URL of requestor does not use TLS; this is not allowed in production mode")
+	}
+	return &jwksKeys{
+		requestor: requestor,
+		url:       url,
+		refresh:   refresh,
+		transport: irma.NewHTTPTransport("", production),
+	}, nil
+}
+
+// get returns the current keys of the requestor, fetching them if they are outdated or if none
+// of them has the specified key identifier (if not empty). If fetching fails, the previously
+// fetched keys are returned. The keys are fetched without holding the lock, so that a slow JWKS
+// URL does not block other requests; these meanwhile get the previously fetched keys.
+func (j *jwksKeys) get(kid string) []requestorKey {
+	j.Lock()
+	now := time.Now()
+	outdated := now.Sub(j.fetched) > j.refresh || (kid != "" && keyIndex(j.keys, kid) < 0)
+	if !outdated || now.Sub(j.attempted) <= minJwksRefreshInterval {
+		defer j.Unlock()
+		return j.keys
+	}
+	j.attempted = now
+	j.Unlock()
+
+	keys, err := j.fetch()
+
+	j.Lock()
+	defer j.Unlock()
+	if err != nil {
+		server.Logger.WithFields(logrus.Fields{"requestor": j.requestor, "url": j.url}).
+			Warn("Failed to fetch requestor JWKS: ", err)
+	} else {
+		j.keys, j.fetched = keys, now
+	}
+	return j.keys
+}
+
+// fetch returns the RSA signing keys in the JWKS at the URL of the requestor.
+func (j *jwksKeys) fetch() ([]requestorKey, error) {
+	var jwks server.JWKS
+	if err := j.transport.Get(j.url, &jwks); err != nil {
+		return nil, err
+	}
+	if jwks.Keys == nil {
+		return nil, errors.New("JWKS contains no keys")
+	}
+
+	keys := make([]requestorKey, 0, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		// Only RSA keys are used, as the publickey authentication method uses RS256
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		pk, err := jwk.PublicKey()
+		if err != nil {
+			server.Logger.WithFields(logrus.Fields{"requestor": j.requestor, "kid": jwk.ID}).
+				Warn("Ignoring invalid key in requestor JWKS: ", err)
+			continue
+		}
+		keys = append(keys, requestorKey{requestor: j.requestor, id: jwk.ID, key: pk})
+	}
+	return keys, nil
+}
@@ -0,0 +1,547 @@
+package requestorserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-chi/chi"
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultOidcTokenValidity is the default validity in seconds of the ID tokens and access tokens
+// issued by the OpenID Connect provider (see Configuration.OidcTokenValidity).
+const DefaultOidcTokenValidity = 300
+
+// oidcCodeValidity is the validity of authorization codes, within which the client must exchange
+// them for tokens at the token endpoint.
+const oidcCodeValidity = time.Minute
+
+// maxOidcAuthorizations is the maximum amount of pending authentication requests, which are kept
+// in memory until their session is finished or expired.
+const maxOidcAuthorizations = 10000
+
+// OidcClient is a client (relying party) of the OpenID Connect provider.
+type OidcClient struct {
+	// Secret with which the client authenticates at the token endpoint
+	Secret string `json:"secret" mapstructure:"secret"`
+	// Redirect URIs that the client may use in authentication requests
+	RedirectURIs []string `json:"redirect_uris" mapstructure:"redirect_uris"`
+	// Scopes that the client may request; if empty, the client may request all scopes
+	Scopes []string `json:"scopes" mapstructure:"scopes"`
+}
+
+// oidcProvider is an OpenID Connect provider that authenticates users using IRMA disclosure
+// sessions, supporting the authorization code flow. Authentication requests, authorization codes
+// and access tokens are kept in memory.
+type oidcProvider struct {
+	conf     *Configuration
+	irmaserv *irmaserver.Server
+	server   *Server // for the limits of the oidc:<client_id> requestors
+	page     *template.Template
+
+	sync.Mutex
+	authorizations map[string]*oidcAuthorization
+	codes          map[string]*oidcGrant
+	accessTokens   map[string]*oidcGrant
+}
+
+// oidcAuthorization is an authentication request of a client, for which an IRMA session is running.
+type oidcAuthorization struct {
+	client        string
+	redirectURI   string
+	state         string
+	nonce         string
+	codeChallenge string
+	claims        []string // in the order of the disjunctions of the disclosure request
+	token         irma.RequestorToken
+	expires       time.Time
+}
+
+// oidcGrant contains the claims of an authenticated user, which a client can obtain using an
+// authorization code or access token.
+type oidcGrant struct {
+	client        string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	claims        map[string]interface{}
+	authTime      time.Time
+	expires       time.Time
+}
+
+// oidcPageData is passed to the template of the page that is shown to the user during authentication.
+type oidcPageData struct {
+	// Session pointer to be rendered as QR or passed to the IRMA app, and its JSON encoding
+	SessionPtr     *irma.Qr `json:"sessionPtr"`
+	SessionPtrJSON string   `json:"-"`
+	// Universal link that starts the session in the IRMA app on mobile devices
+	AppURL string `json:"appUrl"`
+	// URL to poll until it returns a redirect_uri, to which the user must then be redirected
+	StatusURL string `json:"statusUrl"`
+}
+
+const oidcDefaultPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in with IRMA</title>
+</head>
+<body>
+<p><a href="{{.AppURL}}">Log in with IRMA</a></p>
+<script>
+(function poll() {
+	fetch({{.StatusURL}}, {headers: {"Accept": "application/json"}})
+		.then(function (response) { return response.json(); })
+		.then(function (status) {
+			if (status.redirect_uri) window.location = status.redirect_uri;
+			else setTimeout(poll, 1000);
+		})
+		.catch(function () { setTimeout(poll, 1000); });
+})();
+</script>
+</body>
+</html>
+`
+
+func newOidcProvider(s *Server) (*oidcProvider, error) {
+	conf := s.conf
+	page := oidcDefaultPage
+	if conf.OidcLoginTemplate != "" {
+		bts, err := ioutil.ReadFile(conf.OidcLoginTemplate)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Failed to read oidc_login_template", 0)
+		}
+		page = string(bts)
+	}
+	tmpl, err := template.New("login").Parse(page)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to parse oidc_login_template", 0)
+	}
+	return &oidcProvider{
+		conf:           conf,
+		irmaserv:       s.irmaserv,
+		server:         s,
+		page:           tmpl,
+		authorizations: map[string]*oidcAuthorization{},
+		codes:          map[string]*oidcGrant{},
+		accessTokens:   map[string]*oidcGrant{},
+	}, nil
+}
+
+func (p *oidcProvider) routes(r chi.Router) {
+	r.Get("/.well-known/openid-configuration", p.handleDiscovery)
+	r.Get("/authorize", p.handleAuthorize)
+	r.Get("/authorize/{id}/status", p.handleAuthorizeStatus)
+	r.Post("/token", p.handleToken)
+	r.Get("/userinfo", p.handleUserinfo)
+	r.Post("/userinfo", p.handleUserinfo)
+}
+
+func (p *oidcProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	method, err := server.JwtSigningMethod(p.conf.JwtSigningKey.Public())
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	scopes := []string{"openid"}
+	for scope := range p.conf.OidcScopes {
+		if scope != "openid" {
+			scopes = append(scopes, scope)
+		}
+	}
+	claims := []string{"sub"}
+	for claim := range p.conf.OidcClaims {
+		if claim != "sub" {
+			claims = append(claims, claim)
+		}
+	}
+	sort.Strings(scopes[1:])
+	sort.Strings(claims[1:])
+
+	issuer := p.conf.OidcIssuer
+	server.WriteJson(w, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks.json",
+		"scopes_supported":                      scopes,
+		"claims_supported":                      claims,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{method.Alg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// handleAuthorize handles authentication requests, by starting a disclosure session for the
+// claims of the requested scopes. The session pointer is shown to the user using the login page
+// or, if requested using the Accept header, returned as JSON.
+func (p *oidcProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	clientID, redirectURI := query.Get("client_id"), query.Get("redirect_uri")
+	client, ok := p.conf.OidcClients[clientID]
+	if !ok {
+		server.WriteError(w, server.ErrorInvalidRequest, "unknown client_id")
+		return
+	}
+	if !contains(client.RedirectURIs, redirectURI) {
+		server.WriteError(w, server.ErrorInvalidRequest, "redirect_uri not registered for client")
+		return
+	}
+
+	// From here on, errors are reported to the client by redirecting the user to it
+	state := query.Get("state")
+	if query.Get("response_type") != "code" {
+		p.redirectError(w, r, redirectURI, state, "unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	challenge := query.Get("code_challenge")
+	if challenge != "" && query.Get("code_challenge_method") != "S256" {
+		p.redirectError(w, r, redirectURI, state, "invalid_request", "only the S256 code_challenge_method is supported")
+		return
+	}
+	claims, err := p.claims(client, strings.Fields(query.Get("scope")))
+	if err != nil {
+		p.redirectError(w, r, redirectURI, state, "invalid_scope", err.Error())
+		return
+	}
+
+	request := irma.NewDisclosureRequest()
+	for _, claim := range claims {
+		var discon irma.AttributeDisCon
+		for _, attr := range p.conf.OidcClaims[claim] {
+			discon = append(discon, irma.AttributeCon{irma.NewAttributeRequest(attr)})
+		}
+		request.Disclose = append(request.Disclose, discon)
+	}
+
+	requestor := "oidc:" + clientID
+	p.server.reloadLock.RLock()
+	ok, _, reason := p.server.checkLimits(requestor, irma.ActionDisclosing)
+	p.server.reloadLock.RUnlock()
+	if !ok {
+		p.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor exceeded limit: ", reason)
+		p.redirectError(w, r, redirectURI, state, "temporarily_unavailable", "too many authentication requests")
+		return
+	}
+
+	// Add the authentication request before starting its session, so that concurrent requests
+	// cannot exceed the maximum amount of pending authentication requests
+	id := common.NewRandomString(32, common.AlphanumericChars)
+	auth := &oidcAuthorization{
+		client:        clientID,
+		redirectURI:   redirectURI,
+		state:         state,
+		nonce:         query.Get("nonce"),
+		codeChallenge: challenge,
+		claims:        claims,
+		expires:       time.Now().Add(time.Duration(p.conf.MaxSessionLifetime)*time.Second + oidcCodeValidity),
+	}
+	p.Lock()
+	p.removeExpired()
+	full := len(p.authorizations) >= maxOidcAuthorizations
+	if !full {
+		p.authorizations[id] = auth
+	}
+	p.Unlock()
+	if full {
+		p.server.sessionStarted(requestor, "")
+		p.conf.Logger.Warn("Maximum amount of pending OpenID Connect authentication requests reached")
+		p.redirectError(w, r, redirectURI, state, "temporarily_unavailable", "too many authentication requests")
+		return
+	}
+
+	qr, token, _, err := p.irmaserv.StartSessionFor(requestor, request, nil)
+	p.server.sessionStarted(requestor, token)
+	p.Lock()
+	if err != nil {
+		delete(p.authorizations, id)
+	} else {
+		auth.token = token
+	}
+	p.Unlock()
+	if err != nil {
+		_ = server.LogError(err)
+		p.redirectError(w, r, redirectURI, state, "server_error", "failed to start session")
+		return
+	}
+
+	qrjson, err := json.Marshal(qr)
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	data := oidcPageData{
+		SessionPtr:     qr,
+		SessionPtrJSON: string(qrjson),
+		AppURL:         "https://irma.app/-/session#" + url.PathEscape(string(qrjson)),
+		StatusURL:      p.conf.OidcIssuer + "/authorize/" + id + "/status",
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		server.WriteJson(w, data)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = p.page.Execute(w, data); err != nil {
+		_ = server.LogError(err)
+	}
+}
+
+// handleAuthorizeStatus returns the status of the session of an authentication request and, once
+// it is finished, the redirect_uri to which the user must be redirected: containing an
+// authorization code if the user disclosed the requested attributes, and an error otherwise.
+func (p *oidcProvider) handleAuthorizeStatus(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	p.Lock()
+	defer p.Unlock()
+	auth, ok := p.authorizations[id]
+	if !ok || auth.expires.Before(time.Now()) {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+
+	status := irma.ServerStatusTimeout
+	result := p.irmaserv.GetSessionResult(auth.token)
+	if result != nil {
+		status = result.Status
+	}
+	response := struct {
+		Status      irma.ServerStatus `json:"status"`
+		RedirectURI string            `json:"redirect_uri,omitempty"`
+	}{Status: status}
+	if !status.Finished() {
+		server.WriteJson(w, response)
+		return
+	}
+
+	delete(p.authorizations, id)
+	params := url.Values{}
+	if auth.state != "" {
+		params.Set("state", auth.state)
+	}
+	var claims map[string]interface{}
+	if status == irma.ServerStatusDone && result.ProofStatus == irma.ProofStatusValid && len(result.Disclosed) == len(auth.claims) {
+		claims = oidcClaims(auth.claims, result.Disclosed)
+	}
+	// Without the sub claim, clients cannot recognize the user
+	if _, ok := claims["sub"]; ok {
+		code := common.NewRandomString(32, common.AlphanumericChars)
+		p.codes[code] = &oidcGrant{
+			client:        auth.client,
+			redirectURI:   auth.redirectURI,
+			nonce:         auth.nonce,
+			codeChallenge: auth.codeChallenge,
+			claims:        claims,
+			authTime:      time.Now(),
+			expires:       time.Now().Add(oidcCodeValidity),
+		}
+		params.Set("code", code)
+	} else {
+		params.Set("error", "access_denied")
+	}
+	response.RedirectURI = withParams(auth.redirectURI, params)
+	server.WriteJson(w, response)
+}
+
+// handleToken exchanges an authorization code for an ID token and an access token.
+func (p *oidcProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		oidcError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// Client credentials are form-encoded before being put in the Authorization header
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client, ok := p.conf.OidcClients[clientID]
+	if !ok || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		oidcError(w, http.StatusUnauthorized, "invalid_client", "")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		oidcError(w, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	// Authorization codes can be used only once
+	p.Lock()
+	code := r.PostForm.Get("code")
+	grant, ok := p.codes[code]
+	delete(p.codes, code)
+	p.Unlock()
+	if !ok || grant.expires.Before(time.Now()) || grant.client != clientID || grant.redirectURI != r.PostForm.Get("redirect_uri") {
+		oidcError(w, http.StatusBadRequest, "invalid_grant", "")
+		return
+	}
+	if grant.codeChallenge != "" {
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.codeChallenge {
+			oidcError(w, http.StatusBadRequest, "invalid_grant", "invalid code_verifier")
+			return
+		}
+	}
+
+	now := time.Now()
+	validity := time.Duration(p.conf.OidcTokenValidity) * time.Second
+	claims := jwt.MapClaims{
+		"iss":       p.conf.OidcIssuer,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(validity).Unix(),
+		"auth_time": grant.authTime.Unix(),
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	for name, value := range grant.claims {
+		claims[name] = value
+	}
+	idToken, err := server.SignJwt(claims, p.conf.JwtSigningKey)
+	if err != nil {
+		_ = server.LogError(err)
+		oidcError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	accessToken := common.NewRandomString(32, common.AlphanumericChars)
+	p.Lock()
+	p.removeExpired()
+	p.accessTokens[accessToken] = &oidcGrant{client: clientID, claims: grant.claims, expires: now.Add(validity)}
+	p.Unlock()
+
+	p.conf.Logger.WithFields(logrus.Fields{"client": clientID, "claims": len(grant.claims) - 1}).Info("OpenID Connect tokens issued")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	server.WriteJson(w, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   p.conf.OidcTokenValidity,
+		"id_token":     idToken,
+	})
+}
+
+// handleUserinfo returns the claims of the user to whom the bearer access token was issued.
+func (p *oidcProvider) handleUserinfo(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		oidcError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+	p.Lock()
+	grant, ok := p.accessTokens[strings.TrimPrefix(auth, "Bearer ")]
+	p.Unlock()
+	if !ok || grant.expires.Before(time.Now()) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		oidcError(w, http.StatusUnauthorized, "invalid_token", "")
+		return
+	}
+	server.WriteJson(w, grant.claims)
+}
+
+// claims returns the sub claim and the claims of the requested scopes, which must include openid
+// and which the client must be allowed to request, in lexicographic order.
+func (p *oidcProvider) claims(client OidcClient, scopes []string) ([]string, error) {
+	if !contains(scopes, "openid") {
+		return nil, errors.New("scope must include openid")
+	}
+	set := map[string]struct{}{"sub": {}}
+	for _, scope := range scopes {
+		if _, ok := p.conf.OidcScopes[scope]; !ok && scope != "openid" {
+			return nil, errors.Errorf("unknown scope %s", scope)
+		}
+		if len(client.Scopes) > 0 && scope != "openid" && !contains(client.Scopes, scope) {
+			return nil, errors.Errorf("scope %s not allowed for client", scope)
+		}
+		for _, claim := range p.conf.OidcScopes[scope] {
+			set[claim] = struct{}{}
+		}
+	}
+	claims := make([]string, 0, len(set))
+	for claim := range set {
+		claims = append(claims, claim)
+	}
+	sort.Strings(claims)
+	return claims, nil
+}
+
+// removeExpired removes expired authentication requests, authorization codes and access tokens.
+// The caller must hold the lock.
+func (p *oidcProvider) removeExpired() {
+	now := time.Now()
+	for id, auth := range p.authorizations {
+		if auth.expires.Before(now) {
+			delete(p.authorizations, id)
+		}
+	}
+	for _, grants := range []map[string]*oidcGrant{p.codes, p.accessTokens} {
+		for token, grant := range grants {
+			if grant.expires.Before(now) {
+				delete(grants, token)
+			}
+		}
+	}
+}
+
+func (p *oidcProvider) redirectError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) {
+	params := url.Values{"error": {code}, "error_description": {description}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	http.Redirect(w, r, withParams(redirectURI, params), http.StatusFound)
+}
+
+// oidcClaims returns the claims containing the disclosed attributes, which were requested in
+// the order of the names. Claims whose attribute has no value are left out.
+func oidcClaims(names []string, disclosed [][]*irma.DisclosedAttribute) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for i, name := range names {
+		if len(disclosed[i]) > 0 && disclosed[i][0].RawValue != nil {
+			claims[name] = *disclosed[i][0].RawValue
+		}
+	}
+	return claims
+}
+
+func oidcError(w http.ResponseWriter, status int, code, description string) {
+	response := map[string]string{"error": code}
+	if description != "" {
+		response["error_description"] = description
+	}
+	bts, _ := json.Marshal(response)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(bts)
+}
+
+func withParams(uri string, params url.Values) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + params.Encode()
+	}
+	return uri + "?" + params.Encode()
+}
@@ -0,0 +1,102 @@
+package requestorserver
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Reload replaces the requestors, the global permissions and limits, the static sessions and the
+// TLS certificates and client CA of the server with those of the specified configuration; all other parts of the
+// specified configuration are ignored. The new configuration is validated in its entirety before
+// it is swapped in: if it is invalid, an error is returned and the current configuration is kept.
+func (s *Server) Reload(config *Configuration) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	return s.reload(config)
+}
+
+// ReloadConfiguration obtains a new configuration from Configuration.Reloader, and reloads the
+// server with it using Reload().
+func (s *Server) ReloadConfiguration() error {
+	if s.conf.Reloader == nil {
+		return errors.New("no configuration reloader specified")
+	}
+
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	config, err := s.conf.Reloader()
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read configuration", 0)
+	}
+	return s.reload(config)
+}
+
+func (s *Server) reload(config *Configuration) error {
+	// Validate the new configuration using a copy of the current one
+	candidate := *s.conf
+	candidate.Permissions = config.Permissions
+	candidate.Limits = config.Limits
+	candidate.Requestors = config.Requestors
+	candidate.TlsCertificate = config.TlsCertificate
+	candidate.TlsCertificateFile = config.TlsCertificateFile
+	candidate.TlsPrivateKey = config.TlsPrivateKey
+	candidate.TlsPrivateKeyFile = config.TlsPrivateKeyFile
+	candidate.TlsClientCA = config.TlsClientCA
+	candidate.TlsClientCAFile = config.TlsClientCAFile
+	candidate.ClientTlsCertificate = config.ClientTlsCertificate
+	candidate.ClientTlsCertificateFile = config.ClientTlsCertificateFile
+	candidate.ClientTlsPrivateKey = config.ClientTlsPrivateKey
+	candidate.ClientTlsPrivateKeyFile = config.ClientTlsPrivateKeyFile
+
+	if err := candidate.validatePermissions(); err != nil {
+		return err
+	}
+	if err := candidate.validateLimits(); err != nil {
+		return err
+	}
+	auths, err := candidate.newAuthenticators()
+	if err != nil {
+		return err
+	}
+
+	// The listeners cannot switch between HTTP and HTTPS, so only the certificates can be replaced
+	tlsConf, err := candidate.tlsConfig()
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read TLS configuration", 0)
+	}
+	if (tlsConf == nil) != (s.tlsConf == nil) {
+		return errors.New("Enabling or disabling TLS requires a restart")
+	}
+	clientTlsConf, err := candidate.clientTlsConfig()
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read client TLS configuration", 0)
+	}
+	if (clientTlsConf == nil) != (s.clientTlsConf == nil) {
+		return errors.New("Enabling or disabling client TLS requires a restart")
+	}
+
+	// This validates the static sessions, and replaces them only if they are valid. Since this is
+	// the last step that can fail, nothing has been modified yet if it does.
+	if err = s.irmaserv.SetStaticSessions(config.StaticSessions); err != nil {
+		return err
+	}
+
+	s.conf.Permissions = candidate.Permissions
+	s.conf.Limits = candidate.Limits
+	s.conf.Requestors = candidate.Requestors
+	s.conf.TlsCertificate = candidate.TlsCertificate
+	s.conf.TlsCertificateFile = candidate.TlsCertificateFile
+	s.conf.TlsPrivateKey = candidate.TlsPrivateKey
+	s.conf.TlsPrivateKeyFile = candidate.TlsPrivateKeyFile
+	s.conf.TlsClientCA = candidate.TlsClientCA
+	s.conf.TlsClientCAFile = candidate.TlsClientCAFile
+	s.conf.ClientTlsCertificate = candidate.ClientTlsCertificate
+	s.conf.ClientTlsCertificateFile = candidate.ClientTlsCertificateFile
+	s.conf.ClientTlsPrivateKey = candidate.ClientTlsPrivateKey
+	s.conf.ClientTlsPrivateKeyFile = candidate.ClientTlsPrivateKeyFile
+	s.tlsConf = tlsConf
+	s.clientTlsConf = clientTlsConf
+	authenticators = auths
+
+	s.conf.Logger.WithField("requestors", len(s.conf.Requestors)).Info("Configuration reloaded")
+	return nil
+}
@@ -6,6 +6,7 @@ package requestorserver
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -13,15 +14,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
+	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,6 +35,23 @@ type Server struct {
 	irmaserv *irmaserver.Server
 	stop     chan struct{}
 	stopped  chan struct{}
+
+	sessionsPerMinute *server.RateLimiter
+	issuancePerDay    *server.RateLimiter
+
+	// Protects the following fields, and makes checking and taking the limits of requestors atomic
+	limitsLock sync.Mutex
+	// Unfinished sessions of requestors that have a limit on concurrent sessions
+	sessions map[string]map[irma.RequestorToken]struct{}
+	// Amount of sessions of requestors that passed checkLimits() but have not yet been started
+	reserved map[string]int
+
+	// Protects the parts of the configuration that can be replaced using Reload()
+	reloadLock    sync.RWMutex
+	tlsConf       *tls.Config
+	clientTlsConf *tls.Config
+
+	oidc *oidcProvider
 }
 
 // Start the server. If successful then it will not return until Stop() is called.
@@ -42,7 +63,8 @@ func (s *Server) Start(config *Configuration) error {
 		s.conf.Logger.Debug("Configuration: ", string(bts), "\n")
 	}
 
-	// We start either one or two servers, depending on whether a separate client server is enabled, such that:
+	// We start one, two or three servers, depending on whether a separate client server and a metrics server
+	// are enabled, such that:
 	// - if any of them returns, the other is also stopped (neither of them is of use without the other)
 	// - if any of them returns an unexpected error (ie. other than http.ErrServerClosed), the error is logged and returned
 	// - we have a way of stopping all servers from outside (with Stop())
@@ -52,7 +74,10 @@ func (s *Server) Start(config *Configuration) error {
 
 	count := 1
 	if s.conf.separateClientServer() {
-		count = 2
+		count++
+	}
+	if s.conf.metricsServer() {
+		count++
 	}
 	done := make(chan error, count)
 	s.stop = make(chan struct{})
@@ -63,6 +88,11 @@ func (s *Server) Start(config *Configuration) error {
 			done <- s.startClientServer()
 		}()
 	}
+	if s.conf.metricsServer() {
+		go func() {
+			done <- s.startMetricsServer()
+		}()
+	}
 	go func() {
 		done <- s.startRequestorServer()
 	}()
@@ -83,13 +113,66 @@ func (s *Server) Start(config *Configuration) error {
 }
 
 func (s *Server) startRequestorServer() error {
-	tlsConf, _ := s.conf.tlsConfig()
-	return s.startServer(s.Handler(), "Server", s.conf.ListenAddress, s.conf.Port, tlsConf)
+	return s.startServer(s.Handler(), "Server", s.conf.ListenAddress, s.conf.Port, s.serverTlsConfig(false))
 }
 
 func (s *Server) startClientServer() error {
-	tlsConf, _ := s.conf.clientTlsConfig()
-	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
+	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, s.serverTlsConfig(true))
+}
+
+// serverTlsConfig returns the TLS configuration of the requestor server, or of the client server
+// if client is true, or nil if TLS is disabled. The returned configuration always uses the current
+// TLS certificate, so that it can be replaced by Reload() without restarting the server.
+func (s *Server) serverTlsConfig(client bool) *tls.Config {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	tlsConf := s.tlsConf
+	if client {
+		tlsConf = s.clientTlsConf
+	}
+	if tlsConf == nil {
+		return nil
+	}
+
+	tlsConf = tlsConf.Clone()
+	tlsConf.Certificates = nil
+	tlsConf.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		s.reloadLock.RLock()
+		defer s.reloadLock.RUnlock()
+		if client {
+			return &s.clientTlsConf.Certificates[0], nil
+		}
+		return &s.tlsConf.Certificates[0], nil
+	}
+	if !client {
+		// Also use the current CA against which TLS client certificates are verified
+		tlsConf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.reloadLock.RLock()
+			defer s.reloadLock.RUnlock()
+			return s.tlsConf, nil
+		}
+	}
+	return tlsConf
+}
+
+// requestAuthenticators returns the authenticators of the current configuration with which the
+// request can be authenticated, passing the verified TLS client certificates of the request (if any)
+// to authenticators that need them.
+func (s *Server) requestAuthenticators(r *http.Request) []Authenticator {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	auths := make([]Authenticator, 0, len(authenticators))
+	for _, authenticator := range authenticators {
+		if a, ok := authenticator.(PeerCertificateAuthenticator); ok && r.TLS != nil {
+			authenticator = a.WithPeerCertificates(r.TLS.VerifiedChains)
+		}
+		auths = append(auths, authenticator)
+	}
+	return auths
+}
+
+func (s *Server) startMetricsServer() error {
+	return s.startServer(s.MetricsHandler(), "Metrics server", s.conf.MetricsListenAddress, s.conf.MetricsPort, nil)
 }
 
 func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
@@ -130,6 +213,9 @@ func (s *Server) Stop() {
 	if s.conf.separateClientServer() {
 		<-s.stopped
 	}
+	if s.conf.metricsServer() {
+		<-s.stopped
+	}
 }
 
 func New(config *Configuration) (*Server, error) {
@@ -140,10 +226,24 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
-	return &Server{
-		conf:     config,
-		irmaserv: irmaserv,
-	}, nil
+	tlsConf, _ := config.tlsConfig()
+	clientTlsConf, _ := config.clientTlsConfig()
+	s := &Server{
+		conf:              config,
+		irmaserv:          irmaserv,
+		sessionsPerMinute: server.NewRateLimiter(time.Minute),
+		issuancePerDay:    server.NewRateLimiter(24 * time.Hour),
+		sessions:          map[string]map[irma.RequestorToken]struct{}{},
+		reserved:          map[string]int{},
+		tlsConf:           tlsConf,
+		clientTlsConf:     clientTlsConf,
+	}
+	if config.oidcEnabled() {
+		if s.oidc, err = newOidcProvider(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 var corsOptions = cors.Options{
@@ -165,6 +265,13 @@ func (s *Server) ClientHandler() http.Handler {
 	return s.prefixRouter(router)
 }
 
+// MetricsHandler returns a http.Handler that exposes the Prometheus metrics of the server at /metrics.
+func (s *Server) MetricsHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Handle("/metrics", promhttp.Handler())
+	return router
+}
+
 func (s *Server) attachClientEndpoints(router *chi.Mux) {
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
 	if s.conf.StaticPath != "" {
@@ -183,6 +290,14 @@ func (s *Server) Handler() http.Handler {
 		s.attachClientEndpoints(router)
 	}
 
+	// Health checks, without authentication
+	router.Get("/health", server.HandleHealth)
+	router.Get("/ready", server.ReadinessHandler(func() map[string]server.HealthCheck {
+		checks := s.conf.HealthChecks()
+		checks["sessions"] = s.irmaserv.CheckStopping
+		return checks
+	}))
+
 	log := server.LogOptions{Response: true, Headers: true, From: true}
 	router.NotFound(server.LogMiddleware("requestor", log)(router.NotFoundHandler()).ServeHTTP)
 	router.MethodNotAllowed(server.LogMiddleware("requestor", log)(router.MethodNotAllowedHandler()).ServeHTTP)
@@ -196,11 +311,14 @@ func (s *Server) Handler() http.Handler {
 		r.Use(cors.New(corsOptions).Handler)
 		if s.conf.Verbose >= 2 {
 			r.Use(server.LogMiddleware("requestor", log))
+		} else {
+			r.Use(server.TracingMiddleware("requestor"))
 		}
 
 		// Server routes
 		r.Route("/session", func(r chi.Router) {
 			r.Post("/", s.handleCreateSession)
+			r.Post("/validate", s.handleValidateSession)
 			r.Route("/{requestorToken}", func(r chi.Router) {
 				r.Delete("/", s.handleDelete)
 				r.Get("/status", s.handleStatus)
@@ -213,6 +331,7 @@ func (s *Server) Handler() http.Handler {
 		})
 
 		r.Get("/publickey", s.handlePublicKey)
+		r.Get("/.well-known/jwks.json", s.handleJwks)
 	})
 
 	router.Group(func(r chi.Router) {
@@ -221,10 +340,59 @@ func (s *Server) Handler() http.Handler {
 		r.Use(cors.New(corsOptions).Handler)
 		if s.conf.Verbose >= 2 {
 			r.Use(server.LogMiddleware("revocation", log))
+		} else {
+			r.Use(server.TracingMiddleware("revocation"))
 		}
 		r.Post("/revocation", s.handleRevocation)
+		r.Post("/revocation/records", s.handleIssuanceRecords)
+		r.Post("/revocation/status", s.handleRevocationStatus)
 	})
 
+	if s.oidc != nil {
+		router.Group(func(r chi.Router) {
+			r.Use(server.SizeLimitMiddleware)
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Use(cors.New(corsOptions).Handler)
+			if s.conf.Verbose >= 2 {
+				r.Use(server.LogMiddleware("oidc", log))
+			} else {
+				r.Use(server.TracingMiddleware("oidc"))
+			}
+			r.Route("/oidc", func(r chi.Router) {
+				s.oidc.routes(r)
+				r.Get("/jwks.json", s.handleJwks)
+			})
+		})
+	}
+
+	if s.conf.AdminToken != "" {
+		router.Group(func(r chi.Router) {
+			r.Use(server.SizeLimitMiddleware)
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Use(cors.New(corsOptions).Handler)
+			if s.conf.Verbose >= 2 {
+				r.Use(server.LogMiddleware("admin", log))
+			} else {
+				r.Use(server.TracingMiddleware("admin"))
+			}
+			r.Use(s.adminMiddleware)
+			r.Route("/admin/sessions", func(r chi.Router) {
+				r.Get("/", s.handleAdminSessions)
+				r.Route("/{requestorToken}", func(r chi.Router) {
+					r.Delete("/", s.handleAdminDelete)
+				})
+			})
+			r.Post("/admin/reload", s.handleAdminReload)
+			r.Route("/admin/callbacks", func(r chi.Router) {
+				r.Get("/", s.handleAdminCallbacks)
+				r.Route("/{id}", func(r chi.Router) {
+					r.Delete("/", s.handleAdminCallbackDelete)
+					r.Post("/retry", s.handleAdminCallbackRetry)
+				})
+			})
+		})
+	}
+
 	return s.prefixRouter(router)
 }
 
@@ -241,6 +409,77 @@ func (s *Server) StaticFilesHandler() http.Handler {
 	)
 }
 
+// checkLimits checks whether the requestor may start another session of the specified type
+// without exceeding its limits. If so, it records the session start and reserves a slot for the
+// session, which must be passed on to sessionStarted() once the session is started or has failed
+// to start. The caller must hold the reloadLock.
+func (s *Server) checkLimits(requestor string, action irma.Action) (bool, time.Duration, string) {
+	s.limitsLock.Lock()
+	defer s.limitsLock.Unlock()
+
+	limits := s.conf.RequestorLimits(requestor)
+	if limits.ConcurrentSessions > 0 && s.concurrentSessions(requestor, limits.ConcurrentSessions) >= limits.ConcurrentSessions {
+		return false, time.Duration(s.conf.SessionLifetime) * time.Second, "concurrent_sessions"
+	}
+	if ok, retryAfter := s.sessionsPerMinute.Check(requestor, limits.SessionsPerMinute); !ok {
+		return false, retryAfter, "sessions_per_minute"
+	}
+	if action == irma.ActionIssuing {
+		if ok, retryAfter := s.issuancePerDay.Check(requestor, limits.IssuanceSessionsPerDay); !ok {
+			return false, retryAfter, "issuance_sessions_per_day"
+		}
+	}
+
+	// All limits allow the session, so take its slots
+	s.sessionsPerMinute.Allow(requestor, limits.SessionsPerMinute)
+	if action == irma.ActionIssuing {
+		s.issuancePerDay.Allow(requestor, limits.IssuanceSessionsPerDay)
+	}
+	s.reserved[requestor]++
+	return true, 0, ""
+}
+
+// sessionStarted releases the slot reserved by checkLimits(), and if the session was started
+// (i.e. token is nonempty) and the requestor has a limit on concurrent sessions, keeps track of it
+// until it is finished.
+func (s *Server) sessionStarted(requestor string, token irma.RequestorToken) {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	s.limitsLock.Lock()
+	defer s.limitsLock.Unlock()
+
+	if s.reserved[requestor]--; s.reserved[requestor] <= 0 {
+		delete(s.reserved, requestor)
+	}
+	if token == "" || s.conf.RequestorLimits(requestor).ConcurrentSessions <= 0 {
+		return
+	}
+	if s.sessions[requestor] == nil {
+		s.sessions[requestor] = map[irma.RequestorToken]struct{}{}
+	}
+	s.sessions[requestor][token] = struct{}{}
+}
+
+// concurrentSessions returns the amount of unfinished sessions of the requestor, including those
+// being started. Only if the limit is reached, the status of the sessions is checked to forget
+// finished sessions, so that the session store is not consulted for each new session.
+// The caller must hold the limitsLock.
+func (s *Server) concurrentSessions(requestor string, limit int) int {
+	sessions := s.sessions[requestor]
+	if len(sessions)+s.reserved[requestor] < limit {
+		return len(sessions) + s.reserved[requestor]
+	}
+	for token := range sessions {
+		if result := s.irmaserv.GetSessionResult(token); result == nil || result.Status.Finished() {
+			delete(sessions, token)
+		}
+	}
+	if len(sessions) == 0 {
+		delete(s.sessions, requestor)
+	}
+	return len(sessions) + s.reserved[requestor]
+}
+
 func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -259,7 +498,7 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
+	for _, authenticator := range s.requestAuthenticators(r) { // rrequest abbreviates "requestor request"
 		applies, rrequest, requestor, rerr = authenticator.AuthenticateSession(r.Header, body)
 		if applies || rerr != nil {
 			break
@@ -272,6 +511,59 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 	s.createSession(w, requestor, rrequest)
 }
 
+// handleValidateSession authenticates and checks a session request like handleCreateSession,
+// but instead of starting a session it returns all problems found in the request.
+func (s *Server) handleValidateSession(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.conf.Logger.Error("Could not read session request HTTP POST body")
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+
+	// JWTs that could not be authenticated are refused, instead of being reported as malformed below
+	for _, authenticator := range s.requestAuthenticators(r) {
+		if verifier, ok := authenticator.(jwtVerifier); ok {
+			if applies, err := verifier.verifyJwt(r.Header, body); applies && err != nil {
+				s.conf.Logger.Warn("Session request to validate could not be authenticated: ", err.Error())
+				server.WriteError(w, server.ErrorUnauthenticated, err.Error())
+				return
+			}
+		}
+	}
+
+	var (
+		rrequest  irma.RequestorRequest
+		requestor string
+		rerr      *irma.RemoteError
+		applies   bool
+	)
+	for _, authenticator := range s.requestAuthenticators(r) {
+		applies, rrequest, requestor, rerr = authenticator.AuthenticateSession(r.Header, body)
+		if applies || rerr != nil {
+			break
+		}
+	}
+	// Requests that were authenticated but could not be parsed are reported as problem,
+	// while other authentication failures are refused by checkAuth
+	if rerr != nil && rerr.ErrorName == string(server.ErrorInvalidRequest.Type) {
+		server.WriteJson(w, server.NewRequestValidation([]*server.RequestProblem{
+			{Type: server.ProblemMalformedRequest, Message: rerr.Message},
+		}))
+		return
+	}
+	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
+		return
+	}
+
+	s.reloadLock.RLock()
+	problems := s.requestorProblems(requestor, rrequest)
+	s.reloadLock.RUnlock()
+	problems = append(problems, s.irmaserv.CheckSessionRequest(rrequest)...)
+	server.WriteJson(w, server.NewRequestValidation(problems))
+}
+
 func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -287,7 +579,7 @@ func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 		rerr      *irma.RemoteError
 		applies   bool
 	)
-	for _, authenticator := range authenticators {
+	for _, authenticator := range s.requestAuthenticators(r) {
 		applies, revreq, requestor, rerr = authenticator.AuthenticateRevocation(r.Header, body)
 		if applies || rerr != nil {
 			break
@@ -297,7 +589,84 @@ func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.revoke(w, requestor, revreq)
+	s.revoke(r.Context(), w, requestor, revreq)
+}
+
+// handleIssuanceRecords returns a page of the issuance records matching the request.
+func (s *Server) handleIssuanceRecords(w http.ResponseWriter, r *http.Request) {
+	request, ok := s.authenticateIssuanceRecords(w, r)
+	if !ok {
+		return
+	}
+	records, err := s.irmaserv.IssuanceRecords(request)
+	if err != nil {
+		server.WriteError(w, server.ErrorRevocation, err.Error())
+		return
+	}
+	server.WriteJson(w, records)
+}
+
+// handleRevocationStatus returns the revocation status of the credentials issued with the
+// revocationKey of the request. Other filters of the request are ignored.
+func (s *Server) handleRevocationStatus(w http.ResponseWriter, r *http.Request) {
+	request, ok := s.authenticateIssuanceRecords(w, r)
+	if !ok {
+		return
+	}
+	if request.Key == "" {
+		server.WriteError(w, server.ErrorInvalidRequest, "no revocationKey specified")
+		return
+	}
+	status, err := s.irmaserv.RevocationKeyStatus(request.CredentialType, request.Key)
+	if err == irma.ErrUnknownRevocationKey {
+		server.WriteError(w, server.ErrorUnknownRevocationKey, request.Key)
+		return
+	}
+	if err != nil {
+		server.WriteError(w, server.ErrorRevocation, err.Error())
+		return
+	}
+	server.WriteJson(w, status)
+}
+
+// authenticateIssuanceRecords authenticates the issuance records request in the HTTP request, and
+// checks that the requestor is allowed to revoke its credential type. Otherwise, it writes an
+// error and returns false.
+func (s *Server) authenticateIssuanceRecords(w http.ResponseWriter, r *http.Request) (*irma.IssuanceRecordsRequest, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.conf.Logger.Error("Could not read issuance records request HTTP POST body")
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	var (
+		request   *irma.IssuanceRecordsRequest
+		requestor string
+		rerr      *irma.RemoteError
+		applies   bool
+	)
+	for _, authenticator := range s.requestAuthenticators(r) {
+		applies, request, requestor, rerr = authenticator.AuthenticateIssuanceRecords(r.Header, body)
+		if applies || rerr != nil {
+			break
+		}
+	}
+	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
+		return nil, false
+	}
+
+	s.reloadLock.RLock()
+	allowed, reason := s.conf.CanRevoke(requestor, request.CredentialType)
+	s.reloadLock.RUnlock()
+	if !allowed {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "message": reason}).
+			Warn("Requestor not authorized to query issuance records; full request: ", server.ToJson(request))
+		server.WriteError(w, server.ErrorUnauthorized, reason)
+		return nil, false
+	}
+	return request, true
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -332,13 +701,82 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.AdminToken)) != 1 {
+			s.conf.Logger.Warn("Admin API accessed with invalid or missing admin token")
+			server.WriteError(w, server.ErrorAdminUnauthorized, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.irmaserv.ActiveSessions())
+}
+
+func (s *Server) handleAdminDelete(w http.ResponseWriter, r *http.Request) {
+	requestorToken := irma.RequestorToken(chi.URLParam(r, "requestorToken"))
+	if err := s.irmaserv.CancelSession(requestorToken); err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"session": requestorToken}).Info("Session cancelled using admin API")
+}
+
+func (s *Server) handleAdminCallbacks(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.irmaserv.DeadCallbacks())
+}
+
+func (s *Server) handleAdminCallbackDelete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := s.irmaserv.DiscardCallback(id); err != nil {
+		server.WriteError(w, server.ErrorCallbackUnknown, "")
+		return
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"callback": id}).Info("Result callback discarded using admin API")
+}
+
+func (s *Server) handleAdminCallbackRetry(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := s.irmaserv.RetryCallback(id); err != nil {
+		server.WriteError(w, server.ErrorCallbackUnknown, "")
+		return
+	}
+	s.conf.Logger.WithFields(logrus.Fields{"callback": id}).Info("Result callback requeued using admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if s.conf.Reloader == nil {
+		server.WriteError(w, server.ErrorUnsupported, "reloading the configuration is not supported")
+		return
+	}
+	if err := s.ReloadConfiguration(); err != nil {
+		s.conf.Logger.Warn("Failed to reload configuration using admin API: ", err.Error())
+		server.WriteError(w, server.ErrorReloadFailed, err.Error())
+		return
+	}
+	s.conf.Logger.Info("Configuration reloaded using admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
+	format, err := server.ParseResultFormat(r.URL.Query().Get(server.ResultFormatParameter))
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
 	res := s.irmaserv.GetSessionResult(irma.RequestorToken(chi.URLParam(r, "requestorToken")))
 	if res == nil {
 		server.WriteError(w, server.ErrorSessionUnknown, "")
 		return
 	}
-	if res.LegacySession {
+	if format == server.ResultFormatVP {
+		server.WriteJson(w, server.NewVerifiablePresentation(res))
+	} else if res.LegacySession {
 		server.WriteJson(w, res.Legacy())
 	} else {
 		server.WriteJson(w, res)
@@ -346,12 +784,17 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.conf.JwtSigningKey == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
+	format, err := server.ParseResultFormat(r.URL.Query().Get(server.ResultFormatParameter))
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
 	requestorToken := irma.RequestorToken(chi.URLParam(r, "requestorToken"))
 	res := s.irmaserv.GetSessionResult(requestorToken)
 	if res == nil {
@@ -359,10 +802,10 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	j, err := server.ResultJwt(res,
+	j, err := server.FormattedResultJwt(res, format,
 		s.conf.JwtIssuer,
 		s.irmaserv.GetRequest(res.Token).Base().ResultJwtValidity,
-		s.conf.JwtRSAPrivateKey,
+		s.conf.JwtSigningKey,
 	)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
@@ -374,7 +817,7 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.conf.JwtSigningKey == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
@@ -424,8 +867,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.JwtRSAPrivateKey)
+	resultJwt, err := server.SignJwt(claims, s.conf.JwtSigningKey)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
@@ -436,12 +878,12 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.conf.JwtSigningKey == nil {
 		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
 
-	bts, err := x509.MarshalPKIXPublicKey(&s.conf.JwtRSAPrivateKey.PublicKey)
+	bts, err := x509.MarshalPKIXPublicKey(s.conf.JwtSigningKey.Public())
 	if err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -453,65 +895,28 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(pubBytes)
 }
 
-func (s *Server) doResultCallback(result *server.SessionResult) {
-	url := s.irmaserv.GetRequest(result.Token).Base().CallbackURL
-	if url == "" {
+func (s *Server) handleJwks(w http.ResponseWriter, r *http.Request) {
+	jwks := s.conf.JwtKeySet()
+	if len(jwks.Keys) == 0 {
+		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
-	server.DoResultCallback(url,
-		result,
-		s.conf.JwtIssuer,
-		s.irmaserv.GetRequest(result.Token).Base().ResultJwtValidity,
-		s.conf.JwtRSAPrivateKey,
-	)
+	server.WriteJson(w, jwks)
 }
 
 func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest irma.RequestorRequest) {
-	// Authorize request: check if the requestor is allowed to verify or issue
-	// the requested attributes or credentials
-	request := rrequest.SessionRequest()
-	if request.Action() == irma.ActionIssuing {
-		allowed, reason := s.conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to issue credential; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
-	}
-
-	condiscon := request.Disclosure().Disclose
-	if len(condiscon) > 0 {
-		allowed, reason := s.conf.CanVerifyOrSign(requestor, request.Action(), condiscon)
-		if !allowed {
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
-				Warn("Requestor not authorized to verify attribute; full request: ", server.ToJson(request))
-			server.WriteError(w, server.ErrorUnauthorized, reason)
-			return
-		}
-	}
-
-	if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL == "" {
-		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("nextSession provided with empty URL")
-		server.WriteError(w, server.ErrorInvalidRequest, "nextSession provided with empty URL")
-	}
-	if s.conf.JwtRSAPrivateKey == nil && !s.conf.AllowUnsignedCallbacks {
-		var field string
-		if rrequest.Base().CallbackURL != "" {
-			field = "callbackUrl"
-		} else if rrequest.Base().NextSession != nil {
-			field = "nextSession"
-		}
-		if field != "" {
-			errormsg := field + " provided but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration"
-			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn(errormsg)
-			server.WriteError(w, server.ErrorUnsupported, errormsg)
-			return
-		}
+	if ok := s.authorizeSession(w, requestor, rrequest); !ok {
+		return
 	}
 
 	// Everything is authenticated and parsed, we're good to go!
-	qr, requestorToken, frontendRequest, err := s.irmaserv.StartSession(rrequest, s.doResultCallback)
+	// If the request contains a callbackUrl, the irmaserver POSTs the session result to it.
+	qr, requestorToken, frontendRequest, err := s.irmaserv.StartSessionFor(requestor, rrequest, nil)
+	s.sessionStarted(requestor, requestorToken)
+	if err == irmaserver.ErrShuttingDown {
+		server.WriteError(w, server.ErrorShuttingDown, "")
+		return
+	}
 	if err != nil {
 		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
 		return
@@ -524,21 +929,44 @@ func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest
 	})
 }
 
-func (s *Server) revoke(w http.ResponseWriter, requestor string, request *irma.RevocationRequest) {
+// authorizeSession checks that the requestor may start the specified session, writing an error
+// to the response writer and returning false if not.
+func (s *Server) authorizeSession(w http.ResponseWriter, requestor string, rrequest irma.RequestorRequest) bool {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+
+	if problems := s.requestorProblems(requestor, rrequest); len(problems) > 0 {
+		problem := problems[0]
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "problem": problem.Type, "id": problem.Identifier}).
+			Warn("Requestor not authorized to start session: ", problem.Message, "; full request: ", server.ToJson(rrequest.SessionRequest()))
+		server.WriteError(w, requestProblemErrors[problem.Type], problem.Message)
+		return false
+	}
+
+	if ok, retryAfter, reason := s.checkLimits(requestor, rrequest.SessionRequest().Action()); !ok {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("Requestor exceeded limit: ", reason)
+		server.WriteTooManyRequests(w, retryAfter, reason)
+		return false
+	}
+	return true
+}
+
+func (s *Server) revoke(ctx context.Context, w http.ResponseWriter, requestor string, request *irma.RevocationRequest) {
+	s.reloadLock.RLock()
 	allowed, reason := s.conf.CanRevoke(requestor, request.CredentialType)
+	s.reloadLock.RUnlock()
 	if !allowed {
 		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "message": reason}).
 			Warn("Requestor not authorized to revoke credential; full request: ", server.ToJson(request))
 		server.WriteError(w, server.ErrorUnauthorized, reason)
 		return
 	}
-	var issued time.Time
-	if request.Issued != 0 {
-		issued = time.Unix(0, request.Issued)
-	}
-	if err := s.irmaserv.Revoke(request.CredentialType, request.Key, issued); err != nil {
+	if err := s.irmaserv.RevokeBatchContext(ctx, request.CredentialType, request.RevocationKeys()); err != nil {
 		if err == irma.ErrUnknownRevocationKey {
 			server.WriteError(w, server.ErrorUnknownRevocationKey, request.Key)
+		} else if errors.Is(err, irma.ErrUnknownRevocationKey) {
+			// the error is prefixed with the unknown key of the batch
+			server.WriteError(w, server.ErrorUnknownRevocationKey, err.Error())
 		} else {
 			server.WriteError(w, server.ErrorRevocation, err.Error())
 		}
@@ -547,6 +975,71 @@ func (s *Server) revoke(w http.ResponseWriter, requestor string, request *irma.R
 	server.WriteString(w, "OK")
 }
 
+// requestProblemErrors contains the errors with which authorizeSession refuses requests
+// having the problems returned by requestorProblems.
+var requestProblemErrors = map[server.RequestProblemType]server.Error{
+	server.ProblemMissingPermission:  server.ErrorUnauthorized,
+	server.ProblemInvalidRequest:     server.ErrorInvalidRequest,
+	server.ProblemCallbackNotAllowed: server.ErrorCallbackNotAllowed,
+	server.ProblemUnsupported:        server.ErrorUnsupported,
+}
+
+// requestorProblems returns all reasons for which the requestor may not start the session,
+// except exceeded limits. The caller must hold reloadLock.
+func (s *Server) requestorProblems(requestor string, rrequest irma.RequestorRequest) []*server.RequestProblem {
+	var problems []*server.RequestProblem
+	request := rrequest.SessionRequest()
+	if request.Action() == irma.ActionIssuing {
+		for _, cred := range request.(*irma.IssuanceRequest).Credentials {
+			if allowed, _ := s.conf.CanIssue(requestor, []*irma.CredentialRequest{cred}); !allowed {
+				problems = append(problems, &server.RequestProblem{
+					Type:       server.ProblemMissingPermission,
+					Identifier: cred.CredentialTypeID.String(),
+					Message:    "not authorized to issue " + cred.CredentialTypeID.String(),
+				})
+			}
+		}
+	}
+	_ = request.Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+		condiscon := irma.AttributeConDisCon{{{*attr}}}
+		if allowed, _ := s.conf.CanVerifyOrSign(requestor, request.Action(), condiscon); !allowed {
+			problems = append(problems, &server.RequestProblem{
+				Type:       server.ProblemMissingPermission,
+				Identifier: attr.Type.String(),
+				Message:    "not authorized to request " + attr.Type.String(),
+			})
+		}
+		return nil
+	})
+
+	base := rrequest.Base()
+	if base.NextSession != nil && base.NextSession.URL == "" {
+		problems = append(problems, &server.RequestProblem{
+			Type: server.ProblemInvalidRequest, Message: "nextSession provided with empty URL",
+		})
+	}
+	if base.CallbackURL != "" {
+		if !s.conf.CanUseCallbackURL(requestor, base.CallbackURL) {
+			problems = append(problems, &server.RequestProblem{
+				Type: server.ProblemCallbackNotAllowed, Identifier: base.CallbackURL,
+				Message: "not authorized to use callback URL " + base.CallbackURL,
+			})
+		} else if err := s.conf.CheckCallbackURL(base.CallbackURL); err != nil {
+			problems = append(problems, &server.RequestProblem{
+				Type: server.ProblemCallbackNotAllowed, Identifier: base.CallbackURL, Message: err.Error(),
+			})
+		}
+	}
+	if s.conf.JwtSigningKey == nil && !s.conf.AllowUnsignedCallbacks &&
+		(base.CallbackURL != "" || base.NextSession != nil) {
+		problems = append(problems, &server.RequestProblem{
+			Type:    server.ProblemUnsupported,
+			Message: "callbackUrl or nextSession provided but no JWT private key is installed",
+		})
+	}
+	return problems
+}
+
 func (s *Server) checkAuth(w http.ResponseWriter, r *http.Request, rerr *irma.RemoteError, applies bool, body []byte) bool {
 	if rerr != nil {
 		_ = server.LogError(rerr)
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// StaticSessionParameterType is the type of the value of a static session parameter.
+type StaticSessionParameterType string
+
+const (
+	StaticSessionParameterString  StaticSessionParameterType = "string" // the default
+	StaticSessionParameterInteger StaticSessionParameterType = "integer"
+	StaticSessionParameterBoolean StaticSessionParameterType = "boolean"
+)
+
+// StaticSessionParameter declares a parameter of a static session request, whose value is
+// specified when the static session is started (see StaticSessionTemplate).
+type StaticSessionParameter struct {
+	// Type of the value (default string). Integer and boolean parameters that make up an entire
+	// JSON string in the request are replaced by a JSON number or boolean.
+	Type StaticSessionParameterType `json:"type" mapstructure:"type"`
+	// Allowed values of the parameter
+	Values []string `json:"values" mapstructure:"values"`
+	// Regular expression that values of the parameter must match entirely
+	Pattern string `json:"pattern" mapstructure:"pattern"`
+	// Value used when the parameter is not specified; if absent, the parameter is required
+	Default *string `json:"default" mapstructure:"default"`
+
+	pattern *regexp.Regexp
+}
+
+// StaticSessionTemplate is a static session request, in which the string values may contain
+// placeholders of the form {{name}} for its parameters. Since placeholders are only replaced within
+// JSON strings, parameter values cannot change the structure of the request.
+//
+// In the configuration, the parameters are declared in the "parameters" field of the static
+// session request, for example:
+//
+//	{
+//	  "parameters": {"level": {"values": ["PhD", "Master"]}},
+//	  "callbackUrl": "https://example.com/callback",
+//	  "request": {
+//	    "@context": "https://irma.app/ld/request/disclosure/v2",
+//	    "disclose": [[[{"type": "irma-demo.RU.studentCard.level", "value": "{{level}}"}]]]
+//	  }
+//	}
+type StaticSessionTemplate struct {
+	Name       string
+	Parameters map[string]*StaticSessionParameter
+
+	template interface{}
+}
+
+var (
+	staticSessionNameRegexp   = regexp.MustCompile("^[a-zA-Z0-9_]+$")
+	staticSessionPlaceholders = regexp.MustCompile(`{{([a-zA-Z0-9_]*)}}`)
+)
+
+// ParseStaticSessionTemplate parses the static session request (see Configuration.StaticSessions)
+// and validates it by instantiating it with a sample value for each parameter.
+func ParseStaticSessionTemplate(name string, request interface{}) (*StaticSessionTemplate, error) {
+	if !staticSessionNameRegexp.MatchString(name) {
+		return nil, errors.Errorf("static session name %s not allowed, must be alphanumeric", name)
+	}
+	bts, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse static session request "+name, 0)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(bts, &fields); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse static session request "+name, 0)
+	}
+	t := &StaticSessionTemplate{Name: name, Parameters: map[string]*StaticSessionParameter{}}
+	if params, ok := fields["parameters"]; ok {
+		if err = json.Unmarshal(params, &t.Parameters); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse parameters of static session "+name, 0)
+		}
+		delete(fields, "parameters")
+		if bts, err = json.Marshal(fields); err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse static session request "+name, 0)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(bts))
+	dec.UseNumber()
+	if err = dec.Decode(&t.template); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse static session request "+name, 0)
+	}
+
+	for pname, param := range t.Parameters {
+		if err = param.validate(); err != nil {
+			return nil, errors.WrapPrefix(err, "invalid parameter "+pname+" of static session "+name, 0)
+		}
+	}
+	if err = t.checkPlaceholders(t.template); err != nil {
+		return nil, err
+	}
+
+	sample := map[string]interface{}{}
+	for pname, param := range t.Parameters {
+		sample[pname] = param.sample()
+	}
+	if _, err = t.request(sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Request validates the parameter values and returns a new session request in which
+// the placeholders are replaced by them.
+func (t *StaticSessionTemplate) Request(params map[string]string) (irma.RequestorRequest, error) {
+	values := make(map[string]interface{}, len(t.Parameters))
+	for name := range params {
+		if t.Parameters[name] == nil {
+			return nil, errors.Errorf("unknown parameter %s", name)
+		}
+	}
+	for name, param := range t.Parameters {
+		v, ok := params[name]
+		if !ok {
+			if param.Default == nil {
+				return nil, errors.Errorf("missing parameter %s", name)
+			}
+			v = *param.Default
+		}
+		val, err := param.value(v)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid value for parameter "+name, 0)
+		}
+		values[name] = val
+	}
+	return t.request(values)
+}
+
+// request returns a new session request in which the placeholders are replaced by the values.
+func (t *StaticSessionTemplate) request(values map[string]interface{}) (irma.RequestorRequest, error) {
+	bts, err := json.Marshal(t.instantiate(t.template, values))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to instantiate static session request "+t.Name, 0)
+	}
+	rrequest, err := ParseSessionRequest(bts)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse static session request "+t.Name, 0)
+	}
+	action := rrequest.SessionRequest().Action()
+	if action != irma.ActionDisclosing && action != irma.ActionSigning {
+		return nil, errors.Errorf("static session %s must be either a disclosing or signing session", t.Name)
+	}
+	base := rrequest.Base()
+	if base.CallbackURL == "" && (base.NextSession == nil || base.NextSession.URL == "") {
+		return nil, errors.Errorf("static session %s has no callback URL or next session URL", t.Name)
+	}
+	return rrequest, nil
+}
+
+// instantiate returns a copy of the decoded JSON in which the placeholders are replaced.
+func (t *StaticSessionTemplate) instantiate(template interface{}, values map[string]interface{}) interface{} {
+	switch v := template.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = t.instantiate(val, values)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, val := range v {
+			l[i] = t.instantiate(val, values)
+		}
+		return l
+	case string:
+		if match := staticSessionPlaceholders.FindStringSubmatch(v); match != nil && match[0] == v {
+			return values[match[1]]
+		}
+		return staticSessionPlaceholders.ReplaceAllStringFunc(v, func(placeholder string) string {
+			switch val := values[placeholder[2:len(placeholder)-2]].(type) {
+			case string:
+				return val
+			case int64:
+				return strconv.FormatInt(val, 10)
+			default:
+				return strconv.FormatBool(val.(bool))
+			}
+		})
+	default:
+		return v
+	}
+}
+
+// checkPlaceholders checks that all placeholders in the decoded JSON refer to declared parameters.
+func (t *StaticSessionTemplate) checkPlaceholders(template interface{}) error {
+	switch v := template.(type) {
+	case map[string]interface{}:
+		for _, val := range v {
+			if err := t.checkPlaceholders(val); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if err := t.checkPlaceholders(val); err != nil {
+				return err
+			}
+		}
+	case string:
+		for _, match := range staticSessionPlaceholders.FindAllStringSubmatch(v, -1) {
+			if t.Parameters[match[1]] == nil {
+				return errors.Errorf("static session %s uses undeclared parameter %s", t.Name, match[1])
+			}
+		}
+	}
+	return nil
+}
+
+func (p *StaticSessionParameter) validate() error {
+	switch p.Type {
+	case "":
+		p.Type = StaticSessionParameterString
+	case StaticSessionParameterString, StaticSessionParameterInteger, StaticSessionParameterBoolean:
+	default:
+		return errors.Errorf("unsupported type %s", p.Type)
+	}
+	if p.Pattern != "" {
+		var err error
+		if p.pattern, err = regexp.Compile("^(?:" + p.Pattern + ")$"); err != nil {
+			return errors.WrapPrefix(err, "invalid pattern", 0)
+		}
+	}
+	if p.Type == StaticSessionParameterString && len(p.Values) == 0 && p.pattern == nil {
+		return errors.New("string parameters must specify allowed values or a pattern")
+	}
+	for _, v := range p.Values {
+		if _, err := p.value(v); err != nil {
+			return errors.WrapPrefix(err, "invalid allowed value", 0)
+		}
+	}
+	if p.Default != nil {
+		if _, err := p.value(*p.Default); err != nil {
+			return errors.WrapPrefix(err, "invalid default value", 0)
+		}
+	}
+	return nil
+}
+
+// value checks the specified value against the parameter, returning it as string, int64 or bool
+// depending on the type of the parameter.
+func (p *StaticSessionParameter) value(v string) (interface{}, error) {
+	if len(p.Values) > 0 {
+		allowed := false
+		for _, a := range p.Values {
+			if a == v {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, errors.Errorf("value %s not allowed", v)
+		}
+	}
+	if p.pattern != nil && !p.pattern.MatchString(v) {
+		return nil, errors.Errorf("value %s does not match pattern", v)
+	}
+	switch p.Type {
+	case StaticSessionParameterInteger:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("value %s is not an integer", v)
+		}
+		return i, nil
+	case StaticSessionParameterBoolean:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Errorf("value %s is not a boolean", v)
+		}
+		return b, nil
+	default:
+		return v, nil
+	}
+}
+
+// sample returns a value for the parameter with which the template is validated: its default
+// value or first allowed value if present, or else the zero value of its type.
+func (p *StaticSessionParameter) sample() interface{} {
+	if v := p.Default; v != nil || len(p.Values) > 0 {
+		if v == nil {
+			v = &p.Values[0]
+		}
+		val, _ := p.value(*v) // already validated in validate()
+		return val
+	}
+	switch p.Type {
+	case StaticSessionParameterInteger:
+		return int64(0)
+	case StaticSessionParameterBoolean:
+		return false
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultTracingServiceName is the service name under which spans are exported if
+// Configuration.TracingServiceName is not specified.
+const DefaultTracingServiceName = "irma"
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+	tracerEndpoint string
+	tracerMutex    sync.Mutex
+)
+
+// StartTracing installs an OpenTelemetry TracerProvider that exports the spans of irmago
+// to the OTLP/HTTP collector at the specified URL (e.g. http://localhost:4318), and propagates
+// traces across HTTP requests using W3C traceparent headers. If tracing was already started
+// with the same endpoint, nothing happens.
+func StartTracing(endpoint, serviceName string) error {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	if tracerProvider != nil && tracerEndpoint == endpoint {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.Errorf("invalid tracing endpoint %s", endpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to create tracing exporter", 0)
+	}
+
+	if serviceName == "" {
+		serviceName = DefaultTracingServiceName
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	if tracerProvider != nil {
+		_ = tracerProvider.Shutdown(context.Background())
+	}
+	tracerProvider, tracerEndpoint = provider, endpoint
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return nil
+}
+
+// StopTracing exports all pending spans and uninstalls the TracerProvider installed by StartTracing().
+func StopTracing() error {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	if tracerProvider == nil {
+		return nil
+	}
+	err := tracerProvider.Shutdown(context.Background())
+	tracerProvider, tracerEndpoint = nil, ""
+	otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	return err
+}
+
+// TracingEnabled returns whether spans are being exported.
+func TracingEnabled() bool {
+	tracerMutex.Lock()
+	defer tracerMutex.Unlock()
+	return tracerProvider != nil
+}
+
+// StartSpan starts a span as child of the span in the context of the HTTP request, i.e. the
+// span started by LogMiddleware (if any), and returns the request with the new span in its context.
+func StartSpan(r *http.Request, name string, attrs ...attribute.KeyValue) (*http.Request, trace.Span) {
+	ctx, span := irma.StartSpan(r.Context(), name, attrs...)
+	return r.WithContext(ctx), span
+}
+
+// EndSpan records the error in the span if not nil, and ends it.
+func EndSpan(span trace.Span, rerr *irma.RemoteError) {
+	if rerr != nil {
+		span.SetAttributes(attribute.String("irma.error", rerr.ErrorName))
+		span.SetStatus(codes.Error, rerr.ErrorName)
+	}
+	span.End()
+}
+
+// TracingMiddleware is middleware that starts a span for each HTTP request, continuing the
+// trace of the client if it sent a traceparent header. It does nothing if tracing is disabled.
+func TracingMiddleware(typ string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r, span := startRequestSpan(typ, r)
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			defer func() { endRequestSpan(span, typ, r, ww.Status()) }()
+			next.ServeHTTP(ww, r)
+		})
+	}
+}
+
+// startRequestSpan starts a server span for the HTTP request, continuing the trace of the
+// traceparent header if present.
+func startRequestSpan(typ string, r *http.Request) (*http.Request, trace.Span) {
+	ctx := irma.TraceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otel.Tracer(irma.TracerName).Start(ctx, typ+" "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			attribute.String("irma.server", typ),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endRequestSpan records the status and route of the HTTP request in its span and ends it.
+// Only the route pattern is recorded and not the path, since the latter may contain session tokens.
+func endRequestSpan(span trace.Span, typ string, r *http.Request, status int) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			// patterns of mounted subrouters are joined with an extra slash
+			for strings.Contains(pattern, "//") {
+				pattern = strings.ReplaceAll(pattern, "//", "/")
+			}
+			span.SetName(typ + " " + r.Method + " " + pattern)
+			span.SetAttributes(semconv.HTTPRouteKey.String(pattern))
+		}
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"crypto"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// ResultFormat is a format in which session results can be obtained. It is selected using the
+// ResultFormatParameter query parameter of the /result and /result-jwt endpoints of the requestor
+// server, and for result callbacks using the resultFormat field of the session request.
+type ResultFormat string
+
+const (
+	// ResultFormatParameter is the name of the query parameter that selects the result format.
+	ResultFormatParameter = "format"
+
+	ResultFormatIrma ResultFormat = "irma" // Session result as SessionResult (the default)
+	ResultFormatVP   ResultFormat = "vp"   // Disclosed attributes as W3C Verifiable Presentation
+
+	// LDContextVerifiablePresentation is the JSON-LD context of the W3C Verifiable Credentials data model.
+	LDContextVerifiablePresentation = "https://www.w3.org/2018/credentials/v1"
+	// LDContextIrmaPresentation is the JSON-LD context defining the IRMA-specific terms used in
+	// Verifiable Presentations of session results.
+	LDContextIrmaPresentation = "https://irma.app/ld/presentation/v1"
+)
+
+// VerifiablePresentation is a W3C Verifiable Presentation (https://www.w3.org/TR/vc-data-model/)
+// of the attributes disclosed in a session, containing a credential for each disclosed credential.
+// Its IRMA-specific terms are defined by LDContextIrmaPresentation.
+type VerifiablePresentation struct {
+	Context              []string                `json:"@context"`
+	Type                 []string                `json:"type"`
+	VerifiableCredential []*VerifiableCredential `json:"verifiableCredential"`
+
+	SessionToken  irma.RequestorToken `json:"sessionToken"`
+	SessionStatus irma.ServerStatus   `json:"sessionStatus"`
+	ProofStatus   irma.ProofStatus    `json:"proofStatus,omitempty"`
+}
+
+// VerifiableCredential contains the attributes of a disclosed credential. Its issuer, schema and
+// status are identified by URIs of the form irma:<identifier>.
+type VerifiableCredential struct {
+	Context           []string                    `json:"@context"`
+	Type              []string                    `json:"type"`
+	Issuer            string                      `json:"issuer"`
+	IssuanceDate      string                      `json:"issuanceDate"`
+	CredentialSubject map[string]interface{}      `json:"credentialSubject"`
+	CredentialSchema  *VerifiableCredentialSchema `json:"credentialSchema"`
+	CredentialStatus  *VerifiableCredentialStatus `json:"credentialStatus,omitempty"`
+}
+
+// VerifiableCredentialSchema identifies the IRMA credential type of a disclosed credential.
+type VerifiableCredentialSchema struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// VerifiableCredentialStatus contains the result of the nonrevocation proof of a disclosed credential.
+type VerifiableCredentialStatus struct {
+	ID               string `json:"id"`
+	Type             string `json:"type"`
+	NotRevoked       bool   `json:"notRevoked"`
+	NotRevokedBefore string `json:"notRevokedBefore,omitempty"`
+}
+
+// ParseResultFormat parses the value of the ResultFormatParameter query parameter or of the
+// resultFormat field of a session request, which if empty selects ResultFormatIrma.
+func ParseResultFormat(format string) (ResultFormat, error) {
+	switch ResultFormat(format) {
+	case "", ResultFormatIrma:
+		return ResultFormatIrma, nil
+	case ResultFormatVP:
+		return ResultFormatVP, nil
+	default:
+		return "", errors.Errorf("unsupported result format %s", format)
+	}
+}
+
+// NewVerifiablePresentation returns a Verifiable Presentation of the attributes disclosed in
+// the session. Attributes of the same credential are grouped into one credential.
+func NewVerifiablePresentation(result *SessionResult) *VerifiablePresentation {
+	vp := &VerifiablePresentation{
+		Context:              []string{LDContextVerifiablePresentation, LDContextIrmaPresentation},
+		Type:                 []string{"VerifiablePresentation"},
+		VerifiableCredential: []*VerifiableCredential{},
+		SessionToken:         result.Token,
+		SessionStatus:        result.Status,
+		ProofStatus:          result.ProofStatus,
+	}
+
+	type credentialKey struct {
+		credtype irma.CredentialTypeIdentifier
+		issued   time.Time
+	}
+	credentials := map[credentialKey]*VerifiableCredential{}
+	for _, con := range result.Disclosed {
+		for _, attr := range con {
+			if attr == nil || attr.RawValue == nil {
+				continue
+			}
+			credtype := attr.Identifier.CredentialTypeIdentifier()
+			key := credentialKey{credtype, time.Time(attr.IssuanceTime)}
+			vc, ok := credentials[key]
+			if !ok {
+				vc = &VerifiableCredential{
+					Context:           []string{LDContextVerifiablePresentation, LDContextIrmaPresentation},
+					Type:              []string{"VerifiableCredential", "IrmaCredential"},
+					Issuer:            "irma:" + credtype.IssuerIdentifier().String(),
+					IssuanceDate:      key.issued.UTC().Format(time.RFC3339),
+					CredentialSubject: map[string]interface{}{},
+					CredentialSchema: &VerifiableCredentialSchema{
+						ID:   "irma:" + credtype.String(),
+						Type: "IrmaCredentialType",
+					},
+				}
+				credentials[key] = vc
+				vp.VerifiableCredential = append(vp.VerifiableCredential, vc)
+			}
+			vc.CredentialSubject[attr.Identifier.Name()] = *attr.RawValue
+			if attr.NotRevoked || attr.NotRevokedBefore != nil {
+				vc.CredentialStatus = &VerifiableCredentialStatus{
+					ID:         "irma:" + credtype.String() + "#revocation",
+					Type:       "IrmaRevocationStatus",
+					NotRevoked: attr.NotRevoked,
+				}
+				if attr.NotRevokedBefore != nil {
+					vc.CredentialStatus.NotRevokedBefore = time.Time(*attr.NotRevokedBefore).UTC().Format(time.RFC3339)
+				}
+			}
+		}
+	}
+	return vp
+}
+
+// VerifiablePresentationJwt returns a Verifiable Presentation of the session result as JWT
+// (https://www.w3.org/TR/vc-data-model/#jwt-encoding) signed with the private key, with the
+// presentation in the vp claim and the session token in the jti claim.
+func VerifiablePresentationJwt(result *SessionResult, issuer string, validity int, privatekey crypto.Signer) (string, error) {
+	now := time.Now().Unix()
+	return SignJwt(struct {
+		jwt.StandardClaims
+		VP *VerifiablePresentation `json:"vp"`
+	}{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    issuer,
+			IssuedAt:  now,
+			NotBefore: now,
+			ExpiresAt: now + int64(validity),
+			Subject:   string(result.Type) + "_result",
+			Id:        string(result.Token),
+		},
+		VP: NewVerifiablePresentation(result),
+	}, privatekey)
+}
+
+// FormattedResultJwt returns the session result in the specified format as JWT signed with the
+// private key, using ResultJwt() or VerifiablePresentationJwt().
+func FormattedResultJwt(result *SessionResult, format ResultFormat, issuer string, validity int, privatekey crypto.Signer) (string, error) {
+	if format == ResultFormatVP {
+		return VerifiablePresentationJwt(result, issuer, validity, privatekey)
+	}
+	return ResultJwt(result, issuer, validity, privatekey)
+}
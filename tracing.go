@@ -0,0 +1,32 @@
+package irma
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the OpenTelemetry tracer used by irmago. Spans are only recorded
+// if a TracerProvider is installed using otel.SetTracerProvider(); by default, tracing is a no-op.
+const TracerName = "github.com/privacybydesign/irmago"
+
+// TraceContext propagates spans across HTTP requests using the W3C traceparent header.
+var TraceContext = propagation.TraceContext{}
+
+// StartSpan starts a new span as child of the span in ctx, if any.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the error, if not nil, in the span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
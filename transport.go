@@ -21,6 +21,10 @@ import (
 	sseclient "github.com/sietseringers/go-sse"
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/disable_sigpipe"
@@ -33,6 +37,7 @@ type HTTPTransport struct {
 	ForceHTTPS bool
 	client     *retryablehttp.Client
 	headers    http.Header
+	ctx        context.Context
 }
 
 var HTTPHeaders = map[string]http.Header{}
@@ -164,6 +169,12 @@ func (transport *HTTPTransport) log(prefix string, message interface{}, binary b
 	}
 }
 
+// SetContext sets the context of the requests. If it contains an OpenTelemetry span, the spans
+// of the requests become its children, and the trace is propagated to the server.
+func (transport *HTTPTransport) SetContext(ctx context.Context) {
+	transport.ctx = ctx
+}
+
 // SetHeader sets a header to be sent in requests.
 func (transport *HTTPTransport) SetHeader(name, val string) {
 	transport.headers.Set(name, val)
@@ -177,10 +188,34 @@ func (transport *HTTPTransport) request(
 	if common.ForceHTTPS && transport.ForceHTTPS && !strings.HasPrefix(u, "https") {
 		return nil, &SessionError{ErrorType: ErrorHTTPS, Err: errors.New("remote server does not use https")}
 	}
+
 	req.Request, err = http.NewRequest(method, u, reader)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+
+	ctx := transport.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// Record only the scheme and host of the URL, as its path and query may contain tokens
+	ctx, span := otel.Tracer(TracerName).Start(ctx, "HTTP "+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(method),
+			semconv.HTTPSchemeKey.String(req.Request.URL.Scheme),
+			semconv.HTTPHostKey.String(req.Request.URL.Host),
+		),
+	)
+	defer func() {
+		// The error message may contain the URL, so record only the type of the error
+		if serr, ok := err.(*SessionError); ok {
+			EndSpan(span, errors.New(string(serr.ErrorType)))
+		} else {
+			EndSpan(span, err)
+		}
+	}()
+	req.Request = req.Request.WithContext(ctx)
 	req.Header = transport.headers.Clone()
 	if req.Header.Get("User-agent") == "" {
 		req.Header.Set("User-Agent", "irmago")
@@ -188,10 +223,12 @@ func (transport *HTTPTransport) request(
 	if reader != nil && contenttype != "" {
 		req.Header.Set("Content-Type", contenttype)
 	}
+	TraceContext.Inject(ctx, propagation.HeaderCarrier(req.Header))
 	res, err := transport.client.Do(&req)
 	if err != nil {
 		return nil, &SessionError{ErrorType: ErrorTransport, Err: err}
 	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
 	return res, nil
 }
 